@@ -0,0 +1,249 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	_db "kamal/database"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrCategoryNotFound = errors.New("category not found")
+	ErrInvalidCategory  = errors.New("invalid category")
+	ErrSlugTaken        = errors.New("slug already used by another category")
+)
+
+const maxCategoryName = 100
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Category is a node of the category tree, ProductCount counts the displayed products
+// of the category and of all its descendants
+type Category struct {
+	Id           int64       `json:"id"`
+	ParentId     *int64      `json:"parentId"`
+	Name         string      `json:"name"`
+	Slug         string      `json:"slug"`
+	Position     int         `json:"position"`
+	ProductCount int         `json:"productCount"`
+	Children     []*Category `json:"children"`
+}
+
+// CategoryInput is what an admin sends to create or update a category, an empty Slug is made from Name
+type CategoryInput struct {
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	ParentId *int64 `json:"parentId"`
+	Position int    `json:"position"`
+}
+
+func (in *CategoryInput) validate() error {
+	in.Name = strings.TrimSpace(in.Name)
+	if in.Name == "" || len(in.Name) > maxCategoryName {
+		return ErrInvalidCategory
+	}
+	if in.Slug == "" {
+		in.Slug = slugify(in.Name)
+	}
+	if !slugPattern.MatchString(in.Slug) || len(in.Slug) > maxCategoryName {
+		return ErrInvalidCategory
+	}
+	return nil
+}
+
+// slugify lowercases name and joins its letters and digits with '-'
+func slugify(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+	return strings.Join(words, "-")
+}
+
+// CategoryTree returns the root categories with their children, ordered by position then name
+func CategoryTree(ctx context.Context, queries *_db.Queries) ([]*Category, error) {
+	rows, err := queries.ReadDB(ctx).QueryContext(ctx, `SELECT
+		t_categories.id,
+		t_categories.parent_id,
+		t_categories.name,
+		t_categories.slug,
+		t_categories.position,
+		(SELECT count(DISTINCT t_product_categories.foreign_id)
+			FROM shop.t_categories AS descendant
+			JOIN shop.t_product_categories ON t_product_categories.category_id = descendant.id
+			JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_product_categories.foreign_id AND t_basicInfo.display
+			WHERE descendant.path LIKE t_categories.path || '%')
+		FROM shop.t_categories`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byId := map[int64]*Category{}
+	var all []*Category
+	for rows.Next() {
+		category := &Category{Children: []*Category{}}
+		if err := rows.Scan(&category.Id, &category.ParentId, &category.Name, &category.Slug, &category.Position, &category.ProductCount); err != nil {
+			return nil, err
+		}
+		byId[category.Id] = category
+		all = append(all, category)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Position != all[j].Position {
+			return all[i].Position < all[j].Position
+		}
+		return all[i].Name < all[j].Name
+	})
+
+	roots := []*Category{}
+	for _, category := range all {
+		if category.ParentId == nil {
+			roots = append(roots, category)
+			continue
+		}
+		if parent, ok := byId[*category.ParentId]; ok {
+			parent.Children = append(parent.Children, category)
+		}
+	}
+	return roots, nil
+}
+
+// parentPath returns the path of the parent, empty for a root category
+func parentPath(ctx context.Context, tx *sql.Tx, parentId *int64) (string, error) {
+	if parentId == nil {
+		return "", nil
+	}
+	var path string
+	err := tx.QueryRowContext(ctx, `SELECT path FROM shop.t_categories WHERE id = $1`, *parentId).Scan(&path)
+	if err == sql.ErrNoRows {
+		return "", ErrCategoryNotFound
+	}
+	return path, err
+}
+
+func categoryError(err error) error {
+	if _db.IsUniqueViolation(err) {
+		return ErrSlugTaken
+	}
+	return err
+}
+
+// CreateCategory adds a category under in.ParentId, or at the root, and returns its id
+func CreateCategory(ctx context.Context, queries *_db.Queries, in CategoryInput) (int64, error) {
+	if err := in.validate(); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		path, err := parentPath(ctx, tx, in.ParentId)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `INSERT INTO shop.t_categories(parent_id, name, slug, position) VALUES($1, $2, $3, $4) RETURNING id`,
+			in.ParentId, in.Name, in.Slug, in.Position).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE shop.t_categories SET path = $1 WHERE id = $2`, path+strconv.FormatInt(id, 10)+"/", id)
+		return err
+	})
+	return id, categoryError(err)
+}
+
+// UpdateCategory renames, reorders or moves a category, its descendants move with it.
+// A category can't be moved under itself or one of its descendants.
+func UpdateCategory(ctx context.Context, queries *_db.Queries, id int64, in CategoryInput) error {
+	if err := in.validate(); err != nil {
+		return err
+	}
+
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var oldPath string
+		err := tx.QueryRowContext(ctx, `SELECT path FROM shop.t_categories WHERE id = $1 FOR UPDATE`, id).Scan(&oldPath)
+		if err == sql.ErrNoRows {
+			return ErrCategoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := parentPath(ctx, tx, in.ParentId)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(path, oldPath) {
+			return ErrInvalidCategory
+		}
+		newPath := path + strconv.FormatInt(id, 10) + "/"
+
+		_, err = tx.ExecContext(ctx, `UPDATE shop.t_categories
+			SET parent_id = $1, name = $2, slug = $3, position = $4, path = $5, updated_at = floor(extract(epoch from now())::integer)
+			WHERE id = $6`, in.ParentId, in.Name, in.Slug, in.Position, newPath, id)
+		if err != nil || newPath == oldPath {
+			return err
+		}
+
+		// descendants keep the end of their path after the moved category
+		_, err = tx.ExecContext(ctx, `UPDATE shop.t_categories SET path = $1::text || substr(path, length($2::text) + 1)
+			WHERE path LIKE $2::text || '%' AND id <> $3`, newPath, oldPath, id)
+		return err
+	})
+	return categoryError(err)
+}
+
+// DeleteCategory removes a category with its descendants and their product assignments, the products stay
+func DeleteCategory(ctx context.Context, queries *_db.Queries, id int64) error {
+	_db.MarkWritten(ctx)
+	result, err := queries.DB.ExecContext(ctx, `DELETE FROM shop.t_categories WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return ErrCategoryNotFound
+	}
+	return nil
+}
+
+// AssignCategory adds the products to the category, or removes them from it when remove is true.
+// It returns how many assignments changed, ids of products that don't exist are ignored.
+func AssignCategory(ctx context.Context, queries *_db.Queries, categoryId int64, productIds []int64, remove bool) (int64, error) {
+	var changed int64
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM shop.t_categories WHERE id = $1`, categoryId).Scan(&id)
+		if err == sql.ErrNoRows {
+			return ErrCategoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		query := `INSERT INTO shop.t_product_categories(foreign_id, category_id)
+			SELECT t_productId.id, $1 FROM shop.t_productId WHERE t_productId.id = ANY($2)
+			ON CONFLICT DO NOTHING`
+		if remove {
+			query = `DELETE FROM shop.t_product_categories WHERE category_id = $1 AND foreign_id = ANY($2)`
+		}
+		result, err := tx.ExecContext(ctx, query, categoryId, pq.Array(productIds))
+		if err != nil {
+			return err
+		}
+		changed, err = result.RowsAffected()
+		return err
+	})
+	return changed, err
+}
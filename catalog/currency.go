@@ -0,0 +1,474 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	_db "kamal/database"
+)
+
+// Prices are stored in the base currency (CURRENCY_BASE) and converted when they are sent, with these rules:
+//
+//   - a stored price is read as the decimal text of its numeric(12,2) column, 19.99 stays 19.99, and
+//     the decimal strings of the price list are read as they are written
+//   - it is multiplied by the rate exactly, in decimal arithmetic
+//   - the product is rounded once to the minor unit of the currency (Decimals digits), half away from
+//     zero: 1.005 EUR is 1.01 EUR and 125.5 JPY is 126 JPY
+//   - prices in the base currency are sent untouched, without rounding
+//   - a converted price is sent as the decimal of its minor units, 1999 cents is 19.99, it never goes
+//     back through a float
+//
+// Every price is converted on its own, a total computed from converted prices may differ by a few minor
+// units from the converted total.
+
+const (
+	DefaultCurrencyDecimals = 2
+	MaxCurrencyDecimals     = 4
+)
+
+var (
+	ErrInvalidCurrency = errors.New("currency must be a 3 letters code like EUR")
+	ErrUnknownCurrency = errors.New("currency is not supported")
+	ErrInvalidRate     = errors.New("rate must be a positive decimal number")
+	ErrInvalidDecimals = errors.New("decimals must be 0 to 4")
+	ErrBaseCurrency    = errors.New("the rate of the base currency is always 1")
+)
+
+var (
+	currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	// t_currencies.rate is numeric(20, 10)
+	ratePattern = regexp.MustCompile(`^[0-9]{1,10}(\.[0-9]{1,10})?$`)
+	// the grammar of a JSON number
+	pricePattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+)
+
+// Currency is a currency prices can be converted to
+type Currency struct {
+	Code string `json:"code"`
+	// Rate is how many units of this currency one unit of the base currency is worth, a decimal string
+	Rate string `json:"rate"`
+	// Decimals is the number of digits of the minor unit, 2 for cents, 0 for yen
+	Decimals  int   `json:"decimals"`
+	UpdatedAt int64 `json:"updatedAt,omitempty"`
+
+	rate *big.Rat
+	base bool
+}
+
+// IsBase tells if the currency is the one the prices are stored in
+func (c Currency) IsBase() bool {
+	return c.base
+}
+
+// Minor converts a price in the base currency, written as a decimal string, to minor units of c
+func (c Currency) Minor(price string) (int64, bool) {
+	value, ok := new(big.Rat).SetString(strings.TrimSpace(price))
+	if !ok || c.rate == nil {
+		return 0, false
+	}
+	value.Mul(value, c.rate)
+	value.Mul(value, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(c.Decimals)), nil)))
+
+	// half away from zero
+	num := new(big.Int).Abs(value.Num())
+	quotient, remainder := new(big.Int).QuoRem(num, value.Denom(), new(big.Int))
+	if remainder.Lsh(remainder, 1).Cmp(value.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if !quotient.IsInt64() {
+		return 0, false
+	}
+	if value.Sign() < 0 {
+		return -quotient.Int64(), true
+	}
+	return quotient.Int64(), true
+}
+
+// Format writes minor units of c as a decimal string, 1999 is "19.99"
+func (c Currency) Format(minor int64) string {
+	if c.Decimals == 0 {
+		return strconv.FormatInt(minor, 10)
+	}
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	digits := strconv.FormatInt(minor, 10)
+	if len(digits) <= c.Decimals {
+		digits = strings.Repeat("0", c.Decimals-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-c.Decimals] + "." + digits[len(digits)-c.Decimals:]
+}
+
+// Price is a price in the decimal text of a JSON number, it never goes through a float. The numeric price
+// columns are scanned from their text and a converted price is the exact decimal of its minor units.
+type Price string
+
+// MarshalJSON writes the price as a JSON number, the zero Price is 0
+func (p Price) MarshalJSON() ([]byte, error) {
+	if p == "" {
+		return []byte("0"), nil
+	}
+	return []byte(p), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one, without going through a float
+func (p *Price) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = strings.TrimSpace(unquoted)
+	}
+	if !pricePattern.MatchString(text) {
+		return fmt.Errorf("price %s is not a number", data)
+	}
+	*p = Price(text)
+	return nil
+}
+
+// Scan reads a numeric price column, "12.50" is read as 12.5
+func (p *Price) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return p.Scan(string(v))
+	case string:
+		if !pricePattern.MatchString(v) {
+			return fmt.Errorf("price %q is not a number", v)
+		}
+		if strings.Contains(v, ".") && !strings.ContainsAny(v, "eE") {
+			v = strings.TrimRight(strings.TrimRight(v, "0"), ".")
+		}
+		if v == "-0" {
+			v = "0"
+		}
+		*p = Price(v)
+		return nil
+	case int64:
+		*p = Price(strconv.FormatInt(v, 10))
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into a price", src)
+}
+
+// Value writes the price to a numeric column, the zero Price is 0
+func (p Price) Value() (driver.Value, error) {
+	return string(p.Number()), nil
+}
+
+// Number returns the price as a json.Number, the GraphQL Float reads it this way
+func (p Price) Number() json.Number {
+	if p == "" {
+		return "0"
+	}
+	return json.Number(p)
+}
+
+// Convert converts a stored price, the base currency returns it untouched
+func (c Currency) Convert(price Price) Price {
+	if c.base {
+		return price
+	}
+	minor, ok := c.Minor(string(price.Number()))
+	if !ok {
+		return price
+	}
+	return Price(c.Format(minor))
+}
+
+// Base converts a price in c back to the base currency, rounded half away from zero to its DefaultCurrencyDecimals.
+// The price filters of a listing are asked in the currency of the response and compared to the stored prices.
+func (c Currency) Base(price Price) (Price, bool) {
+	if c.base {
+		return price, true
+	}
+	value, ok := new(big.Rat).SetString(string(price.Number()))
+	if !ok || c.rate == nil || c.rate.Sign() == 0 {
+		return "", false
+	}
+	value.Quo(value, c.rate)
+	return Price(value.FloatString(DefaultCurrencyDecimals)), true
+}
+
+// priceKeys are the fields holding a price in the objects of the price list and shipping documents
+var priceKeys = []string{"price", "priceAfterDiscount"}
+
+// ConvertPriceDocument converts the prices of a price list (t_pricelist.bydata) or shipping document,
+// an object or an array of objects. Prices written as strings stay strings. A document that is not
+// json is returned as it is.
+func (c Currency) ConvertPriceDocument(document []byte) []byte {
+	if c.base || len(document) == 0 {
+		return document
+	}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return document
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		c.convertPrices(v)
+	case []interface{}:
+		for _, item := range v {
+			if object, ok := item.(map[string]interface{}); ok {
+				c.convertPrices(object)
+			}
+		}
+	default:
+		return document
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return document
+	}
+	return converted
+}
+
+func (c Currency) convertPrices(object map[string]interface{}) {
+	for _, key := range priceKeys {
+		switch price := object[key].(type) {
+		case json.Number:
+			if minor, ok := c.Minor(price.String()); ok {
+				object[key] = json.Number(c.Format(minor))
+			}
+		case string:
+			if minor, ok := c.Minor(price); ok {
+				object[key] = c.Format(minor)
+			}
+		}
+	}
+}
+
+// Rates is the currencies prices can be converted to, the base currency included
+type Rates struct {
+	Base       Currency
+	currencies map[string]Currency
+}
+
+// BaseCurrency returns the currency the prices are stored in, its rate is 1
+func BaseCurrency(code string) Currency {
+	return Currency{Code: code, Rate: "1", Decimals: DefaultCurrencyDecimals, rate: big.NewRat(1, 1), base: true}
+}
+
+// NewRates returns the rates of the currencies, the ones that are invalid or the base currency are skipped
+func NewRates(base string, currencies []Currency) *Rates {
+	r := &Rates{Base: BaseCurrency(base), currencies: map[string]Currency{base: BaseCurrency(base)}}
+	for _, currency := range currencies {
+		if validateCurrency(&currency) != nil || currency.Code == base {
+			continue
+		}
+		r.currencies[currency.Code] = currency
+	}
+	return r
+}
+
+// Lookup returns the currency of the code, false when it is not supported
+func (r *Rates) Lookup(code string) (Currency, bool) {
+	currency, ok := r.currencies[strings.ToUpper(strings.TrimSpace(code))]
+	return currency, ok
+}
+
+// List returns the supported currencies, the base one first and the others by code
+func (r *Rates) List() []Currency {
+	list := make([]Currency, 0, len(r.currencies))
+	for _, currency := range r.currencies {
+		if !currency.base {
+			list = append(list, currency)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return append([]Currency{r.Base}, list...)
+}
+
+// validateCurrency checks the code, rate and decimals of a currency and parses its rate
+func validateCurrency(currency *Currency) error {
+	currency.Code = strings.ToUpper(strings.TrimSpace(currency.Code))
+	if !currencyCodePattern.MatchString(currency.Code) {
+		return ErrInvalidCurrency
+	}
+	currency.Rate = strings.TrimSpace(currency.Rate)
+	if !ratePattern.MatchString(currency.Rate) {
+		return ErrInvalidRate
+	}
+	rate, ok := new(big.Rat).SetString(currency.Rate)
+	if !ok || rate.Sign() <= 0 {
+		return ErrInvalidRate
+	}
+	if currency.Decimals < 0 || currency.Decimals > MaxCurrencyDecimals {
+		return ErrInvalidDecimals
+	}
+	currency.rate = rate
+	return nil
+}
+
+// LoadRates reads the rates of t_currencies
+func LoadRates(ctx context.Context, queries *_db.Queries, base string) (*Rates, error) {
+	rows, err := queries.ReadDB(ctx).QueryContext(ctx, `SELECT code, rate::text, decimals, updated_at FROM shop.t_currencies ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var currencies []Currency
+	for rows.Next() {
+		var currency Currency
+		if err := rows.Scan(&currency.Code, &currency.Rate, &currency.Decimals, &currency.UpdatedAt); err != nil {
+			return nil, err
+		}
+		currencies = append(currencies, currency)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return NewRates(base, currencies), nil
+}
+
+// RateInput is a rate given to SetRates, a nil Decimals keeps the decimals of a known currency and gives
+// DefaultCurrencyDecimals to a new one
+type RateInput struct {
+	Code     string      `json:"code"`
+	Rate     json.Number `json:"rate"`
+	Decimals *int        `json:"decimals"`
+}
+
+// RateError is a rate SetRates refused, Index is its position in the list
+type RateError struct {
+	Index int    `json:"index"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// SetRates inserts or updates the rates in one transaction, nothing is written when one of them is invalid
+func SetRates(ctx context.Context, queries *_db.Queries, base string, rates []RateInput) ([]RateError, error) {
+	var rateErrors []RateError
+	currencies := make([]Currency, len(rates))
+	for i, rate := range rates {
+		currencies[i] = Currency{Code: rate.Code, Rate: rate.Rate.String(), Decimals: DefaultCurrencyDecimals}
+		if rate.Decimals != nil {
+			currencies[i].Decimals = *rate.Decimals
+		}
+		err := validateCurrency(&currencies[i])
+		if err == nil && currencies[i].Code == strings.ToUpper(base) {
+			err = ErrBaseCurrency
+		}
+		if err != nil {
+			rateErrors = append(rateErrors, RateError{Index: i, Code: currencies[i].Code, Error: err.Error()})
+		}
+	}
+	if len(rateErrors) > 0 || len(rates) == 0 {
+		return rateErrors, nil
+	}
+
+	return nil, queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		for i, currency := range currencies {
+			_, err := tx.ExecContext(ctx, `INSERT INTO shop.t_currencies(code, rate, decimals)
+				VALUES($1, $2::numeric, coalesce($3::smallint, $4))
+				ON CONFLICT (code) DO UPDATE SET rate = EXCLUDED.rate,
+					decimals = coalesce($3::smallint, t_currencies.decimals),
+					updated_at = floor(extract(epoch from now())::integer)`,
+				currency.Code, currency.Rate, rates[i].Decimals, DefaultCurrencyDecimals)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteCurrency stops converting prices to the currency, the users who chose it get the base currency
+func DeleteCurrency(ctx context.Context, queries *_db.Queries, code string) error {
+	_db.MarkWritten(ctx)
+	result, err := queries.DB.ExecContext(ctx, `DELETE FROM shop.t_currencies WHERE code = $1`, strings.ToUpper(strings.TrimSpace(code)))
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return ErrUnknownCurrency
+	}
+	return nil
+}
+
+// ReadRates reads a rates file, format is "csv" with the columns code,rate[,decimals] and an optional
+// header, or "json" with an array of {code, rate, decimals}
+func ReadRates(r io.Reader, format string) ([]RateInput, error) {
+	switch strings.ToLower(format) {
+	case "json":
+		var rates []RateInput
+		decoder := json.NewDecoder(r)
+		decoder.UseNumber()
+		if err := decoder.Decode(&rates); err != nil {
+			return nil, err
+		}
+		return rates, nil
+	case "csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		var rates []RateInput
+		for line, record := range records {
+			if line == 0 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "code") {
+				continue
+			}
+			if len(record) < 2 || len(record) > 3 {
+				return nil, fmt.Errorf("line %d: want code,rate[,decimals]", line+1)
+			}
+			rate := RateInput{Code: record[0], Rate: json.Number(strings.TrimSpace(record[1]))}
+			if len(record) == 3 && strings.TrimSpace(record[2]) != "" {
+				decimals, err := strconv.Atoi(strings.TrimSpace(record[2]))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line+1, ErrInvalidDecimals)
+				}
+				rate.Decimals = &decimals
+			}
+			rates = append(rates, rate)
+		}
+		return rates, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want csv or json", format)
+}
+
+// UserCurrency returns the currency the user chose, empty when none
+func UserCurrency(ctx context.Context, queries *_db.Queries, userId int) (string, error) {
+	var code string
+	// from the primary, the setting was maybe just changed
+	err := queries.DB.QueryRowContext(ctx, `SELECT coalesce(currency, '') FROM shop.t_users WHERE id = $1`, userId).Scan(&code)
+	return code, err
+}
+
+// SetUserCurrency changes the currency the user sees the prices in, empty goes back to the default one
+func SetUserCurrency(ctx context.Context, queries *_db.Queries, userId int, base string, code string) error {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code != "" && !currencyCodePattern.MatchString(code) {
+		return ErrInvalidCurrency
+	}
+	_db.MarkWritten(ctx)
+	result, err := queries.DB.ExecContext(ctx, `UPDATE shop.t_users SET currency = nullif($2, '')
+		WHERE id = $1 AND ($2 = '' OR $2 = $3 OR EXISTS (SELECT 1 FROM shop.t_currencies WHERE code = $2))`, userId, code, strings.ToUpper(base))
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return ErrUnknownCurrency
+	}
+	return nil
+}
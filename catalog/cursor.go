@@ -0,0 +1,39 @@
+package catalog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor is the position after the last product of a page, clients only see it encoded
+type cursor struct {
+	Sort  Sort    `json:"s"`
+	Value float64 `json:"v"`
+	Id    int     `json:"i"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor made by encode, it must belong to the same sort order
+func decodeCursor(value string, sort Sort) (*cursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != sort || c.Id < 1 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
@@ -0,0 +1,190 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bucket is a range of a facet computed from t_basicInfo, Max < 0 means no upper bound
+type bucket struct {
+	Key string
+	Min float64
+	Max float64
+}
+
+// priceBuckets group the products by their lowest price after discount
+var priceBuckets = []bucket{
+	{"0-10", 0, 10},
+	{"10-25", 10, 25},
+	{"25-50", 25, 50},
+	{"50-100", 50, 100},
+	{"100+", 100, -1},
+}
+
+// discountBands group the products by their discount percent
+var discountBands = []bucket{
+	{"0-9", 0, 10},
+	{"10-19", 10, 20},
+	{"20-29", 20, 30},
+	{"30-49", 30, 50},
+	{"50+", 50, -1},
+}
+
+func findBucket(buckets []bucket, key string) *bucket {
+	for i := range buckets {
+		if buckets[i].Key == key {
+			return &buckets[i]
+		}
+	}
+	return nil
+}
+
+func (b bucket) condition(column string) string {
+	condition := column + " >= " + strconv.FormatFloat(b.Min, 'f', -1, 64)
+	if b.Max >= 0 {
+		condition += " AND " + column + " < " + strconv.FormatFloat(b.Max, 'f', -1, 64)
+	}
+	return condition
+}
+
+// bucketCondition keeps the rows whose column is in one of the selected buckets, keys were validated by ParseFilter
+func bucketCondition(buckets []bucket, selected []string, column string) string {
+	var conditions []string
+	for _, key := range selected {
+		if b := findBucket(buckets, key); b != nil {
+			conditions = append(conditions, "("+b.condition(column)+")")
+		}
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// bucketCase returns the key of the bucket of column, NULL when it is in none
+func bucketCase(buckets []bucket, column string) string {
+	var query strings.Builder
+	query.WriteString("CASE")
+	for _, b := range buckets {
+		query.WriteString(" WHEN " + b.condition(column) + " THEN '" + b.Key + "'")
+	}
+	query.WriteString(" END")
+	return query.String()
+}
+
+// FacetValue is one value of a facet with the number of products having it
+type FacetValue struct {
+	Value    string `json:"value"`
+	Count    int    `json:"count"`
+	Selected bool   `json:"selected"`
+}
+
+// Facets are the values of color, size, shipsFrom, price and discount for the products of a listing
+type Facets map[string][]FacetValue
+
+// facets counts the products of the query by facet value. Every facet is counted with the filters
+// of the other facets only, so selecting a color still shows the other colors.
+// It must be called before run, which adds the cursor arguments.
+func (q *pageQuery) facets(ctx context.Context, db *sql.DB) (Facets, error) {
+	args := sqlArgs{values: append([]interface{}(nil), q.args.values...)}
+
+	from := cardFrom
+	for _, join := range q.joins {
+		from += "\n\t" + join
+	}
+	where := func(except string) string {
+		conditions := append(q.filter.whereExcept(&args, except), q.where...)
+		if len(conditions) == 0 {
+			return ""
+		}
+		return "\n\tWHERE " + strings.Join(conditions, "\n\tAND ")
+	}
+
+	var parts []string
+	for _, facet := range propertyFacets {
+		name := args.add(facet)
+		parts = append(parts, "SELECT "+name+"::text, t_product_facets.value, count(*)"+from+
+			"\n\tJOIN shop.t_product_facets ON t_product_facets.foreign_id = t_productId.id AND t_product_facets.facet = "+name+
+			where(facet)+"\n\tGROUP BY t_product_facets.value")
+	}
+	parts = append(parts,
+		"SELECT '"+facetPrice+"', "+bucketCase(priceBuckets, "t_basicInfo.minprice_afterdiscount")+", count(*)"+from+where(facetPrice)+"\n\tGROUP BY 2",
+		"SELECT '"+facetDiscount+"', "+bucketCase(discountBands, "t_basicInfo.discountnumber")+", count(*)"+from+where(facetDiscount)+"\n\tGROUP BY 2",
+	)
+
+	rows, err := db.QueryContext(ctx, strings.Join(parts, "\n\tUNION ALL\n\t"), args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]map[string]int{}
+	for rows.Next() {
+		var facet string
+		var value sql.NullString
+		var count int
+		if err := rows.Scan(&facet, &value, &count); err != nil {
+			return nil, err
+		}
+		if !value.Valid {
+			continue
+		}
+		if counts[facet] == nil {
+			counts[facet] = map[string]int{}
+		}
+		counts[facet][value.String] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	facets := Facets{}
+	for _, facet := range propertyFacets {
+		values := []FacetValue{}
+		for value, count := range counts[facet] {
+			values = append(values, FacetValue{Value: value, Count: count, Selected: contains(q.filter.Facets[facet], value)})
+		}
+		for _, value := range q.filter.Facets[facet] {
+			if _, ok := counts[facet][value]; !ok {
+				values = append(values, FacetValue{Value: value, Selected: true})
+			}
+		}
+		// most common first, selected values are always kept
+		sort.Slice(values, func(i, j int) bool {
+			if values[i].Count != values[j].Count {
+				return values[i].Count > values[j].Count
+			}
+			return values[i].Value < values[j].Value
+		})
+		kept := values[:0]
+		for i, value := range values {
+			if i < maxFacetValues || value.Selected {
+				kept = append(kept, value)
+			}
+		}
+		facets[facet] = kept
+	}
+	// buckets keep their order and are sent even when empty
+	for facet, buckets := range map[string][]bucket{facetPrice: priceBuckets, facetDiscount: discountBands} {
+		selected := q.filter.PriceBuckets
+		if facet == facetDiscount {
+			selected = q.filter.DiscountBands
+		}
+		values := make([]FacetValue, 0, len(buckets))
+		for _, b := range buckets {
+			values = append(values, FacetValue{Value: b.Key, Count: counts[facet][b.Key], Selected: contains(selected, b.Key)})
+		}
+		facets[facet] = values
+	}
+
+	return facets, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
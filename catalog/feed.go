@@ -0,0 +1,318 @@
+package catalog
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	_db "kamal/database"
+)
+
+var ErrInvalidFeed = errors.New("format must be xml, csv or json")
+
+const (
+	FeedXML  = "xml"
+	FeedCSV  = "csv"
+	FeedJSON = "json"
+)
+
+// availability values of the Google Merchant spec
+const (
+	availabilityInStock    = "in_stock"
+	availabilityOutOfStock = "out_of_stock"
+	availabilityPreorder   = "preorder"
+)
+
+// FeedOptions configures WriteFeed
+type FeedOptions struct {
+	Format string
+	// Since only exports the products changed at or after this time, the zero time exports everything.
+	// Hidden products are exported as out of stock by incremental exports so they get removed downstream.
+	Since time.Time
+	// Currency is added to every price, e.g. USD
+	Currency string
+	// ProductURL is the link of a product, {id} is replaced by the product id. Empty uses the product_link column.
+	ProductURL string
+	// Title and Link describe the shop in the XML channel
+	Title string
+	Link  string
+}
+
+// FeedShipping is a shipping method of a product
+type FeedShipping struct {
+	Country      string `json:"country" xml:"g:country"`
+	Service      string `json:"service" xml:"g:service"`
+	Price        Price  `json:"price" xml:"-"`
+	DeliveryDays string `json:"deliveryDays,omitempty" xml:"-"`
+	// PriceText is Price with the currency, as the XML feed wants it
+	PriceText string `json:"-" xml:"g:price"`
+}
+
+// FeedItem is one product of a feed
+type FeedItem struct {
+	XMLName       xml.Name       `json:"-" xml:"item"`
+	Id            int            `json:"id" xml:"g:id"`
+	LongProductId int64          `json:"longProductId" xml:"-"`
+	Title         string         `json:"title" xml:"g:title"`
+	Link          string         `json:"link" xml:"g:link"`
+	Image         string         `json:"imageLink" xml:"g:image_link"`
+	Price         Price          `json:"price" xml:"-"`
+	Currency      string         `json:"currency" xml:"-"`
+	PriceText     string         `json:"-" xml:"g:price"`
+	Availability  string         `json:"availability" xml:"g:availability"`
+	Condition     string         `json:"condition" xml:"g:condition"`
+	Shipping      []FeedShipping `json:"shipping" xml:"g:shipping"`
+	UpdatedAt     int64          `json:"updatedAt" xml:"-"`
+}
+
+// feedWriter writes the items of one format
+type feedWriter interface {
+	begin() error
+	item(item *FeedItem) error
+	end() error
+}
+
+// WriteFeed streams the displayed products to w in the Google Merchant style, ordered by id.
+// It returns how many products were written.
+func WriteFeed(ctx context.Context, queries *_db.Queries, w io.Writer, opts FeedOptions) (int, error) {
+	var writer feedWriter
+	switch opts.Format {
+	case FeedXML:
+		writer = &xmlFeed{w: w, opts: &opts}
+	case FeedCSV:
+		writer = &csvFeed{w: csv.NewWriter(w)}
+	case FeedJSON:
+		writer = &jsonFeed{w: w}
+	default:
+		return 0, ErrInvalidFeed
+	}
+
+	var args sqlArgs
+	where := "t_basicInfo.display"
+	if !opts.Since.IsZero() {
+		where = "t_productId.updated_at >= " + args.add(opts.Since.Unix())
+	}
+
+	rows, err := queries.ReadDB(ctx).QueryContext(ctx, `SELECT
+		t_productId.id,
+		t_productId.myProductId,
+		t_titles.title,
+		t_basicInfo.product_link,
+		COALESCE(t_mainimages.image_link_array->>0, ''),
+		t_basicInfo.minprice_afterdiscount,
+		t_basicInfo.quantityavaliable,
+		t_basicInfo.comingSoon,
+		t_basicInfo.display,
+		COALESCE(t_shippingdetails.shipping::text, '[]'),
+		t_productId.updated_at
+		FROM shop.t_productId
+		JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_productId.id
+		JOIN shop.t_titles ON t_titles.foreign_id = t_productId.id
+		JOIN shop.t_mainimages ON t_mainimages.foreign_id = t_productId.id
+		LEFT JOIN shop.t_shippingdetails ON t_shippingdetails.foreign_id = t_productId.id
+		WHERE `+where+`
+		ORDER BY t_productId.id`, args.values...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if err := writer.begin(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for rows.Next() {
+		item := FeedItem{Currency: opts.Currency, Condition: "new"}
+		var quantity int
+		var comingSoon, display bool
+		var shipping string
+		if err := rows.Scan(&item.Id, &item.LongProductId, &item.Title, &item.Link, &item.Image, &item.Price, &quantity, &comingSoon, &display, &shipping, &item.UpdatedAt); err != nil {
+			return count, err
+		}
+
+		if opts.ProductURL != "" {
+			item.Link = strings.ReplaceAll(opts.ProductURL, "{id}", strconv.Itoa(item.Id))
+		}
+		item.PriceText = feedPrice(item.Price, opts.Currency)
+		switch {
+		case !display:
+			item.Availability = availabilityOutOfStock
+		case comingSoon:
+			item.Availability = availabilityPreorder
+		case quantity > 0:
+			item.Availability = availabilityInStock
+		default:
+			item.Availability = availabilityOutOfStock
+		}
+		item.Shipping = feedShipping(shipping, opts.Currency)
+
+		if err := writer.item(&item); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, writer.end()
+}
+
+// feedPrice writes the price with two decimals, rounded half away from zero like the price columns
+func feedPrice(price Price, currency string) string {
+	minor, _ := BaseCurrency(currency).Minor(string(price.Number()))
+	text := BaseCurrency(currency).Format(minor)
+	if currency != "" {
+		text += " " + currency
+	}
+	return text
+}
+
+// feedShipping reads the shipping methods of t_shippingdetails, methods that can't be read are left out
+func feedShipping(shipping string, currency string) []FeedShipping {
+	var methods []map[string]interface{}
+	if err := json.Unmarshal([]byte(shipping), &methods); err != nil {
+		return []FeedShipping{}
+	}
+
+	text := func(value interface{}) string {
+		switch v := value.(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+
+	list := make([]FeedShipping, 0, len(methods))
+	for _, method := range methods {
+		ship := FeedShipping{Service: text(method["company"]), DeliveryDays: text(method["deliveryDays"])}
+		ship.Country = text(method["shipToCode"])
+		if ship.Country == "" {
+			ship.Country = text(method["shipTo"])
+		}
+		if err := ship.Price.Scan(text(method["price"])); err != nil {
+			continue
+		}
+		ship.PriceText = feedPrice(ship.Price, currency)
+		list = append(list, ship)
+	}
+	return list
+}
+
+// xmlFeed writes an RSS 2.0 channel with the g: namespace of Google Merchant
+type xmlFeed struct {
+	w       io.Writer
+	opts    *FeedOptions
+	encoder *xml.Encoder
+}
+
+func (f *xmlFeed) begin() error {
+	var header strings.Builder
+	header.WriteString(xml.Header)
+	header.WriteString(`<rss version="2.0" xmlns:g="http://base.google.com/ns/1.0">` + "\n<channel>\n")
+	for _, element := range []struct{ name, value string }{{"title", f.opts.Title}, {"link", f.opts.Link}, {"description", f.opts.Title}} {
+		header.WriteString("<" + element.name + ">")
+		xml.EscapeText(&header, []byte(element.value))
+		header.WriteString("</" + element.name + ">\n")
+	}
+	if _, err := io.WriteString(f.w, header.String()); err != nil {
+		return err
+	}
+	f.encoder = xml.NewEncoder(f.w)
+	return nil
+}
+
+func (f *xmlFeed) item(item *FeedItem) error {
+	if err := f.encoder.Encode(item); err != nil {
+		return err
+	}
+	_, err := io.WriteString(f.w, "\n")
+	return err
+}
+
+func (f *xmlFeed) end() error {
+	_, err := io.WriteString(f.w, "</channel>\n</rss>\n")
+	return err
+}
+
+// csvFeed writes the columns of the Google Merchant text feed, shipping is "country::service:price" joined by ','
+type csvFeed struct {
+	w *csv.Writer
+}
+
+func (f *csvFeed) begin() error {
+	return f.w.Write([]string{"id", "title", "link", "image_link", "price", "availability", "condition", "shipping"})
+}
+
+func (f *csvFeed) item(item *FeedItem) error {
+	shipping := make([]string, 0, len(item.Shipping))
+	for _, ship := range item.Shipping {
+		shipping = append(shipping, ship.Country+"::"+ship.Service+":"+ship.PriceText)
+	}
+	if err := f.w.Write([]string{strconv.Itoa(item.Id), item.Title, item.Link, item.Image, item.PriceText, item.Availability, item.Condition, strings.Join(shipping, ",")}); err != nil {
+		return err
+	}
+	// flushed as it goes so the feed streams
+	f.w.Flush()
+	return f.w.Error()
+}
+
+func (f *csvFeed) end() error {
+	f.w.Flush()
+	return f.w.Error()
+}
+
+// jsonFeed writes a JSON array of FeedItem, one item per line
+type jsonFeed struct {
+	w     io.Writer
+	count int
+}
+
+func (f *jsonFeed) begin() error {
+	_, err := io.WriteString(f.w, "[")
+	return err
+}
+
+func (f *jsonFeed) item(item *FeedItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	separator := "\n"
+	if f.count > 0 {
+		separator = ",\n"
+	}
+	f.count++
+	_, err = io.WriteString(f.w, separator+string(data))
+	return err
+}
+
+func (f *jsonFeed) end() error {
+	_, err := io.WriteString(f.w, "\n]\n")
+	return err
+}
+
+// ParseSince reads the "changed since" time of an export, as unix seconds or RFC 3339. Empty is the zero time.
+func ParseSince(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+		return time.Unix(seconds, 0), nil
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("since must be unix seconds or an RFC 3339 time")
+	}
+	return since, nil
+}
@@ -0,0 +1,192 @@
+package catalog
+
+import (
+	"errors"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ProductFilter narrows the products of a listing, nil fields don't filter anything
+type ProductFilter struct {
+	// MinPrice and MaxPrice keep the products whose price range after discount overlaps them,
+	// they are in the base currency
+	MinPrice *Price
+	MaxPrice *Price
+	// MinDiscount keeps the products discounted by at least this percent
+	MinDiscount *int
+	ComingSoon  *bool
+	// Display is the _display flag, the public routes always set it to true
+	Display *bool
+	// Category keeps the products of this category and of its descendants
+	Category *int64
+	// Facets holds the selected values of each property facet (color, size, shipsFrom), a product
+	// must have one of the values of every selected facet
+	Facets map[string][]string
+	// PriceBuckets and DiscountBands are keys of priceBuckets and discountBands, a product must be in one of them
+	PriceBuckets  []string
+	DiscountBands []string
+}
+
+// property facets that can be filtered and counted, as named by shop.facet_name
+var propertyFacets = []string{"color", "size", "shipsFrom"}
+
+const (
+	facetPrice    = "price"
+	facetDiscount = "discount"
+	// maxFacetValues bounds the values selected in one facet
+	maxFacetValues = 50
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// sqlArgs collects the arguments of a query built piece by piece
+type sqlArgs struct {
+	values []interface{}
+}
+
+// add appends value and returns its placeholder
+func (a *sqlArgs) add(value interface{}) string {
+	a.values = append(a.values, value)
+	return "$" + strconv.Itoa(len(a.values))
+}
+
+// where returns the conditions of the filter on t_basicInfo and t_product_facets
+func (f *ProductFilter) where(args *sqlArgs) []string {
+	return f.whereExcept(args, "")
+}
+
+// whereExcept returns the conditions of the filter without the selection of the facet named except,
+// so the counts of a facet still show the values the customer can add to its selection
+func (f *ProductFilter) whereExcept(args *sqlArgs, except string) []string {
+	var conditions []string
+	if f.MinPrice != nil {
+		conditions = append(conditions, "t_basicInfo.maxprice_afterdiscount >= "+args.add(*f.MinPrice))
+	}
+	if f.MaxPrice != nil {
+		conditions = append(conditions, "t_basicInfo.minprice_afterdiscount <= "+args.add(*f.MaxPrice))
+	}
+	if f.MinDiscount != nil {
+		conditions = append(conditions, "t_basicInfo.discountnumber >= "+args.add(*f.MinDiscount))
+	}
+	if f.ComingSoon != nil {
+		conditions = append(conditions, "t_basicInfo.comingSoon = "+args.add(*f.ComingSoon))
+	}
+	if f.Display != nil {
+		conditions = append(conditions, "t_basicInfo.display = "+args.add(*f.Display))
+	}
+	if f.Category != nil {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM shop.t_product_categories JOIN shop.t_categories ON t_categories.id = t_product_categories.category_id WHERE t_product_categories.foreign_id = t_productId.id AND t_categories.path LIKE (SELECT path FROM shop.t_categories WHERE id = "+args.add(*f.Category)+") || '%')")
+	}
+	for _, facet := range propertyFacets {
+		values := f.Facets[facet]
+		if facet == except || len(values) == 0 {
+			continue
+		}
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM shop.t_product_facets WHERE t_product_facets.foreign_id = t_productId.id AND t_product_facets.facet = "+args.add(facet)+" AND t_product_facets.value = ANY("+args.add(pq.Array(values))+"))")
+	}
+	if except != facetPrice && len(f.PriceBuckets) > 0 {
+		conditions = append(conditions, bucketCondition(priceBuckets, f.PriceBuckets, "t_basicInfo.minprice_afterdiscount"))
+	}
+	if except != facetDiscount && len(f.DiscountBands) > 0 {
+		conditions = append(conditions, bucketCondition(discountBands, f.DiscountBands, "t_basicInfo.discountnumber"))
+	}
+	return conditions
+}
+
+// queryValues returns the values of key, repeated (color=Red&color=Blue) or comma separated (color=Red,Blue)
+func queryValues(values url.Values, key string) []string {
+	var list []string
+	for _, raw := range values[key] {
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" && !contains(list, value) {
+				list = append(list, value)
+			}
+		}
+	}
+	return list
+}
+
+// ParseFilter reads the filter from query string values: minPrice, maxPrice, discount, comingSoon, category
+// and the multi-select facets color, size, shipsFrom, priceBucket and discountBand
+func ParseFilter(values url.Values) (ProductFilter, error) {
+	var f ProductFilter
+	get := values.Get
+
+	bounds := map[string]*big.Rat{}
+	for _, field := range []struct {
+		key   string
+		value **Price
+	}{{"minPrice", &f.MinPrice}, {"maxPrice", &f.MaxPrice}} {
+		raw := strings.TrimSpace(get(field.key))
+		if raw == "" {
+			continue
+		}
+		value, ok := new(big.Rat).SetString(raw)
+		if !ok || !pricePattern.MatchString(raw) || value.Sign() < 0 {
+			return f, ErrInvalidFilter
+		}
+		bounds[field.key] = value
+		price := Price(raw)
+		*field.value = &price
+	}
+	if f.MinPrice != nil && f.MaxPrice != nil && bounds["minPrice"].Cmp(bounds["maxPrice"]) > 0 {
+		return f, ErrInvalidFilter
+	}
+
+	if raw := strings.TrimSpace(get("discount")); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 || value > 100 {
+			return f, ErrInvalidFilter
+		}
+		f.MinDiscount = &value
+	}
+
+	if raw := strings.TrimSpace(get("comingSoon")); raw != "" {
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return f, ErrInvalidFilter
+		}
+		f.ComingSoon = &value
+	}
+
+	if raw := strings.TrimSpace(get("category")); raw != "" {
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || value < 1 {
+			return f, ErrInvalidFilter
+		}
+		f.Category = &value
+	}
+
+	for _, facet := range propertyFacets {
+		selected := queryValues(values, facet)
+		if len(selected) == 0 {
+			continue
+		}
+		if len(selected) > maxFacetValues {
+			return f, ErrInvalidFilter
+		}
+		if f.Facets == nil {
+			f.Facets = map[string][]string{}
+		}
+		f.Facets[facet] = selected
+	}
+
+	for _, field := range []struct {
+		key     string
+		buckets []bucket
+		value   *[]string
+	}{{"priceBucket", priceBuckets, &f.PriceBuckets}, {"discountBand", discountBands, &f.DiscountBands}} {
+		for _, key := range queryValues(values, field.key) {
+			if findBucket(field.buckets, key) == nil {
+				return f, ErrInvalidFilter
+			}
+			*field.value = append(*field.value, key)
+		}
+	}
+
+	return f, nil
+}
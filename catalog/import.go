@@ -0,0 +1,477 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_db "kamal/database"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidFormat = errors.New("format must be csv or jsonl")
+	ErrInvalidJob    = errors.New("job must be 1 to 100 letters, digits, '-', '_' or '.'")
+	// errDryRun rolls back the batch of a dry run, it is never returned
+	errDryRun = errors.New("dry run")
+)
+
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+
+	importBatchSize = 500
+	// maxImportLine bounds a JSONL line
+	maxImportLine = 4 << 20
+)
+
+var jobPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,100}$`)
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	// Format is FormatCSV, with a header row naming the Product JSON fields, or FormatJSONL, one Product per line
+	Format string
+	// Job names the import so it can be resumed, the lines it already committed are skipped.
+	// Empty means no progress is kept.
+	Job string
+	// DryRun validates and writes every batch, then rolls it back
+	DryRun bool
+	// OnError is called for every record that was not imported
+	OnError func(RowError)
+	// OnBatch is called with the longProductIds of the products written by every committed batch
+	OnBatch func(longProductIds []int64)
+}
+
+// RowError is a record that was not imported, Line is its line in the file
+type RowError struct {
+	Line          int    `json:"line"`
+	LongProductId int64  `json:"longProductId,omitempty"`
+	Error         string `json:"error"`
+}
+
+// ImportReport counts what Import did, Skipped are the lines committed by an earlier run of the job
+type ImportReport struct {
+	Job      string `json:"job,omitempty"`
+	DryRun   bool   `json:"dryRun"`
+	Lines    int    `json:"lines"`
+	Skipped  int    `json:"skipped"`
+	Inserted int    `json:"inserted"`
+	Updated  int    `json:"updated"`
+	Failed   int    `json:"failed"`
+}
+
+// importRecord is a valid product waiting for its batch
+type importRecord struct {
+	line    int
+	product Product
+}
+
+// importColumn is a column of a product table, the staging table has one column per importColumn
+type importColumn struct {
+	table   string
+	column  string
+	staging string
+	value   func(p *Product) interface{}
+}
+
+func jsonText(value json.RawMessage) interface{} {
+	return string(value)
+}
+
+// the tables after t_productId with their columns, in the order of GetProductData
+var importColumns = []importColumn{
+	{"t_basicInfo", "display", "display", func(p *Product) interface{} { return p.Display }},
+	{"t_basicInfo", "product_link", "product_link", func(p *Product) interface{} { return p.Link }},
+	{"t_basicInfo", "minprice", "minprice", func(p *Product) interface{} { return p.MinPrice }},
+	{"t_basicInfo", "maxprice", "maxprice", func(p *Product) interface{} { return p.MaxPrice }},
+	{"t_basicInfo", "discountnumber", "discountnumber", func(p *Product) interface{} { return p.DiscountNumber }},
+	{"t_basicInfo", "discount", "discount", func(p *Product) interface{} { return p.Discount }},
+	{"t_basicInfo", "minprice_afterdiscount", "minprice_afterdiscount", func(p *Product) interface{} { return p.MinPriceAfterDiscount }},
+	{"t_basicInfo", "maxprice_afterdiscount", "maxprice_afterdiscount", func(p *Product) interface{} { return p.MaxPriceAfterDiscount }},
+	{"t_basicInfo", "multiunitname", "multiunitname", func(p *Product) interface{} { return p.MultiUnitName }},
+	{"t_basicInfo", "oddunitname", "oddunitname", func(p *Product) interface{} { return p.OddUnitName }},
+	{"t_basicInfo", "maxpurchaselimit", "maxpurchaselimit", func(p *Product) interface{} { return p.MaxPurchaseLimit }},
+	{"t_basicInfo", "buylimittext", "buylimittext", func(p *Product) interface{} { return p.BuyLimitText }},
+	{"t_basicInfo", "quantityavaliable", "quantityavaliable", func(p *Product) interface{} { return p.QuantityAvaliable }},
+	{"t_basicInfo", "comingsoon", "comingsoon", func(p *Product) interface{} { return p.ComingSoon }},
+	{"t_titles", "title", "title", func(p *Product) interface{} { return p.Title }},
+	{"t_mainimages", "image_link_array", "images", func(p *Product) interface{} { return jsonText(p.Images) }},
+	{"t_properties", "property_array", "properties", func(p *Product) interface{} { return jsonText(p.SizesColors) }},
+	{"t_pricelist", "byname", "byname", func(p *Product) interface{} { return jsonText(p.PriceListInNames) }},
+	{"t_pricelist", "bynumber", "bynumber", func(p *Product) interface{} { return jsonText(p.PriceListInNumbers) }},
+	{"t_pricelist", "bydata", "bydata", func(p *Product) interface{} { return jsonText(p.PriceListData) }},
+	{"t_specs", "specs", "specs", func(p *Product) interface{} { return jsonText(p.Specs) }},
+	{"t_shippingdetails", "shipping", "shipping", func(p *Product) interface{} { return jsonText(p.Shipping) }},
+	{"t_modifieddescription", "description", "description", func(p *Product) interface{} { return p.ModifiedDescriptionContent }},
+}
+
+// importTables are the tables of importColumns in order, each with its columns
+func importTables() ([]string, map[string][]importColumn) {
+	var tables []string
+	columns := map[string][]importColumn{}
+	for _, column := range importColumns {
+		if _, ok := columns[column.table]; !ok {
+			tables = append(tables, column.table)
+		}
+		columns[column.table] = append(columns[column.table], column)
+	}
+	return tables, columns
+}
+
+// stagingTable creates the temporary table the batch is copied to, its columns take the types
+// of the product tables so COPY parses the values the way the tables expect them
+func stagingTable() string {
+	tables, _ := importTables()
+
+	var query strings.Builder
+	query.WriteString("CREATE TEMP TABLE import_staging ON COMMIT DROP AS SELECT\n\t0::integer AS line, t_productId.id AS foreign_id, t_productId.myproductid")
+	for _, column := range importColumns {
+		query.WriteString(",\n\t" + column.table + "." + column.column + " AS " + column.staging)
+	}
+	query.WriteString("\n\tFROM shop.t_productId")
+	for _, table := range tables {
+		query.WriteString(", shop." + table)
+	}
+	query.WriteString("\n\tWITH NO DATA")
+	return query.String()
+}
+
+// upsertQueries update the rows that exist and insert the missing ones, table by table
+func upsertQueries() []string {
+	tables, columns := importTables()
+
+	queries := []string{
+		`INSERT INTO shop.t_productId(myproductid) SELECT import_staging.myproductid FROM import_staging
+		WHERE NOT EXISTS (SELECT 1 FROM shop.t_productId WHERE t_productId.myproductid = import_staging.myproductid)`,
+		`UPDATE import_staging SET foreign_id = t_productId.id FROM shop.t_productId WHERE t_productId.myproductid = import_staging.myproductid`,
+	}
+	for _, table := range tables {
+		var set, names, values []string
+		for _, column := range columns[table] {
+			set = append(set, column.column+" = import_staging."+column.staging)
+			names = append(names, column.column)
+			values = append(values, "import_staging."+column.staging)
+		}
+		queries = append(queries,
+			"UPDATE shop."+table+" SET "+strings.Join(set, ", ")+" FROM import_staging WHERE "+table+".foreign_id = import_staging.foreign_id",
+			"INSERT INTO shop."+table+"(foreign_id, "+strings.Join(names, ", ")+") SELECT import_staging.foreign_id, "+strings.Join(values, ", ")+
+				" FROM import_staging WHERE NOT EXISTS (SELECT 1 FROM shop."+table+" WHERE "+table+".foreign_id = import_staging.foreign_id)",
+		)
+	}
+	return queries
+}
+
+// importer holds the state of one Import call
+type importer struct {
+	ctx     context.Context
+	queries *_db.Queries
+	opts    ImportOptions
+	report  ImportReport
+	// resumeAfter is the last line committed by an earlier run of the job
+	resumeAfter int
+	// lastLine is the last line read after resumeAfter
+	lastLine int
+	batch    []importRecord
+}
+
+// Import reads products from r and inserts or updates them keyed on longProductId (myproductid),
+// importBatchSize records per transaction. Invalid records are reported to opts.OnError and skipped.
+// A database error stops the import, running the same job again resumes after the last committed batch.
+func Import(ctx context.Context, queries *_db.Queries, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	if opts.Format != FormatCSV && opts.Format != FormatJSONL {
+		return ImportReport{}, ErrInvalidFormat
+	}
+	if opts.Job != "" && !jobPattern.MatchString(opts.Job) {
+		return ImportReport{}, ErrInvalidJob
+	}
+
+	im := &importer{ctx: ctx, queries: queries, opts: opts, report: ImportReport{Job: opts.Job, DryRun: opts.DryRun}}
+	if err := im.loadProgress(); err != nil {
+		return im.report, err
+	}
+	im.lastLine = im.resumeAfter
+
+	var err error
+	if opts.Format == FormatCSV {
+		err = im.readCSV(r)
+	} else {
+		err = im.readJSONL(r)
+	}
+	if err != nil {
+		return im.report, err
+	}
+	return im.report, im.flush(true)
+}
+
+// loadProgress reads where an earlier run of the job stopped, the counts carry on from there
+func (im *importer) loadProgress() error {
+	if im.opts.Job == "" || im.opts.DryRun {
+		return nil
+	}
+	err := im.queries.DB.QueryRowContext(im.ctx, `SELECT line, inserted, updated, failed FROM shop.t_imports WHERE job = $1`, im.opts.Job).
+		Scan(&im.resumeAfter, &im.report.Inserted, &im.report.Updated, &im.report.Failed)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// add validates the product of the line and queues it, the batch is written once it is full
+func (im *importer) add(line int, product Product, decodeErr error) error {
+	im.report.Lines++
+	if line <= im.resumeAfter {
+		im.report.Skipped++
+		return nil
+	}
+	im.lastLine = line
+
+	err := decodeErr
+	if err == nil {
+		err = product.Validate()
+	}
+	if err != nil {
+		im.report.Failed++
+		if im.opts.OnError != nil {
+			im.opts.OnError(RowError{Line: line, LongProductId: product.LongProductId, Error: err.Error()})
+		}
+		return nil
+	}
+
+	im.batch = append(im.batch, importRecord{line: line, product: product})
+	if len(im.batch) < importBatchSize {
+		return nil
+	}
+	return im.flush(false)
+}
+
+// flush writes the batch and saves the progress of the job in the same transaction,
+// the last flush saves it even when the batch is empty and marks the job finished
+func (im *importer) flush(last bool) error {
+	if len(im.batch) == 0 && (!last || im.opts.Job == "" || im.opts.DryRun) {
+		return nil
+	}
+
+	// a product appearing twice in the batch keeps its last line
+	var records []importRecord
+	seen := map[int64]int{}
+	for _, record := range im.batch {
+		if i, ok := seen[record.product.LongProductId]; ok {
+			records[i] = record
+			continue
+		}
+		seen[record.product.LongProductId] = len(records)
+		records = append(records, record)
+	}
+	lastLine := im.lastLine
+
+	var inserted, updated int
+	var productIds []int64
+	err := im.queries.WithTx(im.ctx, nil, func(tx *sql.Tx) error {
+		inserted, updated, productIds = 0, 0, nil
+		// imports don't run side by side, two of them could insert the same myproductid
+		if _, err := tx.ExecContext(im.ctx, `SELECT pg_advisory_xact_lock(hashtext('shop.t_imports'))`); err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			var err error
+			if inserted, updated, productIds, err = im.write(tx, records); err != nil {
+				return err
+			}
+		}
+		if im.opts.DryRun {
+			return errDryRun
+		}
+		if im.opts.Job == "" {
+			return nil
+		}
+		_, err := tx.ExecContext(im.ctx, `INSERT INTO shop.t_imports(job, line, inserted, updated, failed, finished)
+			VALUES($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (job) DO UPDATE SET line = EXCLUDED.line, inserted = EXCLUDED.inserted, updated = EXCLUDED.updated,
+			failed = EXCLUDED.failed, finished = EXCLUDED.finished, updated_at = floor(extract(epoch from now())::integer)`,
+			im.opts.Job, lastLine, im.report.Inserted+inserted, im.report.Updated+updated, im.report.Failed, last)
+		return err
+	})
+	if err != nil && err != errDryRun {
+		return err
+	}
+
+	im.report.Inserted += inserted
+	im.report.Updated += updated
+	im.resumeAfter = lastLine
+	im.batch = im.batch[:0]
+	if err == nil && im.opts.OnBatch != nil && len(productIds) > 0 {
+		im.opts.OnBatch(productIds)
+	}
+	return nil
+}
+
+// write copies the records to the staging table, then upserts them into the product tables
+func (im *importer) write(tx *sql.Tx, records []importRecord) (inserted int, updated int, productIds []int64, err error) {
+	if _, err := tx.ExecContext(im.ctx, stagingTable()); err != nil {
+		return 0, 0, nil, err
+	}
+
+	columns := []string{"line", "myproductid"}
+	for _, column := range importColumns {
+		columns = append(columns, column.staging)
+	}
+	stmt, err := tx.PrepareContext(im.ctx, pq.CopyIn("import_staging", columns...))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	for _, record := range records {
+		values := []interface{}{record.line, record.product.LongProductId}
+		for _, column := range importColumns {
+			values = append(values, column.value(&record.product))
+		}
+		if _, err := stmt.ExecContext(im.ctx, values...); err != nil {
+			stmt.Close()
+			return 0, 0, nil, err
+		}
+	}
+	if _, err := stmt.ExecContext(im.ctx); err != nil {
+		stmt.Close()
+		return 0, 0, nil, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, 0, nil, err
+	}
+
+	err = tx.QueryRowContext(im.ctx, `SELECT count(*) FROM import_staging
+		WHERE EXISTS (SELECT 1 FROM shop.t_productId WHERE t_productId.myproductid = import_staging.myproductid)`).Scan(&updated)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	inserted = len(records) - updated
+
+	for _, query := range upsertQueries() {
+		if _, err := tx.ExecContext(im.ctx, query); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	rows, err := tx.QueryContext(im.ctx, `SELECT myproductid FROM import_staging`)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, 0, nil, err
+		}
+		productIds = append(productIds, id)
+	}
+	return inserted, updated, productIds, rows.Err()
+}
+
+func (im *importer) readJSONL(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var product Product
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&product)
+		if err := im.add(line, product, err); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// productFieldKinds maps the JSON names of Product to the kind of their field
+var productFieldKinds = func() map[string]reflect.Kind {
+	kinds := map[string]reflect.Kind{}
+	t := reflect.TypeOf(Product{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		kinds[name] = t.Field(i).Type.Kind()
+	}
+	return kinds
+}()
+
+// readCSV reads a header naming the Product JSON fields, then one product per record.
+// JSONB fields hold their JSON, the other cells hold the plain value.
+func (im *importer) readCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	header = append([]string(nil), header...)
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if _, ok := productFieldKinds[name]; !ok {
+			return errors.New("unknown csv column " + strconv.Quote(name))
+		}
+		header[i] = name
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		// a malformed record (wrong field count, stray quote) is reported like an invalid product,
+		// the reader goes on with the line after it
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if err := im.add(parseErr.Line, Product{}, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+
+		// the record becomes a JSON object so it is decoded and validated like a JSONL line
+		object := map[string]json.RawMessage{}
+		var cellErr error
+		for i, cell := range record {
+			cell = strings.TrimSpace(cell)
+			if cell == "" {
+				continue
+			}
+			if productFieldKinds[header[i]] == reflect.String {
+				object[header[i]], _ = json.Marshal(cell)
+				continue
+			}
+			if !json.Valid([]byte(cell)) {
+				cellErr = errors.New("column " + header[i] + " is not a valid value")
+				break
+			}
+			object[header[i]] = json.RawMessage(cell)
+		}
+		var product Product
+		if cellErr == nil {
+			data, _ := json.Marshal(object)
+			cellErr = json.Unmarshal(data, &product)
+		}
+		if err := im.add(line, product, cellErr); err != nil {
+			return err
+		}
+	}
+}
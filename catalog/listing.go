@@ -0,0 +1,249 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_db "kamal/database"
+	"kamal/images"
+
+	"github.com/lib/pq"
+)
+
+// ProductCard is the light version of a product sent by listings, GetProductData has the full product.
+// Thumbnail is the signed /img URL of Image at the card size, Image itself when IMG_SECRET is not set.
+type ProductCard struct {
+	ProductId     int    `json:"productId"`
+	LongProductId int    `json:"longProductId"`
+	Title         string `json:"title"`
+	Image         string `json:"image"`
+	Thumbnail     string `json:"thumbnail"`
+	// the prices are in the base currency, the routes convert them to the one of the response
+	MinPrice              Price   `json:"minPrice"`
+	MaxPrice              Price   `json:"maxPrice"`
+	MinPriceAfterDiscount Price   `json:"minPrice_AfterDiscount"`
+	MaxPriceAfterDiscount Price   `json:"maxPrice_AfterDiscount"`
+	DiscountNumber        float32 `json:"discountNumber"`
+	Discount              string  `json:"discount"`
+	ComingSoon            bool    `json:"comingSoon"`
+	QuantityAvaliable     int     `json:"quantityAvaliable"`
+	// Highlight is only sent by search
+	Highlight *Highlight `json:"highlight,omitempty"`
+}
+
+// Page is one page of cards, NextCursor is empty on the last page.
+// Facets are only counted for the first page, they don't change with the cursor.
+type Page struct {
+	Items      []ProductCard `json:"items"`
+	NextCursor string        `json:"nextCursor"`
+	Facets     Facets        `json:"facets,omitempty"`
+}
+
+type Sort string
+
+const (
+	SortNewest    Sort = "newest"
+	SortPriceAsc  Sort = "price_asc"
+	SortPriceDesc Sort = "price_desc"
+	SortDiscount  Sort = "discount"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// sort key and direction of every listing order, ties are broken by the product id in the same direction
+var sortKeys = map[Sort]struct {
+	key  string
+	desc bool
+}{
+	SortNewest:    {"t_productId.id", true},
+	SortPriceAsc:  {"t_basicInfo.minprice_afterdiscount", false},
+	SortPriceDesc: {"t_basicInfo.minprice_afterdiscount", true},
+	SortDiscount:  {"t_basicInfo.discountnumber", true},
+}
+
+// ValidSort reports whether sort is one of the listing orders
+func ValidSort(sort Sort) bool {
+	_, ok := sortKeys[sort]
+	return ok
+}
+
+const cardColumns = `
+	t_productId.id,
+	t_productId.myProductId,
+	t_titles.title,
+	COALESCE(t_mainimages.image_link_array->>0, ''),
+	t_basicInfo.minprice,
+	t_basicInfo.maxprice,
+	t_basicInfo.minprice_afterdiscount,
+	t_basicInfo.maxprice_afterdiscount,
+	t_basicInfo.discountnumber,
+	t_basicInfo.discount,
+	t_basicInfo.comingSoon,
+	t_basicInfo.quantityavaliable`
+
+const cardFrom = `
+	FROM shop.t_productId
+	JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_productId.id
+	JOIN shop.t_titles ON t_titles.foreign_id = t_productId.id
+	JOIN shop.t_mainimages ON t_mainimages.foreign_id = t_productId.id`
+
+// ListRequest describes the page of GET /products
+type ListRequest struct {
+	Filter ProductFilter
+	Sort   Sort
+	Cursor string
+	Limit  int
+}
+
+// List returns a page of product cards, keyset paginated on the sort key and the product id
+func List(ctx context.Context, queries *_db.Queries, req ListRequest) (Page, error) {
+	if req.Sort == "" {
+		req.Sort = SortNewest
+	}
+	spec, ok := sortKeys[req.Sort]
+	if !ok {
+		return Page{}, ErrInvalidFilter
+	}
+
+	q := pageQuery{filter: req.Filter, sort: req.Sort, sortKey: spec.key, desc: spec.desc, limit: req.Limit}
+
+	var err error
+	if q.cursor, err = decodeCursor(req.Cursor, req.Sort); err != nil {
+		return Page{}, err
+	}
+
+	return q.page(ctx, queries.ReadDB(ctx))
+}
+
+// pageQuery builds and runs the keyset paginated query shared by the listings
+type pageQuery struct {
+	args   sqlArgs
+	filter ProductFilter
+	joins  []string
+	// where holds the conditions added to the filter, like the search match
+	where   []string
+	sortKey string
+	desc    bool
+	sort    Sort
+	cursor  *cursor
+	limit   int
+	// extraColumns are selected after the sort value and scanned into extraDest
+	extraColumns string
+	extraDest    func(card *ProductCard) []interface{}
+}
+
+// page runs the query, with the facet counts when it is the first page
+func (q *pageQuery) page(ctx context.Context, db *sql.DB) (Page, error) {
+	var facets Facets
+	if q.cursor == nil {
+		var err error
+		if facets, err = q.facets(ctx, db); err != nil {
+			return Page{}, err
+		}
+	}
+
+	page, err := q.run(ctx, db)
+	if err != nil {
+		return Page{}, err
+	}
+	page.Facets = facets
+	return page, nil
+}
+
+func (q *pageQuery) run(ctx context.Context, db *sql.DB) (Page, error) {
+	if q.limit < 1 {
+		q.limit = DefaultLimit
+	}
+	if q.limit > MaxLimit {
+		q.limit = MaxLimit
+	}
+
+	sortValue := "COALESCE(" + q.sortKey + ", 0)::float8"
+	direction, compare := "ASC", ">"
+	if q.desc {
+		direction, compare = "DESC", "<"
+	}
+
+	where := append(q.filter.where(&q.args), q.where...)
+	if q.cursor != nil {
+		where = append(where, "("+sortValue+", t_productId.id) "+compare+" ("+q.args.add(q.cursor.Value)+"::float8, "+q.args.add(q.cursor.Id)+")")
+	}
+
+	var query strings.Builder
+	query.WriteString("SELECT " + cardColumns + ",\n\t" + sortValue + q.extraColumns + cardFrom)
+	for _, join := range q.joins {
+		query.WriteString("\n\t" + join)
+	}
+	if len(where) > 0 {
+		query.WriteString("\n\tWHERE " + strings.Join(where, "\n\tAND "))
+	}
+	query.WriteString("\n\tORDER BY " + sortValue + " " + direction + ", t_productId.id " + direction)
+	// one more row than asked tells if there is a next page
+	query.WriteString("\n\tLIMIT " + q.args.add(q.limit+1))
+
+	rows, err := db.QueryContext(ctx, query.String(), q.args.values...)
+	if err != nil {
+		return Page{}, err
+	}
+	defer rows.Close()
+
+	page := Page{Items: []ProductCard{}}
+	var last cursor
+	for rows.Next() {
+		var card ProductCard
+		var value float64
+		dest := cardScanDest(&card, &value)
+		if q.extraDest != nil {
+			dest = append(dest, q.extraDest(&card)...)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return Page{}, err
+		}
+		card.Thumbnail = images.URL(card.Image, "card", "")
+
+		if len(page.Items) == q.limit {
+			page.NextCursor = last.encode()
+			break
+		}
+		page.Items = append(page.Items, card)
+		last = cursor{Sort: q.sort, Value: value, Id: card.ProductId}
+	}
+	if err := rows.Err(); err != nil {
+		return Page{}, err
+	}
+
+	return page, nil
+}
+
+// cardScanDest returns the scan destinations of cardColumns followed by the sort value
+func cardScanDest(card *ProductCard, sortValue *float64) []interface{} {
+	return []interface{}{
+		&card.ProductId,
+		&card.LongProductId,
+		&card.Title,
+		&card.Image,
+		&card.MinPrice,
+		&card.MaxPrice,
+		&card.MinPriceAfterDiscount,
+		&card.MaxPriceAfterDiscount,
+		&card.DiscountNumber,
+		&card.Discount,
+		&card.ComingSoon,
+		&card.QuantityAvaliable,
+		sortValue,
+	}
+}
+
+// CardsByIds returns the cards of the displayed products among ids, in the order of ids
+func CardsByIds(ctx context.Context, queries *_db.Queries, ids []int64) ([]ProductCard, error) {
+	if len(ids) == 0 {
+		return []ProductCard{}, nil
+	}
+	var args sqlArgs
+	join := "JOIN unnest(" + args.add(pq.Int64Array(ids)) + "::bigint[]) WITH ORDINALITY AS v(id, position) ON v.id = t_productId.id"
+	return scoredCards(ctx, queries.ReadDB(ctx), &args, join, "-v.position", nil, len(ids))
+}
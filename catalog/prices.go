@@ -0,0 +1,204 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	_db "kamal/database"
+	"kamal/notifications"
+	"kamal/print"
+)
+
+const (
+	DefaultHistoryLimit = 200
+	MaxHistoryLimit     = 1000
+	// MaxPriceAlertThreshold is the largest drop in percent a user can wait for, t_users has the same check
+	MaxPriceAlertThreshold = 90
+)
+
+var ErrInvalidThreshold = errors.New("thresholdPercent must be 0 to 90")
+
+// PricePoint is the prices of a product from RecordedAt (unix seconds) until the next point
+type PricePoint struct {
+	MinPrice              Price `json:"minPrice"`
+	MaxPrice              Price `json:"maxPrice"`
+	MinPriceAfterDiscount Price `json:"minPriceAfterDiscount"`
+	MaxPriceAfterDiscount Price `json:"maxPriceAfterDiscount"`
+	RecordedAt            int64 `json:"recordedAt"`
+}
+
+// PriceHistory returns the prices of a displayed product since the unix time, oldest first.
+// When there are more than limit points the newest ones are kept. The point in effect at since
+// comes first so the series starts with the price of that moment.
+func PriceHistory(ctx context.Context, queries *_db.Queries, productId int, since int64, limit int) ([]PricePoint, error) {
+	if limit < 1 || limit > MaxHistoryLimit {
+		limit = DefaultHistoryLimit
+	}
+	db := queries.ReadDB(ctx)
+
+	var display bool
+	err := db.QueryRowContext(ctx, `SELECT display FROM shop.t_basicInfo WHERE foreign_id = $1`, productId).Scan(&display)
+	if err == sql.ErrNoRows || (err == nil && !display) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT min_price, max_price, min_price_after_discount, max_price_after_discount, recorded_at FROM (
+			SELECT * FROM shop.t_price_history WHERE foreign_id = $1 AND recorded_at >= $2
+			UNION ALL
+			(SELECT * FROM shop.t_price_history WHERE foreign_id = $1 AND recorded_at < $2 ORDER BY recorded_at DESC, id DESC LIMIT 1)
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT $3
+		) points ORDER BY recorded_at, id`, productId, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []PricePoint{}
+	for rows.Next() {
+		var p PricePoint
+		if err := rows.Scan(&p.MinPrice, &p.MaxPrice, &p.MinPriceAfterDiscount, &p.MaxPriceAfterDiscount, &p.RecordedAt); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// PriceAlertThreshold returns the drop in percent the user is notified of, 0 when the alerts are off
+func PriceAlertThreshold(ctx context.Context, queries *_db.Queries, userId int) (int, error) {
+	var threshold int
+	// from the primary, the setting was maybe just changed
+	err := queries.DB.QueryRowContext(ctx, `SELECT price_alert_threshold FROM shop.t_users WHERE id = $1`, userId).Scan(&threshold)
+	return threshold, err
+}
+
+// SetPriceAlertThreshold changes the drop in percent the user is notified of, 0 turns the alerts off
+func SetPriceAlertThreshold(ctx context.Context, queries *_db.Queries, userId int, threshold int) error {
+	if threshold < 0 || threshold > MaxPriceAlertThreshold {
+		return ErrInvalidThreshold
+	}
+	_db.MarkWritten(ctx)
+	_, err := queries.DB.ExecContext(ctx, `UPDATE shop.t_users SET price_alert_threshold = $2 WHERE id = $1`, userId, threshold)
+	return err
+}
+
+// PriceDrop is the data of a notifications.PriceDrop notification
+type PriceDrop struct {
+	ProductId     int    `json:"productId"`
+	LongProductId string `json:"longProductId"`
+	Title         string `json:"title"`
+	OldPrice      Price  `json:"oldPrice"`
+	NewPrice      Price  `json:"newPrice"`
+	DropPercent   int    `json:"dropPercent"`
+
+	userId int
+}
+
+// PriceDropReport is what CheckPriceDrops did
+type PriceDropReport struct {
+	Notified int `json:"notified"`
+	// Skipped is true when another server was already checking
+	Skipped bool `json:"skipped"`
+}
+
+// priceAlertLock is the advisory lock key held while checking, so two servers never notify twice
+const priceAlertLock = 7_411_045
+
+// CheckPriceDrops notifies the users whose wishlisted products got at least their threshold cheaper.
+// The price compared is minprice_afterdiscount, the lowest one a buyer pays. Each wishlist row keeps
+// the price of its last alert in alert_price: new rows start at the current price, a price increase
+// raises it, and an alert lowers it to the new price so the same drop is notified once.
+func CheckPriceDrops(ctx context.Context, queries *_db.Queries) (PriceDropReport, error) {
+	var report PriceDropReport
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		report = PriceDropReport{}
+		var locked bool
+		if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, priceAlertLock).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			report.Skipped = true
+			return nil
+		}
+
+		_, err := tx.ExecContext(ctx, `UPDATE shop.t_wishlist_products w SET alert_price = b.minprice_afterdiscount
+			FROM shop.t_basicInfo b
+			WHERE b.foreign_id = w.foreign_product_id AND b.minprice_afterdiscount > 0
+			AND (w.alert_price IS NULL OR b.minprice_afterdiscount > w.alert_price)`)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, `WITH drops AS (
+				SELECT w.foreign_user_id, w.foreign_product_id, w.alert_price, b.minprice_afterdiscount AS price
+				FROM shop.t_wishlist_products w
+				JOIN shop.t_users u ON u.id = w.foreign_user_id
+				JOIN shop.t_basicInfo b ON b.foreign_id = w.foreign_product_id
+				WHERE u.price_alert_threshold > 0 AND b.display AND b.minprice_afterdiscount > 0
+				AND b.minprice_afterdiscount <= w.alert_price * (1 - u.price_alert_threshold / 100.0)
+			)
+			UPDATE shop.t_wishlist_products w SET alert_price = drops.price
+			FROM drops
+			JOIN shop.t_productId ON t_productId.id = drops.foreign_product_id
+			JOIN shop.t_titles ON t_titles.foreign_id = drops.foreign_product_id
+			WHERE w.foreign_user_id = drops.foreign_user_id AND w.foreign_product_id = drops.foreign_product_id
+			RETURNING drops.foreign_user_id, t_productId.id, t_productId.myproductid, t_titles.title, drops.alert_price, drops.price,
+				round((1 - drops.price / drops.alert_price) * 100)::integer`)
+		if err != nil {
+			return err
+		}
+		var drops []PriceDrop
+		for rows.Next() {
+			var d PriceDrop
+			if err := rows.Scan(&d.userId, &d.ProductId, &d.LongProductId, &d.Title, &d.OldPrice, &d.NewPrice, &d.DropPercent); err != nil {
+				rows.Close()
+				return err
+			}
+			drops = append(drops, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, d := range drops {
+			if err := notifications.Add(ctx, tx, d.userId, notifications.PriceDrop, d); err != nil {
+				return err
+			}
+		}
+		report.Notified = len(drops)
+		return nil
+	})
+	return report, err
+}
+
+// WatchPriceDrops runs CheckPriceDrops every interval until ctx is done
+func WatchPriceDrops(ctx context.Context, queries *_db.Queries, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		report, err := CheckPriceDrops(checkCtx, queries)
+		cancel()
+		if err != nil {
+			print.Str("Error checking price drops:", err)
+			continue
+		}
+		if report.Notified > 0 {
+			print.Str("Price drop notifications:", report.Notified)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	_db "kamal/database"
+)
+
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrProductExists   = errors.New("a product with this longProductId already exists")
+)
+
+// Product is the aggregate written to the nine product tables, the JSON names are the ones
+// sent by GetProductData so a product read there can be edited and sent back
+type Product struct {
+	LongProductId         int64   `json:"longProductId"`
+	Display               bool    `json:"_display"`
+	Link                  string  `json:"link"`
+	MinPrice              float64 `json:"minPrice"`
+	MaxPrice              float64 `json:"maxPrice"`
+	DiscountNumber        float64 `json:"discountNumber"`
+	Discount              string  `json:"discount"`
+	MinPriceAfterDiscount float64 `json:"minPrice_AfterDiscount"`
+	MaxPriceAfterDiscount float64 `json:"maxPrice_AfterDiscount"`
+	MultiUnitName         string  `json:"multiUnitName"`
+	OddUnitName           string  `json:"oddUnitName"`
+	MaxPurchaseLimit      int     `json:"maxPurchaseLimit"`
+	BuyLimitText          string  `json:"buyLimitText"`
+	QuantityAvaliable     int     `json:"quantityAvaliable"`
+	ComingSoon            bool    `json:"comingSoon"`
+	Title                 string  `json:"title"`
+	// JSONB columns, checked by Validate
+	Images                     json.RawMessage `json:"images"`
+	SizesColors                json.RawMessage `json:"sizesColors"`
+	PriceListInNames           json.RawMessage `json:"priceList_InNames"`
+	PriceListInNumbers         json.RawMessage `json:"priceList_InNumbers"`
+	PriceListData              json.RawMessage `json:"priceList_Data"`
+	Specs                      json.RawMessage `json:"specs"`
+	Shipping                   json.RawMessage `json:"shipping"`
+	ModifiedDescriptionContent string          `json:"modified_description_content"`
+}
+
+// ProductError lists the invalid fields of a product with the reason, keyed by JSON name
+type ProductError struct {
+	Fields map[string]string
+}
+
+func (e *ProductError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var msg strings.Builder
+	msg.WriteString("invalid product:")
+	for _, name := range names {
+		msg.WriteString(" " + name + " " + e.Fields[name] + ";")
+	}
+	return msg.String()
+}
+
+// jsonArray decodes value as an array, the elements stay raw
+func jsonArray(value json.RawMessage) ([]json.RawMessage, bool) {
+	var items []json.RawMessage
+	if len(value) == 0 || json.Unmarshal(value, &items) != nil || items == nil {
+		return nil, false
+	}
+	return items, true
+}
+
+// jsonObjects decodes value as an array of objects
+func jsonObjects(value json.RawMessage) ([]map[string]json.RawMessage, bool) {
+	items, ok := jsonArray(value)
+	if !ok {
+		return nil, false
+	}
+	objects := make([]map[string]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		var object map[string]json.RawMessage
+		if json.Unmarshal(item, &object) != nil || object == nil {
+			return nil, false
+		}
+		objects = append(objects, object)
+	}
+	return objects, true
+}
+
+// jsonStrings decodes value as an array of non empty strings
+func jsonStrings(value json.RawMessage) ([]string, bool) {
+	var items []string
+	if len(value) == 0 || json.Unmarshal(value, &items) != nil || items == nil {
+		return nil, false
+	}
+	for _, item := range items {
+		if strings.TrimSpace(item) == "" {
+			return nil, false
+		}
+	}
+	return items, true
+}
+
+func isJSONString(value json.RawMessage) bool {
+	var s string
+	return len(value) > 0 && json.Unmarshal(value, &s) == nil && s != ""
+}
+
+// Validate checks the columns and the shape of the JSONB fields, it returns a *ProductError
+func (p *Product) Validate() error {
+	fields := map[string]string{}
+
+	p.Title = strings.TrimSpace(p.Title)
+	if p.LongProductId < 1 {
+		fields["longProductId"] = "must be positive"
+	}
+	if p.Title == "" {
+		fields["title"] = "is required"
+	}
+	if p.MinPrice < 0 || p.MaxPrice < p.MinPrice {
+		fields["minPrice"] = "must be positive and not above maxPrice"
+	}
+	if p.MinPriceAfterDiscount < 0 || p.MaxPriceAfterDiscount < p.MinPriceAfterDiscount {
+		fields["minPrice_AfterDiscount"] = "must be positive and not above maxPrice_AfterDiscount"
+	}
+	if p.DiscountNumber < 0 || p.DiscountNumber > 100 {
+		fields["discountNumber"] = "must be between 0 and 100"
+	}
+	if p.MaxPurchaseLimit < 0 {
+		fields["maxPurchaseLimit"] = "can't be negative"
+	}
+	if p.QuantityAvaliable < 0 {
+		fields["quantityAvaliable"] = "can't be negative"
+	}
+
+	if images, ok := jsonStrings(p.Images); !ok || len(images) == 0 {
+		fields["images"] = "must be an array of image urls"
+	}
+
+	if properties, ok := jsonObjects(p.SizesColors); !ok {
+		fields["sizesColors"] = "must be an array of properties"
+	} else {
+		for _, property := range properties {
+			values, ok := jsonObjects(property["skuPropertyValues"])
+			if !isJSONString(property["skuPropertyName"]) || !ok {
+				fields["sizesColors"] = "every property needs a skuPropertyName and skuPropertyValues"
+				break
+			}
+			for _, value := range values {
+				if !isJSONString(value["propertyValueName"]) && !isJSONString(value["propertyValueDisplayName"]) {
+					fields["sizesColors"] = "every property value needs a propertyValueName"
+					break
+				}
+			}
+		}
+	}
+
+	// the three price lists describe the same skus in the same order
+	byName, okName := jsonStrings(p.PriceListInNames)
+	byNumber, okNumber := jsonStrings(p.PriceListInNumbers)
+	byData, okData := jsonObjects(p.PriceListData)
+	if !okName {
+		fields["priceList_InNames"] = "must be an array of strings"
+	}
+	if !okNumber {
+		fields["priceList_InNumbers"] = "must be an array of strings"
+	}
+	if !okData {
+		fields["priceList_Data"] = "must be an array of objects"
+	}
+	if okName && okNumber && okData && (len(byName) != len(byNumber) || len(byName) != len(byData)) {
+		fields["priceList_Data"] = "priceList_InNames, priceList_InNumbers and priceList_Data must have the same length"
+	}
+
+	if specs, ok := jsonObjects(p.Specs); !ok {
+		fields["specs"] = "must be an array of specs"
+	} else {
+		for _, spec := range specs {
+			if !isJSONString(spec["attrName"]) {
+				fields["specs"] = "every spec needs an attrName"
+				break
+			}
+		}
+	}
+
+	if _, ok := jsonObjects(p.Shipping); !ok {
+		fields["shipping"] = "must be an array of shipping methods"
+	}
+
+	if len(fields) > 0 {
+		return &ProductError{Fields: fields}
+	}
+	return nil
+}
+
+// productRow writes the product's row of one of the tables after t_productId, its arguments fit both queries
+type productRow struct {
+	insert string
+	update string
+	args   []interface{}
+}
+
+// rows returns the rows of the product in the order of GetProductData
+func (p *Product) rows(id int) []productRow {
+	return []productRow{
+		{`INSERT INTO shop.t_basicInfo(foreign_id, display, product_link, minprice, maxprice, discountnumber, discount, minprice_afterdiscount, maxprice_afterdiscount, multiunitname, oddunitname, maxpurchaselimit, buylimittext, quantityavaliable, comingSoon)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+			`UPDATE shop.t_basicInfo SET display = $2, product_link = $3, minprice = $4, maxprice = $5, discountnumber = $6, discount = $7, minprice_afterdiscount = $8, maxprice_afterdiscount = $9, multiunitname = $10, oddunitname = $11, maxpurchaselimit = $12, buylimittext = $13, quantityavaliable = $14, comingSoon = $15 WHERE foreign_id = $1`,
+			[]interface{}{id, p.Display, p.Link, p.MinPrice, p.MaxPrice, p.DiscountNumber, p.Discount, p.MinPriceAfterDiscount, p.MaxPriceAfterDiscount, p.MultiUnitName, p.OddUnitName, p.MaxPurchaseLimit, p.BuyLimitText, p.QuantityAvaliable, p.ComingSoon}},
+		{`INSERT INTO shop.t_titles(foreign_id, title) VALUES($1, $2)`,
+			`UPDATE shop.t_titles SET title = $2 WHERE foreign_id = $1`,
+			[]interface{}{id, p.Title}},
+		{`INSERT INTO shop.t_mainimages(foreign_id, image_link_array) VALUES($1, $2)`,
+			`UPDATE shop.t_mainimages SET image_link_array = $2 WHERE foreign_id = $1`,
+			[]interface{}{id, string(p.Images)}},
+		{`INSERT INTO shop.t_properties(foreign_id, property_array) VALUES($1, $2)`,
+			`UPDATE shop.t_properties SET property_array = $2 WHERE foreign_id = $1`,
+			[]interface{}{id, string(p.SizesColors)}},
+		{`INSERT INTO shop.t_pricelist(foreign_id, byname, bynumber, bydata) VALUES($1, $2, $3, $4)`,
+			`UPDATE shop.t_pricelist SET byname = $2, bynumber = $3, bydata = $4 WHERE foreign_id = $1`,
+			[]interface{}{id, string(p.PriceListInNames), string(p.PriceListInNumbers), string(p.PriceListData)}},
+		{`INSERT INTO shop.t_specs(foreign_id, specs) VALUES($1, $2)`,
+			`UPDATE shop.t_specs SET specs = $2 WHERE foreign_id = $1`,
+			[]interface{}{id, string(p.Specs)}},
+		{`INSERT INTO shop.t_shippingdetails(foreign_id, shipping) VALUES($1, $2)`,
+			`UPDATE shop.t_shippingdetails SET shipping = $2 WHERE foreign_id = $1`,
+			[]interface{}{id, string(p.Shipping)}},
+		{`INSERT INTO shop.t_modifieddescription(foreign_id, description) VALUES($1, $2)`,
+			`UPDATE shop.t_modifieddescription SET description = $2 WHERE foreign_id = $1`,
+			[]interface{}{id, p.ModifiedDescriptionContent}},
+	}
+}
+
+// CreateProduct validates the product and writes it to the nine tables in one transaction, it returns the new id
+func CreateProduct(ctx context.Context, queries *_db.Queries, p *Product) (int, error) {
+	if err := p.Validate(); err != nil {
+		return 0, err
+	}
+
+	id := 0
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var existing int
+		err := tx.QueryRowContext(ctx, `SELECT id FROM shop.t_productId WHERE myproductid = $1`, p.LongProductId).Scan(&existing)
+		if err == nil {
+			return ErrProductExists
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		if err := tx.QueryRowContext(ctx, `INSERT INTO shop.t_productId(myproductid) VALUES($1) RETURNING id`, p.LongProductId).Scan(&id); err != nil {
+			return err
+		}
+		for _, row := range p.rows(id) {
+			if _, err := tx.ExecContext(ctx, row.insert, row.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return id, err
+}
+
+// UpdateProduct replaces every column of the product in one transaction,
+// a table missing the product's row gets it inserted. It returns the longProductId the product had
+// before, it differs from p.LongProductId when the update changed it.
+func UpdateProduct(ctx context.Context, queries *_db.Queries, id int, p *Product) (int64, error) {
+	if err := p.Validate(); err != nil {
+		return 0, err
+	}
+
+	var previousLongProductId int64
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT myproductid FROM shop.t_productId WHERE id = $1 FOR UPDATE`, id).Scan(&previousLongProductId)
+		if err == sql.ErrNoRows {
+			return ErrProductNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var existing int
+		err = tx.QueryRowContext(ctx, `SELECT id FROM shop.t_productId WHERE myproductid = $1 AND id <> $2`, p.LongProductId, id).Scan(&existing)
+		if err == nil {
+			return ErrProductExists
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE shop.t_productId SET myproductid = $1 WHERE id = $2`, p.LongProductId, id); err != nil {
+			return err
+		}
+
+		for _, row := range p.rows(id) {
+			result, err := tx.ExecContext(ctx, row.update, row.args...)
+			if err != nil {
+				return err
+			}
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if updated > 0 {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, row.insert, row.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return previousLongProductId, err
+}
+
+// SetProductDisplay shows or hides the product (the _display flag), hidden products are not listed.
+// It returns the longProductId of the product.
+func SetProductDisplay(ctx context.Context, queries *_db.Queries, id int, display bool) (int64, error) {
+	_db.MarkWritten(ctx)
+	var longProductId int64
+	err := queries.DB.QueryRowContext(ctx, `UPDATE shop.t_basicInfo SET display = $1
+		FROM shop.t_productId WHERE t_basicInfo.foreign_id = $2 AND t_productId.id = t_basicInfo.foreign_id
+		RETURNING t_productId.myproductid`, display, id).Scan(&longProductId)
+	if err == sql.ErrNoRows {
+		return 0, ErrProductNotFound
+	}
+	return longProductId, err
+}
+
+// DeleteProduct removes the product from the nine tables in one transaction,
+// with the wishlist items and cart rows pointing at it. It returns the longProductId the product had.
+func DeleteProduct(ctx context.Context, queries *_db.Queries, id int) (int64, error) {
+	var longProductId int64
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT myproductid FROM shop.t_productId WHERE id = $1 FOR UPDATE`, id).Scan(&longProductId)
+		if err == sql.ErrNoRows {
+			return ErrProductNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, query := range []string{
+			`DELETE FROM shop.t_wishlist_products WHERE foreign_product_id = $1`,
+			`DELETE FROM shop.t_cart WHERE foreign_product_id = $1`,
+			`DELETE FROM shop.t_basicInfo WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_titles WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_mainimages WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_properties WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_pricelist WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_specs WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_shippingdetails WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_modifieddescription WHERE foreign_id = $1`,
+			`DELETE FROM shop.t_productId WHERE id = $1`,
+		} {
+			if _, err := tx.ExecContext(ctx, query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return longProductId, err
+}
@@ -0,0 +1,539 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	_db "kamal/database"
+	"kamal/notifications"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrQuestionNotFound = errors.New("question not found")
+	ErrAnswerNotFound   = errors.New("answer not found")
+	ErrInvalidQuestion  = errors.New("text must have between 1 and 1000 characters")
+	ErrOwnPost          = errors.New("users can't vote for what they wrote")
+)
+
+const maxQuestionBody = 1000
+
+// answersPerQuestion is how many answers come with every listed question, the others are listed by ListAnswers
+const answersPerQuestion = 3
+
+// kinds of the upvotes of shop.t_qa_votes
+const (
+	VoteQuestion = "question"
+	VoteAnswer   = "answer"
+)
+
+// question orders, ties are broken by the id in the same direction. Answers are always listed
+// staff answers first, then by upvotes.
+const (
+	SortQuestionNewest Sort = "newest"
+	SortQuestionVotes  Sort = "votes"
+)
+
+var questionSortKeys = map[Sort]struct {
+	key  string
+	desc bool
+}{
+	SortQuestionNewest: {"t_questions.created_at", true},
+	SortQuestionVotes:  {"t_questions.upvotes", true},
+}
+
+// answerOrder puts the staff answers before the others, whatever their upvotes
+const answerOrder = "(CASE WHEN t_answers.is_staff THEN 1000000000 ELSE 0 END + t_answers.upvotes)"
+
+// Question is a question as listed, with its first answers
+type Question struct {
+	Id          int64    `json:"id"`
+	ProductId   int      `json:"productId"`
+	Author      string   `json:"author"`
+	Body        string   `json:"body"`
+	Status      string   `json:"status"`
+	Upvotes     int      `json:"upvotes"`
+	AnswerCount int      `json:"answerCount"`
+	CreatedAt   int64    `json:"createdAt"`
+	Answers     []Answer `json:"answers"`
+}
+
+// Answer is an answer as listed, IsStaff is the badge of the answers written by admins
+type Answer struct {
+	Id         int64  `json:"id"`
+	QuestionId int64  `json:"questionId"`
+	Author     string `json:"author"`
+	Body       string `json:"body"`
+	IsStaff    bool   `json:"isStaff"`
+	Status     string `json:"status"`
+	Upvotes    int    `json:"upvotes"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+// QuestionPage is one page of questions, NextCursor is empty on the last page
+type QuestionPage struct {
+	Items      []Question `json:"items"`
+	NextCursor string     `json:"nextCursor"`
+}
+
+// AnswerPage is one page of answers, NextCursor is empty on the last page
+type AnswerPage struct {
+	Items      []Answer `json:"items"`
+	NextCursor string   `json:"nextCursor"`
+}
+
+// QuestionQuery selects the questions to list. ProductId 0 lists the questions of every product, for moderation.
+type QuestionQuery struct {
+	ProductId int
+	Status    string
+	Sort      Sort
+	Cursor    string
+	Limit     int
+}
+
+// AnswerQuery selects the answers to list. QuestionId 0 lists the answers of every question, for moderation.
+type AnswerQuery struct {
+	QuestionId int64
+	Status     string
+	Cursor     string
+	Limit      int
+}
+
+func questionBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" || utf8.RuneCountInString(body) > maxQuestionBody {
+		return "", ErrInvalidQuestion
+	}
+	return body, nil
+}
+
+// AskQuestion writes the question of the user on a displayed product, it is pending when premoderation is on
+func AskQuestion(ctx context.Context, queries *_db.Queries, userId int, productId int, body string, premoderation bool) (*Question, error) {
+	body, err := questionBody(body)
+	if err != nil {
+		return nil, err
+	}
+	status := ReviewApproved
+	if premoderation {
+		status = ReviewPending
+	}
+
+	question := Question{ProductId: productId, Body: body, Answers: []Answer{}}
+	err = queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var email string
+		err := tx.QueryRowContext(ctx, `SELECT t_users.email
+			FROM shop.t_productId
+			JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_productId.id
+			JOIN shop.t_users ON t_users.id = $2
+			WHERE t_productId.id = $1 AND t_basicInfo.display`, productId, userId).Scan(&email)
+		if err == sql.ErrNoRows {
+			return ErrProductNotFound
+		}
+		if err != nil {
+			return err
+		}
+		question.Author = maskEmail(email)
+
+		return tx.QueryRowContext(ctx, `INSERT INTO shop.t_questions(foreign_id, foreign_user_id, body, status) VALUES($1, $2, $3, $4)
+			RETURNING id, status, created_at`, productId, userId, body, status).Scan(&question.Id, &question.Status, &question.CreatedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &question, nil
+}
+
+// answeredQuestion is what an answer needs to know about its question
+type answeredQuestion struct {
+	id        int64
+	productId int
+	askerId   int
+}
+
+// approveAnswer counts an answer that became approved and tells the asker about it, once
+func approveAnswer(ctx context.Context, tx *sql.Tx, question *answeredQuestion, answerId int64, writerId int, isStaff bool, notified bool) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE shop.t_questions SET answer_count = answer_count + 1 WHERE id = $1`, question.id); err != nil {
+		return err
+	}
+	if notified || writerId == question.askerId {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE shop.t_answers SET notified = true WHERE id = $1`, answerId); err != nil {
+		return err
+	}
+	return notifications.Add(ctx, tx, question.askerId, notifications.QuestionAnswered, map[string]interface{}{
+		"productId": question.productId, "questionId": question.id, "answerId": answerId, "isStaff": isStaff,
+	})
+}
+
+// AnswerQuestion writes the answer of the user to an approved question. Answers of admins get the staff badge
+// and skip premoderation. The asker is notified once the answer is approved.
+func AnswerQuestion(ctx context.Context, queries *_db.Queries, userId int, questionId int64, body string, premoderation bool) (*Answer, error) {
+	body, err := questionBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := Answer{QuestionId: questionId, Body: body}
+	err = queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		question := answeredQuestion{id: questionId}
+		err := tx.QueryRowContext(ctx, `SELECT foreign_id, foreign_user_id FROM shop.t_questions WHERE id = $1 AND status = 'approved' FOR UPDATE`, questionId).
+			Scan(&question.productId, &question.askerId)
+		if err == sql.ErrNoRows {
+			return ErrQuestionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var email string
+		if err := tx.QueryRowContext(ctx, `SELECT email, isAdmin FROM shop.t_users WHERE id = $1`, userId).Scan(&email, &answer.IsStaff); err != nil {
+			return err
+		}
+		answer.Author = maskEmail(email)
+		answer.Status = ReviewApproved
+		if premoderation && !answer.IsStaff {
+			answer.Status = ReviewPending
+		}
+
+		err = tx.QueryRowContext(ctx, `INSERT INTO shop.t_answers(question_id, foreign_user_id, body, is_staff, status) VALUES($1, $2, $3, $4, $5)
+			RETURNING id, created_at`, questionId, userId, body, answer.IsStaff, answer.Status).Scan(&answer.Id, &answer.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if answer.Status != ReviewApproved {
+			return nil
+		}
+		return approveAnswer(ctx, tx, &question, answer.Id, userId, answer.IsStaff, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
+// ModerateQuestion sets the moderation state of a question
+func ModerateQuestion(ctx context.Context, queries *_db.Queries, questionId int64, status string) error {
+	if !ValidReviewStatus(status) {
+		return ErrInvalidStatus
+	}
+	_db.MarkWritten(ctx)
+	result, err := queries.DB.ExecContext(ctx, `UPDATE shop.t_questions SET status = $2 WHERE id = $1`, questionId, status)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return ErrQuestionNotFound
+	}
+	return err
+}
+
+// ModerateAnswer sets the moderation state of an answer, approving it notifies the asker if it was not done yet
+func ModerateAnswer(ctx context.Context, queries *_db.Queries, answerId int64, status string) error {
+	if !ValidReviewStatus(status) {
+		return ErrInvalidStatus
+	}
+	return queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var question answeredQuestion
+		var writerId int
+		var previous string
+		var isStaff, notified bool
+		err := tx.QueryRowContext(ctx, `SELECT t_answers.question_id, t_questions.foreign_id, t_questions.foreign_user_id,
+			t_answers.foreign_user_id, t_answers.status, t_answers.is_staff, t_answers.notified
+			FROM shop.t_answers
+			JOIN shop.t_questions ON t_questions.id = t_answers.question_id
+			WHERE t_answers.id = $1
+			FOR UPDATE OF t_answers, t_questions`, answerId).Scan(&question.id, &question.productId, &question.askerId, &writerId, &previous, &isStaff, &notified)
+		if err == sql.ErrNoRows {
+			return ErrAnswerNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if previous == status {
+			return nil
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE shop.t_answers SET status = $2 WHERE id = $1`, answerId, status); err != nil {
+			return err
+		}
+		if status == ReviewApproved {
+			return approveAnswer(ctx, tx, &question, answerId, writerId, isStaff, notified)
+		}
+		if previous == ReviewApproved {
+			_, err = tx.ExecContext(ctx, `UPDATE shop.t_questions SET answer_count = greatest(answer_count - 1, 0) WHERE id = $1`, question.id)
+		}
+		return err
+	})
+}
+
+// DeleteQuestion deletes a question of the user with its answers and their votes
+func DeleteQuestion(ctx context.Context, queries *_db.Queries, userId int, questionId int64) error {
+	return queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var answerIds pq.Int64Array
+		err := tx.QueryRowContext(ctx, `SELECT coalesce(array_agg(t_answers.id) FILTER (WHERE t_answers.id IS NOT NULL), '{}')
+			FROM shop.t_questions
+			LEFT JOIN shop.t_answers ON t_answers.question_id = t_questions.id
+			WHERE t_questions.id = $1 AND t_questions.foreign_user_id = $2
+			GROUP BY t_questions.id`, questionId, userId).Scan(&answerIds)
+		if err == sql.ErrNoRows {
+			return ErrQuestionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM shop.t_qa_votes WHERE (kind = 'question' AND target_id = $1) OR (kind = 'answer' AND target_id = ANY($2))`, questionId, answerIds); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM shop.t_questions WHERE id = $1`, questionId)
+		return err
+	})
+}
+
+// DeleteAnswer deletes an answer of the user with its votes
+func DeleteAnswer(ctx context.Context, queries *_db.Queries, userId int, answerId int64) error {
+	return queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var questionId int64
+		var status string
+		err := tx.QueryRowContext(ctx, `DELETE FROM shop.t_answers WHERE id = $1 AND foreign_user_id = $2 RETURNING question_id, status`, answerId, userId).Scan(&questionId, &status)
+		if err == sql.ErrNoRows {
+			return ErrAnswerNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM shop.t_qa_votes WHERE kind = 'answer' AND target_id = $1`, answerId); err != nil {
+			return err
+		}
+		if status == ReviewApproved {
+			_, err = tx.ExecContext(ctx, `UPDATE shop.t_questions SET answer_count = greatest(answer_count - 1, 0) WHERE id = $1`, questionId)
+		}
+		return err
+	})
+}
+
+// VoteQA upvotes an approved question or answer (kind VoteQuestion or VoteAnswer) for the user,
+// or takes the upvote back when up is false. Voting twice counts once. It returns the new upvote count.
+func VoteQA(ctx context.Context, queries *_db.Queries, userId int, kind string, id int64, up bool) (int, error) {
+	table, notFound := "shop.t_questions", ErrQuestionNotFound
+	if kind == VoteAnswer {
+		table, notFound = "shop.t_answers", ErrAnswerNotFound
+	}
+
+	count := 0
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var writer int
+		err := tx.QueryRowContext(ctx, `SELECT foreign_user_id, upvotes FROM `+table+` WHERE id = $1 AND status = 'approved' FOR UPDATE`, id).Scan(&writer, &count)
+		if err == sql.ErrNoRows {
+			return notFound
+		}
+		if err != nil {
+			return err
+		}
+		if writer == userId {
+			return ErrOwnPost
+		}
+
+		var result sql.Result
+		if up {
+			result, err = tx.ExecContext(ctx, `INSERT INTO shop.t_qa_votes(kind, target_id, foreign_user_id) VALUES($1, $2, $3) ON CONFLICT DO NOTHING`, kind, id, userId)
+		} else {
+			result, err = tx.ExecContext(ctx, `DELETE FROM shop.t_qa_votes WHERE kind = $1 AND target_id = $2 AND foreign_user_id = $3`, kind, id, userId)
+		}
+		if err != nil {
+			return err
+		}
+		changed, err := result.RowsAffected()
+		if err != nil || changed == 0 {
+			return err
+		}
+
+		step := 1
+		if !up {
+			step = -1
+		}
+		return tx.QueryRowContext(ctx, `UPDATE `+table+` SET upvotes = greatest(upvotes + $2, 0) WHERE id = $1 RETURNING upvotes`, id, step).Scan(&count)
+	})
+	return count, err
+}
+
+// ListQuestions returns a page of questions in the order of q.Sort, each with its first approved answers
+func ListQuestions(ctx context.Context, queries *_db.Queries, q QuestionQuery) (*QuestionPage, error) {
+	if q.Sort == "" {
+		q.Sort = SortQuestionNewest
+	}
+	order, ok := questionSortKeys[q.Sort]
+	if !ok {
+		return nil, ErrInvalidFilter
+	}
+	if !ValidReviewStatus(q.Status) {
+		return nil, ErrInvalidStatus
+	}
+	c, err := decodeCursor(q.Cursor, q.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit < 1 || q.Limit > MaxLimit {
+		q.Limit = DefaultLimit
+	}
+
+	var args sqlArgs
+	conditions := []string{"t_questions.status = " + args.add(q.Status)}
+	if q.ProductId > 0 {
+		conditions = append(conditions, "t_questions.foreign_id = "+args.add(q.ProductId))
+	}
+	comparison, direction := ">", "ASC"
+	if order.desc {
+		comparison, direction = "<", "DESC"
+	}
+	if c != nil {
+		conditions = append(conditions, "("+order.key+", t_questions.id) "+comparison+" ("+args.add(c.Value)+", "+args.add(c.Id)+")")
+	}
+
+	db := queries.ReadDB(ctx)
+	rows, err := db.QueryContext(ctx, `SELECT t_questions.id, t_questions.foreign_id, t_users.email, t_questions.body, t_questions.status,
+		t_questions.upvotes, t_questions.answer_count, t_questions.created_at
+		FROM shop.t_questions
+		JOIN shop.t_users ON t_users.id = t_questions.foreign_user_id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+order.key+` `+direction+`, t_questions.id `+direction+`
+		LIMIT `+strconv.Itoa(q.Limit+1), args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &QuestionPage{Items: []Question{}}
+	for rows.Next() {
+		question := Question{Answers: []Answer{}}
+		var email string
+		if err := rows.Scan(&question.Id, &question.ProductId, &email, &question.Body, &question.Status,
+			&question.Upvotes, &question.AnswerCount, &question.CreatedAt); err != nil {
+			return nil, err
+		}
+		question.Author = maskEmail(email)
+		page.Items = append(page.Items, question)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[len(page.Items)-1]
+		next := cursor{Sort: q.Sort, Value: float64(last.CreatedAt), Id: int(last.Id)}
+		if q.Sort == SortQuestionVotes {
+			next.Value = float64(last.Upvotes)
+		}
+		page.NextCursor = next.encode()
+	}
+	if len(page.Items) == 0 {
+		return page, nil
+	}
+
+	ids := make([]int64, 0, len(page.Items))
+	index := make(map[int64]int, len(page.Items))
+	for i, question := range page.Items {
+		ids = append(ids, question.Id)
+		index[question.Id] = i
+	}
+	answerRows, err := db.QueryContext(ctx, `SELECT id, question_id, email, body, is_staff, status, upvotes, created_at FROM (
+			SELECT t_answers.id, t_answers.question_id, t_users.email, t_answers.body, t_answers.is_staff, t_answers.status,
+				t_answers.upvotes, t_answers.created_at,
+				row_number() OVER (PARTITION BY t_answers.question_id ORDER BY `+answerOrder+` DESC, t_answers.id DESC) AS rank
+			FROM shop.t_answers
+			JOIN shop.t_users ON t_users.id = t_answers.foreign_user_id
+			WHERE t_answers.question_id = ANY($1) AND t_answers.status = 'approved'
+		) AS answers
+		WHERE rank <= $2
+		ORDER BY question_id, rank`, pq.Array(ids), answersPerQuestion)
+	if err != nil {
+		return nil, err
+	}
+	defer answerRows.Close()
+	for answerRows.Next() {
+		answer, err := scanAnswer(answerRows)
+		if err != nil {
+			return nil, err
+		}
+		question := &page.Items[index[answer.QuestionId]]
+		question.Answers = append(question.Answers, *answer)
+	}
+	return page, answerRows.Err()
+}
+
+func scanAnswer(row rowScanner) (*Answer, error) {
+	var answer Answer
+	var email string
+	if err := row.Scan(&answer.Id, &answer.QuestionId, &email, &answer.Body, &answer.IsStaff, &answer.Status, &answer.Upvotes, &answer.CreatedAt); err != nil {
+		return nil, err
+	}
+	answer.Author = maskEmail(email)
+	return &answer, nil
+}
+
+// ListAnswers returns a page of answers, staff answers first then by upvotes
+func ListAnswers(ctx context.Context, queries *_db.Queries, q AnswerQuery) (*AnswerPage, error) {
+	if !ValidReviewStatus(q.Status) {
+		return nil, ErrInvalidStatus
+	}
+	c, err := decodeCursor(q.Cursor, SortQuestionVotes)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit < 1 || q.Limit > MaxLimit {
+		q.Limit = DefaultLimit
+	}
+
+	var args sqlArgs
+	conditions := []string{"t_answers.status = " + args.add(q.Status)}
+	if q.QuestionId > 0 {
+		conditions = append(conditions, "t_answers.question_id = "+args.add(q.QuestionId))
+	}
+	if c != nil {
+		conditions = append(conditions, "("+answerOrder+", t_answers.id) < ("+args.add(c.Value)+", "+args.add(c.Id)+")")
+	}
+
+	rows, err := queries.ReadDB(ctx).QueryContext(ctx, `SELECT t_answers.id, t_answers.question_id, t_users.email, t_answers.body,
+		t_answers.is_staff, t_answers.status, t_answers.upvotes, t_answers.created_at
+		FROM shop.t_answers
+		JOIN shop.t_users ON t_users.id = t_answers.foreign_user_id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+answerOrder+` DESC, t_answers.id DESC
+		LIMIT `+strconv.Itoa(q.Limit+1), args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &AnswerPage{Items: []Answer{}}
+	for rows.Next() {
+		answer, err := scanAnswer(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Items = append(page.Items, *answer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[len(page.Items)-1]
+		value := float64(last.Upvotes)
+		if last.IsStaff {
+			value += 1000000000
+		}
+		page.NextCursor = cursor{Sort: SortQuestionVotes, Value: value, Id: int(last.Id)}.encode()
+	}
+	return page, nil
+}
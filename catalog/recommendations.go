@@ -0,0 +1,227 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_db "kamal/database"
+	"kamal/images"
+
+	"github.com/lib/pq"
+)
+
+// RecommendOptions tunes ComputeRecommendations, zero values use the defaults
+type RecommendOptions struct {
+	// MinTogether is how many users must have saved two products for them to be related
+	MinTogether int
+	// PerProduct is how many related products are kept for each product
+	PerProduct int
+	// MaxBasket leaves out the users who saved more products than this, they relate everything to everything
+	MaxBasket int
+}
+
+const (
+	defaultMinTogether = 2
+	defaultPerProduct  = 50
+	defaultMaxBasket   = 500
+)
+
+// RecommendReport is what ComputeRecommendations wrote
+type RecommendReport struct {
+	Products int64 `json:"products"`
+	Pairs    int64 `json:"pairs"`
+}
+
+// savedProducts is every (user, product) saved in a wishlist or in the cart, once
+const savedProducts = `saved_all AS (
+		SELECT foreign_user_id, foreign_product_id AS product_id FROM shop.t_wishlist_products
+		UNION
+		SELECT foreign_user_id, foreign_product_id FROM shop.t_cart
+	),
+	saved AS (
+		SELECT s.foreign_user_id, s.product_id FROM saved_all s
+		JOIN shop.t_productId ON t_productId.id = s.product_id
+		WHERE s.foreign_user_id IN (SELECT foreign_user_id FROM saved_all GROUP BY foreign_user_id HAVING count(*) <= $1)
+	)`
+
+// ComputeRecommendations rebuilds t_product_popularity and t_related_products in one transaction,
+// readers keep the previous scores until it commits.
+// The score of two products is how many users saved both divided by the geometric mean of how many
+// saved each one (cosine similarity), so best sellers don't end up related to every product.
+func ComputeRecommendations(ctx context.Context, queries *_db.Queries, opts RecommendOptions) (RecommendReport, error) {
+	if opts.MinTogether < 1 {
+		opts.MinTogether = defaultMinTogether
+	}
+	if opts.PerProduct < 1 {
+		opts.PerProduct = defaultPerProduct
+	}
+	if opts.MaxBasket < 2 {
+		opts.MaxBasket = defaultMaxBasket
+	}
+
+	var report RecommendReport
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		report = RecommendReport{}
+		for _, query := range []string{`DELETE FROM shop.t_related_products`, `DELETE FROM shop.t_product_popularity`} {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, `INSERT INTO shop.t_product_popularity(product_id, users)
+			WITH `+savedProducts+`
+			SELECT product_id, count(*) FROM saved GROUP BY product_id`, opts.MaxBasket)
+		if err != nil {
+			return err
+		}
+		if report.Products, err = result.RowsAffected(); err != nil {
+			return err
+		}
+
+		result, err = tx.ExecContext(ctx, `INSERT INTO shop.t_related_products(product_id, related_id, together, score)
+			WITH `+savedProducts+`,
+			pairs AS (
+				SELECT a.product_id, b.product_id AS related_id, count(*) AS together
+				FROM saved a JOIN saved b ON b.foreign_user_id = a.foreign_user_id AND b.product_id <> a.product_id
+				GROUP BY a.product_id, b.product_id
+				HAVING count(*) >= $2
+			),
+			scored AS (
+				SELECT pairs.product_id, pairs.related_id, pairs.together,
+					pairs.together / sqrt(pa.users::float8 * pb.users::float8) AS score
+				FROM pairs
+				JOIN shop.t_product_popularity pa ON pa.product_id = pairs.product_id
+				JOIN shop.t_product_popularity pb ON pb.product_id = pairs.related_id
+			)
+			SELECT product_id, related_id, together, score FROM (
+				SELECT scored.*, row_number() OVER (PARTITION BY product_id ORDER BY score DESC, together DESC, related_id) AS rank
+				FROM scored
+			) ranked
+			WHERE rank <= $3`, opts.MaxBasket, opts.MinTogether, opts.PerProduct)
+		if err != nil {
+			return err
+		}
+		report.Pairs, err = result.RowsAffected()
+		return err
+	})
+	return report, err
+}
+
+// Recommendations are product cards, best first. The last Fallback ones are popular products
+// filling in when there were not enough related products, all of them on a cold start.
+type Recommendations struct {
+	Items    []ProductCard `json:"items"`
+	Fallback int           `json:"fallback"`
+}
+
+// userSaved is the products the user saved in a wishlist or in the cart, userId is the placeholder
+func userSaved(userId string) string {
+	return `SELECT foreign_product_id FROM shop.t_wishlist_products WHERE foreign_user_id = ` + userId + `
+		UNION SELECT foreign_product_id FROM shop.t_cart WHERE foreign_user_id = ` + userId
+}
+
+// Related returns the displayed products most saved together with the product
+func Related(ctx context.Context, queries *_db.Queries, productId int, limit int) (Recommendations, error) {
+	limit = recommendationLimit(limit)
+	db := queries.ReadDB(ctx)
+
+	var args sqlArgs
+	join := `JOIN shop.t_related_products r ON r.related_id = t_productId.id AND r.product_id = ` + args.add(productId)
+	items, err := scoredCards(ctx, db, &args, join, "r.score", nil, limit)
+	if err != nil {
+		return Recommendations{}, err
+	}
+
+	exclude := []int64{int64(productId)}
+	return withPopular(ctx, db, items, exclude, "", nil, limit)
+}
+
+// ForUser returns the displayed products most saved together with the products the user saved,
+// the scores of every saved product are added up. Saved products are never recommended.
+func ForUser(ctx context.Context, queries *_db.Queries, userId int, limit int) (Recommendations, error) {
+	limit = recommendationLimit(limit)
+	db := queries.ReadDB(ctx)
+
+	var args sqlArgs
+	user := args.add(userId)
+	join := `JOIN (
+		SELECT r.related_id, sum(r.score) AS score FROM shop.t_related_products r
+		WHERE r.product_id IN (` + userSaved(user) + `)
+		AND r.related_id NOT IN (` + userSaved(user) + `)
+		GROUP BY r.related_id
+	) rec ON rec.related_id = t_productId.id`
+	items, err := scoredCards(ctx, db, &args, join, "rec.score", nil, limit)
+	if err != nil {
+		return Recommendations{}, err
+	}
+
+	return withPopular(ctx, db, items, nil, "t_productId.id NOT IN ("+userSaved("$1")+")", userId, limit)
+}
+
+func recommendationLimit(limit int) int {
+	if limit < 1 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+// withPopular tops items up to limit with the most saved products that are not in items nor in exclude.
+// The condition, when given, uses $1 for arg.
+func withPopular(ctx context.Context, db *sql.DB, items []ProductCard, exclude []int64, condition string, arg interface{}, limit int) (Recommendations, error) {
+	recs := Recommendations{Items: items}
+	if len(items) >= limit {
+		return recs, nil
+	}
+
+	var args sqlArgs
+	var where []string
+	if condition != "" {
+		args.add(arg)
+		where = append(where, condition)
+	}
+	for _, card := range items {
+		exclude = append(exclude, int64(card.ProductId))
+	}
+	if len(exclude) > 0 {
+		where = append(where, "t_productId.id <> ALL("+args.add(pq.Int64Array(exclude))+"::bigint[])")
+	}
+
+	popular, err := scoredCards(ctx, db, &args, `LEFT JOIN shop.t_product_popularity pop ON pop.product_id = t_productId.id`, "COALESCE(pop.users, 0)", where, limit-len(items))
+	if err != nil {
+		return Recommendations{}, err
+	}
+	recs.Items = append(recs.Items, popular...)
+	recs.Fallback = len(popular)
+	return recs, nil
+}
+
+// scoredCards returns the displayed product cards of join ordered by score, newest first on ties
+func scoredCards(ctx context.Context, db *sql.DB, args *sqlArgs, join string, score string, where []string, limit int) ([]ProductCard, error) {
+	where = append([]string{"t_basicInfo.display"}, where...)
+	query := "SELECT " + cardColumns + ",\n\t(" + score + ")::float8 AS rank_score" + cardFrom + "\n\t" + join +
+		"\n\tWHERE " + strings.Join(where, "\n\tAND ") +
+		"\n\tORDER BY rank_score DESC, t_productId.id DESC" +
+		"\n\tLIMIT " + args.add(limit)
+
+	rows, err := db.QueryContext(ctx, query, args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []ProductCard{}
+	for rows.Next() {
+		var card ProductCard
+		var value float64
+		if err := rows.Scan(cardScanDest(&card, &value)...); err != nil {
+			return nil, err
+		}
+		card.Thumbnail = images.URL(card.Image, "card", "")
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
@@ -0,0 +1,332 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	_db "kamal/database"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrReviewNotFound = errors.New("review not found")
+	ErrInvalidReview  = errors.New("rating must be between 1 and 5, title up to 150 and body up to 5000 characters")
+	ErrOwnReview      = errors.New("users can't vote for their own review")
+	ErrInvalidStatus  = errors.New("status must be pending, approved or rejected")
+)
+
+const (
+	maxReviewTitle = 150
+	maxReviewBody  = 5000
+)
+
+// moderation states of a review, only approved reviews are listed publicly and counted in the rating
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// ValidReviewStatus reports whether status is one of the moderation states
+func ValidReviewStatus(status string) bool {
+	return status == ReviewPending || status == ReviewApproved || status == ReviewRejected
+}
+
+// review orders, ties are broken by the review id in the same direction
+const (
+	SortReviewNewest     Sort = "newest"
+	SortReviewOldest     Sort = "oldest"
+	SortReviewHelpful    Sort = "helpful"
+	SortReviewRatingDesc Sort = "rating_desc"
+	SortReviewRatingAsc  Sort = "rating_asc"
+)
+
+var reviewSortKeys = map[Sort]struct {
+	key  string
+	desc bool
+}{
+	SortReviewNewest:     {"t_reviews.created_at", true},
+	SortReviewOldest:     {"t_reviews.created_at", false},
+	SortReviewHelpful:    {"t_reviews.helpful_count", true},
+	SortReviewRatingDesc: {"t_reviews.rating", true},
+	SortReviewRatingAsc:  {"t_reviews.rating", false},
+}
+
+// Review is a review as listed, Author is the masked email of its writer
+type Review struct {
+	Id               int64  `json:"id"`
+	ProductId        int    `json:"productId"`
+	Author           string `json:"author"`
+	Rating           int    `json:"rating"`
+	Title            string `json:"title"`
+	Body             string `json:"body"`
+	Status           string `json:"status"`
+	VerifiedPurchase bool   `json:"verifiedPurchase"`
+	HelpfulCount     int    `json:"helpfulCount"`
+	CreatedAt        int64  `json:"createdAt"`
+	UpdatedAt        int64  `json:"updatedAt"`
+}
+
+// ReviewInput is what a user sends to review a product
+type ReviewInput struct {
+	Rating int    `json:"rating"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+}
+
+func (in *ReviewInput) validate() error {
+	in.Title = strings.TrimSpace(in.Title)
+	in.Body = strings.TrimSpace(in.Body)
+	if in.Rating < 1 || in.Rating > 5 || utf8.RuneCountInString(in.Title) > maxReviewTitle || utf8.RuneCountInString(in.Body) > maxReviewBody {
+		return ErrInvalidReview
+	}
+	return nil
+}
+
+// Rating sums up the approved reviews of a product, Stars counts the reviews of 1 to 5 stars
+type Rating struct {
+	Count   int     `json:"count"`
+	Average float64 `json:"average"`
+	Stars   []int64 `json:"stars"`
+}
+
+// ReviewPage is one page of reviews, NextCursor is empty on the last page.
+// Rating is only sent with the first page of a product.
+type ReviewPage struct {
+	Items      []Review `json:"items"`
+	NextCursor string   `json:"nextCursor"`
+	Rating     *Rating  `json:"rating,omitempty"`
+}
+
+// ReviewQuery selects the reviews to list. ProductId 0 lists the reviews of every product, for moderation.
+type ReviewQuery struct {
+	ProductId int
+	Status    string
+	// Rating only lists the reviews with that many stars when it is set
+	Rating int
+	Sort   Sort
+	Cursor string
+	Limit  int
+}
+
+// maskEmail keeps the first letter of the email name, reviews don't publish addresses
+func maskEmail(email string) string {
+	name := email
+	if at := strings.IndexByte(email, '@'); at >= 0 {
+		name = email[:at]
+	}
+	first, _ := utf8.DecodeRuneInString(name)
+	if first == utf8.RuneError {
+		return "***"
+	}
+	return string(first) + "***"
+}
+
+// PostReview writes the review of the user for the product, a user posting again edits the review.
+// The review is pending when premoderation is on, approved otherwise; an edited rejected review goes back to pending.
+// It returns the review and the longProductId of the product, whose cached data holds the rating.
+func PostReview(ctx context.Context, queries *_db.Queries, userId int, productId int, in ReviewInput, premoderation bool) (*Review, int64, error) {
+	if err := in.validate(); err != nil {
+		return nil, 0, err
+	}
+	status := ReviewApproved
+	if premoderation {
+		status = ReviewPending
+	}
+
+	review := Review{ProductId: productId, Rating: in.Rating, Title: in.Title, Body: in.Body}
+	var longProductId int64
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var email string
+		err := tx.QueryRowContext(ctx, `SELECT t_productId.myproductid, t_users.email
+			FROM shop.t_productId
+			JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_productId.id
+			JOIN shop.t_users ON t_users.id = $2
+			WHERE t_productId.id = $1 AND t_basicInfo.display`, productId, userId).Scan(&longProductId, &email)
+		if err == sql.ErrNoRows {
+			return ErrProductNotFound
+		}
+		if err != nil {
+			return err
+		}
+		review.Author = maskEmail(email)
+
+		return tx.QueryRowContext(ctx, `INSERT INTO shop.t_reviews(foreign_id, foreign_user_id, rating, title, body, status)
+			VALUES($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (foreign_id, foreign_user_id) DO UPDATE SET rating = EXCLUDED.rating, title = EXCLUDED.title, body = EXCLUDED.body,
+				status = CASE WHEN t_reviews.status = 'rejected' THEN 'pending' ELSE EXCLUDED.status END,
+				updated_at = floor(extract(epoch from now())::integer)
+			RETURNING id, status, verified_purchase, helpful_count, created_at, updated_at`,
+			productId, userId, in.Rating, in.Title, in.Body, status).Scan(&review.Id, &review.Status, &review.VerifiedPurchase, &review.HelpfulCount, &review.CreatedAt, &review.UpdatedAt)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &review, longProductId, nil
+}
+
+// DeleteReview deletes the review of the user for the product, it returns the longProductId of the product
+func DeleteReview(ctx context.Context, queries *_db.Queries, userId int, productId int) (int64, error) {
+	_db.MarkWritten(ctx)
+	var longProductId int64
+	err := queries.DB.QueryRowContext(ctx, `DELETE FROM shop.t_reviews USING shop.t_productId
+		WHERE t_reviews.foreign_id = $1 AND t_reviews.foreign_user_id = $2 AND t_productId.id = t_reviews.foreign_id
+		RETURNING t_productId.myproductid`, productId, userId).Scan(&longProductId)
+	if err == sql.ErrNoRows {
+		return 0, ErrReviewNotFound
+	}
+	return longProductId, err
+}
+
+// VoteReview marks an approved review as helpful for the user, or takes the vote back when helpful is false.
+// Voting twice counts once. It returns the new helpful count.
+func VoteReview(ctx context.Context, queries *_db.Queries, userId int, reviewId int64, helpful bool) (int, error) {
+	count := 0
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var writer int
+		err := tx.QueryRowContext(ctx, `SELECT foreign_user_id, helpful_count FROM shop.t_reviews WHERE id = $1 AND status = 'approved' FOR UPDATE`, reviewId).Scan(&writer, &count)
+		if err == sql.ErrNoRows {
+			return ErrReviewNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if writer == userId {
+			return ErrOwnReview
+		}
+
+		var result sql.Result
+		if helpful {
+			result, err = tx.ExecContext(ctx, `INSERT INTO shop.t_review_votes(review_id, foreign_user_id) VALUES($1, $2) ON CONFLICT DO NOTHING`, reviewId, userId)
+		} else {
+			result, err = tx.ExecContext(ctx, `DELETE FROM shop.t_review_votes WHERE review_id = $1 AND foreign_user_id = $2`, reviewId, userId)
+		}
+		if err != nil {
+			return err
+		}
+		changed, err := result.RowsAffected()
+		if err != nil || changed == 0 {
+			return err
+		}
+
+		step := 1
+		if !helpful {
+			step = -1
+		}
+		return tx.QueryRowContext(ctx, `UPDATE shop.t_reviews SET helpful_count = greatest(helpful_count + $2, 0) WHERE id = $1 RETURNING helpful_count`, reviewId, step).Scan(&count)
+	})
+	return count, err
+}
+
+// ModerateReview sets the moderation state of a review, it returns the longProductId of its product
+func ModerateReview(ctx context.Context, queries *_db.Queries, reviewId int64, status string) (int64, error) {
+	if !ValidReviewStatus(status) {
+		return 0, ErrInvalidStatus
+	}
+	_db.MarkWritten(ctx)
+	var longProductId int64
+	err := queries.DB.QueryRowContext(ctx, `UPDATE shop.t_reviews SET status = $2 FROM shop.t_productId
+		WHERE t_reviews.id = $1 AND t_productId.id = t_reviews.foreign_id
+		RETURNING t_productId.myproductid`, reviewId, status).Scan(&longProductId)
+	if err == sql.ErrNoRows {
+		return 0, ErrReviewNotFound
+	}
+	return longProductId, err
+}
+
+// ListReviews returns a page of reviews in the order of q.Sort, the first page of a product comes with its rating
+func ListReviews(ctx context.Context, queries *_db.Queries, q ReviewQuery) (*ReviewPage, error) {
+	if q.Sort == "" {
+		q.Sort = SortReviewNewest
+	}
+	order, ok := reviewSortKeys[q.Sort]
+	if !ok {
+		return nil, ErrInvalidFilter
+	}
+	if !ValidReviewStatus(q.Status) {
+		return nil, ErrInvalidStatus
+	}
+	c, err := decodeCursor(q.Cursor, q.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit < 1 || q.Limit > MaxLimit {
+		q.Limit = DefaultLimit
+	}
+
+	var args sqlArgs
+	conditions := []string{"t_reviews.status = " + args.add(q.Status)}
+	if q.ProductId > 0 {
+		conditions = append(conditions, "t_reviews.foreign_id = "+args.add(q.ProductId))
+	}
+	if q.Rating > 0 {
+		conditions = append(conditions, "t_reviews.rating = "+args.add(q.Rating))
+	}
+	comparison := ">"
+	direction := "ASC"
+	if order.desc {
+		comparison, direction = "<", "DESC"
+	}
+	if c != nil {
+		conditions = append(conditions, "("+order.key+", t_reviews.id) "+comparison+" ("+args.add(c.Value)+", "+args.add(c.Id)+")")
+	}
+
+	db := queries.ReadDB(ctx)
+	rows, err := db.QueryContext(ctx, `SELECT t_reviews.id, t_reviews.foreign_id, t_users.email, t_reviews.rating, t_reviews.title, t_reviews.body,
+		t_reviews.status, t_reviews.verified_purchase, t_reviews.helpful_count, t_reviews.created_at, t_reviews.updated_at
+		FROM shop.t_reviews
+		JOIN shop.t_users ON t_users.id = t_reviews.foreign_user_id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+order.key+` `+direction+`, t_reviews.id `+direction+`
+		LIMIT `+strconv.Itoa(q.Limit+1), args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &ReviewPage{Items: []Review{}}
+	for rows.Next() {
+		var review Review
+		var email string
+		if err := rows.Scan(&review.Id, &review.ProductId, &email, &review.Rating, &review.Title, &review.Body,
+			&review.Status, &review.VerifiedPurchase, &review.HelpfulCount, &review.CreatedAt, &review.UpdatedAt); err != nil {
+			return nil, err
+		}
+		review.Author = maskEmail(email)
+		page.Items = append(page.Items, review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[len(page.Items)-1]
+		next := cursor{Sort: q.Sort, Id: int(last.Id)}
+		switch q.Sort {
+		case SortReviewNewest, SortReviewOldest:
+			next.Value = float64(last.CreatedAt)
+		case SortReviewHelpful:
+			next.Value = float64(last.HelpfulCount)
+		default:
+			next.Value = float64(last.Rating)
+		}
+		page.NextCursor = next.encode()
+	}
+
+	if q.ProductId > 0 && q.Cursor == "" {
+		rating := Rating{Stars: []int64{0, 0, 0, 0, 0}}
+		err := db.QueryRowContext(ctx, `SELECT rating_count, rating_average, stars FROM shop.t_product_ratings WHERE foreign_id = $1`, q.ProductId).
+			Scan(&rating.Count, &rating.Average, (*pq.Int64Array)(&rating.Stars))
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		page.Rating = &rating
+	}
+	return page, nil
+}
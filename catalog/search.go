@@ -0,0 +1,148 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+
+	_db "kamal/database"
+)
+
+// SortRelevance orders search results by rank, it is the default order of search
+const SortRelevance Sort = "relevance"
+
+var ErrInvalidQuery = errors.New("search query is empty or too long")
+
+const maxQueryLength = 200
+
+// Highlight holds the matched words wrapped in <mark></mark>, the rest of the text is HTML escaped
+type Highlight struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// ts_headline marks the matches with these control characters, the text is escaped before they
+// are turned into <mark></mark> so a title can't carry its own tags
+const (
+	markStart = "\x02"
+	markStop  = "\x03"
+)
+
+var markReplacer = strings.NewReplacer(markStart, "<mark>", markStop, "</mark>")
+
+// highlight escapes the ts_headline output and marks its matches
+func highlight(headline string) string {
+	return markReplacer.Replace(html.EscapeString(headline))
+}
+
+// SearchRequest is a listing request with the text typed by the customer
+type SearchRequest struct {
+	ListRequest
+	Query string
+}
+
+var phrasePattern = regexp.MustCompile(`"([^"]*)"`)
+
+// searchTerms splits the text into "quoted phrases", plain words and the last word, which is
+// matched as a prefix so results show up while the customer is still typing
+func searchTerms(text string) (phrases []string, words []string, prefix string) {
+	for _, match := range phrasePattern.FindAllStringSubmatch(text, -1) {
+		if phrase := strings.TrimSpace(match[1]); phrase != "" {
+			phrases = append(phrases, phrase)
+		}
+	}
+
+	rest := strings.Fields(phrasePattern.ReplaceAllString(text, " "))
+	if len(rest) > 0 && !strings.HasSuffix(text, " ") && !strings.HasSuffix(text, `"`) {
+		// to_tsquery syntax characters are dropped, only letters and digits are kept
+		prefix = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, rest[len(rest)-1])
+		rest = rest[:len(rest)-1]
+	}
+	return phrases, rest, prefix
+}
+
+// tsquery returns the SQL building the tsquery of the text, empty when the text has no usable term
+func tsquery(text string, args *sqlArgs) string {
+	phrases, words, prefix := searchTerms(text)
+
+	var parts []string
+	for _, phrase := range phrases {
+		parts = append(parts, "phraseto_tsquery('english', "+args.add(phrase)+")")
+	}
+	if len(words) > 0 {
+		parts = append(parts, "plainto_tsquery('english', "+args.add(strings.Join(words, " "))+")")
+	}
+	if prefix != "" {
+		parts = append(parts, "to_tsquery('english', "+args.add(prefix+":*")+")")
+	}
+	return strings.Join(parts, " && ")
+}
+
+// Search runs a full text search over titles, descriptions and specs with the listing filters.
+// Titles that are close to the text (typos) match too, through pg_trgm word similarity.
+func Search(ctx context.Context, queries *_db.Queries, req SearchRequest) (Page, error) {
+	text := strings.TrimSpace(req.Query)
+	if text == "" || len(text) > maxQueryLength {
+		return Page{}, ErrInvalidQuery
+	}
+	if req.Sort == "" {
+		req.Sort = SortRelevance
+	}
+
+	q := pageQuery{filter: req.Filter, sort: req.Sort, limit: req.Limit}
+
+	tsq := tsquery(req.Query, &q.args)
+	if tsq == "" {
+		return Page{}, ErrInvalidQuery
+	}
+	textArg := q.args.add(text)
+
+	q.joins = []string{
+		"CROSS JOIN (SELECT " + tsq + " AS tsq) AS search_query",
+		"LEFT JOIN shop.t_search ON t_search.foreign_id = t_productId.id",
+		"LEFT JOIN shop.t_modifieddescription ON t_modifieddescription.foreign_id = t_productId.id",
+	}
+	q.where = append(q.where, "(t_search.document @@ search_query.tsq OR "+textArg+" <% t_titles.title)")
+
+	if req.Sort == SortRelevance {
+		q.sortKey = "ts_rank(t_search.document, search_query.tsq) + 0.1 * word_similarity(" + textArg + ", t_titles.title)"
+		q.desc = true
+	} else {
+		spec, ok := sortKeys[req.Sort]
+		if !ok {
+			return Page{}, ErrInvalidFilter
+		}
+		q.sortKey, q.desc = spec.key, spec.desc
+	}
+
+	q.extraColumns = `,
+	ts_headline('english', t_titles.title, search_query.tsq, 'StartSel=` + markStart + `, StopSel=` + markStop + `, HighlightAll=true'),
+	ts_headline('english', regexp_replace(coalesce(t_modifieddescription.description, ''), '<[^>]*>', ' ', 'g'), search_query.tsq, 'StartSel=` + markStart + `, StopSel=` + markStop + `, MaxFragments=2, MaxWords=20, MinWords=5')`
+	q.extraDest = func(card *ProductCard) []interface{} {
+		card.Highlight = &Highlight{}
+		return []interface{}{&card.Highlight.Title, &card.Highlight.Description}
+	}
+
+	var err error
+	if q.cursor, err = decodeCursor(req.Cursor, req.Sort); err != nil {
+		return Page{}, err
+	}
+
+	page, err := q.page(ctx, queries.ReadDB(ctx))
+	if err != nil {
+		return page, err
+	}
+	for _, card := range page.Items {
+		card.Highlight.Title = highlight(card.Highlight.Title)
+		card.Highlight.Description = highlight(card.Highlight.Description)
+	}
+	return page, nil
+}
@@ -0,0 +1,230 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	_db "kamal/database"
+)
+
+var (
+	ErrSkuNotFound = errors.New("sku not found")
+	ErrOutOfStock  = errors.New("not enough stock for this sku")
+)
+
+// Sku is a variant of a product, one entry of its price list. The rows of shop.t_skus are kept
+// in sync with t_pricelist and t_properties by the triggers of the 007_skus migration.
+type Sku struct {
+	Id        int64 `json:"id"`
+	ProductId int   `json:"productId"`
+	// ExternalId is the skuId of priceList_Data, when the product has one
+	ExternalId *int64 `json:"externalSkuId"`
+	// Name and Numbers are the priceList_InNames and priceList_InNumbers entries, e.g. "Red;XL;China"
+	Name    string `json:"name"`
+	Numbers string `json:"numbers"`
+	// Properties gives the value of every property of the product, e.g. {"Color": "Red", "Size": "XL"}
+	Properties         map[string]string `json:"properties"`
+	Price              Price             `json:"price"`
+	PriceAfterDiscount Price             `json:"priceAfterDiscount"`
+	Discount           int               `json:"discount"`
+	AvailQuantity      int               `json:"availQuantity"`
+	ImageUrl           string            `json:"imageUrl"`
+}
+
+// CartName is the cartName of the sku in t_cart, the format the clients used before skus
+func (s *Sku) CartName() string {
+	return strconv.Itoa(s.ProductId) + "-" + s.Name
+}
+
+const skuColumns = `t_skus.id, t_skus.foreign_id, t_skus.external_id, t_skus.name, t_skus.numbers, t_skus.properties,
+	t_skus.price, t_skus.price_after_discount, t_skus.discount, t_skus.quantity, t_skus.image_url`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSku(row rowScanner) (*Sku, error) {
+	var sku Sku
+	var externalId sql.NullInt64
+	var properties []byte
+	if err := row.Scan(&sku.Id, &sku.ProductId, &externalId, &sku.Name, &sku.Numbers, &properties,
+		&sku.Price, &sku.PriceAfterDiscount, &sku.Discount, &sku.AvailQuantity, &sku.ImageUrl); err != nil {
+		return nil, err
+	}
+	if externalId.Valid {
+		sku.ExternalId = &externalId.Int64
+	}
+	sku.Properties = map[string]string{}
+	if err := json.Unmarshal(properties, &sku.Properties); err != nil {
+		return nil, err
+	}
+	return &sku, nil
+}
+
+// ProductSkus returns the skus of a displayed product in the order of its price list,
+// ErrSkuNotFound when it has none
+func ProductSkus(ctx context.Context, queries *_db.Queries, productId int) ([]Sku, error) {
+	rows, err := queries.ReadDB(ctx).QueryContext(ctx, `SELECT `+skuColumns+`
+		FROM shop.t_skus
+		JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_skus.foreign_id
+		WHERE t_skus.foreign_id = $1 AND t_basicInfo.display
+		ORDER BY t_skus.position`, productId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skus := []Sku{}
+	for rows.Next() {
+		sku, err := scanSku(rows)
+		if err != nil {
+			return nil, err
+		}
+		skus = append(skus, *sku)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(skus) == 0 {
+		return nil, ErrSkuNotFound
+	}
+	return skus, nil
+}
+
+// SkuResolution is the answer to a property selection
+type SkuResolution struct {
+	// Sku is set once the selection picks exactly one sku
+	Sku *Sku `json:"sku"`
+	// Matches are the skus having every selected value
+	Matches []Sku `json:"matches"`
+	// Options gives, for every property, the values that are in stock with the other selected values,
+	// so a client can disable the ones leading nowhere
+	Options map[string][]string `json:"options"`
+}
+
+// ResolveSku matches a selection such as {"Color": "Red", "Size": "XL"} against the skus of a product.
+// Property names and values are compared ignoring case, a partial selection returns the remaining matches.
+func ResolveSku(skus []Sku, selection map[string]string) *SkuResolution {
+	resolution := &SkuResolution{Matches: []Sku{}, Options: map[string][]string{}}
+
+	for _, sku := range skus {
+		if skuMatches(&sku, selection, "") {
+			resolution.Matches = append(resolution.Matches, sku)
+		}
+	}
+	if len(resolution.Matches) == 1 && len(selection) > 0 {
+		resolution.Sku = &resolution.Matches[0]
+	}
+
+	// the options of a property ignore its own selected value, like the facet counts
+	seen := map[string]map[string]bool{}
+	for _, sku := range skus {
+		for name, value := range sku.Properties {
+			if seen[name] == nil {
+				seen[name] = map[string]bool{}
+				resolution.Options[name] = []string{}
+			}
+			if sku.AvailQuantity <= 0 || !skuMatches(&sku, selection, name) {
+				continue
+			}
+			if !seen[name][value] {
+				seen[name][value] = true
+				resolution.Options[name] = append(resolution.Options[name], value)
+			}
+		}
+	}
+	for name := range resolution.Options {
+		sort.Strings(resolution.Options[name])
+	}
+	return resolution
+}
+
+// skuMatches tells if the sku has every selected value, except the one of the property named except
+func skuMatches(sku *Sku, selection map[string]string, except string) bool {
+	for name, value := range selection {
+		if strings.EqualFold(name, except) {
+			continue
+		}
+		found := false
+		for property, skuValue := range sku.Properties {
+			if strings.EqualFold(property, name) {
+				found = strings.EqualFold(skuValue, strings.TrimSpace(value))
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// CartSku is a sku with the shipping method chosen for it, ready to be written to t_cart
+type CartSku struct {
+	Sku
+	ShippingDetails json.RawMessage
+	ShippingPrice   Price
+}
+
+// SelectedProperties is the selectedProperties of the cart row
+func (c *CartSku) SelectedProperties() json.RawMessage {
+	data, _ := json.Marshal(c.Properties)
+	return data
+}
+
+// CartSkuForUpdate reads a sku of a displayed product, and locks it until tx ends, to put quantity of it in a cart.
+// The shipping method is the one of shippingCompany, or the first one of the product when it is empty or unknown.
+func CartSkuForUpdate(ctx context.Context, tx *sql.Tx, skuId int64, quantity int, shippingCompany string) (*CartSku, error) {
+	sku, err := scanSku(tx.QueryRowContext(ctx, `SELECT `+skuColumns+`
+		FROM shop.t_skus
+		JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_skus.foreign_id
+		WHERE t_skus.id = $1 AND t_basicInfo.display
+		FOR SHARE OF t_skus`, skuId))
+	if err == sql.ErrNoRows {
+		return nil, ErrSkuNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if quantity > sku.AvailQuantity {
+		return nil, ErrOutOfStock
+	}
+
+	cartSku := &CartSku{Sku: *sku, ShippingDetails: json.RawMessage("null")}
+
+	var shipping []byte
+	err = tx.QueryRowContext(ctx, `SELECT shipping FROM shop.t_shippingdetails WHERE foreign_id = $1`, sku.ProductId).Scan(&shipping)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	var methods []json.RawMessage
+	if len(shipping) == 0 || json.Unmarshal(shipping, &methods) != nil || len(methods) == 0 {
+		return cartSku, nil
+	}
+
+	chosen := methods[0]
+	for _, method := range methods {
+		var fields struct {
+			Company string `json:"company"`
+		}
+		if json.Unmarshal(method, &fields) == nil && shippingCompany != "" && strings.EqualFold(fields.Company, shippingCompany) {
+			chosen = method
+			break
+		}
+	}
+	cartSku.ShippingDetails = chosen
+
+	// a price that is not a number is 0, like a method without one
+	var price struct {
+		Price Price `json:"price"`
+	}
+	if json.Unmarshal(chosen, &price) == nil {
+		cartSku.ShippingPrice = price.Price
+	}
+	return cartSku, nil
+}
@@ -0,0 +1,337 @@
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	_db "kamal/database"
+	"kamal/notifications"
+	"kamal/print"
+
+	"github.com/lib/pq"
+)
+
+var ErrAlreadyAvailable = errors.New("already available")
+
+// reasons of a stock subscription, what blocked the purchase when the user subscribed
+const (
+	StockReasonComingSoon  = "comingSoon"
+	StockReasonBackInStock = "backInStock"
+)
+
+// StockSubscription is a pending "notify me" of a product, or of one of its skus when SkuId is set
+type StockSubscription struct {
+	Id            int64    `json:"id"`
+	ProductId     int      `json:"productId"`
+	LongProductId string   `json:"longProductId"`
+	Title         string   `json:"title"`
+	SkuId         *int64   `json:"skuId"`
+	Reason        string   `json:"reason"`
+	Channels      []string `json:"channels"`
+	CreatedAt     int64    `json:"createdAt"`
+}
+
+// Subscribe asks for the user to be told through channels when the product, or its sku when skuId
+// is not 0, can be bought: coming soon products once they are released, others once they are in stock.
+// Subscribing again to the same item replaces the channels, a channel listed twice is kept once.
+// Items that can be bought already return ErrAlreadyAvailable.
+func Subscribe(ctx context.Context, queries *_db.Queries, userId int, productId int, skuId int64, channels []string) (*StockSubscription, error) {
+	channels = appendMissing(nil, channels...)
+	sub := StockSubscription{ProductId: productId, Channels: channels}
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var comingSoon bool
+		var quantity int
+		err := tx.QueryRowContext(ctx, `SELECT t_productId.myproductid, t_titles.title, t_basicInfo.comingSoon, t_basicInfo.quantityavaliable
+			FROM shop.t_productId
+			JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = t_productId.id
+			JOIN shop.t_titles ON t_titles.foreign_id = t_productId.id
+			WHERE t_productId.id = $1 AND t_basicInfo.display`, productId).Scan(&sub.LongProductId, &sub.Title, &comingSoon, &quantity)
+		if err == sql.ErrNoRows {
+			return ErrProductNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var sku sql.NullInt64
+		if skuId != 0 {
+			err := tx.QueryRowContext(ctx, `SELECT quantity FROM shop.t_skus WHERE id = $1 AND foreign_id = $2`, skuId, productId).Scan(&quantity)
+			if err == sql.ErrNoRows {
+				return ErrSkuNotFound
+			}
+			if err != nil {
+				return err
+			}
+			sku = sql.NullInt64{Int64: skuId, Valid: true}
+			sub.SkuId = &skuId
+		}
+
+		switch {
+		case comingSoon:
+			sub.Reason = StockReasonComingSoon
+		case quantity <= 0:
+			sub.Reason = StockReasonBackInStock
+		default:
+			return ErrAlreadyAvailable
+		}
+
+		return tx.QueryRowContext(ctx, `INSERT INTO shop.t_stock_subscriptions(foreign_user_id, foreign_id, sku_id, reason, channels)
+			VALUES($1, $2, $3, $4, $5)
+			ON CONFLICT (foreign_user_id, foreign_id, (coalesce(sku_id, 0))) DO UPDATE SET
+				reason = EXCLUDED.reason,
+				channels = EXCLUDED.channels,
+				created_at = EXCLUDED.created_at,
+				notified_at = NULL
+			RETURNING id, created_at`, userId, productId, sku, sub.Reason, pq.Array(channels)).Scan(&sub.Id, &sub.CreatedAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// Unsubscribe cancels the pending subscription of the user to the product, or to its sku when skuId is not 0.
+// It reports whether there was one.
+func Unsubscribe(ctx context.Context, queries *_db.Queries, userId int, productId int, skuId int64) (bool, error) {
+	_db.MarkWritten(ctx)
+	result, err := queries.DB.ExecContext(ctx, `DELETE FROM shop.t_stock_subscriptions
+		WHERE foreign_user_id = $1 AND foreign_id = $2 AND coalesce(sku_id, 0) = $3 AND notified_at IS NULL`, userId, productId, skuId)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// Subscriptions returns the pending subscriptions of the user, newest first
+func Subscriptions(ctx context.Context, queries *_db.Queries, userId int) ([]StockSubscription, error) {
+	// from the primary, the user maybe just subscribed in an earlier request that a replica hasn't replayed
+	rows, err := queries.DB.QueryContext(ctx, `SELECT s.id, s.foreign_id, t_productId.myproductid, t_titles.title, s.sku_id, s.reason, s.channels, s.created_at
+		FROM shop.t_stock_subscriptions s
+		JOIN shop.t_productId ON t_productId.id = s.foreign_id
+		JOIN shop.t_titles ON t_titles.foreign_id = s.foreign_id
+		WHERE s.foreign_user_id = $1 AND s.notified_at IS NULL
+		ORDER BY s.id DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []StockSubscription{}
+	for rows.Next() {
+		var sub StockSubscription
+		var skuId sql.NullInt64
+		if err := rows.Scan(&sub.Id, &sub.ProductId, &sub.LongProductId, &sub.Title, &skuId, &sub.Reason, pq.Array(&sub.Channels), &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		if skuId.Valid {
+			sub.SkuId = &skuId.Int64
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// StockAlertOptions tunes CheckStock, zero values use the defaults
+type StockAlertOptions struct {
+	// MaxPerHour is how many subscriptions of a user can fire in an hour, the others wait for the next hour
+	MaxPerHour int
+}
+
+const defaultStockAlertsPerHour = 10
+
+// StockAlertReport is what CheckStock did
+type StockAlertReport struct {
+	// Sent is how many messages went out, Failed how many could not be delivered on any channel
+	Sent    int  `json:"sent"`
+	Failed  int  `json:"failed"`
+	Skipped bool `json:"skipped"`
+}
+
+// StockAlert is the data of the notifications.BackInStock and notifications.NowAvailable notifications
+type StockAlert struct {
+	ProductId     int    `json:"productId"`
+	LongProductId string `json:"longProductId"`
+	Title         string `json:"title"`
+	SkuId         *int64 `json:"skuId"`
+	SkuName       string `json:"skuName"`
+}
+
+// stockMessage is the alert of a user about a product, with the subscriptions it answers
+type stockMessage struct {
+	message  notifications.Message
+	channels []string
+	ids      []int64
+}
+
+// stockAlertLock is the advisory lock key held while claiming the subscriptions, like priceAlertLock
+const stockAlertLock = 7_411_046
+
+// CheckStock fires the pending subscriptions whose item can be bought now: the product is displayed and
+// not coming soon, and it has stock (its sku has stock for a sku subscription). As a subscription is only
+// taken while the item can't be bought, this is the moment the stock goes from 0 to positive or comingSoon
+// flips to false.
+// The subscriptions are claimed in a transaction then delivered, each user gets one message per product
+// through the union of the channels of its subscriptions. A message no channel could deliver is released
+// to be retried on the next check, one delivered on some channel is not sent again.
+func CheckStock(ctx context.Context, queries *_db.Queries, dispatcher *notifications.Dispatcher, opts StockAlertOptions) (StockAlertReport, error) {
+	if opts.MaxPerHour < 1 {
+		opts.MaxPerHour = defaultStockAlertsPerHour
+	}
+
+	var report StockAlertReport
+	var messages []*stockMessage
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		report = StockAlertReport{}
+		messages = nil
+		var locked bool
+		if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, stockAlertLock).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			report.Skipped = true
+			return nil
+		}
+
+		rows, err := tx.QueryContext(ctx, `WITH sent AS (
+				SELECT foreign_user_id, count(*) AS alerts FROM shop.t_stock_subscriptions
+				WHERE notified_at > floor(extract(epoch from now())::integer) - 3600
+				GROUP BY foreign_user_id
+			),
+			due AS (
+				SELECT s.id, s.foreign_user_id, u.email, s.foreign_id, t_productId.myproductid, t_titles.title,
+					t_basicInfo.product_link, s.sku_id, coalesce(k.name, '') AS sku_name, s.reason, s.channels,
+					coalesce(sent.alerts, 0) + row_number() OVER (PARTITION BY s.foreign_user_id ORDER BY s.id) AS alerts
+				FROM shop.t_stock_subscriptions s
+				JOIN shop.t_users u ON u.id = s.foreign_user_id
+				JOIN shop.t_productId ON t_productId.id = s.foreign_id
+				JOIN shop.t_titles ON t_titles.foreign_id = s.foreign_id
+				JOIN shop.t_basicInfo ON t_basicInfo.foreign_id = s.foreign_id
+				LEFT JOIN shop.t_skus k ON k.id = s.sku_id
+				LEFT JOIN sent ON sent.foreign_user_id = s.foreign_user_id
+				WHERE s.notified_at IS NULL AND t_basicInfo.display AND NOT t_basicInfo.comingSoon
+				AND CASE WHEN s.sku_id IS NULL THEN t_basicInfo.quantityavaliable > 0 ELSE k.quantity > 0 END
+			)
+			UPDATE shop.t_stock_subscriptions s SET notified_at = floor(extract(epoch from now())::integer)
+			FROM due
+			WHERE s.id = due.id AND due.alerts <= $1
+			RETURNING due.id, due.foreign_user_id, due.email, due.foreign_id, due.myproductid, due.title,
+				due.product_link, due.sku_id, due.sku_name, due.reason, due.channels`, opts.MaxPerHour)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		byUserProduct := map[[2]int]*stockMessage{}
+		for rows.Next() {
+			var id int64
+			var alert StockAlert
+			var m notifications.Message
+			var link, reason string
+			var skuId sql.NullInt64
+			var channels []string
+			if err := rows.Scan(&id, &m.UserId, &m.Email, &alert.ProductId, &alert.LongProductId, &alert.Title,
+				&link, &skuId, &alert.SkuName, &reason, pq.Array(&channels)); err != nil {
+				return err
+			}
+			if skuId.Valid {
+				alert.SkuId = &skuId.Int64
+			}
+
+			key := [2]int{m.UserId, alert.ProductId}
+			msg, ok := byUserProduct[key]
+			if !ok {
+				msg = &stockMessage{message: m}
+				byUserProduct[key] = msg
+				messages = append(messages, msg)
+			}
+			msg.ids = append(msg.ids, id)
+			msg.channels = appendMissing(msg.channels, channels...)
+			// the subscription to the whole product wins over the ones to its skus
+			if !ok || alert.SkuId == nil {
+				msg.setAlert(alert, reason, link)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, msg := range messages {
+		delivered := false
+		for _, channel := range msg.channels {
+			if err := dispatcher.Send(ctx, channel, msg.message); err != nil {
+				print.Str("Error sending stock alert:", channel, msg.message.UserId, err)
+				continue
+			}
+			delivered = true
+		}
+		if delivered {
+			report.Sent++
+			continue
+		}
+		report.Failed++
+		_, err := queries.DB.ExecContext(ctx, `UPDATE shop.t_stock_subscriptions SET notified_at = NULL WHERE id = ANY($1)`, pq.Int64Array(msg.ids))
+		if err != nil {
+			print.Str("Error releasing stock alert:", err)
+		}
+	}
+	return report, nil
+}
+
+func (msg *stockMessage) setAlert(alert StockAlert, reason, link string) {
+	msg.message.Data = alert
+	msg.message.Kind, msg.message.Subject = notifications.BackInStock, "Back in stock: "+alert.Title
+	if reason == StockReasonComingSoon {
+		msg.message.Kind, msg.message.Subject = notifications.NowAvailable, "Now available: "+alert.Title
+	}
+	msg.message.Text = alert.Title
+	if alert.SkuName != "" {
+		msg.message.Text += " (" + alert.SkuName + ")"
+	}
+	msg.message.Text += " can be bought now.\n" + link
+}
+
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// WatchStock runs CheckStock every interval until ctx is done
+func WatchStock(ctx context.Context, queries *_db.Queries, dispatcher *notifications.Dispatcher, opts StockAlertOptions, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		report, err := CheckStock(checkCtx, queries, dispatcher, opts)
+		cancel()
+		if err != nil {
+			print.Str("Error checking stock alerts:", err)
+			continue
+		}
+		if report.Sent > 0 || report.Failed > 0 {
+			print.Str("Stock alerts sent:", report.Sent, "failed:", report.Failed)
+		}
+	}
+}
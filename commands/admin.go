@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strings"
+
+	_db "kamal/database"
+	"kamal/print"
+)
+
+// Admin gives or takes back the admin role of a user, admins can use the /admin routes.
+// usage: admin -email <email> [-revoke]
+func Admin(queries *_db.Queries, args []string) error {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	revoke := flags.Bool("revoke", false, "take the admin role back")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*email) == "" {
+		return errors.New("-email is required")
+	}
+
+	result, err := queries.DB.ExecContext(context.Background(), `UPDATE shop.t_users SET isAdmin = $1 WHERE email = $2`, !*revoke, strings.TrimSpace(*email))
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return errors.New("no user with this email")
+	}
+
+	if *revoke {
+		print.Str("Admin role revoked:", *email)
+	} else {
+		print.Str("Admin role given:", *email)
+	}
+	return nil
+}
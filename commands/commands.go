@@ -0,0 +1,29 @@
+package commands
+
+import (
+	"fmt"
+
+	_db "kamal/database"
+)
+
+// Run executes the subcommand given on the command line instead of starting the server
+func Run(name string, args []string, queries *_db.Queries) error {
+	switch name {
+	case "seed":
+		return Seed(queries, args)
+	case "import":
+		return Import(queries, args)
+	case "export":
+		return Export(queries, args)
+	case "recommend":
+		return Recommend(queries, args)
+	case "price-alerts":
+		return PriceAlerts(queries, args)
+	case "currency-rates":
+		return CurrencyRates(queries, args)
+	case "admin":
+		return Admin(queries, args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
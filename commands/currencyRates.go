@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	"kamal/print"
+	route "kamal/routes"
+)
+
+// CurrencyRates adds or updates the rates of a CSV (code,rate[,decimals]) or JSON ([{code, rate, decimals}])
+// file, all of them or none when one is invalid. The rates are how many units of each currency one unit of
+// CURRENCY_BASE is worth.
+// usage: currency-rates -file rates.csv [-format csv|json]
+func CurrencyRates(queries *_db.Queries, args []string) error {
+	flags := flag.NewFlagSet("currency-rates", flag.ContinueOnError)
+	file := flags.String("file", "", "CSV or JSON file, - reads stdin")
+	format := flags.String("format", "", "csv or json, taken from the file extension by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*file)), ".")
+	}
+
+	var input io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	rates, err := catalog.ReadRates(input, *format)
+	if err != nil {
+		return err
+	}
+	if len(rates) == 0 {
+		return errors.New("the file has no rate")
+	}
+
+	ctx := context.Background()
+	rateErrors, err := catalog.SetRates(ctx, queries, route.BaseCurrencyCode(), rates)
+	if err != nil {
+		return err
+	}
+	if len(rateErrors) > 0 {
+		encoder := json.NewEncoder(os.Stderr)
+		for _, rateErr := range rateErrors {
+			encoder.Encode(rateErr)
+		}
+		return errors.New("invalid rates, nothing was written")
+	}
+	route.InvalidateRates(ctx)
+	print.Str("Rates written:", len(rates))
+	return nil
+}
@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	route "kamal/routes"
+)
+
+// Export writes the catalog feed for shopping sites.
+// usage: export [-format xml|csv|json] [-since 1700000000|2024-01-02T15:04:05Z] [-out feed.xml]
+func Export(queries *_db.Queries, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", catalog.FeedXML, "xml (Google Merchant RSS), csv or json")
+	sinceFlag := flags.String("since", "", "only the products changed since this time, unix seconds or RFC 3339")
+	out := flags.String("out", "", "file receiving the feed, stdout by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	since, err := catalog.ParseSince(*sinceFlag)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+
+	generatedAt := time.Now().Unix()
+	count, err := catalog.WriteFeed(context.Background(), queries, buffered, route.FeedOptions(*format, since))
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	// written to stderr so it doesn't end up in a feed written to stdout
+	fmt.Fprintln(os.Stderr, "Products exported:", count, "next -since:", strconv.FormatInt(generatedAt, 10))
+	return nil
+}
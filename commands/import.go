@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	"kamal/print"
+	route "kamal/routes"
+)
+
+// Import reads a CSV or JSONL file of products and inserts or updates them keyed on longProductId.
+// usage: import -file products.csv [-format csv|jsonl] [-job name] [-dry-run] [-report errors.jsonl]
+// The row errors are written as JSON lines to -report, or to stderr.
+func Import(queries *_db.Queries, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("file", "", "CSV or JSONL file, - reads stdin")
+	format := flags.String("format", "", "csv or jsonl, taken from the file extension by default")
+	job := flags.String("job", "", "name of the import, running the same job again resumes it")
+	dryRun := flags.Bool("dry-run", false, "validate and write every batch, then roll it back")
+	reportPath := flags.String("report", "", "file receiving the row errors")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*file)), ".")
+	}
+
+	var input io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	var report io.Writer = os.Stderr
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		report = f
+	}
+	encoder := json.NewEncoder(report)
+
+	ctx := context.Background()
+	result, err := catalog.Import(ctx, queries, input, catalog.ImportOptions{
+		Format: *format,
+		Job:    *job,
+		DryRun: *dryRun,
+		OnError: func(rowErr catalog.RowError) {
+			encoder.Encode(rowErr)
+		},
+		OnBatch: func(productIds []int64) {
+			route.InvalidateProducts(ctx, productIds...)
+			print.Str("Imported up to product", productIds[len(productIds)-1])
+		},
+	})
+	print.Str("Lines:", result.Lines, "skipped:", result.Skipped, "inserted:", result.Inserted, "updated:", result.Updated, "failed:", result.Failed, "dry run:", result.DryRun)
+	if err != nil && *job != "" {
+		print.Str("Run the same command again to resume the job", *job)
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package commands
+
+import (
+	"context"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	"kamal/print"
+)
+
+// PriceAlerts notifies the owners of the wishlisted products whose price dropped, once. The server already
+// does it every PRICE_ALERT_INTERVAL, this is for PRICE_ALERT_INTERVAL=0 and a cron instead.
+// usage: price-alerts
+func PriceAlerts(queries *_db.Queries, args []string) error {
+	report, err := catalog.CheckPriceDrops(context.Background(), queries)
+	if err != nil {
+		return err
+	}
+	if report.Skipped {
+		print.Str("Another price alert check is running")
+		return nil
+	}
+	print.Str("Price drop notifications:", report.Notified)
+	return nil
+}
@@ -0,0 +1,30 @@
+package commands
+
+import (
+	"context"
+	"flag"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	"kamal/print"
+)
+
+// Recommend recomputes the related products from the wishlists and carts, run it periodically (cron).
+// usage: recommend [-min-together 2] [-per-product 50] [-max-basket 500]
+func Recommend(queries *_db.Queries, args []string) error {
+	flags := flag.NewFlagSet("recommend", flag.ContinueOnError)
+	var opts catalog.RecommendOptions
+	flags.IntVar(&opts.MinTogether, "min-together", 2, "users that must have saved both products")
+	flags.IntVar(&opts.PerProduct, "per-product", 50, "related products kept for each product")
+	flags.IntVar(&opts.MaxBasket, "max-basket", 500, "users who saved more products than this are left out")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := catalog.ComputeRecommendations(context.Background(), queries, opts)
+	if err != nil {
+		return err
+	}
+	print.Str("Products:", report.Products, "related pairs:", report.Pairs)
+	return nil
+}
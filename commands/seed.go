@@ -0,0 +1,450 @@
+package commands
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	_db "kamal/database"
+	"kamal/print"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password of every seeded user
+const seedPassword = "password123"
+
+// seeded products get myproductid seedProductBase + seed * seedProductStride + index,
+// so the same seed always writes the same rows
+const (
+	seedProductBase   = 4000000000000000
+	seedProductStride = 1000000
+)
+
+var (
+	seedAdjectives = []string{"Classic", "Vintage", "Casual", "Slim Fit", "Oversized", "Lightweight", "Waterproof", "Premium", "Portable", "Minimalist", "Retro", "Outdoor"}
+	seedMaterials  = []string{"Cotton", "Linen", "Leather", "Silk", "Wool", "Denim", "Stainless Steel", "Bamboo", "Ceramic", "Nylon", "Canvas", "Aluminium"}
+	seedNouns      = []string{"T-Shirt", "Hoodie", "Dress", "Jacket", "Sneakers", "Backpack", "Wallet", "Watch", "Sunglasses", "Water Bottle", "Desk Lamp", "Phone Case", "Scarf", "Beanie", "Mug"}
+	seedColors     = []string{"Black", "White", "Red", "Navy Blue", "Green", "Beige", "Grey", "Pink", "Yellow", "Brown"}
+	seedSizes      = []string{"XS", "S", "M", "L", "XL", "XXL"}
+	seedShipsFrom  = []struct{ name, code string }{{"China", "CN"}, {"United States", "US"}, {"SPAIN", "ES"}, {"France", "FR"}, {"Australia", "AU"}}
+	seedCarriers   = []string{"AliExpress Standard Shipping", "Cainiao Super Economy", "DHL", "FedEx", "Seller's Shipping Method"}
+	seedUnitNames  = []struct{ multi, odd string }{{"pieces", "piece"}, {"pairs", "pair"}, {"sets", "set"}}
+	seedListNames  = []string{"Birthday Ideas", "Summer", "For Later", "Gifts", "Home"}
+)
+
+// Seed fills the shop schema with generated products, users, wishlists and carts.
+// usage: seed [-seed 1] [-products 200] [-users 10]
+// Running it again with the same flags changes nothing, rows that already exist are skipped.
+func Seed(queries *_db.Queries, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	seed := flags.Int64("seed", 1, "seed of the generator, the same seed and sizes always produce the same data")
+	products := flags.Int("products", 200, "number of products")
+	users := flags.Int("users", 10, "number of users, each one gets wishlists and a cart")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *seed < 0 || *seed > 999 {
+		return errors.New("-seed must be between 0 and 999")
+	}
+	if *products < 1 || *products >= seedProductStride {
+		return fmt.Errorf("-products must be between 1 and %d", seedProductStride-1)
+	}
+	if *users < 0 {
+		return errors.New("-users can't be negative")
+	}
+
+	ctx := context.Background()
+
+	productIds := make([]int, 0, *products)
+	created := 0
+	for index := 0; index < *products; index++ {
+		// every product has its own generator so adding products doesn't change the existing ones
+		rng := rand.New(rand.NewSource(*seed*seedProductStride + int64(index)))
+		product := generateProduct(rng, seedProductBase+*seed*seedProductStride+int64(index))
+
+		id, isNew, err := seedProduct(ctx, queries, &product)
+		if err != nil {
+			return fmt.Errorf("product %d: %w", product.myProductId, err)
+		}
+		if isNew {
+			created++
+		}
+		productIds = append(productIds, id)
+	}
+	print.Str("Products:", created, "created,", *products-created, "already there")
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(seedPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	for index := 0; index < *users; index++ {
+		rng := rand.New(rand.NewSource(-(*seed*seedProductStride + int64(index) + 1)))
+		email := "user" + strconv.Itoa(index+1) + "-seed" + strconv.FormatInt(*seed, 10) + "@example.com"
+		if err := seedUser(ctx, queries, rng, email, string(hashedPassword), productIds); err != nil {
+			return fmt.Errorf("user %s: %w", email, err)
+		}
+	}
+	print.Str("Users:", *users, "seeded, password:", seedPassword)
+
+	return nil
+}
+
+type seedSku struct {
+	SkuId              int64   `json:"skuId"`
+	AvailQuantity      int     `json:"availQuantity"`
+	Price              float64 `json:"price"`
+	PriceAfterDiscount float64 `json:"priceAfterDiscount"`
+	Discount           int     `json:"discount"`
+	ImageUrl           string  `json:"imageUrl"`
+}
+
+type seedProductData struct {
+	myProductId           int64
+	display               bool
+	link                  string
+	minPrice              float64
+	maxPrice              float64
+	discountNumber        int
+	discount              string
+	minPriceAfterDiscount float64
+	maxPriceAfterDiscount float64
+	multiUnitName         string
+	oddUnitName           string
+	maxPurchaseLimit      int
+	buyLimitText          string
+	quantityAvaliable     int
+	comingSoon            bool
+	title                 string
+	images                []string
+	properties            []map[string]interface{}
+	priceByName           []string
+	priceByNumber         []string
+	priceData             []seedSku
+	specs                 []map[string]string
+	shipping              []map[string]interface{}
+	description           string
+	colorImages           map[string]string
+}
+
+func pick(rng *rand.Rand, values []string) string {
+	return values[rng.Intn(len(values))]
+}
+
+func roundPrice(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+func generateProduct(rng *rand.Rand, myProductId int64) seedProductData {
+	p := seedProductData{myProductId: myProductId}
+	idText := strconv.FormatInt(myProductId, 10)
+
+	material := pick(rng, seedMaterials)
+	noun := pick(rng, seedNouns)
+	p.title = pick(rng, seedAdjectives) + " " + material + " " + noun
+	p.link = "https://www.aliexpress.com/item/" + idText + ".html"
+	p.display = rng.Intn(20) != 0
+	p.comingSoon = rng.Intn(15) == 0
+
+	for i := 0; i < 3+rng.Intn(4); i++ {
+		p.images = append(p.images, "https://picsum.photos/seed/"+idText+"-"+strconv.Itoa(i)+"/800/800")
+	}
+
+	// properties, same layout as the scraped ones: Color, Size and Ships From
+	colors := shuffled(rng, seedColors)[:2+rng.Intn(3)]
+	sizes := seedSizes[rng.Intn(2) : 3+rng.Intn(4)]
+	shipsFrom := seedShipsFrom[:1+rng.Intn(2)]
+
+	p.colorImages = make(map[string]string)
+	var colorValues, sizeValues, shipValues []map[string]interface{}
+	for i, color := range colors {
+		image := "https://picsum.photos/seed/" + idText + "-" + strings.ReplaceAll(strings.ToLower(color), " ", "-") + "/400/400"
+		p.colorImages[color] = image
+		colorValues = append(colorValues, map[string]interface{}{
+			"propertyValueId":           200 + i,
+			"propertyValueIdLong":       200 + i,
+			"propertyValueName":         color,
+			"propertyValueDisplayName":  color,
+			"skuPropertyTips":           color,
+			"skuPropertyValueTips":      color,
+			"skuPropertyImagePath":      image,
+			"skuPropertyValueShowOrder": 1,
+		})
+	}
+	for i, size := range sizes {
+		sizeValues = append(sizeValues, map[string]interface{}{
+			"propertyValueId":           100 + i,
+			"propertyValueIdLong":       100 + i,
+			"propertyValueName":         size,
+			"propertyValueDisplayName":  size,
+			"skuPropertyTips":           size,
+			"skuPropertyValueTips":      size,
+			"skuPropertyValueShowOrder": 2,
+		})
+	}
+	for i, ship := range shipsFrom {
+		shipValues = append(shipValues, map[string]interface{}{
+			"propertyValueId":                 201336100 + i,
+			"propertyValueIdLong":             201336100 + i,
+			"propertyValueName":               ship.name,
+			"propertyValueDisplayName":        ship.name,
+			"skuPropertyTips":                 ship.name,
+			"skuPropertyValueTips":            ship.name,
+			"skuPropertySendGoodsCountryCode": ship.code,
+			"skuPropertyValueShowOrder":       2,
+		})
+	}
+	p.properties = []map[string]interface{}{
+		{"order": 1, "skuPropertyId": 14, "skuPropertyName": "Color", "isShowTypeColor": false, "showType": "none", "showTypeColor": false, "skuPropertyValues": colorValues},
+		{"order": 2, "skuPropertyId": 5, "skuPropertyName": "Size", "isShowTypeColor": false, "showType": "none", "showTypeColor": false, "skuPropertyValues": sizeValues},
+		{"order": 3, "skuPropertyId": 200007763, "skuPropertyName": "Ships From", "isShowTypeColor": false, "showType": "none", "showTypeColor": false, "skuPropertyValues": shipValues},
+	}
+
+	// price list, one entry per combination, byname/bynumber/bydata share the same index
+	basePrice := 3 + rng.Float64()*80
+	p.discountNumber = []int{0, 0, 5, 10, 15, 20, 30, 40, 50}[rng.Intn(9)]
+	p.discount = strconv.Itoa(p.discountNumber) + "%"
+	p.minPrice, p.maxPrice = math.MaxFloat64, 0
+	skuId := p.myProductId * 100
+	for ci, color := range colors {
+		for si, size := range sizes {
+			for hi, ship := range shipsFrom {
+				price := roundPrice(basePrice + float64(si)*1.5 + float64(hi)*2.25)
+				quantity := 0
+				if !p.comingSoon && rng.Intn(8) != 0 {
+					quantity = 1 + rng.Intn(300)
+				}
+				sku := seedSku{
+					SkuId:              skuId,
+					AvailQuantity:      quantity,
+					Price:              price,
+					PriceAfterDiscount: roundPrice(price * float64(100-p.discountNumber) / 100),
+					Discount:           p.discountNumber,
+					ImageUrl:           p.colorImages[color],
+				}
+				skuId++
+
+				p.priceByName = append(p.priceByName, color+";"+size+";"+ship.name)
+				p.priceByNumber = append(p.priceByNumber, strconv.Itoa(200+ci)+";"+strconv.Itoa(100+si)+";"+strconv.Itoa(201336100+hi))
+				p.priceData = append(p.priceData, sku)
+				p.quantityAvaliable += quantity
+				p.minPrice = math.Min(p.minPrice, price)
+				p.maxPrice = math.Max(p.maxPrice, price)
+			}
+		}
+	}
+	p.minPriceAfterDiscount = roundPrice(p.minPrice * float64(100-p.discountNumber) / 100)
+	p.maxPriceAfterDiscount = roundPrice(p.maxPrice * float64(100-p.discountNumber) / 100)
+
+	units := seedUnitNames[rng.Intn(len(seedUnitNames))]
+	p.multiUnitName, p.oddUnitName = units.multi, units.odd
+	p.maxPurchaseLimit = []int{0, 5, 10, 99}[rng.Intn(4)]
+	if p.maxPurchaseLimit > 0 {
+		p.buyLimitText = "Max. " + strconv.Itoa(p.maxPurchaseLimit) + " " + p.multiUnitName + " per customer"
+	}
+
+	p.specs = []map[string]string{
+		{"attrName": "Material", "attrValue": material},
+		{"attrName": "Brand Name", "attrValue": "NONE"},
+		{"attrName": "Origin", "attrValue": "Mainland China"},
+		{"attrName": "Item Type", "attrValue": noun},
+		{"attrName": "Model Number", "attrValue": "SD-" + idText[len(idText)-6:]},
+	}
+
+	for _, ship := range shipsFrom {
+		price := 0.0
+		if rng.Intn(3) == 0 {
+			price = roundPrice(1 + rng.Float64()*9)
+		}
+		minDays := 5 + rng.Intn(15)
+		p.shipping = append(p.shipping, map[string]interface{}{
+			"company":      pick(rng, seedCarriers),
+			"shipFrom":     ship.name,
+			"shipFromCode": ship.code,
+			"shipTo":       "United States",
+			"price":        price,
+			"deliveryDays": strconv.Itoa(minDays) + "-" + strconv.Itoa(minDays+10),
+			"tracking":     rng.Intn(2) == 0,
+		})
+	}
+
+	p.description = "<p>" + p.title + " made of " + strings.ToLower(material) + ".</p>" +
+		"<ul><li>Available in " + strings.Join(colors, ", ") + "</li><li>Sizes " + strings.Join(sizes, ", ") + "</li></ul>" +
+		"<img src=\"" + p.images[0] + "\"/>"
+
+	return p
+}
+
+func shuffled(rng *rand.Rand, values []string) []string {
+	out := append([]string(nil), values...)
+	rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+func toJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(err) // only called with the generator's own values
+	}
+	return string(data)
+}
+
+// seedProduct writes the product to the nine product tables in one transaction,
+// a product whose myproductid already exists is left as it is
+func seedProduct(ctx context.Context, queries *_db.Queries, p *seedProductData) (int, bool, error) {
+	id := 0
+	isNew := false
+	err := queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		isNew = false
+		err := tx.QueryRowContext(ctx, `SELECT id FROM shop.t_productId WHERE myproductid = $1`, p.myProductId).Scan(&id)
+		if err == nil {
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		isNew = true
+
+		if err := tx.QueryRowContext(ctx, `INSERT INTO shop.t_productId(myproductid) VALUES($1) RETURNING id`, p.myProductId).Scan(&id); err != nil {
+			return err
+		}
+
+		inserts := []struct {
+			query string
+			args  []interface{}
+		}{
+			{`INSERT INTO shop.t_basicInfo(foreign_id, display, product_link, minprice, maxprice, discountnumber, discount, minprice_afterdiscount, maxprice_afterdiscount, multiunitname, oddunitname, maxpurchaselimit, buylimittext, quantityavaliable, comingSoon)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+				[]interface{}{id, p.display, p.link, p.minPrice, p.maxPrice, p.discountNumber, p.discount, p.minPriceAfterDiscount, p.maxPriceAfterDiscount, p.multiUnitName, p.oddUnitName, p.maxPurchaseLimit, p.buyLimitText, p.quantityAvaliable, p.comingSoon}},
+			{`INSERT INTO shop.t_titles(foreign_id, title) VALUES($1, $2)`, []interface{}{id, p.title}},
+			{`INSERT INTO shop.t_mainimages(foreign_id, image_link_array) VALUES($1, $2)`, []interface{}{id, toJSON(p.images)}},
+			{`INSERT INTO shop.t_properties(foreign_id, property_array) VALUES($1, $2)`, []interface{}{id, toJSON(p.properties)}},
+			{`INSERT INTO shop.t_pricelist(foreign_id, byname, bynumber, bydata) VALUES($1, $2, $3, $4)`, []interface{}{id, toJSON(p.priceByName), toJSON(p.priceByNumber), toJSON(p.priceData)}},
+			{`INSERT INTO shop.t_specs(foreign_id, specs) VALUES($1, $2)`, []interface{}{id, toJSON(p.specs)}},
+			{`INSERT INTO shop.t_shippingdetails(foreign_id, shipping) VALUES($1, $2)`, []interface{}{id, toJSON(p.shipping)}},
+			{`INSERT INTO shop.t_modifieddescription(foreign_id, description) VALUES($1, $2)`, []interface{}{id, p.description}},
+		}
+		for _, insert := range inserts {
+			if _, err := tx.ExecContext(ctx, insert.query, insert.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return id, isNew, err
+}
+
+// seedUser creates the user with a Default list and a few more, then fills the lists and the cart
+func seedUser(ctx context.Context, queries *_db.Queries, rng *rand.Rand, email string, hashedPassword string, productIds []int) error {
+	// draw everything first so the data doesn't depend on what already exists
+	listNames := append([]string{"Default"}, shuffled(rng, seedListNames)[:rng.Intn(3)]...)
+	wishlisted := make([][]int, len(listNames))
+	for i := range listNames {
+		for n := rng.Intn(8); n > 0; n-- {
+			wishlisted[i] = append(wishlisted[i], productIds[rng.Intn(len(productIds))])
+		}
+	}
+	type cartItem struct {
+		productId int
+		quantity  int
+		pick      int64
+	}
+	var cart []cartItem
+	for n := rng.Intn(5); n > 0; n-- {
+		cart = append(cart, cartItem{productIds[rng.Intn(len(productIds))], 1 + rng.Intn(3), rng.Int63()})
+	}
+
+	return queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var userId int
+		err := tx.QueryRowContext(ctx, `SELECT id FROM shop.t_users WHERE email = $1`, email).Scan(&userId)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRowContext(ctx, `INSERT INTO shop.t_users(email, password) VALUES($1, $2) RETURNING id`, email, hashedPassword).Scan(&userId)
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, name := range listNames {
+			var listId int
+			err := tx.QueryRowContext(ctx, `SELECT id FROM shop.t_wishlist WHERE foreign_user_id = $1 AND wishlistname = $2`, userId, name).Scan(&listId)
+			if err == sql.ErrNoRows {
+				err = tx.QueryRowContext(ctx, `INSERT INTO shop.t_wishlist(foreign_user_id, wishlistname, created_at) VALUES($1, $2, floor(extract(epoch from now())::integer)) RETURNING id`, userId, name).Scan(&listId)
+			}
+			if err != nil {
+				return err
+			}
+
+			for _, productId := range wishlisted[i] {
+				var image string
+				if err := tx.QueryRowContext(ctx, `SELECT image_link_array->>0 FROM shop.t_mainimages WHERE foreign_id = $1`, productId).Scan(&image); err != nil {
+					return err
+				}
+				// a product can only be in one list of the user, the first list it was drawn for keeps it
+				if _, err := tx.ExecContext(ctx, `INSERT INTO shop.t_wishlist_products(foreign_user_id, foreign_product_id, foreign_wishlist_id, selectedImageUrl) VALUES($1, $2, $3, $4) ON CONFLICT (foreign_user_id, foreign_product_id) DO NOTHING`, userId, productId, listId, image); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, item := range cart {
+			var byName, priceData, properties, shipping []byte
+			if err := tx.QueryRowContext(ctx, `SELECT t_pricelist.byname, t_pricelist.bydata, t_properties.property_array, t_shippingdetails.shipping
+				FROM shop.t_pricelist
+				JOIN shop.t_properties ON t_properties.foreign_id = t_pricelist.foreign_id
+				JOIN shop.t_shippingdetails ON t_shippingdetails.foreign_id = t_pricelist.foreign_id
+				WHERE t_pricelist.foreign_id = $1`, item.productId).Scan(&byName, &priceData, &properties, &shipping); err != nil {
+				return err
+			}
+
+			var names []string
+			var skus []seedSku
+			var shippingList []map[string]interface{}
+			if err := json.Unmarshal(byName, &names); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(priceData, &skus); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(shipping, &shippingList); err != nil {
+				return err
+			}
+			if len(names) == 0 || len(names) != len(skus) || len(shippingList) == 0 {
+				continue // not a product written by seed
+			}
+
+			index := int(item.pick % int64(len(names)))
+			sku := skus[index]
+			parts := strings.Split(names[index], ";")
+			selected := map[string]string{"Color": parts[0]}
+			if len(parts) > 2 {
+				selected["Size"], selected["Ships From"] = parts[1], parts[2]
+			}
+			cartName := strconv.Itoa(item.productId) + "-" + names[index]
+			shippingPrice, _ := shippingList[0]["price"].(float64)
+
+			var cartId int
+			err := tx.QueryRowContext(ctx, `SELECT id FROM shop.t_cart WHERE cartName = $1 AND foreign_user_id = $2`, cartName, userId).Scan(&cartId)
+			if err == nil {
+				continue
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO shop.t_cart(foreign_product_id, foreign_user_id, cartName, quantity, price, shippingPrice, discount, selectedProperties, shippingDetails, selectedImageUrl, sku_id) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, (SELECT id FROM shop.t_skus WHERE foreign_id = $1 AND name = $11))`,
+				item.productId, userId, cartName, item.quantity, sku.Price, shippingPrice, sku.Discount, toJSON(selected), toJSON(shippingList[0]), sku.ImageUrl, names[index]); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE shop.t_users SET cartCount = (SELECT count(*) FROM shop.t_cart WHERE foreign_user_id = $1) WHERE id = $1`, userId)
+		return err
+	})
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+type RouteConfig struct {
+	// Timeout is the deadline given to every DB and Redis call made by the route
+	Timeout time.Duration
+	// CacheControl is the Cache-Control header of the cacheable answers, none is sent when empty
+	CacheControl string
+}
+
+// default values, each one can be overridden from .env with ROUTE_TIMEOUT_<routeName>=2s
+// and ROUTE_CACHE_CONTROL_<routeName>="public, max-age=60"
+var defaultRoute = RouteConfig{Timeout: 5 * time.Second}
+
+var routes = map[string]RouteConfig{
+	"getProductData":          {Timeout: 3 * time.Second},
+	"getProduct":              {Timeout: 3 * time.Second, CacheControl: "public, max-age=20"},
+	"getProductsData":         {Timeout: 3 * time.Second},
+	"signup":                  {Timeout: 5 * time.Second},
+	"login":                   {Timeout: 5 * time.Second},
+	"getWishlist":             {Timeout: 3 * time.Second},
+	"getCertainWishlist":      {Timeout: 3 * time.Second},
+	"getUserData":             {Timeout: 3 * time.Second},
+	"deleteProductFromCart":   {Timeout: 3 * time.Second},
+	"addProductToWishList":    {Timeout: 3 * time.Second},
+	"addProductToCart":        {Timeout: 3 * time.Second},
+	"createNewListInWishlist": {Timeout: 3 * time.Second},
+	"updateWishListName":      {Timeout: 3 * time.Second},
+	"deleteWishList":          {Timeout: 3 * time.Second},
+	"listProducts":            {Timeout: 3 * time.Second},
+	"searchProducts":          {Timeout: 3 * time.Second},
+	"resolveSku":              {Timeout: 3 * time.Second},
+	"getCategories":           {Timeout: 3 * time.Second},
+	"createCategory":          {Timeout: 5 * time.Second},
+	"updateCategory":          {Timeout: 5 * time.Second},
+	"deleteCategory":          {Timeout: 5 * time.Second},
+	"assignCategory":          {Timeout: 10 * time.Second},
+	"createProduct":           {Timeout: 5 * time.Second},
+	"updateProduct":           {Timeout: 5 * time.Second},
+	"setProductDisplay":       {Timeout: 3 * time.Second},
+	"deleteProduct":           {Timeout: 5 * time.Second},
+	"importProducts":          {Timeout: 30 * time.Minute},
+	"exportFeed":              {Timeout: 10 * time.Minute},
+	"listReviews":             {Timeout: 3 * time.Second},
+	"postReview":              {Timeout: 5 * time.Second},
+	"deleteReview":            {Timeout: 3 * time.Second},
+	"voteReview":              {Timeout: 3 * time.Second},
+	"listModerationReviews":   {Timeout: 5 * time.Second},
+	"moderateReview":          {Timeout: 3 * time.Second},
+	"listQuestions":           {Timeout: 3 * time.Second},
+	"listAnswers":             {Timeout: 3 * time.Second},
+	"askQuestion":             {Timeout: 5 * time.Second},
+	"answerQuestion":          {Timeout: 5 * time.Second},
+	"voteQuestion":            {Timeout: 3 * time.Second},
+	"voteAnswer":              {Timeout: 3 * time.Second},
+	"deleteQuestion":          {Timeout: 3 * time.Second},
+	"deleteAnswer":            {Timeout: 3 * time.Second},
+	"listModerationQuestions": {Timeout: 5 * time.Second},
+	"moderateQuestion":        {Timeout: 3 * time.Second},
+	"moderateAnswer":          {Timeout: 3 * time.Second},
+	"getNotifications":        {Timeout: 3 * time.Second},
+	"readNotifications":       {Timeout: 3 * time.Second},
+	"relatedProducts":         {Timeout: 3 * time.Second},
+	"recommendations":         {Timeout: 3 * time.Second},
+	"getRecentlyViewed":       {Timeout: 3 * time.Second},
+	"clearRecentlyViewed":     {Timeout: 3 * time.Second},
+	"serveImage":              {Timeout: 20 * time.Second},
+	"priceHistory":            {Timeout: 3 * time.Second},
+	"getPriceAlertSettings":   {Timeout: 3 * time.Second},
+	"setPriceAlertSettings":   {Timeout: 3 * time.Second},
+	"notifyMe":                {Timeout: 3 * time.Second},
+	"cancelNotifyMe":          {Timeout: 3 * time.Second},
+	"getNotifyMe":             {Timeout: 3 * time.Second},
+	"graphql":                 {Timeout: 5 * time.Second},
+	"getCurrencies":           {Timeout: 3 * time.Second},
+	"getCurrencyPreference":   {Timeout: 3 * time.Second},
+	"setCurrencyPreference":   {Timeout: 3 * time.Second},
+	"setCurrencyRates":        {Timeout: 5 * time.Second},
+	"deleteCurrencyRate":      {Timeout: 3 * time.Second},
+}
+
+// Load reads .env and applies the route overrides found in it
+func Load() error {
+	if err := godotenv.Load(); err != nil {
+		return err
+	}
+
+	if value, ok := lookupDuration("ROUTE_TIMEOUT_DEFAULT"); ok {
+		defaultRoute.Timeout = value
+	}
+
+	for name, route := range routes {
+		if value, ok := lookupDuration("ROUTE_TIMEOUT_" + name); ok {
+			route.Timeout = value
+		}
+		if value, ok := os.LookupEnv("ROUTE_CACHE_CONTROL_" + name); ok {
+			route.CacheControl = strings.TrimSpace(value)
+		}
+		routes[name] = route
+	}
+	return nil
+}
+
+// Route returns the config of a route, routes that are not listed get the default one
+func Route(name string) RouteConfig {
+	route, ok := routes[name]
+	if !ok {
+		return defaultRoute
+	}
+	return route
+}
+
+// MaxTimeout returns the longest timeout of the routes, the default one included
+func MaxTimeout() time.Duration {
+	max := defaultRoute.Timeout
+	for _, route := range routes {
+		if route.Timeout > max {
+			max = route.Timeout
+		}
+	}
+	return max
+}
+
+// Get returns the value of an env key, Load must be called first
+func Get(keyName string) string {
+	return os.Getenv(keyName)
+}
+
+// Duration returns the duration stored under keyName (e.g. "1500ms"), fallback when it is missing or invalid
+func Duration(keyName string, fallback time.Duration) time.Duration {
+	if value, ok := lookupDuration(keyName); ok {
+		return value
+	}
+	return fallback
+}
+
+// Int returns the integer stored under keyName, fallback when it is missing or invalid
+func Int(keyName string, fallback int) int {
+	value, err := strconv.Atoi(strings.TrimSpace(os.Getenv(keyName)))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// List splits a comma separated env value, empty items are dropped
+func List(keyName string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(keyName), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func lookupDuration(keyName string) (time.Duration, bool) {
+	value, ok := os.LookupEnv(keyName)
+	if !ok || strings.TrimSpace(value) == "" {
+		return 0, false
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || duration <= 0 {
+		return 0, false
+	}
+	return duration, true
+}
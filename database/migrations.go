@@ -0,0 +1,580 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"kamal/print"
+)
+
+// migration is a schema change, applied once and in order by Migrate
+type migration struct {
+	name  string
+	query string
+}
+
+// append new migrations at the end, never edit one that was released
+var migrations = []migration{
+	{"001_product_search", `
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+	-- search document of every product, kept up to date by the triggers below
+	CREATE TABLE IF NOT EXISTS shop.t_search (
+		foreign_id bigint PRIMARY KEY REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		document tsvector NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS t_search_document_idx ON shop.t_search USING gin (document);
+	CREATE INDEX IF NOT EXISTS t_titles_title_trgm_idx ON shop.t_titles USING gin (title gin_trgm_ops);
+
+	-- title weighs the most, then the description without its html, then every string of the specs
+	CREATE OR REPLACE FUNCTION shop.refresh_search_document(product_id bigint) RETURNS void
+	LANGUAGE sql AS $$
+		INSERT INTO shop.t_search(foreign_id, document)
+		SELECT t_productId.id,
+			setweight(to_tsvector('english', coalesce(t_titles.title, '')), 'A') ||
+			setweight(to_tsvector('english', regexp_replace(coalesce(t_modifieddescription.description, ''), '<[^>]*>', ' ', 'g')), 'B') ||
+			setweight(coalesce(jsonb_to_tsvector('english', t_specs.specs::jsonb, '["string"]'), ''::tsvector), 'C')
+		FROM shop.t_productId
+		LEFT JOIN shop.t_titles ON t_titles.foreign_id = t_productId.id
+		LEFT JOIN shop.t_modifieddescription ON t_modifieddescription.foreign_id = t_productId.id
+		LEFT JOIN shop.t_specs ON t_specs.foreign_id = t_productId.id
+		WHERE t_productId.id = product_id
+		ON CONFLICT (foreign_id) DO UPDATE SET document = EXCLUDED.document
+	$$;
+
+	CREATE OR REPLACE FUNCTION shop.refresh_search_document_trigger() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		PERFORM shop.refresh_search_document(NEW.foreign_id);
+		RETURN NULL;
+	END
+	$$;
+
+	DROP TRIGGER IF EXISTS t_titles_search ON shop.t_titles;
+	CREATE TRIGGER t_titles_search AFTER INSERT OR UPDATE ON shop.t_titles
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_search_document_trigger();
+	DROP TRIGGER IF EXISTS t_modifieddescription_search ON shop.t_modifieddescription;
+	CREATE TRIGGER t_modifieddescription_search AFTER INSERT OR UPDATE ON shop.t_modifieddescription
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_search_document_trigger();
+	DROP TRIGGER IF EXISTS t_specs_search ON shop.t_specs;
+	CREATE TRIGGER t_specs_search AFTER INSERT OR UPDATE ON shop.t_specs
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_search_document_trigger();
+
+	SELECT shop.refresh_search_document(id) FROM shop.t_productId;`},
+	{"002_product_facets", `
+	-- one row per product and property value (color, size, shipsFrom...), filled from
+	-- t_properties.property_array and t_shippingdetails.shipping by the triggers below
+	CREATE TABLE IF NOT EXISTS shop.t_product_facets (
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		facet text NOT NULL,
+		value text NOT NULL,
+		PRIMARY KEY (foreign_id, facet, value)
+	);
+	CREATE INDEX IF NOT EXISTS t_product_facets_value_idx ON shop.t_product_facets (facet, value);
+
+	CREATE OR REPLACE FUNCTION shop.facet_name(name text) RETURNS text
+	LANGUAGE sql IMMUTABLE AS $$
+		SELECT CASE lower(trim(name))
+			WHEN 'color' THEN 'color'
+			WHEN 'colour' THEN 'color'
+			WHEN 'size' THEN 'size'
+			WHEN 'shoe size' THEN 'size'
+			WHEN 'ships from' THEN 'shipsFrom'
+			ELSE regexp_replace(lower(trim(name)), '[^a-z0-9]+', '_', 'g')
+		END
+	$$;
+
+	CREATE OR REPLACE FUNCTION shop.refresh_product_facets(product_id bigint) RETURNS void
+	LANGUAGE sql AS $$
+		DELETE FROM shop.t_product_facets WHERE foreign_id = product_id;
+
+		INSERT INTO shop.t_product_facets(foreign_id, facet, value)
+		SELECT DISTINCT product_id, facets.facet, facets.value FROM (
+			SELECT shop.facet_name(property->>'skuPropertyName') AS facet,
+				trim(coalesce(property_value->>'propertyValueDisplayName', property_value->>'propertyValueName')) AS value
+			FROM shop.t_properties,
+				jsonb_array_elements(CASE WHEN jsonb_typeof(t_properties.property_array::jsonb) = 'array' THEN t_properties.property_array::jsonb ELSE '[]'::jsonb END) AS property,
+				jsonb_array_elements(CASE WHEN jsonb_typeof(property->'skuPropertyValues') = 'array' THEN property->'skuPropertyValues' ELSE '[]'::jsonb END) AS property_value
+			WHERE t_properties.foreign_id = product_id
+			UNION ALL
+			SELECT 'shipsFrom', trim(ship->>'shipFrom')
+			FROM shop.t_shippingdetails,
+				jsonb_array_elements(CASE WHEN jsonb_typeof(t_shippingdetails.shipping::jsonb) = 'array' THEN t_shippingdetails.shipping::jsonb ELSE '[]'::jsonb END) AS ship
+			WHERE t_shippingdetails.foreign_id = product_id
+		) AS facets
+		WHERE facets.facet IS NOT NULL AND facets.facet <> '' AND facets.value IS NOT NULL AND facets.value <> ''
+		ON CONFLICT DO NOTHING;
+	$$;
+
+	CREATE OR REPLACE FUNCTION shop.refresh_product_facets_trigger() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		PERFORM shop.refresh_product_facets(NEW.foreign_id);
+		RETURN NULL;
+	END
+	$$;
+
+	DROP TRIGGER IF EXISTS t_properties_facets ON shop.t_properties;
+	CREATE TRIGGER t_properties_facets AFTER INSERT OR UPDATE ON shop.t_properties
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_product_facets_trigger();
+	DROP TRIGGER IF EXISTS t_shippingdetails_facets ON shop.t_shippingdetails;
+	CREATE TRIGGER t_shippingdetails_facets AFTER INSERT OR UPDATE ON shop.t_shippingdetails
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_product_facets_trigger();
+
+	SELECT shop.refresh_product_facets(id) FROM shop.t_productId;`},
+	{"003_user_admin", `
+	ALTER TABLE shop.t_users ADD COLUMN IF NOT EXISTS isAdmin boolean NOT NULL DEFAULT false;`},
+	{"004_categories", `
+	-- path is the materialized path of the category, the ids from the root separated and
+	-- ended by '/' (e.g. '1/5/9/'), so the descendants of a category are path LIKE '1/5/%'
+	CREATE TABLE IF NOT EXISTS shop.t_categories (
+		id bigserial PRIMARY KEY,
+		parent_id bigint REFERENCES shop.t_categories(id) ON DELETE CASCADE,
+		name text NOT NULL,
+		slug text NOT NULL UNIQUE,
+		path text NOT NULL DEFAULT '',
+		position integer NOT NULL DEFAULT 0,
+		updated_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	);
+	CREATE INDEX IF NOT EXISTS t_categories_path_idx ON shop.t_categories (path text_pattern_ops);
+
+	CREATE TABLE IF NOT EXISTS shop.t_product_categories (
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		category_id bigint NOT NULL REFERENCES shop.t_categories(id) ON DELETE CASCADE,
+		PRIMARY KEY (foreign_id, category_id)
+	);
+	CREATE INDEX IF NOT EXISTS t_product_categories_category_idx ON shop.t_product_categories (category_id);`},
+	{"005_imports", `
+	-- progress of the named imports, line is the last line of the file that was committed
+	CREATE TABLE IF NOT EXISTS shop.t_imports (
+		job text PRIMARY KEY,
+		line bigint NOT NULL DEFAULT 0,
+		inserted bigint NOT NULL DEFAULT 0,
+		updated bigint NOT NULL DEFAULT 0,
+		failed bigint NOT NULL DEFAULT 0,
+		finished boolean NOT NULL DEFAULT false,
+		started_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer),
+		updated_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	);`},
+	{"006_product_updated_at", `
+	-- last change of any of the product tables, used by the incremental feed exports
+	ALTER TABLE shop.t_productId ADD COLUMN IF NOT EXISTS updated_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer);
+	CREATE INDEX IF NOT EXISTS t_productId_updated_at_idx ON shop.t_productId (updated_at, id);
+
+	CREATE OR REPLACE FUNCTION shop.touch_product_trigger() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		UPDATE shop.t_productId SET updated_at = floor(extract(epoch from now())::integer) WHERE id = NEW.foreign_id;
+		RETURN NULL;
+	END
+	$$;
+
+	DROP TRIGGER IF EXISTS t_basicinfo_touch ON shop.t_basicInfo;
+	CREATE TRIGGER t_basicinfo_touch AFTER INSERT OR UPDATE ON shop.t_basicInfo
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_titles_touch ON shop.t_titles;
+	CREATE TRIGGER t_titles_touch AFTER INSERT OR UPDATE ON shop.t_titles
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_mainimages_touch ON shop.t_mainimages;
+	CREATE TRIGGER t_mainimages_touch AFTER INSERT OR UPDATE ON shop.t_mainimages
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_properties_touch ON shop.t_properties;
+	CREATE TRIGGER t_properties_touch AFTER INSERT OR UPDATE ON shop.t_properties
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_pricelist_touch ON shop.t_pricelist;
+	CREATE TRIGGER t_pricelist_touch AFTER INSERT OR UPDATE ON shop.t_pricelist
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_specs_touch ON shop.t_specs;
+	CREATE TRIGGER t_specs_touch AFTER INSERT OR UPDATE ON shop.t_specs
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_shippingdetails_touch ON shop.t_shippingdetails;
+	CREATE TRIGGER t_shippingdetails_touch AFTER INSERT OR UPDATE ON shop.t_shippingdetails
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();
+	DROP TRIGGER IF EXISTS t_modifieddescription_touch ON shop.t_modifieddescription;
+	CREATE TRIGGER t_modifieddescription_touch AFTER INSERT OR UPDATE ON shop.t_modifieddescription
+		FOR EACH ROW EXECUTE FUNCTION shop.touch_product_trigger();`},
+	{"007_skus", `
+	-- one row per variant of a product, derived from t_pricelist (byname, bynumber and bydata share
+	-- the same index) and t_properties by the triggers below. Rows are upserted on (foreign_id, name)
+	-- so the id of a variant stays the same while the price list is edited.
+	CREATE TABLE IF NOT EXISTS shop.t_skus (
+		id bigserial PRIMARY KEY,
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		-- the byname entry, e.g. 'Red;XL;China', and its bynumber entry
+		name text NOT NULL,
+		numbers text NOT NULL DEFAULT '',
+		position integer NOT NULL,
+		external_id bigint,
+		-- the property name of every part of name, e.g. {"Color": "Red", "Size": "XL", "Ships From": "China"}
+		properties jsonb NOT NULL DEFAULT '{}',
+		price double precision NOT NULL DEFAULT 0,
+		price_after_discount double precision NOT NULL DEFAULT 0,
+		discount integer NOT NULL DEFAULT 0,
+		quantity integer NOT NULL DEFAULT 0,
+		image_url text NOT NULL DEFAULT '',
+		UNIQUE (foreign_id, name)
+	);
+
+	-- number of a json value written as a number or a numeric string, null otherwise
+	CREATE OR REPLACE FUNCTION shop.json_number(value jsonb) RETURNS double precision
+	LANGUAGE sql IMMUTABLE AS $$
+		SELECT CASE
+			WHEN jsonb_typeof(value) = 'number' THEN (value #>> '{}')::double precision
+			WHEN jsonb_typeof(value) = 'string' AND trim(value #>> '{}') ~ '^-?[0-9]+(\.[0-9]+)?$' THEN trim(value #>> '{}')::double precision
+		END
+	$$;
+
+	CREATE OR REPLACE FUNCTION shop.refresh_product_skus(product_id bigint) RETURNS void
+	LANGUAGE sql AS $$
+		DELETE FROM shop.t_skus WHERE foreign_id = product_id AND NOT EXISTS (
+			SELECT 1 FROM shop.t_pricelist,
+				jsonb_array_elements_text(CASE WHEN jsonb_typeof(t_pricelist.byname::jsonb) = 'array' THEN t_pricelist.byname::jsonb ELSE '[]'::jsonb END) AS names(name)
+			WHERE t_pricelist.foreign_id = product_id AND names.name = t_skus.name
+		);
+
+		INSERT INTO shop.t_skus(foreign_id, name, numbers, position, external_id, properties, price, price_after_discount, discount, quantity, image_url)
+		SELECT DISTINCT ON (entries.name) product_id, entries.name,
+			coalesce(entries.bynumber->>entries.position, ''),
+			entries.position,
+			shop.json_number(entries.data->'skuId')::bigint,
+			coalesce((
+				SELECT jsonb_object_agg(property->>'skuPropertyName', trim(parts.part))
+				FROM unnest(string_to_array(entries.name, ';')) WITH ORDINALITY AS parts(part, n)
+				JOIN jsonb_array_elements(entries.property_array) WITH ORDINALITY AS properties(property, n) ON properties.n = parts.n
+				WHERE property->>'skuPropertyName' IS NOT NULL
+			), '{}'::jsonb),
+			coalesce(shop.json_number(entries.data->'price'), 0),
+			coalesce(shop.json_number(entries.data->'priceAfterDiscount'), shop.json_number(entries.data->'price'), 0),
+			coalesce(round(shop.json_number(entries.data->'discount')), 0),
+			greatest(coalesce(shop.json_number(entries.data->'availQuantity'), 0), 0),
+			coalesce(entries.data->>'imageUrl', '')
+		FROM (
+			SELECT names.name, (names.n - 1)::integer AS position,
+				CASE WHEN jsonb_typeof(t_pricelist.bynumber::jsonb) = 'array' THEN t_pricelist.bynumber::jsonb ELSE '[]'::jsonb END AS bynumber,
+				CASE WHEN jsonb_typeof(t_pricelist.bydata::jsonb) = 'array' THEN t_pricelist.bydata::jsonb->((names.n - 1)::integer) END AS data,
+				CASE WHEN jsonb_typeof(t_properties.property_array::jsonb) = 'array' THEN t_properties.property_array::jsonb ELSE '[]'::jsonb END AS property_array
+			FROM shop.t_pricelist
+			LEFT JOIN shop.t_properties ON t_properties.foreign_id = t_pricelist.foreign_id,
+				jsonb_array_elements_text(CASE WHEN jsonb_typeof(t_pricelist.byname::jsonb) = 'array' THEN t_pricelist.byname::jsonb ELSE '[]'::jsonb END) WITH ORDINALITY AS names(name, n)
+			WHERE t_pricelist.foreign_id = product_id AND trim(names.name) <> ''
+		) AS entries
+		ORDER BY entries.name, entries.position
+		ON CONFLICT (foreign_id, name) DO UPDATE SET
+			numbers = EXCLUDED.numbers,
+			position = EXCLUDED.position,
+			external_id = EXCLUDED.external_id,
+			properties = EXCLUDED.properties,
+			price = EXCLUDED.price,
+			price_after_discount = EXCLUDED.price_after_discount,
+			discount = EXCLUDED.discount,
+			quantity = EXCLUDED.quantity,
+			image_url = EXCLUDED.image_url;
+	$$;
+
+	CREATE OR REPLACE FUNCTION shop.refresh_product_skus_trigger() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		PERFORM shop.refresh_product_skus(NEW.foreign_id);
+		RETURN NULL;
+	END
+	$$;
+
+	DROP TRIGGER IF EXISTS t_pricelist_skus ON shop.t_pricelist;
+	CREATE TRIGGER t_pricelist_skus AFTER INSERT OR UPDATE ON shop.t_pricelist
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_product_skus_trigger();
+	DROP TRIGGER IF EXISTS t_properties_skus ON shop.t_properties;
+	CREATE TRIGGER t_properties_skus AFTER INSERT OR UPDATE ON shop.t_properties
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_product_skus_trigger();
+
+	SELECT shop.refresh_product_skus(id) FROM shop.t_productId;
+
+	-- the variant in the cart, the rows added before are matched on their cartName ("<productId>-<byname>")
+	ALTER TABLE shop.t_cart ADD COLUMN IF NOT EXISTS sku_id bigint REFERENCES shop.t_skus(id) ON DELETE SET NULL;
+	UPDATE shop.t_cart SET sku_id = t_skus.id FROM shop.t_skus
+		WHERE t_cart.sku_id IS NULL AND t_skus.foreign_id = t_cart.foreign_product_id
+		AND t_cart.cartName = t_cart.foreign_product_id || '-' || t_skus.name;`},
+	{"008_reviews", `
+	-- one review per user and product, only the approved ones are listed and rated.
+	-- verified_purchase stays false until orders are recorded.
+	CREATE TABLE IF NOT EXISTS shop.t_reviews (
+		id bigserial PRIMARY KEY,
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		rating smallint NOT NULL CHECK (rating BETWEEN 1 AND 5),
+		title text NOT NULL DEFAULT '',
+		body text NOT NULL DEFAULT '',
+		status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+		verified_purchase boolean NOT NULL DEFAULT false,
+		helpful_count integer NOT NULL DEFAULT 0,
+		created_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer),
+		updated_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer),
+		UNIQUE (foreign_id, foreign_user_id)
+	);
+	CREATE INDEX IF NOT EXISTS t_reviews_product_idx ON shop.t_reviews (foreign_id, status, created_at, id);
+	CREATE INDEX IF NOT EXISTS t_reviews_status_idx ON shop.t_reviews (status, created_at, id);
+
+	CREATE TABLE IF NOT EXISTS shop.t_review_votes (
+		review_id bigint NOT NULL REFERENCES shop.t_reviews(id) ON DELETE CASCADE,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		PRIMARY KEY (review_id, foreign_user_id)
+	);
+
+	-- rating of every product with an approved review, kept up to date by the trigger below
+	-- and read by GetProductData. stars counts the reviews of 1 to 5 stars.
+	CREATE TABLE IF NOT EXISTS shop.t_product_ratings (
+		foreign_id bigint PRIMARY KEY REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		rating_count integer NOT NULL DEFAULT 0,
+		rating_average double precision NOT NULL DEFAULT 0,
+		stars integer[] NOT NULL DEFAULT '{0,0,0,0,0}'
+	);
+
+	CREATE OR REPLACE FUNCTION shop.refresh_product_rating(product_id bigint) RETURNS void
+	LANGUAGE sql AS $$
+		INSERT INTO shop.t_product_ratings(foreign_id, rating_count, rating_average, stars)
+		SELECT product_id, count(*), coalesce(round(avg(rating), 2), 0),
+			ARRAY[count(*) FILTER (WHERE rating = 1), count(*) FILTER (WHERE rating = 2), count(*) FILTER (WHERE rating = 3),
+				count(*) FILTER (WHERE rating = 4), count(*) FILTER (WHERE rating = 5)]::integer[]
+		FROM shop.t_reviews
+		WHERE foreign_id = product_id AND status = 'approved'
+		ON CONFLICT (foreign_id) DO UPDATE SET rating_count = EXCLUDED.rating_count,
+			rating_average = EXCLUDED.rating_average, stars = EXCLUDED.stars;
+	$$;
+
+	CREATE OR REPLACE FUNCTION shop.refresh_product_rating_trigger() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			PERFORM shop.refresh_product_rating(OLD.foreign_id);
+		ELSE
+			PERFORM shop.refresh_product_rating(NEW.foreign_id);
+		END IF;
+		RETURN NULL;
+	END
+	$$;
+
+	-- helpful votes only change helpful_count, they don't trigger a refresh
+	DROP TRIGGER IF EXISTS t_reviews_rating ON shop.t_reviews;
+	CREATE TRIGGER t_reviews_rating AFTER INSERT OR DELETE OR UPDATE OF rating, status ON shop.t_reviews
+		FOR EACH ROW EXECUTE FUNCTION shop.refresh_product_rating_trigger();`},
+	{"009_questions", `
+	-- questions asked on a product and their answers, with the moderation states of the reviews.
+	-- answer_count and upvotes only count approved answers and votes, they are kept by the queries writing them.
+	CREATE TABLE IF NOT EXISTS shop.t_questions (
+		id bigserial PRIMARY KEY,
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		body text NOT NULL,
+		status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+		upvotes integer NOT NULL DEFAULT 0,
+		answer_count integer NOT NULL DEFAULT 0,
+		created_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	);
+	CREATE INDEX IF NOT EXISTS t_questions_product_idx ON shop.t_questions (foreign_id, status, created_at, id);
+	CREATE INDEX IF NOT EXISTS t_questions_status_idx ON shop.t_questions (status, created_at, id);
+
+	-- is_staff is the badge of answers written by admins, notified is set once the asker was told about the answer
+	CREATE TABLE IF NOT EXISTS shop.t_answers (
+		id bigserial PRIMARY KEY,
+		question_id bigint NOT NULL REFERENCES shop.t_questions(id) ON DELETE CASCADE,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		body text NOT NULL,
+		is_staff boolean NOT NULL DEFAULT false,
+		status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+		upvotes integer NOT NULL DEFAULT 0,
+		notified boolean NOT NULL DEFAULT false,
+		created_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	);
+	CREATE INDEX IF NOT EXISTS t_answers_question_idx ON shop.t_answers (question_id, status);
+	CREATE INDEX IF NOT EXISTS t_answers_status_idx ON shop.t_answers (status, created_at, id);
+
+	-- upvotes of questions (kind 'question') and answers (kind 'answer')
+	CREATE TABLE IF NOT EXISTS shop.t_qa_votes (
+		kind text NOT NULL CHECK (kind IN ('question', 'answer')),
+		target_id bigint NOT NULL,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		PRIMARY KEY (kind, target_id, foreign_user_id)
+	);
+
+	-- in-app notifications, data depends on the kind
+	CREATE TABLE IF NOT EXISTS shop.t_notifications (
+		id bigserial PRIMARY KEY,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		kind text NOT NULL,
+		data jsonb NOT NULL DEFAULT '{}',
+		created_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer),
+		read_at bigint
+	);
+	CREATE INDEX IF NOT EXISTS t_notifications_user_idx ON shop.t_notifications (foreign_user_id, id);`},
+	{"010_recommendations", `
+	-- precomputed by the recommend command from the products users saved together in their wishlists and cart.
+	-- together is how many users saved both products, score is together damped by the popularity of both.
+	CREATE TABLE IF NOT EXISTS shop.t_related_products (
+		product_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		related_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		together integer NOT NULL,
+		score float8 NOT NULL,
+		PRIMARY KEY (product_id, related_id)
+	);
+	CREATE INDEX IF NOT EXISTS t_related_products_score_idx ON shop.t_related_products (product_id, score DESC);
+
+	-- how many users saved each product, the cold start fallback
+	CREATE TABLE IF NOT EXISTS shop.t_product_popularity (
+		product_id bigint PRIMARY KEY REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		users integer NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS t_product_popularity_users_idx ON shop.t_product_popularity (users DESC, product_id DESC);`},
+	{"011_price_history", `
+	-- a row each time the prices of a product change, written by the trigger on t_basicInfo so every
+	-- writer (admin routes, imports, seed) is recorded. recorded_at is in unix seconds.
+	CREATE TABLE IF NOT EXISTS shop.t_price_history (
+		id bigserial PRIMARY KEY,
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		min_price real NOT NULL,
+		max_price real NOT NULL,
+		min_price_after_discount real NOT NULL,
+		max_price_after_discount real NOT NULL,
+		recorded_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	);
+	CREATE INDEX IF NOT EXISTS t_price_history_product_idx ON shop.t_price_history (foreign_id, recorded_at, id);
+
+	CREATE OR REPLACE FUNCTION shop.record_price_trigger() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		IF TG_OP = 'UPDATE' AND NEW.minprice IS NOT DISTINCT FROM OLD.minprice
+			AND NEW.maxprice IS NOT DISTINCT FROM OLD.maxprice
+			AND NEW.minprice_afterdiscount IS NOT DISTINCT FROM OLD.minprice_afterdiscount
+			AND NEW.maxprice_afterdiscount IS NOT DISTINCT FROM OLD.maxprice_afterdiscount THEN
+			RETURN NULL;
+		END IF;
+		INSERT INTO shop.t_price_history(foreign_id, min_price, max_price, min_price_after_discount, max_price_after_discount)
+		VALUES (NEW.foreign_id, coalesce(NEW.minprice, 0), coalesce(NEW.maxprice, 0), coalesce(NEW.minprice_afterdiscount, 0), coalesce(NEW.maxprice_afterdiscount, 0));
+		RETURN NULL;
+	END
+	$$;
+
+	DROP TRIGGER IF EXISTS t_basicInfo_price_history ON shop.t_basicInfo;
+	CREATE TRIGGER t_basicInfo_price_history AFTER INSERT OR UPDATE ON shop.t_basicInfo
+		FOR EACH ROW EXECUTE FUNCTION shop.record_price_trigger();
+
+	INSERT INTO shop.t_price_history(foreign_id, min_price, max_price, min_price_after_discount, max_price_after_discount)
+	SELECT foreign_id, coalesce(minprice, 0), coalesce(maxprice, 0), coalesce(minprice_afterdiscount, 0), coalesce(maxprice_afterdiscount, 0)
+	FROM shop.t_basicInfo
+	WHERE NOT EXISTS (SELECT 1 FROM shop.t_price_history WHERE t_price_history.foreign_id = t_basicInfo.foreign_id);
+
+	-- price drop alerts: a user is notified when a wishlisted product gets price_alert_threshold percent cheaper
+	-- than alert_price, 0 turns the alerts off. alert_price is the price when the product was first seen by the
+	-- alert job or the last alert, raised when the price goes up.
+	ALTER TABLE shop.t_users ADD COLUMN IF NOT EXISTS price_alert_threshold smallint NOT NULL DEFAULT 10
+		CHECK (price_alert_threshold BETWEEN 0 AND 90);
+	ALTER TABLE shop.t_wishlist_products ADD COLUMN IF NOT EXISTS alert_price real;`},
+	{"012_stock_subscriptions", `
+	-- "notify me" requests for a product or one of its skus that can't be bought yet. Only pending rows
+	-- (notified_at null) are watched, notified rows are kept to rate limit the alerts of each user.
+	-- reason is 'comingSoon' or 'backInStock', what blocked the purchase when the user subscribed.
+	CREATE TABLE IF NOT EXISTS shop.t_stock_subscriptions (
+		id bigserial PRIMARY KEY,
+		foreign_user_id bigint NOT NULL REFERENCES shop.t_users(id) ON DELETE CASCADE,
+		foreign_id bigint NOT NULL REFERENCES shop.t_productId(id) ON DELETE CASCADE,
+		sku_id bigint REFERENCES shop.t_skus(id) ON DELETE CASCADE,
+		reason text NOT NULL CHECK (reason IN ('comingSoon', 'backInStock')),
+		channels text[] NOT NULL,
+		created_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer),
+		notified_at bigint
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS t_stock_subscriptions_unique_idx ON shop.t_stock_subscriptions (foreign_user_id, foreign_id, (coalesce(sku_id, 0)));
+	CREATE INDEX IF NOT EXISTS t_stock_subscriptions_pending_idx ON shop.t_stock_subscriptions (foreign_id) WHERE notified_at IS NULL;
+	CREATE INDEX IF NOT EXISTS t_stock_subscriptions_notified_idx ON shop.t_stock_subscriptions (foreign_user_id, notified_at) WHERE notified_at IS NOT NULL;`},
+	{"013_currencies", `
+	-- the currencies prices can be shown in besides the base one (CURRENCY_BASE), which has no row.
+	-- rate is how many units of the currency one unit of the base currency is worth and decimals the
+	-- digits of its minor unit, 2 for cents and 0 for yen. The price columns hold the base currency, the
+	-- other ones are converted from them when a response is sent (see 014_numeric_prices for their type).
+	CREATE TABLE IF NOT EXISTS shop.t_currencies (
+		code text PRIMARY KEY CHECK (code ~ '^[A-Z]{3}$'),
+		rate numeric(20, 10) NOT NULL CHECK (rate > 0),
+		decimals smallint NOT NULL DEFAULT 2 CHECK (decimals BETWEEN 0 AND 4),
+		updated_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	);
+
+	-- the currency the user chose, null for the one of the Accept-Currency header or the base one.
+	-- A currency removed from t_currencies falls back to the base one.
+	ALTER TABLE shop.t_users ADD COLUMN IF NOT EXISTS currency text;`},
+	{"014_numeric_prices", `
+	-- prices are exact decimals in the base currency, cents included. The float columns are read back
+	-- through double precision so the real ones keep their cents above 10000.
+	ALTER TABLE shop.t_basicInfo
+		ALTER COLUMN minprice TYPE numeric(12, 2) USING round(minprice::double precision::numeric, 2),
+		ALTER COLUMN maxprice TYPE numeric(12, 2) USING round(maxprice::double precision::numeric, 2),
+		ALTER COLUMN minprice_afterdiscount TYPE numeric(12, 2) USING round(minprice_afterdiscount::double precision::numeric, 2),
+		ALTER COLUMN maxprice_afterdiscount TYPE numeric(12, 2) USING round(maxprice_afterdiscount::double precision::numeric, 2);
+	ALTER TABLE shop.t_cart
+		ALTER COLUMN price TYPE numeric(12, 2) USING round(price::double precision::numeric, 2),
+		ALTER COLUMN shippingprice TYPE numeric(12, 2) USING round(shippingprice::double precision::numeric, 2);
+	ALTER TABLE shop.t_skus
+		ALTER COLUMN price TYPE numeric(12, 2) USING round(price::numeric, 2),
+		ALTER COLUMN price_after_discount TYPE numeric(12, 2) USING round(price_after_discount::numeric, 2);
+	ALTER TABLE shop.t_price_history
+		ALTER COLUMN min_price TYPE numeric(12, 2) USING round(min_price::double precision::numeric, 2),
+		ALTER COLUMN max_price TYPE numeric(12, 2) USING round(max_price::double precision::numeric, 2),
+		ALTER COLUMN min_price_after_discount TYPE numeric(12, 2) USING round(min_price_after_discount::double precision::numeric, 2),
+		ALTER COLUMN max_price_after_discount TYPE numeric(12, 2) USING round(max_price_after_discount::double precision::numeric, 2);
+	ALTER TABLE shop.t_wishlist_products
+		ALTER COLUMN alert_price TYPE numeric(12, 2) USING round(alert_price::double precision::numeric, 2);
+
+	-- the prices of the price list documents reach t_skus without a float either
+	DROP FUNCTION IF EXISTS shop.json_number(jsonb);
+	CREATE FUNCTION shop.json_number(value jsonb) RETURNS numeric
+	LANGUAGE sql IMMUTABLE AS $$
+		SELECT CASE
+			WHEN jsonb_typeof(value) = 'number' THEN (value #>> '{}')::numeric
+			WHEN jsonb_typeof(value) = 'string' AND trim(value #>> '{}') ~ '^-?[0-9]+(\.[0-9]+)?$' THEN trim(value #>> '{}')::numeric
+		END
+	$$;`},
+}
+
+// Migrate applies the migrations that were not applied yet, each one in its own transaction.
+// An advisory lock keeps two servers starting at the same time from racing.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS shop.t_schema_migrations (
+		name text PRIMARY KEY,
+		applied_at bigint NOT NULL DEFAULT floor(extract(epoch from now())::integer)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		applied := false
+		err := runTx(ctx, db, &sql.TxOptions{}, func(tx *sql.Tx) error {
+			applied = false
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('shop.t_schema_migrations'))`); err != nil {
+				return err
+			}
+
+			var name string
+			err := tx.QueryRowContext(ctx, `SELECT name FROM shop.t_schema_migrations WHERE name = $1`, m.name).Scan(&name)
+			if err == nil {
+				return nil
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, m.query); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO shop.t_schema_migrations(name) VALUES($1)`, m.name); err != nil {
+				return err
+			}
+			applied = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		if applied {
+			print.Str("Migration applied:", m.name)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,11 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -17,16 +20,34 @@ const (
 )
 
 // ConnectToDatabase creates a connection to the PostgreSQL database
-func ConnectToDatabase() (sql.DB, error) {
+func ConnectToDatabase(ctx context.Context) (*sql.DB, error) {
+	return connect(ctx, host, port)
+}
+
+// ConnectToReplica creates a connection to a read replica, addr is "host" or "host:port"
+func ConnectToReplica(ctx context.Context, addr string) (*sql.DB, error) {
+	replicaHost, replicaPort := addr, port
+	if index := strings.LastIndex(addr, ":"); index != -1 {
+		value, err := strconv.Atoi(addr[index+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid replica address %q", addr)
+		}
+		replicaHost, replicaPort = addr[:index], value
+	}
+	return connect(ctx, replicaHost, replicaPort)
+}
+
+func connect(ctx context.Context, host string, port int) (*sql.DB, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
 	db, err := sql.Open("postgres", psqlInfo)
 	if err != nil {
-		return sql.DB{}, err
+		return nil, err
 	}
 
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err != nil {
-		return sql.DB{}, err
+		db.Close()
+		return nil, err
 	}
 	
 	// Set the maximum number of connections in the pool
@@ -37,6 +58,6 @@ func ConnectToDatabase() (sql.DB, error) {
 
 	db.SetConnMaxLifetime(time.Second * 30)
 
-	return *db, nil
+	return db, nil
 }
 
@@ -1,46 +1,64 @@
 package postgres
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"kamal/print"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
-// var stmt *sql.Stmt
+// Statement names a prepared statement, use the constants below with Queries.Stmt. Every constant has its
+// query in statements, init checks it at startup and NewQueries prepares all of them or fails, so a lookup
+// can't miss and Stmt has no error to return.
+type Statement int
 
-func handleError(err error)  {
-	if err != nil {
-		panic(err)
-	}
+const (
+	GetProductData Statement = iota
+	GetProductDataByIds
+	GetProductDataByLongIds
+	EmailAlreadyExist
+	SignUpUser
+	CreateDefaultWishlist
+	Login
+	GetUserAllWishListsNamesIds
+	GetUserWishListData
+	GetUserWishListsTopItems
+	GetUserCertainWishListData
+	GetUserData
+	GetUserCartData
+	DeleteProductFromCart
+	AddProductToWishlist
+	CheckProductExistInUserCart
+	UpdateProductInCart
+	AddProductInCart
+	IncrementCartCount
+	CreateNewListInWishList
+	UpdateWishlistName
+	DeleteWishlist
+	IsAdmin
+
+	// statementCount is the number of statements, keep it last
+	statementCount
+)
+
+// statements that only read catalog data, they are sent to a read replica when one is healthy
+var replicaStatements = map[Statement]bool{
+	GetProductData:          true,
+	GetProductDataByIds:     true,
+	GetProductDataByLongIds: true,
 }
 
-type Queries struct {
-	DB *sql.DB
-	GetProductData *sql.Stmt
-	EmailAlreadyExist *sql.Stmt
-	SignUpUser *sql.Stmt
-	CreateDefaultWishlist *sql.Stmt
-	Login *sql.Stmt
-	GetUserAllWishListsNamesIds *sql.Stmt
-	GetUserWishListData *sql.Stmt
-	GetUserCertainWishListData *sql.Stmt
-	GetUserData *sql.Stmt
-	GetUserCartData *sql.Stmt
-	DeleteProductFromCart *sql.Stmt
-	AddProductToWishlist *sql.Stmt
-	CheckProductExistInUserCart *sql.Stmt
-	UpdateProductInCart *sql.Stmt
-	AddProductInCart *sql.Stmt
-	IncrementCartCount *sql.Stmt
-	CreateNewListInWishList *sql.Stmt
-	UpdateWishlistName *sql.Stmt
-	DeleteWishlist *sql.Stmt
-}
-var queries Queries
-
-
-func GetProductDataQuery(db *sql.DB) Queries {
-	var err error
-
-	queries.DB = db
-
-	queries.GetProductData, err = db.Prepare(`select 
+type statement struct {
+	name  string
+	query string
+}
+
+// productDataSelect is the product page, GetProductData and the batched statements add the where clause
+const productDataSelect = `select 
 	t_basicInfo.display as "_display",
 	t_basicInfo.product_link as "link",
 	t_basicInfo.minprice as "minPrice",
@@ -65,7 +83,9 @@ func GetProductDataQuery(db *sql.DB) Queries {
 	t_pricelist.bydata  as "priceList_Data",
 	t_specs.specs as "specs",
 	t_shippingdetails.shipping as "shipping",
-	t_modifieddescription.description as "modified_description_content"
+	t_modifieddescription.description as "modified_description_content",
+	coalesce(t_product_ratings.rating_average, 0) as "ratingAverage",
+	coalesce(t_product_ratings.rating_count, 0) as "ratingCount"
 	from shop.t_productId
 	join shop.t_basicInfo on t_basicInfo.foreign_id = t_productId.id
 	join shop.t_titles on t_titles.foreign_id = t_productId.id
@@ -75,25 +95,19 @@ func GetProductDataQuery(db *sql.DB) Queries {
 	join shop.t_specs on t_specs.foreign_id = t_productId.id
 	join shop.t_shippingdetails on t_shippingdetails.foreign_id = t_productId.id
 	join shop.t_modifieddescription on t_modifieddescription.foreign_id = t_productId.id
-	where t_productId.myproductid = $1`)
-	handleError(err)
-	
-	queries.EmailAlreadyExist, err = db.Prepare("SELECT email FROM shop.t_users WHERE email = $1")
-	handleError(err)
-	
-	queries.SignUpUser, err = db.Prepare("INSERT into shop.t_users(email, password) Values($1, $2) RETURNING id")
-	handleError(err)
-	
-	queries.CreateDefaultWishlist, err = db.Prepare("INSERT into shop.t_wishlist(foreign_user_id, wishlistname, created_at) Values($1, $2, floor(extract(epoch from now())::integer))")
-	handleError(err)
-	
-	queries.Login, err = db.Prepare("SELECT id, email, password from shop.t_users WHERE email = $1")
-	handleError(err)
-	
-	queries.GetUserAllWishListsNamesIds, err = db.Prepare(`SELECT json_agg(wishlistname) as "wishListNames", json_agg(id) as "wishListIds" from shop.t_wishList WHERE foreign_user_id = $1 GROUP BY foreign_user_id`)
-	handleError(err)
-	
-	queries.GetUserWishListData, err = db.Prepare(`
+	left join shop.t_product_ratings on t_product_ratings.foreign_id = t_productId.id
+	`
+
+var statements = [statementCount]statement{
+	GetProductData:              {"GetProductData", productDataSelect + `where t_productId.myproductid = $1`},
+	GetProductDataByIds:         {"GetProductDataByIds", productDataSelect + `where t_productId.id = ANY($1)`},
+	GetProductDataByLongIds:     {"GetProductDataByLongIds", productDataSelect + `where t_productId.myproductid = ANY($1)`},
+	EmailAlreadyExist:           {"EmailAlreadyExist", "SELECT email FROM shop.t_users WHERE email = $1"},
+	SignUpUser:                  {"SignUpUser", "INSERT into shop.t_users(email, password) Values($1, $2) RETURNING id"},
+	CreateDefaultWishlist:       {"CreateDefaultWishlist", "INSERT into shop.t_wishlist(foreign_user_id, wishlistname, created_at) Values($1, $2, floor(extract(epoch from now())::integer))"},
+	Login:                       {"Login", "SELECT id, email, password from shop.t_users WHERE email = $1"},
+	GetUserAllWishListsNamesIds: {"GetUserAllWishListsNamesIds", `SELECT json_agg(wishlistname) as "wishListNames", json_agg(id) as "wishListIds" from shop.t_wishList WHERE foreign_user_id = $1 GROUP BY foreign_user_id`},
+	GetUserWishListData: {"GetUserWishListData", `
     SELECT     
     t_titles.title,
     t_wishlist_products.id as "wishListId",
@@ -109,10 +123,47 @@ func GetProductDataQuery(db *sql.DB) Queries {
     JOIN shop.t_productId ON t_productId.id = t_wishlist_products.foreign_product_id
     JOIN shop.t_titles ON t_titles.foreign_id = t_wishlist_products.foreign_product_id
     JOIN shop.t_basicinfo ON t_basicinfo.foreign_id = t_wishlist_products.foreign_product_id
-    where t_wishlist_products.foreign_wishlist_id = $1 ORDER BY t_wishlist_products.created_at DESC LIMIT $2`)
-	handleError(err)
-	
-	queries.GetUserCertainWishListData, err = db.Prepare(`
+    where t_wishlist_products.foreign_wishlist_id = $1 ORDER BY t_wishlist_products.created_at DESC LIMIT $2`},
+	GetUserWishListsTopItems: {"GetUserWishListsTopItems", `
+    SELECT
+    t_wishlist.id,
+    t_wishlist.wishlistname,
+    COALESCE(items.data, '[]'::json) as "items"
+    FROM shop.t_wishlist
+    LEFT JOIN LATERAL (
+        SELECT json_agg(json_build_object(
+            'title', top.title,
+            'wishListId', top.id,
+            'parentWishListId', top.foreign_wishlist_id,
+            'selectedImageUrl', top.selectedImageUrl,
+            'productId', top.foreign_product_id,
+            'longProductId', top.myProductId,
+            'wishListName', t_wishlist.wishlistname,
+            'minPrice', top.minprice,
+            'maxPrice', top.maxprice
+        ) ORDER BY top.created_at DESC) as data
+        FROM (
+            SELECT
+            t_titles.title,
+            t_wishlist_products.id,
+            t_wishlist_products.foreign_wishlist_id,
+            t_wishlist_products.selectedImageUrl,
+            t_wishlist_products.foreign_product_id,
+            t_productId.myProductId,
+            minprice,
+            maxprice,
+            t_wishlist_products.created_at
+            FROM shop.t_wishlist_products
+            JOIN shop.t_productId ON t_productId.id = t_wishlist_products.foreign_product_id
+            JOIN shop.t_titles ON t_titles.foreign_id = t_wishlist_products.foreign_product_id
+            JOIN shop.t_basicinfo ON t_basicinfo.foreign_id = t_wishlist_products.foreign_product_id
+            WHERE t_wishlist_products.foreign_wishlist_id = t_wishlist.id
+            ORDER BY t_wishlist_products.created_at DESC LIMIT $2
+        ) top
+    ) items ON true
+    WHERE t_wishlist.foreign_user_id = $1
+    ORDER BY t_wishlist.id`},
+	GetUserCertainWishListData: {"GetUserCertainWishListData", `
     SELECT     
     t_titles.title,
     t_wishlist_products.id as "wishListId",
@@ -128,13 +179,9 @@ func GetProductDataQuery(db *sql.DB) Queries {
     JOIN shop.t_productId ON t_productId.id = t_wishlist_products.foreign_product_id
     JOIN shop.t_titles ON t_titles.foreign_id = t_wishlist_products.foreign_product_id
     JOIN shop.t_basicinfo ON t_basicinfo.foreign_id = t_wishlist_products.foreign_product_id
-    where t_wishlist_products.foreign_user_id = $1 AND t_wishlist_products.foreign_wishlist_id = $2 ORDER BY t_wishlist_products.created_at DESC LIMIT $3 OFFSET $4`)
-	handleError(err)
-
-	queries.GetUserData, err = db.Prepare(`SELECT email from shop.t_users WHERE id = $1`)
-	handleError(err)
-	
-	queries.GetUserCartData, err = db.Prepare(`SELECT 
+    where t_wishlist_products.foreign_user_id = $1 AND t_wishlist_products.foreign_wishlist_id = $2 ORDER BY t_wishlist_products.created_at DESC LIMIT $3 OFFSET $4`},
+	GetUserData: {"GetUserData", `SELECT email from shop.t_users WHERE id = $1`},
+	GetUserCartData: {"GetUserCartData", `SELECT 
     title,
     t_cart.id as "cartId",
     t_cart.foreign_product_id as "productId",
@@ -156,41 +203,249 @@ func GetProductDataQuery(db *sql.DB) Queries {
     quantityavaliable as "quantityAvaliable",
     byname as "priceList_InNames",
     bynumber as "priceList_InNumbers",
-    bydata as "priceList_Data"
+    bydata as "priceList_Data",
+    t_cart.sku_id as "skuId"
     FROM shop.t_cart 
     JOIN shop.t_productId ON t_productId.id = t_cart.foreign_product_id
     JOIN shop.t_titles ON t_titles.foreign_id = t_cart.foreign_product_id
     JOIN shop.t_basicinfo ON t_basicinfo.foreign_id = t_cart.foreign_product_id
     JOIN shop.t_pricelist ON t_pricelist.foreign_id = t_cart.foreign_product_id
-    WHERE foreign_user_id = $1`)
-	handleError(err)
-
-	queries.DeleteProductFromCart, err = db.Prepare(`DELETE from shop.t_cart WHERE foreign_product_id = $1 and foreign_user_id = $2 and id = $3 RETURNING id`)
-	handleError(err)
-	
-	queries.AddProductToWishlist, err = db.Prepare(`INSERT into shop.t_wishlist_products(foreign_user_id, foreign_product_id, foreign_wishlist_id, selectedImageUrl) Values($1, $2, $3, $4) ON CONFLICT (foreign_user_id, foreign_product_id) DO UPDATE SET foreign_wishlist_id = $5, selectedImageUrl = $6, created_at = floor(extract(epoch from NOW())::integer) RETURNING id`)
-	handleError(err)
-	
-	queries.CheckProductExistInUserCart, err = db.Prepare(`SELECT id from shop.t_cart WHERE cartName = $1 and foreign_user_id = $2`)
-	handleError(err)
-	
-	queries.UpdateProductInCart, err = db.Prepare(`UPDATE shop.t_cart SET quantity = $1, price = $2, shippingPrice = $3, discount = $4, selectedProperties = $5, shippingDetails = $6, selectedImageUrl = $7 WHERE foreign_user_id = $8 and foreign_product_id = $9 and cartName = $10 RETURNING id`)
-	handleError(err)
-	
-	queries.AddProductInCart, err = db.Prepare(`INSERT into shop.t_cart(foreign_product_id, foreign_user_id, cartName, quantity, price, shippingPrice, discount, selectedProperties, shippingDetails, selectedImageUrl) Values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`)
-	handleError(err)
-	
-	queries.IncrementCartCount, err = db.Prepare(`UPDATE shop.t_users SET cartCount = cartCount + 1 WHERE id = $1`)
-	handleError(err)
-	
-	queries.CreateNewListInWishList, err = db.Prepare(`INSERT into shop.t_wishlist(foreign_user_id, wishlistname, created_at) Values($1, $2, floor(extract(epoch from now())::integer)) RETURNING id`)
-	handleError(err)
-	
-	queries.UpdateWishlistName, err = db.Prepare(`UPDATE shop.t_wishlist SET wishlistname = $1 WHERE foreign_user_id = $2 and id = $3 and wishlistname = $4`)
-	handleError(err)
-	
-	queries.DeleteWishlist, err = db.Prepare(`DELETE FROM shop.t_wishlist WHERE foreign_user_id = $1 and id = $2`)
-	handleError(err)
-	
-	return queries
-}
\ No newline at end of file
+    WHERE foreign_user_id = $1`},
+	DeleteProductFromCart:       {"DeleteProductFromCart", `DELETE from shop.t_cart WHERE foreign_product_id = $1 and foreign_user_id = $2 and id = $3 RETURNING id`},
+	AddProductToWishlist:        {"AddProductToWishlist", `INSERT into shop.t_wishlist_products(foreign_user_id, foreign_product_id, foreign_wishlist_id, selectedImageUrl) Values($1, $2, $3, $4) ON CONFLICT (foreign_user_id, foreign_product_id) DO UPDATE SET foreign_wishlist_id = $5, selectedImageUrl = $6, created_at = floor(extract(epoch from NOW())::integer) RETURNING id`},
+	CheckProductExistInUserCart: {"CheckProductExistInUserCart", `SELECT id from shop.t_cart WHERE cartName = $1 and foreign_user_id = $2`},
+	UpdateProductInCart:         {"UpdateProductInCart", `UPDATE shop.t_cart SET quantity = $1, price = $2, shippingPrice = $3, discount = $4, selectedProperties = $5, shippingDetails = $6, selectedImageUrl = $7, sku_id = $11 WHERE foreign_user_id = $8 and foreign_product_id = $9 and cartName = $10 RETURNING id`},
+	AddProductInCart:            {"AddProductInCart", `INSERT into shop.t_cart(foreign_product_id, foreign_user_id, cartName, quantity, price, shippingPrice, discount, selectedProperties, shippingDetails, selectedImageUrl, sku_id) Values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`},
+	IncrementCartCount:          {"IncrementCartCount", `UPDATE shop.t_users SET cartCount = cartCount + 1 WHERE id = $1`},
+	CreateNewListInWishList:     {"CreateNewListInWishList", `INSERT into shop.t_wishlist(foreign_user_id, wishlistname, created_at) Values($1, $2, floor(extract(epoch from now())::integer)) RETURNING id`},
+	UpdateWishlistName:          {"UpdateWishlistName", `UPDATE shop.t_wishlist SET wishlistname = $1 WHERE foreign_user_id = $2 and id = $3 and wishlistname = $4`},
+	DeleteWishlist:              {"DeleteWishlist", `DELETE FROM shop.t_wishlist WHERE foreign_user_id = $1 and id = $2`},
+	IsAdmin:                     {"IsAdmin", `SELECT isAdmin FROM shop.t_users WHERE id = $1`},
+}
+
+// Statements lists every registered statement in the order NewQueries prepares them
+func Statements() []Statement {
+	list := make([]Statement, statementCount)
+	for i := range list {
+		list[i] = Statement(i)
+	}
+	return list
+}
+
+// String returns the name of the statement
+func (s Statement) String() string {
+	if s < 0 || s >= statementCount {
+		return "Statement(" + strconv.Itoa(int(s)) + ")"
+	}
+	return statements[s].name
+}
+
+// init is the only place that panics on the registry: a constant without a query or a name given twice
+// is a programming error caught when the binary starts, not in a handler
+func init() {
+	names := make(map[string]bool, len(statements))
+	for i, s := range statements {
+		if s.name == "" || s.query == "" || names[s.name] {
+			panic("postgres: statement " + strconv.Itoa(i) + " has no query or its name is registered twice: " + s.name)
+		}
+		names[s.name] = true
+	}
+	for name := range replicaStatements {
+		if name < 0 || name >= statementCount {
+			panic("postgres: replica statement is not registered: " + name.String())
+		}
+	}
+}
+
+// PrepareError holds every statement that failed to prepare or close, keyed by its name
+type PrepareError struct {
+	Errors map[string]error
+}
+
+func (e *PrepareError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, name+": "+e.Errors[name].Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Queries is the registry of the prepared statements used by the routes
+type Queries struct {
+	DB    *sql.DB
+	mu    sync.RWMutex
+	stmts map[Statement]*sql.Stmt
+
+	// read replicas, see replicas.go
+	replicas    []*replica
+	nextReplica uint32
+	maxLag      time.Duration
+
+	retireAfter time.Duration
+}
+
+// NewQueries prepares every statement, if some of them fail the ones that were prepared are closed
+// and a *PrepareError listing all the failures is returned
+func NewQueries(ctx context.Context, db *sql.DB) (*Queries, error) {
+	stmts, err := prepareAll(ctx, db, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Queries{DB: db, stmts: stmts}, nil
+}
+
+// prepareAll prepares the statements on db, only the ones allowed on replicas when replicaOnly is set
+func prepareAll(ctx context.Context, db *sql.DB, replicaOnly bool) (map[Statement]*sql.Stmt, error) {
+	stmts := make(map[Statement]*sql.Stmt, len(statements))
+	failed := make(map[string]error)
+
+	for i, s := range statements {
+		if replicaOnly && !replicaStatements[Statement(i)] {
+			continue
+		}
+		stmt, err := db.PrepareContext(ctx, s.query)
+		if err != nil {
+			failed[s.name] = err
+			continue
+		}
+		stmts[Statement(i)] = stmt
+	}
+
+	if len(failed) > 0 {
+		closeAll(stmts)
+		return nil, &PrepareError{Errors: failed}
+	}
+	return stmts, nil
+}
+
+func closeAll(stmts map[Statement]*sql.Stmt) error {
+	failed := make(map[string]error)
+	for name, stmt := range stmts {
+		if err := stmt.Close(); err != nil {
+			failed[name.String()] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &PrepareError{Errors: failed}
+	}
+	return nil
+}
+
+// Stmt returns the prepared statement of s. It is never nil for one of the constants while the registry
+// is open, see Statement.
+func (q *Queries) Stmt(s Statement) *sql.Stmt {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.stmts[s]
+}
+
+// Names lists the registered statements in sorted order
+func (q *Queries) Names() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	names := make([]string, 0, len(q.stmts))
+	for name := range q.stmts {
+		names = append(names, name.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultRetireAfter is how long a replaced set of statements stays open when SetRetireAfter wasn't called
+const defaultRetireAfter = time.Minute
+
+// SetRetireAfter sets how long a replaced set of statements stays open, the requests that got one of them
+// from Stmt just before the swap still run it, so it must be longer than the longest route timeout.
+// It must be called before the registry is used.
+func (q *Queries) SetRetireAfter(retireAfter time.Duration) {
+	q.retireAfter = retireAfter
+}
+
+// retire closes the replaced statements once the requests using them are done
+func (q *Queries) retire(stmts map[Statement]*sql.Stmt) {
+	retireAfter := q.retireAfter
+	if retireAfter <= 0 {
+		retireAfter = defaultRetireAfter
+	}
+	time.AfterFunc(retireAfter, func() {
+		if err := closeAll(stmts); err != nil {
+			print.Str("Error closing replaced statements:", err)
+		}
+	})
+}
+
+// Reprepare prepares the whole set again and swaps it in, the old statements are closed after the
+// retire period of SetRetireAfter. On failure the current set is kept.
+func (q *Queries) Reprepare(ctx context.Context) error {
+	stmts, err := prepareAll(ctx, q.DB, false)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	old := q.stmts
+	q.stmts = stmts
+	q.mu.Unlock()
+
+	q.retire(old)
+	return nil
+}
+
+// Close closes every statement and the replicas, the registry must not be used afterwards
+func (q *Queries) Close() error {
+	q.mu.Lock()
+	old := q.stmts
+	q.stmts = map[Statement]*sql.Stmt{}
+	q.mu.Unlock()
+
+	err := closeAll(old)
+	for _, r := range q.replicas {
+		if replicaErr := r.close(); replicaErr != nil && err == nil {
+			err = replicaErr
+		}
+	}
+	return err
+}
+
+// WatchConnection pings the database every interval and re-prepares the statements once it
+// answers again after being unreachable (e.g. after a Postgres restart). It returns when ctx is done.
+func (q *Queries) WatchConnection(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	down := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := q.DB.PingContext(pingCtx)
+		cancel()
+		if err != nil {
+			if !down {
+				print.Str("Database unreachable:", err)
+			}
+			down = true
+			continue
+		}
+
+		if down {
+			if err := q.Reprepare(ctx); err != nil {
+				print.Str("Error re-preparing statements:", err)
+				continue
+			}
+			down = false
+			print.Str("Database reachable again, statements re-prepared")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"kamal/print"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lag of a replica in seconds, 0 when it has replayed everything it received
+const replicaLagQuery = `SELECT CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+type replica struct {
+	addr string
+	db   *sql.DB
+
+	mu      sync.RWMutex
+	stmts   map[Statement]*sql.Stmt
+	healthy bool
+	lag     time.Duration
+}
+
+// stmt returns the replica's statement, nil when the replica is down or lags more than maxLag
+func (r *replica) stmt(name Statement, maxLag time.Duration) *sql.Stmt {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.healthy || (maxLag > 0 && r.lag > maxLag) {
+		return nil
+	}
+	return r.stmts[name]
+}
+
+func (r *replica) close() error {
+	r.mu.Lock()
+	old := r.stmts
+	r.stmts = map[Statement]*sql.Stmt{}
+	r.healthy = false
+	r.mu.Unlock()
+
+	err := closeAll(old)
+	if dbErr := r.db.Close(); dbErr != nil && err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+// AddReplica prepares the replica statements on db and starts routing reads to it.
+// The registry owns db from now on and closes it in Close. It must be called before the registry is used.
+func (q *Queries) AddReplica(ctx context.Context, addr string, db *sql.DB) error {
+	stmts, err := prepareAll(ctx, db, true)
+	if err != nil {
+		return err
+	}
+	q.replicas = append(q.replicas, &replica{addr: addr, db: db, stmts: stmts, healthy: true})
+	return nil
+}
+
+// SetMaxReplicaLag sets how far behind the primary a replica may be before reads go back to the primary,
+// 0 disables the check
+func (q *Queries) SetMaxReplicaLag(maxLag time.Duration) {
+	q.maxLag = maxLag
+}
+
+// Read returns the statement to use for a read. Statements listed in replicaStatements go to a healthy
+// replica in turn, everything else, and every read made after the request wrote something, stays on the primary.
+func (q *Queries) Read(ctx context.Context, name Statement) *sql.Stmt {
+	if !replicaStatements[name] || len(q.replicas) == 0 || HasWritten(ctx) {
+		return q.Stmt(name)
+	}
+
+	start := atomic.AddUint32(&q.nextReplica, 1)
+	for i := 0; i < len(q.replicas); i++ {
+		r := q.replicas[(int(start)+i)%len(q.replicas)]
+		if stmt := r.stmt(name, q.maxLag); stmt != nil {
+			return stmt
+		}
+	}
+	return q.Stmt(name)
+}
+
+// Write returns the primary statement and marks the request as having written,
+// so the reads that follow it see its own changes
+func (q *Queries) Write(ctx context.Context, name Statement) *sql.Stmt {
+	MarkWritten(ctx)
+	return q.Stmt(name)
+}
+
+// WatchReplicas checks every replica each interval, a replica that can't be reached is skipped by Read
+// until it answers again, its statements are re-prepared at that point. It returns when ctx is done.
+func (q *Queries) WatchReplicas(ctx context.Context, interval time.Duration) {
+	if len(q.replicas) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, r := range q.replicas {
+			q.checkReplica(ctx, r, interval)
+		}
+	}
+}
+
+func (q *Queries) checkReplica(ctx context.Context, r *replica, timeout time.Duration) {
+	checkCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	r.mu.RLock()
+	wasHealthy := r.healthy
+	r.mu.RUnlock()
+
+	var lagSeconds float64
+	err := r.db.QueryRowContext(checkCtx, replicaLagQuery).Scan(&lagSeconds)
+	if err != nil {
+		if wasHealthy {
+			print.Str("Replica unreachable:", r.addr, err)
+		}
+		r.mu.Lock()
+		r.healthy = false
+		r.mu.Unlock()
+		return
+	}
+
+	var old map[Statement]*sql.Stmt
+	if !wasHealthy {
+		stmts, err := prepareAll(checkCtx, r.db, true)
+		if err != nil {
+			print.Str("Error re-preparing replica statements:", r.addr, err)
+			return
+		}
+		print.Str("Replica reachable again:", r.addr)
+
+		r.mu.Lock()
+		old = r.stmts
+		r.stmts = stmts
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	r.healthy = true
+	r.lag = time.Duration(lagSeconds * float64(time.Second))
+	r.mu.Unlock()
+
+	if old != nil {
+		q.retire(old)
+	}
+}
+
+// ReadDB returns the pool to run an ad-hoc catalog read on (listing, search), a healthy replica when
+// there is one and the request hasn't written yet, the primary otherwise
+func (q *Queries) ReadDB(ctx context.Context) *sql.DB {
+	if len(q.replicas) == 0 || HasWritten(ctx) {
+		return q.DB
+	}
+
+	start := atomic.AddUint32(&q.nextReplica, 1)
+	for i := 0; i < len(q.replicas); i++ {
+		r := q.replicas[(int(start)+i)%len(q.replicas)]
+		r.mu.RLock()
+		usable := r.healthy && (q.maxLag == 0 || r.lag <= q.maxLag)
+		r.mu.RUnlock()
+		if usable {
+			return r.db
+		}
+	}
+	return q.DB
+}
@@ -0,0 +1,31 @@
+package postgres
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type sessionKey struct{}
+
+// session remembers if the request already wrote to the primary
+type session struct {
+	written atomic.Bool
+}
+
+// WithSession returns a context that remembers the writes made with it, give one to every request
+func WithSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &session{})
+}
+
+// MarkWritten records that the request wrote to the primary, it does nothing without WithSession
+func MarkWritten(ctx context.Context) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.written.Store(true)
+	}
+}
+
+// HasWritten reports whether MarkWritten was called for the request
+func HasWritten(ctx context.Context) bool {
+	s, ok := ctx.Value(sessionKey{}).(*session)
+	return ok && s.written.Load()
+}
@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TxOptions configures WithTx, a nil *TxOptions means read committed with the default retries
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxRetries is how many times the transaction is run again after a serialization failure
+	// or a deadlock, 0 uses defaultTxRetries and a negative value disables retrying
+	MaxRetries int
+}
+
+const (
+	defaultTxRetries = 3
+	txBackoffBase    = 20 * time.Millisecond
+	txBackoffMax     = 500 * time.Millisecond
+)
+
+// WithTx runs fn inside a transaction on the primary. The transaction is committed when fn returns nil
+// and rolled back when fn returns an error or panics (the panic is raised again after the rollback).
+// Serialization failures and deadlocks run fn again from the start after a backoff, so fn must not keep
+// state between calls other than the values it assigns.
+func (q *Queries) WithTx(ctx context.Context, opts *TxOptions, fn func(tx *sql.Tx) error) error {
+	MarkWritten(ctx)
+
+	txOptions := &sql.TxOptions{}
+	retries := defaultTxRetries
+	if opts != nil {
+		txOptions.Isolation = opts.Isolation
+		txOptions.ReadOnly = opts.ReadOnly
+		if opts.MaxRetries > 0 {
+			retries = opts.MaxRetries
+		} else if opts.MaxRetries < 0 {
+			retries = 0
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, q.DB, txOptions, fn)
+		if err == nil || attempt >= retries || !IsRetryable(err) {
+			return err
+		}
+
+		if err := sleepContext(ctx, txBackoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			return &TxError{Err: err, RollbackErr: rollbackErr}
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TxError is returned when rolling back after an error failed too
+type TxError struct {
+	Err         error
+	RollbackErr error
+}
+
+func (e *TxError) Error() string {
+	return e.Err.Error() + " (rollback failed: " + e.RollbackErr.Error() + ")"
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is a serialization failure or a deadlock, running the transaction again may succeed
+func IsRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		return true
+	}
+	return false
+}
+
+// IsUniqueViolation reports whether err was caused by a unique constraint
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// txBackoff doubles the wait on every attempt, with jitter so concurrent retries don't collide again
+func txBackoff(attempt int) time.Duration {
+	wait := txBackoffBase << uint(attempt)
+	if wait > txBackoffMax || wait <= 0 {
+		wait = txBackoffMax
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func sleepContext(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func newMockQueries(t *testing.T) (*Queries, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Queries{DB: db}, mock
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	queries, mock := newMockQueries(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE shop.t_users").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	fnErr := errors.New("wishlist not found")
+	err := queries.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE shop.t_users SET cartCount = cartCount + 1 WHERE id = $1", 1); err != nil {
+			return err
+		}
+		return fnErr
+	})
+	if err != fnErr {
+		t.Fatalf("WithTx returned %v, want %v", err, fnErr)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTxRollsBackAndPanicsAgain(t *testing.T) {
+	queries, mock := newMockQueries(t)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Fatalf("recovered %v, want the panic of fn", p)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	queries.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		panic("boom")
+	})
+	t.Fatal("WithTx returned instead of panicking")
+}
+
+func TestWithTxRetriesSerializationFailures(t *testing.T) {
+	for _, code := range []pq.ErrorCode{"40001", "40P01"} {
+		t.Run(string(code), func(t *testing.T) {
+			queries, mock := newMockQueries(t)
+			retryErr := &pq.Error{Code: code}
+			if !IsRetryable(retryErr) {
+				t.Fatalf("IsRetryable(%s) = false", code)
+			}
+
+			// the first attempt fails on commit, the second one commits
+			mock.ExpectBegin()
+			mock.ExpectCommit().WillReturnError(retryErr)
+			mock.ExpectBegin()
+			mock.ExpectCommit()
+
+			calls := 0
+			err := queries.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+				calls++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calls != 2 {
+				t.Fatalf("fn ran %d times, want 2", calls)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWithTxDoesNotRetryOtherErrors(t *testing.T) {
+	queries, mock := newMockQueries(t)
+	uniqueErr := &pq.Error{Code: "23505"}
+	if IsRetryable(uniqueErr) {
+		t.Fatal("IsRetryable(23505) = true")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	calls := 0
+	err := queries.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		return uniqueErr
+	})
+	if err != uniqueErr || calls != 1 {
+		t.Fatalf("WithTx returned %v after %d calls, want the error after 1", err, calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTxStopsAfterMaxRetries(t *testing.T) {
+	queries, mock := newMockQueries(t)
+	retryErr := &pq.Error{Code: "40001"}
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+	}
+
+	calls := 0
+	err := queries.WithTx(context.Background(), &TxOptions{MaxRetries: 1}, func(tx *sql.Tx) error {
+		calls++
+		return retryErr
+	})
+	if err != retryErr || calls != 2 {
+		t.Fatalf("WithTx returned %v after %d calls, want the error after 2", err, calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,36 @@
 package _err
 
 import (
+	"context"
+	"errors"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 )
 
+// StatusClientClosedRequest is sent when the client went away before the route finished
+const StatusClientClosedRequest = 499
+
 func AbortRequestWithError(c *gin.Context, routeName *string, status int, data gin.H, stopAll bool)  {
 	if c != nil {
 		c.AbortWithStatusJSON(status, data)
 	}
-}
\ No newline at end of file
+}
+
+// AbortIfCanceled aborts the request when err was caused by the request context being
+// canceled or running out of time, it returns false for every other error
+func AbortIfCanceled(c *gin.Context, routeName *string, ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || (ctx != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)) {
+		AbortRequestWithError(c, routeName, http.StatusGatewayTimeout, gin.H{"error": true, "success": false, "code": "Request timed out"}, true)
+		return true
+	}
+	if errors.Is(err, context.Canceled) || (ctx != nil && errors.Is(ctx.Err(), context.Canceled)) {
+		AbortRequestWithError(c, routeName, StatusClientClosedRequest, gin.H{"error": true, "success": false, "code": "Request canceled"}, true)
+		return true
+	}
+	return false
+}
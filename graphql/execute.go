@@ -0,0 +1,633 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"kamal/print"
+)
+
+// Request is the body of a GraphQL request
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Response is the body of a GraphQL response, Data is missing when the request was not executed
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// Execute parses, validates and runs the request.
+// The fields are resolved level by level: every field of a level is resolved before the Thunks they
+// returned are called, so the keys of a whole level are loaded in one batch. A field that fails is null
+// and reported in Errors, a null non-null field nulls its parent up to the nearest nullable field, and
+// data itself when there is none.
+func (s *Schema) Execute(ctx context.Context, req Request, limits Limits) *Response {
+	doc, err := Parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []*Error{toError(err)}}
+	}
+
+	op, gqlErr := selectOperation(doc, req.OperationName)
+	if gqlErr != nil {
+		return &Response{Errors: []*Error{gqlErr}}
+	}
+	root := s.Query
+	switch op.Type {
+	case "mutation":
+		root = s.Mutation
+	case "subscription":
+		root = nil
+	}
+	if root == nil {
+		return &Response{Errors: []*Error{newError(op.Loc, op.Type+"s are not supported")}}
+	}
+
+	vars, errs := s.coerceVariables(op, req.Variables)
+	if len(errs) > 0 {
+		return &Response{Errors: errs}
+	}
+	if errs := s.validate(doc, op, root, vars, limits); len(errs) > 0 {
+		return &Response{Errors: errs}
+	}
+
+	e := &executor{ctx: ctx, doc: doc, vars: vars}
+	data, nulled := e.run(root, op.SelectionSet)
+	if nulled {
+		return &Response{Data: json.RawMessage("null"), Errors: e.errs}
+	}
+	return &Response{Data: data, Errors: e.errs}
+}
+
+func toError(err error) *Error {
+	var gqlErr *Error
+	if errors.As(err, &gqlErr) {
+		return gqlErr
+	}
+	return &Error{Message: err.Error()}
+}
+
+func selectOperation(doc *Document, name string) (*Operation, *Error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return nil, &Error{Message: "operationName is required when the document has several operations"}
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: "unknown operation " + strconv.Quote(name)}
+}
+
+// inputType returns the type of a variable definition, only scalars and lists of scalars can be inputs
+func (s *Schema) inputType(ref *TypeRef) (Type, bool) {
+	var t Type
+	if ref.Elem != nil {
+		elem, ok := s.inputType(ref.Elem)
+		if !ok {
+			return nil, false
+		}
+		t = &List{Of: elem}
+	} else {
+		scalar, ok := s.scalars[ref.Name]
+		if !ok {
+			return nil, false
+		}
+		t = scalar
+	}
+	if ref.NonNull {
+		t = &NonNull{Of: t}
+	}
+	return t, true
+}
+
+func (s *Schema) coerceVariables(op *Operation, input map[string]interface{}) (map[string]interface{}, []*Error) {
+	vars := map[string]interface{}{}
+	var errs []*Error
+	for _, def := range op.Variables {
+		t, ok := s.inputType(def.Type)
+		if !ok {
+			errs = append(errs, newError(def.Loc, "variable $"+def.Name+" has the unknown input type "+def.Type.String()))
+			continue
+		}
+		value, present := input[def.Name]
+		if !present {
+			if def.Default != nil {
+				value, err := coerceLiteral(def.Default, t, nil)
+				if err != nil {
+					errs = append(errs, newError(def.Loc, "variable $"+def.Name+" has an invalid default value"))
+					continue
+				}
+				vars[def.Name] = value
+			} else if _, nonNull := t.(*NonNull); nonNull {
+				errs = append(errs, newError(def.Loc, "variable $"+def.Name+" of type "+t.String()+" is required"))
+			}
+			continue
+		}
+		coerced, err := coerceValue(value, t)
+		if err != nil {
+			errs = append(errs, newError(def.Loc, "variable $"+def.Name+" is not a valid "+t.String()))
+			continue
+		}
+		vars[def.Name] = coerced
+	}
+	return vars, errs
+}
+
+// coerceValue checks a value decoded from JSON, or already coerced, against an input type
+func coerceValue(value interface{}, t Type) (interface{}, error) {
+	if nonNull, ok := t.(*NonNull); ok {
+		if value == nil {
+			return nil, errInvalidValue
+		}
+		return coerceValue(value, nonNull.Of)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	switch typ := t.(type) {
+	case *List:
+		items, ok := value.([]interface{})
+		if !ok {
+			item, err := coerceValue(value, typ.Of)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			coerced, err := coerceValue(item, typ.Of)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = coerced
+		}
+		return list, nil
+	case *Scalar:
+		return typ.ParseValue(value)
+	}
+	return nil, errInvalidValue
+}
+
+// coerceLiteral reads a value of the query as an input type
+func coerceLiteral(v *Value, t Type, vars map[string]interface{}) (interface{}, error) {
+	if v.Kind == VariableValue {
+		value, ok := vars[v.Raw]
+		if !ok {
+			value = nil
+		}
+		return coerceValue(value, t)
+	}
+	if nonNull, ok := t.(*NonNull); ok {
+		if v.Kind == NullValue {
+			return nil, errInvalidValue
+		}
+		return coerceLiteral(v, nonNull.Of, vars)
+	}
+	if v.Kind == NullValue {
+		return nil, nil
+	}
+	switch typ := t.(type) {
+	case *List:
+		if v.Kind != ListValue {
+			item, err := coerceLiteral(v, typ.Of, vars)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		list := make([]interface{}, len(v.List))
+		for i, item := range v.List {
+			coerced, err := coerceLiteral(item, typ.Of, vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = coerced
+		}
+		return list, nil
+	case *Scalar:
+		return typ.ParseLiteral(v)
+	}
+	return nil, errInvalidValue
+}
+
+// coerceArgs returns the arguments of a field or directive with their defaults
+func coerceArgs(defs map[string]*ArgDef, args []*Argument, vars map[string]interface{}) (map[string]interface{}, *Error) {
+	given := map[string]*Argument{}
+	for _, arg := range args {
+		if _, ok := defs[arg.Name]; !ok {
+			return nil, newError(arg.Loc, "unknown argument "+arg.Name)
+		}
+		if _, ok := given[arg.Name]; ok {
+			return nil, newError(arg.Loc, "argument "+arg.Name+" is given twice")
+		}
+		given[arg.Name] = arg
+	}
+
+	values := map[string]interface{}{}
+	for name, def := range defs {
+		arg, ok := given[name]
+		if ok && arg.Value.Kind == VariableValue {
+			if _, set := vars[arg.Value.Raw]; !set {
+				ok = false
+			}
+		}
+		if !ok {
+			if def.Default != nil {
+				values[name] = def.Default
+			} else if _, nonNull := def.Type.(*NonNull); nonNull {
+				loc := Location{}
+				if arg != nil {
+					loc = arg.Loc
+				}
+				return nil, newError(loc, "argument "+name+" of type "+def.Type.String()+" is required")
+			}
+			continue
+		}
+		value, err := coerceLiteral(arg.Value, def.Type, vars)
+		if err != nil {
+			return nil, newError(arg.Loc, "argument "+name+" is not a valid "+def.Type.String())
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+type executor struct {
+	ctx  context.Context
+	doc  *Document
+	vars map[string]interface{}
+	errs []*Error
+}
+
+// job is an object whose fields are resolved on the next level
+type job struct {
+	obj    *Object
+	source interface{}
+	fields []*collectedField
+	out    *orderedMap
+	path   []interface{}
+	// slot is where out is in the response
+	slot *slot
+}
+
+// slot is a place of the response a value is written to. Nulling a slot of a non-null type nulls its
+// parent too, up to the nearest nullable one, the root slot is data.
+type slot struct {
+	parent  *slot
+	nonNull bool
+	set     func(value interface{})
+	nulled  bool
+}
+
+func (s *slot) null() {
+	for ; s != nil && !s.nulled; s = s.parent {
+		s.nulled = true
+		s.set(nil)
+		if !s.nonNull {
+			return
+		}
+	}
+}
+
+// dead reports whether the slot or one of its parents was nulled, nothing below it is resolved anymore
+func (s *slot) dead() bool {
+	for ; s != nil; s = s.parent {
+		if s.nulled {
+			return true
+		}
+	}
+	return false
+}
+
+func isNonNull(t Type) bool {
+	_, ok := t.(*NonNull)
+	return ok
+}
+
+// collectedField is the fields answering under the same key, their selections are merged
+type collectedField struct {
+	key    string
+	fields []*Field
+}
+
+type pendingField struct {
+	job   *job
+	field *collectedField
+	def   *FieldDef
+	value interface{}
+	err   error
+}
+
+// run resolves the selection set on root, nulled is true when a null propagated up to data
+func (e *executor) run(root *Object, set []Selection) (data *orderedMap, nulled bool) {
+	data = newOrderedMap()
+	rootSlot := &slot{set: func(interface{}) { nulled = true }}
+	level := []*job{{obj: root, fields: e.collectFields(root, [][]Selection{set}), out: data, slot: rootSlot}}
+	for len(level) > 0 {
+		if err := e.ctx.Err(); err != nil {
+			e.errs = append(e.errs, &Error{Message: err.Error()})
+			break
+		}
+
+		var pending []*pendingField
+		for _, j := range level {
+			if j.slot.dead() {
+				continue
+			}
+			for _, f := range j.fields {
+				first := f.fields[0]
+				if first.Name == "__typename" {
+					j.out.set(f.key, j.obj.Name)
+					continue
+				}
+				def := j.obj.Fields[first.Name]
+				j.out.set(f.key, nil)
+				p := &pendingField{job: j, field: f, def: def}
+				args, err := coerceArgs(def.Args, first.Arguments, e.vars)
+				if err != nil {
+					p.err = err
+				} else {
+					p.value, p.err = e.resolve(def, j.source, args)
+				}
+				pending = append(pending, p)
+			}
+		}
+
+		var next []*job
+		for _, p := range pending {
+			if p.job.slot.dead() {
+				continue
+			}
+			if thunk, ok := p.value.(Thunk); ok && p.err == nil {
+				p.value, p.err = e.force(thunk)
+			}
+			path := appendPath(p.job.path, p.field.key)
+			out, key := p.job.out, p.field.key
+			s := &slot{parent: p.job.slot, nonNull: isNonNull(p.def.Type), set: func(value interface{}) { out.set(key, value) }}
+			if p.err != nil {
+				e.fieldError(p.err, p.field.fields[0].Loc, path)
+				s.null()
+				continue
+			}
+			e.complete(p.def.Type, p.field, p.value, path, s, &next)
+		}
+		level = next
+	}
+	return data, nulled
+}
+
+func appendPath(path []interface{}, key interface{}) []interface{} {
+	result := make([]interface{}, len(path), len(path)+1)
+	copy(result, path)
+	return append(result, key)
+}
+
+// resolve calls the resolver of the field, a panic fails the field instead of the server
+func (e *executor) resolve(def *FieldDef, source interface{}, args map[string]interface{}) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			print.Str("GraphQL resolver panic:", r)
+			value, err = nil, errors.New("internal error")
+		}
+	}()
+	if def.Resolve == nil {
+		return nil, errors.New("field has no resolver")
+	}
+	return def.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: args})
+}
+
+func (e *executor) force(thunk Thunk) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			print.Str("GraphQL loader panic:", r)
+			value, err = nil, errors.New("internal error")
+		}
+	}()
+	return thunk()
+}
+
+func (e *executor) fieldError(err error, loc Location, path []interface{}) {
+	gqlErr := toError(err)
+	e.errs = append(e.errs, &Error{Message: gqlErr.Message, Locations: []Location{loc}, Path: path})
+}
+
+// complete turns a resolved value into its response value and writes it to s, objects are queued on next
+func (e *executor) complete(t Type, f *collectedField, value interface{}, path []interface{}, s *slot, next *[]*job) {
+	if thunk, ok := value.(Thunk); ok {
+		var err error
+		if value, err = e.force(thunk); err != nil {
+			e.fieldError(err, f.fields[0].Loc, path)
+			s.null()
+			return
+		}
+	}
+
+	if nonNull, ok := t.(*NonNull); ok {
+		if isNil(value) {
+			e.fieldError(errors.New("cannot return null for the non-null field "+f.fields[0].Name), f.fields[0].Loc, path)
+			s.null()
+			return
+		}
+		e.complete(nonNull.Of, f, value, path, s, next)
+		return
+	}
+	if isNil(value) {
+		s.null()
+		return
+	}
+
+	switch typ := t.(type) {
+	case *List:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			e.fieldError(errors.New("field "+f.fields[0].Name+" did not resolve to a list"), f.fields[0].Loc, path)
+			s.null()
+			return
+		}
+		items := make([]interface{}, rv.Len())
+		s.set(items)
+		for i := range items {
+			i := i
+			item := &slot{parent: s, nonNull: isNonNull(typ.Of), set: func(value interface{}) { items[i] = value }}
+			e.complete(typ.Of, f, rv.Index(i).Interface(), appendPath(path, i), item, next)
+			if s.nulled {
+				return
+			}
+		}
+	case *Scalar:
+		serialized, err := typ.Serialize(value)
+		if err != nil {
+			e.fieldError(err, f.fields[0].Loc, path)
+			s.null()
+			return
+		}
+		s.set(serialized)
+	case *Object:
+		var sets [][]Selection
+		for _, field := range f.fields {
+			sets = append(sets, field.SelectionSet)
+		}
+		out := newOrderedMap()
+		s.set(out)
+		*next = append(*next, &job{obj: typ, source: value, fields: e.collectFields(typ, sets), out: out, path: path, slot: s})
+	default:
+		s.null()
+	}
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// collectFields flattens the fragments of the selection sets and groups the fields by response key
+func (e *executor) collectFields(obj *Object, sets [][]Selection) []*collectedField {
+	var fields []*collectedField
+	byKey := map[string]*collectedField{}
+	visited := map[string]bool{}
+
+	var walk func(set []Selection)
+	walk = func(set []Selection) {
+		for _, selection := range set {
+			switch s := selection.(type) {
+			case *Field:
+				if !e.included(s.Directives) {
+					continue
+				}
+				key := s.ResponseKey()
+				if f, ok := byKey[key]; ok {
+					f.fields = append(f.fields, s)
+					continue
+				}
+				f := &collectedField{key: key, fields: []*Field{s}}
+				byKey[key] = f
+				fields = append(fields, f)
+			case *FragmentSpread:
+				if visited[s.Name] || !e.included(s.Directives) {
+					continue
+				}
+				visited[s.Name] = true
+				fragment := e.doc.Fragments[s.Name]
+				if fragment.TypeCondition == obj.Name && e.included(fragment.Directives) {
+					walk(fragment.SelectionSet)
+				}
+			case *InlineFragment:
+				if !e.included(s.Directives) || s.TypeCondition != "" && s.TypeCondition != obj.Name {
+					continue
+				}
+				walk(s.SelectionSet)
+			}
+		}
+	}
+	for _, set := range sets {
+		walk(set)
+	}
+	return fields
+}
+
+// included applies @skip and @include, they were validated
+func (e *executor) included(directives []*Directive) bool {
+	for _, d := range directives {
+		args, err := coerceArgs(conditionArgs, d.Arguments, e.vars)
+		if err != nil {
+			continue
+		}
+		condition, _ := args["if"].(bool)
+		if d.Name == "skip" && condition || d.Name == "include" && !condition {
+			return false
+		}
+	}
+	return true
+}
+
+// orderedMap is a response object, its keys are written in the order of the query
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedMap() *orderedMap {
+	return &orderedMap{values: map[string]interface{}{}}
+}
+
+func (m *orderedMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// FieldOf is a resolver reading the json field name of a struct (or pointer to one) or the key of a map
+func FieldOf(name string) ResolveFunc {
+	return func(p ResolveParams) (interface{}, error) {
+		return fieldValue(p.Source, name), nil
+	}
+}
+
+func fieldValue(source interface{}, name string) interface{} {
+	if m, ok := source.(map[string]interface{}); ok {
+		return m[name]
+	}
+	rv := reflect.ValueOf(source)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == name || tag == "" && field.Name == name {
+			return rv.Field(i).Interface()
+		}
+	}
+	return nil
+}
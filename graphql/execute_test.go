@@ -0,0 +1,228 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type testLoaderKey struct{}
+
+// newTestSchema is a small schema with a field of every kind the executor handles: nullable and
+// non-null fields that fail or return null, lists of non-null objects and loaded fields
+func newTestSchema() *Schema {
+	user := &Object{Name: "User"}
+	user.Fields = map[string]*FieldDef{
+		"id":   {Type: &NonNull{Of: Int}, Resolve: FieldOf("id")},
+		"name": {Type: &NonNull{Of: String}, Resolve: FieldOf("name")},
+		// nick fails but may be null
+		"nick": {Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, errors.New("nick is unavailable")
+		}},
+		// broken can't be null but resolves to null
+		"broken": {Type: &NonNull{Of: String}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+		// friend is the user id+10, loaded in batches
+		"friend": {Type: user, Resolve: func(p ResolveParams) (interface{}, error) {
+			loader := p.Context.Value(testLoaderKey{}).(*Loader)
+			return loader.Load(int64(p.Source.(*testUser).Id + 10)), nil
+		}},
+	}
+
+	query := &Object{Name: "Query", Fields: map[string]*FieldDef{
+		"ok": {Type: String, Resolve: func(p ResolveParams) (interface{}, error) { return "yes", nil }},
+		"user": {
+			Type: user,
+			Args: map[string]*ArgDef{"id": {Type: &NonNull{Of: Int}}},
+			Resolve: func(p ResolveParams) (interface{}, error) {
+				id := p.Args["id"].(int)
+				return &testUser{Id: id, Name: "user" + string(rune('0'+id%10))}, nil
+			},
+		},
+		"users": {
+			Type:       &NonNull{Of: &List{Of: &NonNull{Of: user}}},
+			Args:       map[string]*ArgDef{"first": {Type: Int, Default: 3}},
+			Multiplier: func(args map[string]interface{}) int { return args["first"].(int) },
+			Resolve: func(p ResolveParams) (interface{}, error) {
+				users := make([]*testUser, p.Args["first"].(int))
+				for i := range users {
+					users[i] = &testUser{Id: i + 1, Name: "user" + string(rune('1'+i))}
+				}
+				return users, nil
+			},
+		},
+		// maybeUsers is a nullable list of non-null users
+		"maybeUsers": {
+			Type: &List{Of: &NonNull{Of: user}},
+			Resolve: func(p ResolveParams) (interface{}, error) {
+				return []*testUser{{Id: 1, Name: "user1"}, nil}, nil
+			},
+		},
+		// me is a non-null user
+		"me": {Type: &NonNull{Of: user}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return &testUser{Id: 1, Name: "user1"}, nil
+		}},
+	}}
+	return NewSchema(query, nil)
+}
+
+// execute runs the query with a Loader counting its batches
+func execute(t *testing.T, schema *Schema, query string, variables map[string]interface{}, limits Limits) (string, []*Error, [][]int64) {
+	t.Helper()
+	var batches [][]int64
+	loader := NewLoader(context.Background(), func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+		batches = append(batches, append([]int64(nil), keys...))
+		users := make(map[int64]interface{}, len(keys))
+		for _, key := range keys {
+			if key < 40 {
+				users[key] = &testUser{Id: int(key), Name: "friend"}
+			}
+		}
+		return users, nil
+	})
+	ctx := context.WithValue(context.Background(), testLoaderKey{}, loader)
+
+	response := schema.Execute(ctx, Request{Query: query, Variables: variables}, limits)
+	if response.Data == nil {
+		return "", response.Errors, batches
+	}
+	data, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), response.Errors, batches
+}
+
+func errorMessages(errs []*Error) string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func TestExecute(t *testing.T) {
+	data, errs, _ := execute(t, newTestSchema(), `query($id: Int!) { a: user(id: $id) { id name } ok __typename }`, map[string]interface{}{"id": 2}, Limits{})
+	if len(errs) > 0 {
+		t.Fatal(errorMessages(errs))
+	}
+	if want := `{"a":{"id":2,"name":"user2"},"ok":"yes","__typename":"Query"}`; data != want {
+		t.Fatalf("data is %s, want %s", data, want)
+	}
+}
+
+func TestNullPropagation(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		data  string
+		path  string
+	}{
+		// a nullable field that fails is null, its parent is kept
+		{"nullable field", `{ user(id: 1) { id nick } }`, `{"user":{"id":1,"nick":null}}`, `["user","nick"]`},
+		// a non-null field that is null nulls the nearest nullable parent
+		{"nullable parent", `{ user(id: 1) { id broken } ok }`, `{"user":null,"ok":"yes"}`, `["user","broken"]`},
+		// a non-null item nulls the nullable list that holds it
+		{"nullable list", `{ maybeUsers { id } ok }`, `{"maybeUsers":null,"ok":"yes"}`, `["maybeUsers",1]`},
+		// non-null all the way up nulls data
+		{"data", `{ ok me { broken } }`, `null`, `["me","broken"]`},
+		{"data through a list", `{ users(first: 2) { broken } }`, `null`, `["users",0,"broken"]`},
+		// a nulled object stops the fields below it
+		{"nested", `{ user(id: 1) { friend { broken friend { id } } } }`, `{"user":{"friend":null}}`, `["user","friend","broken"]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, errs, _ := execute(t, newTestSchema(), test.query, nil, Limits{})
+			if data != test.data {
+				t.Fatalf("data is %s, want %s", data, test.data)
+			}
+			if len(errs) != 1 {
+				t.Fatalf("got the errors %q, want one", errorMessages(errs))
+			}
+			if path, _ := json.Marshal(errs[0].Path); string(path) != test.path {
+				t.Fatalf("error %q at %s, want %s", errs[0].Message, path, test.path)
+			}
+		})
+	}
+}
+
+func TestLoaderBatchesEachLevel(t *testing.T) {
+	data, errs, batches := execute(t, newTestSchema(), `{
+		users(first: 3) { friend { id friend { id } } }
+		again: user(id: 2) { friend { id } }
+	}`, nil, Limits{})
+	if len(errs) > 0 {
+		t.Fatal(errorMessages(errs))
+	}
+	// the friends of the first level are loaded together, user 2 asks for 12 again and it is loaded once,
+	// then their friends in one more batch
+	if want := [][]int64{{11, 12, 13}, {21, 22, 23}}; !reflect.DeepEqual(batches, want) {
+		t.Fatalf("batches %v, want %v", batches, want)
+	}
+	if !strings.Contains(data, `"again":{"friend":{"id":12}}`) {
+		t.Fatalf("data %s", data)
+	}
+}
+
+func TestLoaderMissingKeyIsNull(t *testing.T) {
+	// the loader has no user 41
+	data, errs, batches := execute(t, newTestSchema(), `{ user(id: 31) { friend { id } } }`, nil, Limits{})
+	if len(errs) > 0 {
+		t.Fatal(errorMessages(errs))
+	}
+	if want := `{"user":{"friend":null}}`; data != want {
+		t.Fatalf("data is %s, want %s", data, want)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("%d batches, want 1", len(batches))
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		limits  Limits
+		message string
+	}{
+		{"depth", `{ user(id: 1) { friend { friend { id } } } }`, Limits{MaxDepth: 3}, "query depth 4 exceeds the limit of 3"},
+		{"depth through a fragment", `{ user(id: 1) { ...deep } } fragment deep on User { friend { friend { id } } }`, Limits{MaxDepth: 3}, "query depth 4 exceeds the limit of 3"},
+		// users costs 1 and its 2 fields 50 times
+		{"complexity", `{ users(first: 50) { id name } }`, Limits{MaxComplexity: 100}, "query complexity 101 exceeds the limit of 100"},
+		// without first the list counts the 3 items of the default argument
+		{"complexity of the default argument", `{ users { friend { friend { id } } } }`, Limits{MaxComplexity: 9}, "query complexity 10 exceeds the limit of 9"},
+		{"fragment cycle", `{ user(id: 1) { ...a } } fragment a on User { friend { ...b } } fragment b on User { ...a }`, Limits{}, "fragment a spreads itself"},
+		{"fragment spreading itself", `{ user(id: 1) { ...a } } fragment a on User { id ...a }`, Limits{}, "fragment a spreads itself"},
+		{"undefined variable", `{ user(id: $id) { id } }`, Limits{}, "variable $id is not defined"},
+		{"undefined variable in a directive", `query($id: Int!) { user(id: $id) { id @skip(if: $hide) } }`, Limits{}, "variable $hide is not defined"},
+		{"unknown field", `{ user(id: 1) { email } }`, Limits{}, "cannot query field email on type User"},
+		{"unknown fragment", `{ user(id: 1) { ...missing } }`, Limits{}, "unknown fragment missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, errs, batches := execute(t, newTestSchema(), test.query, map[string]interface{}{"id": 1}, test.limits)
+			if data != "" || len(batches) > 0 {
+				t.Fatalf("the request ran: %s", data)
+			}
+			if got := errorMessages(errs); got != test.message {
+				t.Fatalf("errors %q, want %q", got, test.message)
+			}
+		})
+	}
+}
+
+func TestWithinLimits(t *testing.T) {
+	_, errs, _ := execute(t, newTestSchema(), `{ users(first: 50) { id name } }`, nil, Limits{MaxDepth: 2, MaxComplexity: 101})
+	if len(errs) > 0 {
+		t.Fatal(errorMessages(errs))
+	}
+}
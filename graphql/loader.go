@@ -0,0 +1,62 @@
+package graphql
+
+import "context"
+
+// BatchFunc loads the values of keys in one go, a key missing from the map resolves to null
+type BatchFunc func(ctx context.Context, keys []int64) (map[int64]interface{}, error)
+
+// Loader batches the loads of one request: the keys asked while the fields of a level are resolved are
+// fetched together when the first of their Thunks is called, and every value is fetched once per request.
+// The executor resolves one field at a time, a Loader is not safe for concurrent use.
+type Loader struct {
+	ctx     context.Context
+	fetch   BatchFunc
+	pending []int64
+	queued  map[int64]bool
+	values  map[int64]interface{}
+	errs    map[int64]error
+}
+
+func NewLoader(ctx context.Context, fetch BatchFunc) *Loader {
+	return &Loader{
+		ctx:    ctx,
+		fetch:  fetch,
+		queued: map[int64]bool{},
+		values: map[int64]interface{}{},
+		errs:   map[int64]error{},
+	}
+}
+
+// Load queues the key and returns the Thunk of its value, return it from a resolver
+func (l *Loader) Load(key int64) Thunk {
+	_, loaded := l.values[key]
+	_, failed := l.errs[key]
+	if !loaded && !failed && !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	return func() (interface{}, error) {
+		if l.queued[key] {
+			l.flush()
+		}
+		if err, failed := l.errs[key]; failed {
+			return nil, err
+		}
+		return l.values[key], nil
+	}
+}
+
+func (l *Loader) flush() {
+	keys := l.pending
+	l.pending = nil
+	l.queued = map[int64]bool{}
+
+	values, err := l.fetch(l.ctx, keys)
+	for _, key := range keys {
+		if err != nil {
+			l.errs[key] = err
+		} else {
+			l.values[key] = values[key]
+		}
+	}
+}
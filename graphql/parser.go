@@ -0,0 +1,657 @@
+package graphql
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	loc   Location
+}
+
+// lexer splits the query in tokens, commas and comments are ignored like whitespace
+type lexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func (l *lexer) advance(n int) {
+	for i := 0; i < n; i++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+		l.pos++
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) {
+		ch := l.src[l.pos]
+		if ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',' {
+			l.advance(1)
+		} else if ch == '#' {
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.advance(1)
+			}
+		} else if strings.HasPrefix(l.src[l.pos:], "\uFEFF") {
+			l.pos += 3
+		} else {
+			break
+		}
+	}
+
+	loc := Location{Line: l.line, Column: l.col}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, loc: loc}, nil
+	}
+
+	ch := l.src[l.pos]
+	switch {
+	case strings.HasPrefix(l.src[l.pos:], "..."):
+		l.advance(3)
+		return token{kind: tokPunct, value: "...", loc: loc}, nil
+	case strings.IndexByte("!$&():=@[]{}|", ch) >= 0:
+		l.advance(1)
+		return token{kind: tokPunct, value: string(ch), loc: loc}, nil
+	case ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z':
+		start := l.pos
+		for l.pos < len(l.src) && isNameChar(l.src[l.pos]) {
+			l.advance(1)
+		}
+		return token{kind: tokName, value: l.src[start:l.pos], loc: loc}, nil
+	case ch == '-' || ch >= '0' && ch <= '9':
+		return l.number(loc)
+	case ch == '"':
+		return l.string(loc)
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return token{}, syntaxError(loc, "unexpected character "+strconv.QuoteRune(r))
+}
+
+func isNameChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+func (l *lexer) digits() int {
+	n := 0
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.advance(1)
+		n++
+	}
+	return n
+}
+
+func (l *lexer) number(loc Location) (token, error) {
+	start := l.pos
+	kind := tokInt
+	if l.src[l.pos] == '-' {
+		l.advance(1)
+	}
+	leadingZero := l.pos < len(l.src) && l.src[l.pos] == '0'
+	if n := l.digits(); n == 0 || leadingZero && n > 1 {
+		return token{}, syntaxError(loc, "invalid number")
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = tokFloat
+		l.advance(1)
+		if l.digits() == 0 {
+			return token{}, syntaxError(loc, "invalid number")
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = tokFloat
+		l.advance(1)
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.advance(1)
+		}
+		if l.digits() == 0 {
+			return token{}, syntaxError(loc, "invalid number")
+		}
+	}
+	if l.pos < len(l.src) && (isNameChar(l.src[l.pos]) || l.src[l.pos] == '.') {
+		return token{}, syntaxError(loc, "invalid number")
+	}
+	return token{kind: kind, value: l.src[start:l.pos], loc: loc}, nil
+}
+
+func (l *lexer) string(loc Location) (token, error) {
+	if strings.HasPrefix(l.src[l.pos:], `"""`) {
+		return l.blockString(loc)
+	}
+	l.advance(1)
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' || l.src[l.pos] == '\r' {
+			return token{}, syntaxError(loc, "unterminated string")
+		}
+		ch := l.src[l.pos]
+		if ch == '"' {
+			l.advance(1)
+			return token{kind: tokString, value: b.String(), loc: loc}, nil
+		}
+		if ch != '\\' {
+			r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+			b.WriteRune(r)
+			l.advance(size)
+			continue
+		}
+		if l.pos+1 >= len(l.src) {
+			return token{}, syntaxError(loc, "unterminated string")
+		}
+		escape := l.src[l.pos+1]
+		l.advance(2)
+		switch escape {
+		case '"', '\\', '/':
+			b.WriteByte(escape)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if l.pos+4 > len(l.src) {
+				return token{}, syntaxError(loc, "invalid unicode escape")
+			}
+			code, err := strconv.ParseUint(l.src[l.pos:l.pos+4], 16, 32)
+			if err != nil {
+				return token{}, syntaxError(loc, "invalid unicode escape")
+			}
+			b.WriteRune(rune(code))
+			l.advance(4)
+		default:
+			return token{}, syntaxError(loc, "invalid escape \\"+string(escape))
+		}
+	}
+}
+
+// blockString reads a """ string, its common indentation and blank first and last lines are removed
+func (l *lexer) blockString(loc Location) (token, error) {
+	l.advance(3)
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			return token{}, syntaxError(loc, "unterminated string")
+		}
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			l.advance(3)
+			return token{kind: tokString, value: blockStringValue(b.String()), loc: loc}, nil
+		}
+		if strings.HasPrefix(l.src[l.pos:], `\"""`) {
+			b.WriteString(`"""`)
+			l.advance(4)
+			continue
+		}
+		b.WriteByte(l.src[l.pos])
+		l.advance(1)
+	}
+}
+
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\r", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+type parser struct {
+	lex lexer
+	tok token
+	// depth bounds the nesting so a hostile query can't exhaust the stack before the depth limit is checked
+	depth int
+}
+
+const maxParseDepth = 64
+
+// Parse parses a query document, only operations and fragments are accepted
+func Parse(query string) (*Document, error) {
+	p := &parser{lex: lexer{src: query, line: 1, col: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Fragments: map[string]*Fragment{}}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.peek(tokPunct, "{"), p.peek(tokName, "query"), p.peek(tokName, "mutation"), p.peek(tokName, "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		case p.peek(tokName, "fragment"):
+			fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.Fragments[fragment.Name]; exists {
+				return nil, syntaxError(fragment.Loc, "fragment "+fragment.Name+" is defined twice")
+			}
+			doc.Fragments[fragment.Name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.Operations) == 0 {
+		return nil, syntaxError(p.tok.loc, "the document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *parser) skip(kind tokenKind, value string) (bool, error) {
+	if !p.peek(kind, value) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *parser) expect(kind tokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokEOF {
+		return syntaxError(p.tok.loc, "unexpected end of query")
+	}
+	return syntaxError(p.tok.loc, "unexpected "+strconv.Quote(p.tok.value))
+}
+
+func (p *parser) operation() (*Operation, error) {
+	op := &Operation{Type: "query", Loc: p.tok.loc}
+	if p.tok.kind == tokName {
+		op.Type = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokName {
+			op.Name = p.tok.value
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek(tokPunct, "(") {
+			vars, err := p.variableDefs()
+			if err != nil {
+				return nil, err
+			}
+			op.Variables = vars
+		}
+		directives, err := p.directives()
+		if err != nil {
+			return nil, err
+		}
+		op.Directives = directives
+	}
+	set, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.SelectionSet = set
+	return op, nil
+}
+
+func (p *parser) variableDefs() ([]*VariableDef, error) {
+	if err := p.expect(tokPunct, "("); err != nil {
+		return nil, err
+	}
+	var defs []*VariableDef
+	for !p.peek(tokPunct, ")") {
+		def := &VariableDef{Loc: p.tok.loc}
+		if err := p.expect(tokPunct, "$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		def.Name = name
+		if err := p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+		if def.Type, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.skip(tokPunct, "="); err != nil {
+			return nil, err
+		} else if ok {
+			if def.Default, err = p.value(true); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := p.directives(); err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+	return defs, p.advance()
+}
+
+func (p *parser) typeRef() (*TypeRef, error) {
+	t := &TypeRef{}
+	if ok, err := p.skip(tokPunct, "["); err != nil {
+		return nil, err
+	} else if ok {
+		elem, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		t.Elem = elem
+		if err := p.expect(tokPunct, "]"); err != nil {
+			return nil, err
+		}
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		t.Name = name
+	}
+	nonNull, err := p.skip(tokPunct, "!")
+	t.NonNull = nonNull
+	return t, err
+}
+
+func (p *parser) fragment() (*Fragment, error) {
+	fragment := &Fragment{Loc: p.tok.loc}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, syntaxError(fragment.Loc, "a fragment can't be named on")
+	}
+	fragment.Name = name
+	if err := p.expect(tokName, "on"); err != nil {
+		return nil, err
+	}
+	if fragment.TypeCondition, err = p.name(); err != nil {
+		return nil, err
+	}
+	if fragment.Directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	fragment.SelectionSet, err = p.selectionSet()
+	return fragment, err
+}
+
+func (p *parser) selectionSet() ([]Selection, error) {
+	if err := p.expect(tokPunct, "{"); err != nil {
+		return nil, err
+	}
+	p.depth++
+	if p.depth > maxParseDepth {
+		return nil, syntaxError(p.tok.loc, "the query is nested too deeply")
+	}
+	var set []Selection
+	for !p.peek(tokPunct, "}") {
+		selection, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, selection)
+	}
+	if len(set) == 0 {
+		return nil, syntaxError(p.tok.loc, "empty selection set")
+	}
+	p.depth--
+	return set, p.advance()
+}
+
+func (p *parser) selection() (Selection, error) {
+	loc := p.tok.loc
+	if ok, err := p.skip(tokPunct, "..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == tokName && p.tok.value != "on" {
+			spread := &FragmentSpread{Name: p.tok.value, Loc: loc}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			directives, err := p.directives()
+			spread.Directives = directives
+			return spread, err
+		}
+		inline := &InlineFragment{Loc: loc}
+		if ok, err := p.skip(tokName, "on"); err != nil {
+			return nil, err
+		} else if ok {
+			if inline.TypeCondition, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if inline.Directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		inline.SelectionSet, err = p.selectionSet()
+		return inline, err
+	}
+
+	field := &Field{Loc: loc}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field.Name = name
+	if ok, err := p.skip(tokPunct, ":"); err != nil {
+		return nil, err
+	} else if ok {
+		field.Alias = name
+		if field.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if field.Arguments, err = p.arguments(false); err != nil {
+		return nil, err
+	}
+	if field.Directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(tokPunct, "{") {
+		if field.SelectionSet, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *parser) arguments(constant bool) ([]*Argument, error) {
+	if ok, err := p.skip(tokPunct, "("); err != nil || !ok {
+		return nil, err
+	}
+	var args []*Argument
+	for !p.peek(tokPunct, ")") {
+		arg := &Argument{Loc: p.tok.loc}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		arg.Name = name
+		if err := p.expect(tokPunct, ":"); err != nil {
+			return nil, err
+		}
+		if arg.Value, err = p.value(constant); err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil, syntaxError(p.tok.loc, "empty arguments")
+	}
+	return args, p.advance()
+}
+
+func (p *parser) directives() ([]*Directive, error) {
+	var directives []*Directive
+	for p.peek(tokPunct, "@") {
+		directive := &Directive{Loc: p.tok.loc}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		directive.Name = name
+		if directive.Arguments, err = p.arguments(false); err != nil {
+			return nil, err
+		}
+		directives = append(directives, directive)
+	}
+	return directives, nil
+}
+
+// value parses a value, constant ones (variable defaults) can't use variables
+func (p *parser) value(constant bool) (*Value, error) {
+	v := &Value{Loc: p.tok.loc, Raw: p.tok.value}
+	switch p.tok.kind {
+	case tokPunct:
+		switch p.tok.value {
+		case "$":
+			if constant {
+				return nil, p.unexpected()
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			v.Kind, v.Raw = VariableValue, name
+			return v, err
+		case "[":
+			v.Kind = ListValue
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			p.depth++
+			if p.depth > maxParseDepth {
+				return nil, syntaxError(v.Loc, "the query is nested too deeply")
+			}
+			for !p.peek(tokPunct, "]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				v.List = append(v.List, item)
+			}
+			p.depth--
+			return v, p.advance()
+		case "{":
+			v.Kind = ObjectValue
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			p.depth++
+			if p.depth > maxParseDepth {
+				return nil, syntaxError(v.Loc, "the query is nested too deeply")
+			}
+			for !p.peek(tokPunct, "}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(tokPunct, ":"); err != nil {
+					return nil, err
+				}
+				fieldValue, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				v.Fields = append(v.Fields, &ObjectField{Name: name, Value: fieldValue})
+			}
+			p.depth--
+			return v, p.advance()
+		}
+		return nil, p.unexpected()
+	case tokInt:
+		v.Kind = IntValue
+	case tokFloat:
+		v.Kind = FloatValue
+	case tokString:
+		v.Kind = StringValue
+	case tokName:
+		switch p.tok.value {
+		case "true", "false":
+			v.Kind = BooleanValue
+		case "null":
+			v.Kind = NullValue
+		default:
+			v.Kind = EnumValue
+		}
+	default:
+		return nil, p.unexpected()
+	}
+	return v, p.advance()
+}
@@ -0,0 +1,81 @@
+package graphql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := Parse(`
+		query Product($id: Int!, $withTitle: Boolean = true) {
+			first: product(id: $id) { ...card title @include(if: $withTitle) }
+		}
+		fragment card on Product { id prices { min } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Operations) != 1 || len(doc.Fragments) != 1 {
+		t.Fatalf("parsed %d operations and %d fragments, want 1 and 1", len(doc.Operations), len(doc.Fragments))
+	}
+	op := doc.Operations[0]
+	if op.Type != "query" || op.Name != "Product" || len(op.Variables) != 2 {
+		t.Fatalf("operation %s %s with %d variables", op.Type, op.Name, len(op.Variables))
+	}
+	if got := op.Variables[0].Type.String(); got != "Int!" {
+		t.Fatalf("$id is a %s, want Int!", got)
+	}
+	if op.Variables[1].Default == nil || op.Variables[1].Default.Raw != "true" {
+		t.Fatal("$withTitle lost its default value")
+	}
+	field := op.SelectionSet[0].(*Field)
+	if field.ResponseKey() != "first" || field.Name != "product" || len(field.Arguments) != 1 || len(field.SelectionSet) != 2 {
+		t.Fatalf("field %+v", field)
+	}
+	if title := field.SelectionSet[1].(*Field); len(title.Directives) != 1 || title.Directives[0].Name != "include" {
+		t.Fatalf("title has directives %+v", title.Directives)
+	}
+	if doc.Fragments["card"].TypeCondition != "Product" {
+		t.Fatalf("fragment card is on %s", doc.Fragments["card"].TypeCondition)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		message string
+		line    int
+		column  int
+	}{
+		{"", "the document has no operation", 1, 1},
+		{"{ a", "unexpected end of query", 1, 4},
+		{"{ }", "empty selection set", 1, 3},
+		{"{ a(x: ) }", `unexpected ")"`, 1, 8},
+		{"{ a(x: \"open) }", "unterminated string", 1, 8},
+		{`{ a(x: "\q") }`, `invalid escape \q`, 1, 8},
+		{"{ a(x: 01) }", "invalid number", 1, 8},
+		{"{ a % }", "unexpected character '%'", 1, 5},
+		{"query Q($v: ) { a }", `unexpected ")"`, 1, 13},
+		{"{\n  a\n  b(\n}", `unexpected "}"`, 4, 1},
+		{"fragment F on T { a } fragment F on T { b } { a }", "fragment F is defined twice", 1, 23},
+		{"type T { a: Int }", `unexpected "type"`, 1, 1},
+		{strings.Repeat("{ a ", maxParseDepth+1) + strings.Repeat("} ", maxParseDepth+1), "the query is nested too deeply", 1, 4*maxParseDepth + 3},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.query)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded", test.query)
+			continue
+		}
+		gqlErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Parse(%q) returned %T, want *Error", test.query, err)
+			continue
+		}
+		if gqlErr.Message != "Syntax error: "+test.message {
+			t.Errorf("Parse(%q) = %q, want %q", test.query, gqlErr.Message, "Syntax error: "+test.message)
+		}
+		if len(gqlErr.Locations) != 1 || gqlErr.Locations[0] != (Location{Line: test.line, Column: test.column}) {
+			t.Errorf("Parse(%q) at %v, want %d:%d", test.query, gqlErr.Locations, test.line, test.column)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Type is a *Scalar, an *Object, a *List or a *NonNull
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type. Serialize turns a resolved value into its JSON value, ParseValue checks a
+// variable decoded from JSON and ParseLiteral a value written in the query.
+type Scalar struct {
+	Name         string
+	Serialize    func(value interface{}) (interface{}, error)
+	ParseValue   func(value interface{}) (interface{}, error)
+	ParseLiteral func(value *Value) (interface{}, error)
+}
+
+func (s *Scalar) String() string { return s.Name }
+
+// Object is a type with fields, the only composite type there is: no interfaces, unions nor input objects
+type Object struct {
+	Name   string
+	Fields map[string]*FieldDef
+}
+
+func (o *Object) String() string { return o.Name }
+
+type List struct {
+	Of Type
+}
+
+func (l *List) String() string { return "[" + l.Of.String() + "]" }
+
+type NonNull struct {
+	Of Type
+}
+
+func (n *NonNull) String() string { return n.Of.String() + "!" }
+
+// FieldDef is a field of an object. Resolve gets the value of the parent object as Source, it may
+// return a Thunk to be batched with the other fields of the same level (see Loader).
+type FieldDef struct {
+	Type    Type
+	Args    map[string]*ArgDef
+	Resolve ResolveFunc
+	// Cost is the complexity of the field itself, 1 when 0
+	Cost int
+	// Multiplier is how many times the selection of a list field is resolved, from the arguments.
+	// Lists without one count DefaultListSize times.
+	Multiplier func(args map[string]interface{}) int
+}
+
+// ArgDef is an argument of a field, only scalars and lists of scalars are accepted
+type ArgDef struct {
+	Type    Type
+	Default interface{}
+}
+
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+}
+
+type ResolveFunc func(p ResolveParams) (interface{}, error)
+
+// Thunk is a value resolved later, when every field of the level asked for its keys
+type Thunk func() (interface{}, error)
+
+// Schema is the entry points of the API, Mutation is nil when there is none
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+	// scalars are the input types variables can be declared with
+	scalars map[string]*Scalar
+}
+
+// NewSchema returns the schema, the scalars variables can use are the built-in ones and extra
+func NewSchema(query, mutation *Object, extra ...*Scalar) *Schema {
+	s := &Schema{Query: query, Mutation: mutation, scalars: map[string]*Scalar{}}
+	for _, scalar := range append([]*Scalar{Int, Float, String, Boolean, ID}, extra...) {
+		s.scalars[scalar.Name] = scalar
+	}
+	return s
+}
+
+// Error is an error of the response, Path is the response keys and list indexes of the failed field
+type Error struct {
+	Message   string        `json:"message"`
+	Locations []Location    `json:"locations,omitempty"`
+	Path      []interface{} `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func syntaxError(loc Location, message string) *Error {
+	return &Error{Message: "Syntax error: " + message, Locations: []Location{loc}}
+}
+
+func newError(loc Location, message string) *Error {
+	if loc.Line == 0 {
+		return &Error{Message: message}
+	}
+	return &Error{Message: message, Locations: []Location{loc}}
+}
+
+var errInvalidValue = errors.New("invalid value")
+
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, v >= math.MinInt32 && v <= math.MaxInt32
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), v >= math.MinInt32 && v <= math.MaxInt32
+	case float64:
+		return int(v), v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32
+	case json.Number:
+		n, err := strconv.ParseInt(string(v), 10, 32)
+		return int(n), err == nil
+	}
+	return 0, false
+}
+
+// numberer is a decimal number kept as text, like the prices of the catalog
+type numberer interface {
+	Number() json.Number
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case numberer:
+		f, err := v.Number().Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case float32:
+		// the shortest decimal of the float32, 19.99 and not 19.989999771118164
+		f, err := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return f, err == nil
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Int is a signed 32 bit integer
+var Int = &Scalar{
+	Name: "Int",
+	Serialize: func(value interface{}) (interface{}, error) {
+		if n, ok := toInt(value); ok {
+			return n, nil
+		}
+		return nil, errors.New("Int can't represent " + strconv.Quote(toString(value)))
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		if n, ok := toInt(value); ok {
+			return n, nil
+		}
+		return nil, errInvalidValue
+	},
+	ParseLiteral: func(value *Value) (interface{}, error) {
+		if value.Kind != IntValue {
+			return nil, errInvalidValue
+		}
+		n, err := strconv.ParseInt(value.Raw, 10, 32)
+		if err != nil {
+			return nil, errInvalidValue
+		}
+		return int(n), nil
+	},
+}
+
+var Float = &Scalar{
+	Name: "Float",
+	Serialize: func(value interface{}) (interface{}, error) {
+		if f, ok := toFloat(value); ok && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f, nil
+		}
+		return nil, errors.New("Float can't represent " + strconv.Quote(toString(value)))
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		if f, ok := toFloat(value); ok {
+			return f, nil
+		}
+		return nil, errInvalidValue
+	},
+	ParseLiteral: func(value *Value) (interface{}, error) {
+		if value.Kind != IntValue && value.Kind != FloatValue {
+			return nil, errInvalidValue
+		}
+		f, err := strconv.ParseFloat(value.Raw, 64)
+		if err != nil {
+			return nil, errInvalidValue
+		}
+		return f, nil
+	},
+}
+
+var String = &Scalar{
+	Name: "String",
+	Serialize: func(value interface{}) (interface{}, error) {
+		return toString(value), nil
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, errInvalidValue
+	},
+	ParseLiteral: func(value *Value) (interface{}, error) {
+		if value.Kind != StringValue {
+			return nil, errInvalidValue
+		}
+		return value.Raw, nil
+	},
+}
+
+var Boolean = &Scalar{
+	Name: "Boolean",
+	Serialize: func(value interface{}) (interface{}, error) {
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.New("Boolean can't represent " + strconv.Quote(toString(value)))
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, errInvalidValue
+	},
+	ParseLiteral: func(value *Value) (interface{}, error) {
+		if value.Kind != BooleanValue {
+			return nil, errInvalidValue
+		}
+		return value.Raw == "true", nil
+	},
+}
+
+// ID is serialized as a string, it accepts strings and integers
+var ID = &Scalar{
+	Name: "ID",
+	Serialize: func(value interface{}) (interface{}, error) {
+		return toString(value), nil
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		if n, ok := toInt(value); ok {
+			return strconv.Itoa(n), nil
+		}
+		return nil, errInvalidValue
+	},
+	ParseLiteral: func(value *Value) (interface{}, error) {
+		if value.Kind != StringValue && value.Kind != IntValue {
+			return nil, errInvalidValue
+		}
+		return value.Raw, nil
+	},
+}
+
+// JSON is any JSON value, for the documents stored as json in the database. It can't be an argument.
+var JSON = &Scalar{
+	Name: "JSON",
+	Serialize: func(value interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case []byte:
+			if len(v) == 0 {
+				return nil, nil
+			}
+			if !json.Valid(v) {
+				return nil, errors.New("JSON can't represent invalid json")
+			}
+			return json.RawMessage(v), nil
+		case json.RawMessage:
+			return v, nil
+		}
+		return value, nil
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		return nil, errInvalidValue
+	},
+	ParseLiteral: func(value *Value) (interface{}, error) {
+		return nil, errInvalidValue
+	},
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return string(v)
+	case numberer:
+		return string(v.Number())
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
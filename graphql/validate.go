@@ -0,0 +1,258 @@
+package graphql
+
+import (
+	"fmt"
+	"math"
+)
+
+// Limits bound the work a request can ask for, zero values are not checked
+type Limits struct {
+	// MaxDepth is how deep the objects can be nested, the fields of the root are at depth 1
+	MaxDepth int
+	// MaxComplexity is the sum of the costs of the fields, the fields under a list counted once per
+	// expected item (FieldDef.Multiplier)
+	MaxComplexity int
+}
+
+// DefaultListSize is the expected number of items of the list fields without a Multiplier
+const DefaultListSize = 10
+
+type validator struct {
+	schema *Schema
+	doc    *Document
+	vars   map[string]interface{}
+	errs   []*Error
+	// declared is the variables the operation defines
+	declared map[string]bool
+	// fragments memoizes the cost and depth of the fragments, they always apply to the same type
+	fragments map[string]*fragmentCost
+}
+
+type fragmentCost struct {
+	cost, depth int
+	done        bool
+}
+
+// validate checks the operation against the schema and measures it, the variables are already coerced
+func (s *Schema) validate(doc *Document, op *Operation, root *Object, vars map[string]interface{}, limits Limits) []*Error {
+	v := &validator{schema: s, doc: doc, vars: vars, fragments: map[string]*fragmentCost{}}
+
+	v.declared = map[string]bool{}
+	for _, def := range op.Variables {
+		if v.declared[def.Name] {
+			v.errorf(def.Loc, "variable $%s is defined twice", def.Name)
+		}
+		v.declared[def.Name] = true
+	}
+	v.directives(op.Directives)
+
+	cost, depth := v.selection(root, op.SelectionSet)
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		v.errorf(op.Loc, "query depth %d exceeds the limit of %d", depth, limits.MaxDepth)
+	}
+	if limits.MaxComplexity > 0 && cost > limits.MaxComplexity {
+		v.errorf(op.Loc, "query complexity %d exceeds the limit of %d", cost, limits.MaxComplexity)
+	}
+	return v.errs
+}
+
+func (v *validator) errorf(loc Location, format string, args ...interface{}) {
+	v.errs = append(v.errs, newError(loc, fmt.Sprintf(format, args...)))
+}
+
+// add sums costs without overflowing, a huge cost only has to stay above the limit
+func add(a, b int) int {
+	if a > math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
+
+func mul(a, b int) int {
+	if a != 0 && b > math.MaxInt32/a {
+		return math.MaxInt32
+	}
+	return a * b
+}
+
+// selection checks the selection set of an object and returns its cost and depth
+func (v *validator) selection(obj *Object, set []Selection) (int, int) {
+	cost, depth := 0, 1
+	fields := map[string]*Field{}
+	for _, selection := range set {
+		switch s := selection.(type) {
+		case *Field:
+			v.directives(s.Directives)
+			if other, ok := fields[s.ResponseKey()]; ok && other.Name != s.Name {
+				v.errorf(s.Loc, "fields %s and %s both answer as %s, use an alias", other.Name, s.Name, s.ResponseKey())
+			}
+			fields[s.ResponseKey()] = s
+			fieldCost, fieldDepth := v.field(obj, s)
+			cost = add(cost, fieldCost)
+			if fieldDepth > depth {
+				depth = fieldDepth
+			}
+		case *FragmentSpread:
+			v.directives(s.Directives)
+			fragment, ok := v.doc.Fragments[s.Name]
+			if !ok {
+				v.errorf(s.Loc, "unknown fragment %s", s.Name)
+				continue
+			}
+			if fragment.TypeCondition != obj.Name {
+				v.errorf(s.Loc, "fragment %s on %s can't be spread on %s", s.Name, fragment.TypeCondition, obj.Name)
+				continue
+			}
+			memo, ok := v.fragments[s.Name]
+			if ok && !memo.done {
+				v.errorf(s.Loc, "fragment %s spreads itself", s.Name)
+				continue
+			}
+			if !ok {
+				memo = &fragmentCost{}
+				v.fragments[s.Name] = memo
+				v.directives(fragment.Directives)
+				memo.cost, memo.depth = v.selection(obj, fragment.SelectionSet)
+				memo.done = true
+			}
+			cost = add(cost, memo.cost)
+			if memo.depth > depth {
+				depth = memo.depth
+			}
+		case *InlineFragment:
+			v.directives(s.Directives)
+			if s.TypeCondition != "" && s.TypeCondition != obj.Name {
+				v.errorf(s.Loc, "fragment on %s can't be spread on %s", s.TypeCondition, obj.Name)
+				continue
+			}
+			fragmentCost, fragmentDepth := v.selection(obj, s.SelectionSet)
+			cost = add(cost, fragmentCost)
+			if fragmentDepth > depth {
+				depth = fragmentDepth
+			}
+		}
+	}
+	return cost, depth
+}
+
+func (v *validator) field(obj *Object, f *Field) (int, int) {
+	if f.Name == "__typename" {
+		if f.SelectionSet != nil {
+			v.errorf(f.Loc, "__typename has no fields")
+		}
+		if len(f.Arguments) > 0 {
+			v.errorf(f.Loc, "__typename has no arguments")
+		}
+		return 0, 1
+	}
+	def, ok := obj.Fields[f.Name]
+	if !ok {
+		v.errorf(f.Loc, "cannot query field %s on type %s", f.Name, obj.Name)
+		return 0, 1
+	}
+	if !v.variables(f.Arguments) {
+		return 0, 1
+	}
+	args, err := coerceArgs(def.Args, f.Arguments, v.vars)
+	if err != nil {
+		v.errs = append(v.errs, err)
+		return 0, 1
+	}
+
+	cost := def.Cost
+	if cost == 0 {
+		cost = 1
+	}
+	switch named := namedType(def.Type).(type) {
+	case *Scalar:
+		if f.SelectionSet != nil {
+			v.errorf(f.Loc, "field %s of type %s has no fields", f.Name, def.Type)
+		}
+		return cost, 1
+	case *Object:
+		if f.SelectionSet == nil {
+			v.errorf(f.Loc, "field %s of type %s must have a selection of fields", f.Name, def.Type)
+			return cost, 1
+		}
+		childCost, childDepth := v.selection(named, f.SelectionSet)
+		if isList(def.Type) {
+			size := DefaultListSize
+			if def.Multiplier != nil {
+				size = def.Multiplier(args)
+			}
+			childCost = mul(childCost, size)
+		}
+		return add(cost, childCost), childDepth + 1
+	}
+	return cost, 1
+}
+
+// directives accepts @skip(if:) and @include(if:), the only ones there are
+func (v *validator) directives(directives []*Directive) {
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			v.errorf(d.Loc, "unknown directive @%s", d.Name)
+			continue
+		}
+		if !v.variables(d.Arguments) {
+			continue
+		}
+		if _, err := coerceArgs(conditionArgs, d.Arguments, v.vars); err != nil {
+			v.errs = append(v.errs, err)
+		}
+	}
+}
+
+// variables reports the variables used by the arguments that the operation does not define, false when
+// there is one and the arguments can't be coerced
+func (v *validator) variables(args []*Argument) bool {
+	defined := true
+	var walk func(value *Value)
+	walk = func(value *Value) {
+		switch value.Kind {
+		case VariableValue:
+			if !v.declared[value.Raw] {
+				v.errorf(value.Loc, "variable $%s is not defined", value.Raw)
+				defined = false
+			}
+		case ListValue:
+			for _, item := range value.List {
+				walk(item)
+			}
+		case ObjectValue:
+			for _, field := range value.Fields {
+				walk(field.Value)
+			}
+		}
+	}
+	for _, arg := range args {
+		walk(arg.Value)
+	}
+	return defined
+}
+
+var conditionArgs = map[string]*ArgDef{"if": {Type: &NonNull{Of: Boolean}}}
+
+func namedType(t Type) Type {
+	for {
+		switch wrapped := t.(type) {
+		case *NonNull:
+			t = wrapped.Of
+		case *List:
+			t = wrapped.Of
+		default:
+			return t
+		}
+	}
+}
+
+func isList(t Type) bool {
+	if nonNull, ok := t.(*NonNull); ok {
+		t = nonNull.Of
+	}
+	_, ok := t.(*List)
+	return ok
+}
@@ -0,0 +1,245 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	// decoders of the source images
+	_ "image/gif"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+var contentTypes = map[string]string{
+	FormatJPEG: "image/jpeg",
+	FormatPNG:  "image/png",
+	FormatWebP: "image/webp",
+}
+
+var (
+	ErrUnknownPreset  = errors.New("unknown preset")
+	ErrUnknownFormat  = errors.New("unknown format")
+	ErrInvalidSource  = errors.New("invalid source url")
+	ErrSourceFetch    = errors.New("source image could not be fetched")
+	ErrSourceTooLarge = errors.New("source image is too large")
+	ErrNotImage       = errors.New("source is not a supported image")
+	ErrPrivateSource  = errors.New("source image is on a private network")
+)
+
+// Image is a resized image ready to be sent
+type Image struct {
+	Data        []byte
+	ContentType string
+	// ETag is quoted, it changes with the bytes
+	ETag string
+}
+
+// Proxy fetches, resizes, encodes and caches the images. Concurrent requests of the same image share one fetch.
+type Proxy struct {
+	Cache  *DiskCache
+	Client *http.Client
+	// MaxSourceBytes and MaxSourcePixels bound the source images, decoding a huge image would exhaust the memory
+	MaxSourceBytes  int64
+	MaxSourcePixels int
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	img  *Image
+	err  error
+}
+
+// NewProxy returns a proxy whose client only connects to public addresses, see dialPublic
+func NewProxy(cache *DiskCache, maxSourceBytes int64) *Proxy {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialPublic}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Proxy{
+		Cache:           cache,
+		Client:          &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		MaxSourceBytes:  maxSourceBytes,
+		MaxSourcePixels: 40_000_000,
+		calls:           map[string]*call{},
+	}
+}
+
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// dialPublic refuses to connect to loopback, private, link-local, multicast and unspecified addresses.
+// It runs on the resolved address of every connection, redirects included, so a signed src can't
+// reach the server itself or the network behind it.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnat.Contains(ip) {
+		return ErrPrivateSource
+	}
+	return nil
+}
+
+func cacheKey(src, preset, format string) string {
+	sum := sha256.Sum256([]byte(src + "\n" + preset + "\n" + format))
+	return hex.EncodeToString(sum[:])
+}
+
+// Matches reports whether the If-None-Match header lists the ETag of the image, the comparison is weak
+func (img *Image) Matches(ifNoneMatch string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == img.ETag {
+			return true
+		}
+	}
+	return false
+}
+
+func newImage(data []byte, format string) *Image {
+	sum := sha256.Sum256(data)
+	return &Image{Data: data, ContentType: contentTypes[format], ETag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+}
+
+// Get returns src resized to the preset in format, from the cache when it is there.
+// ctx only bounds the wait, the fetch goes on for the other requests waiting for the same image.
+func (p *Proxy) Get(ctx context.Context, src, presetName, format string) (*Image, error) {
+	preset, ok := Presets[presetName]
+	if !ok {
+		return nil, ErrUnknownPreset
+	}
+	if _, ok := contentTypes[format]; !ok {
+		return nil, ErrUnknownFormat
+	}
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidSource
+	}
+
+	key := cacheKey(src, presetName, format)
+	if data, ok := p.Cache.Get(key); ok {
+		return newImage(data, format), nil
+	}
+
+	p.mu.Lock()
+	c, running := p.calls[key]
+	if !running {
+		c = &call{done: make(chan struct{})}
+		p.calls[key] = c
+	}
+	p.mu.Unlock()
+
+	if !running {
+		go func() {
+			c.img, c.err = p.render(src, preset, format)
+			if c.err == nil {
+				// a failed write only costs a new render next time
+				p.Cache.Put(key, c.img.Data)
+			}
+			p.mu.Lock()
+			delete(p.calls, key)
+			p.mu.Unlock()
+			close(c.done)
+		}()
+	}
+
+	select {
+	case <-c.done:
+		return c.img, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Proxy) render(src string, preset Preset, format string) (*Image, error) {
+	source, err := p.fetch(src)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+	if config.Width*config.Height > p.MaxSourcePixels {
+		return nil, ErrSourceTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, ErrNotImage
+	}
+
+	resized := Resize(img, preset)
+	var buf bytes.Buffer
+	switch format {
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, flatten(resized), &jpeg.Options{Quality: 82})
+	case FormatPNG:
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, resized)
+	case FormatWebP:
+		err = EncodeWebP(&buf, resized)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newImage(buf.Bytes(), format), nil
+}
+
+func (p *Proxy) fetch(src string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, ErrInvalidSource
+	}
+	req.Header.Set("Accept", "image/*")
+	res, err := p.Client.Do(req)
+	if errors.Is(err, ErrPrivateSource) {
+		return nil, ErrPrivateSource
+	}
+	if err != nil {
+		return nil, ErrSourceFetch
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrSourceFetch
+	}
+	if res.ContentLength > p.MaxSourceBytes {
+		return nil, ErrSourceTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, p.MaxSourceBytes+1))
+	if err != nil {
+		return nil, ErrSourceFetch
+	}
+	if int64(len(data)) > p.MaxSourceBytes {
+		return nil, ErrSourceTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,451 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// origin serves generated PNGs, /photo.png is 2000x1000 and /small.png 100x50
+type origin struct {
+	*httptest.Server
+	hits int32
+}
+
+func newOrigin(t *testing.T) *origin {
+	t.Helper()
+	o := &origin{}
+	files := map[string][]byte{
+		"/photo.png": encodePNG(t, 2000, 1000),
+		"/small.png": encodePNG(t, 100, 50),
+		"/text.png":  []byte("not an image"),
+	}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&o.hits, 1)
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Query().Get("chunked") != "" {
+			// flushing before the body sends it without a Content-Length
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+// encodePNG draws a horizontal gradient so resizing and cropping change the pixels
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestProxy returns a proxy caching in a temporary directory, its client may reach the local origin
+func newTestProxy(t *testing.T, o *origin) *Proxy {
+	t.Helper()
+	cache, err := NewDiskCache(t.TempDir(), 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(cache, 8<<20)
+	p.Client = o.Client()
+	return p
+}
+
+func decode(t *testing.T, img *Image) image.Image {
+	t.Helper()
+	var decoded image.Image
+	var err error
+	switch img.ContentType {
+	case "image/jpeg":
+		decoded, err = jpeg.Decode(bytes.NewReader(img.Data))
+	case "image/png":
+		decoded, err = png.Decode(bytes.NewReader(img.Data))
+	case "image/webp":
+		decoded, err = webp.Decode(bytes.NewReader(img.Data))
+	default:
+		t.Fatalf("unexpected content type %q", img.ContentType)
+	}
+	if err != nil {
+		t.Fatalf("decoding %s: %v", img.ContentType, err)
+	}
+	return decoded
+}
+
+func TestSignature(t *testing.T) {
+	defer SetSecret("")
+
+	SetSecret("")
+	if got := URL("https://shop.example/a.jpg", "card", ""); got != "https://shop.example/a.jpg" {
+		t.Fatalf("URL without a secret = %q, want the source", got)
+	}
+	if Verify("https://shop.example/a.jpg", "card", "", signature("https://shop.example/a.jpg", "card", "")) {
+		t.Fatal("Verify accepted a signature without a secret")
+	}
+
+	SetSecret("test-secret")
+	signed, err := url.Parse(URL("https://shop.example/a.jpg", "card", "webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Path != "/img" {
+		t.Fatalf("URL path = %q, want /img", signed.Path)
+	}
+	q := signed.Query()
+	src, preset, format, sig := q.Get("src"), q.Get("p"), q.Get("f"), q.Get("s")
+	if !Verify(src, preset, format, sig) {
+		t.Fatal("Verify refused the URL it signed")
+	}
+
+	tampered := []struct{ name, src, preset, format, sig string }{
+		{"src", "https://evil.example/a.jpg", preset, format, sig},
+		{"preset", src, "large", format, sig},
+		{"format", src, preset, "png", sig},
+		{"signature", src, preset, format, sig[:len(sig)-1] + "A"},
+		{"empty signature", src, preset, format, ""},
+	}
+	for _, tc := range tampered {
+		if Verify(tc.src, tc.preset, tc.format, tc.sig) {
+			t.Errorf("Verify accepted a changed %s", tc.name)
+		}
+	}
+
+	SetSecret("other-secret")
+	if Verify(src, preset, format, sig) {
+		t.Fatal("Verify accepted a signature made with another secret")
+	}
+
+	sizes := URLs("https://shop.example/a.jpg")
+	for _, u := range []string{sizes.Thumb, sizes.Card, sizes.Medium, sizes.Large} {
+		parsed, _ := url.Parse(u)
+		q := parsed.Query()
+		if !Verify(q.Get("src"), q.Get("p"), q.Get("f"), q.Get("s")) {
+			t.Errorf("URLs made an invalid URL %q", u)
+		}
+	}
+}
+
+func TestSigningTag(t *testing.T) {
+	defer SetSecret("")
+
+	SetSecret("test-secret")
+	tag := SigningTag()
+	if tag != SigningTag() {
+		t.Fatal("SigningTag changed without a new secret or preset")
+	}
+
+	SetSecret("other-secret")
+	if SigningTag() == tag {
+		t.Fatal("SigningTag kept its value when the secret was rotated")
+	}
+
+	SetSecret("test-secret")
+	card := Presets["card"]
+	defer func() { Presets["card"] = card }()
+	Presets["card"] = Preset{Width: 400, Height: 400, Crop: true}
+	if SigningTag() == tag {
+		t.Fatal("SigningTag kept its value when a preset changed")
+	}
+}
+
+func TestPresetSizes(t *testing.T) {
+	o := newOrigin(t)
+	p := newTestProxy(t, o)
+
+	tests := []struct {
+		src           string
+		preset        string
+		width, height int
+	}{
+		// crop presets fill the box from the center, fit presets keep the ratio
+		{"/photo.png", "thumb", 160, 160},
+		{"/photo.png", "card", 320, 320},
+		{"/photo.png", "medium", 640, 320},
+		{"/photo.png", "large", 1280, 640},
+		// images are never enlarged
+		{"/small.png", "card", 50, 50},
+		{"/small.png", "large", 100, 50},
+	}
+	for _, tc := range tests {
+		img, err := p.Get(context.Background(), o.URL+tc.src, tc.preset, FormatPNG)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.src, tc.preset, err)
+		}
+		b := decode(t, img).Bounds()
+		if b.Dx() != tc.width || b.Dy() != tc.height {
+			t.Errorf("%s %s is %dx%d, want %dx%d", tc.src, tc.preset, b.Dx(), b.Dy(), tc.width, tc.height)
+		}
+	}
+
+	// the crop keeps the middle of the photo, the left and right edges are cut
+	img, err := p.Get(context.Background(), o.URL+"/photo.png", "thumb", FormatPNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := color.NRGBAModel.Convert(decode(t, img).At(0, 80)).(color.NRGBA)
+	if left.R < 50 || left.R > 80 {
+		t.Errorf("left edge of the crop has red %d, want the 1/4 of the gradient (~64)", left.R)
+	}
+
+	if _, err := p.Get(context.Background(), o.URL+"/photo.png", "huge", FormatPNG); err != ErrUnknownPreset {
+		t.Errorf("unknown preset returned %v", err)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	o := newOrigin(t)
+	p := newTestProxy(t, o)
+
+	for format, contentType := range contentTypes {
+		img, err := p.Get(context.Background(), o.URL+"/photo.png", "card", format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if img.ContentType != contentType {
+			t.Errorf("%s has content type %q, want %q", format, img.ContentType, contentType)
+		}
+		decoded := decode(t, img)
+		if b := decoded.Bounds(); b.Dx() != 320 || b.Dy() != 320 {
+			t.Errorf("%s decoded to %dx%d", format, b.Dx(), b.Dy())
+		}
+		if format == FormatJPEG {
+			continue
+		}
+
+		// PNG and WebP are lossless, both must give back the resized pixels
+		want, err := p.Get(context.Background(), o.URL+"/photo.png", "card", FormatPNG)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantImg := decode(t, want)
+		for _, pt := range []image.Point{{0, 0}, {160, 160}, {319, 319}, {17, 301}} {
+			got := color.NRGBAModel.Convert(decoded.At(pt.X, pt.Y))
+			exp := color.NRGBAModel.Convert(wantImg.At(pt.X, pt.Y))
+			if got != exp {
+				t.Errorf("%s pixel %v = %v, want %v", format, pt, got, exp)
+			}
+		}
+	}
+
+	if _, err := p.Get(context.Background(), o.URL+"/photo.png", "card", "gif"); err != ErrUnknownFormat {
+		t.Errorf("unknown format returned %v", err)
+	}
+	if _, err := p.Get(context.Background(), o.URL+"/text.png", "card", FormatPNG); err != ErrNotImage {
+		t.Errorf("a source that isn't an image returned %v", err)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{cacheKey("a", "card", FormatPNG), cacheKey("b", "card", FormatPNG), cacheKey("c", "card", FormatPNG)}
+	for _, key := range keys {
+		if err := cache.Put(key, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a is used again, b becomes the least recently used one
+	if _, ok := cache.Get(keys[0]); !ok {
+		t.Fatal("a was not cached")
+	}
+	d := cacheKey("d", "card", FormatPNG)
+	if err := cache.Put(d, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cache.Get(keys[1]); ok {
+		t.Error("b should have been evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, keys[1][:2], keys[1])); !os.IsNotExist(err) {
+		t.Errorf("the file of b is still there: %v", err)
+	}
+	for _, key := range []string{keys[0], keys[2], d} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%s was evicted", key[:8])
+		}
+	}
+
+	// the index is rebuilt from the files, a bigger image evicts the oldest ones
+	reopened, err := NewDiskCache(dir, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.size != 300 {
+		t.Fatalf("reopened cache holds %d bytes, want 300", reopened.size)
+	}
+	if err := reopened.Put(cacheKey("e", "card", FormatPNG), make([]byte, 250)); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.size > 300 {
+		t.Errorf("cache holds %d bytes, over its 300 bytes", reopened.size)
+	}
+}
+
+func TestETag(t *testing.T) {
+	o := newOrigin(t)
+	p := newTestProxy(t, o)
+
+	// serve answers like ServeImage: the ETag on every answer and 304 when If-None-Match lists it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		img, err := p.Get(r.Context(), o.URL+"/photo.png", r.URL.Query().Get("p"), FormatJPEG)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("ETag", img.ETag)
+		if img.Matches(r.Header.Get("If-None-Match")) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", img.ContentType)
+		w.Write(img.Data)
+	}))
+	defer server.Close()
+
+	get := func(preset, ifNoneMatch string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"?p="+preset, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	first := get("card", "")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || len(etag) < 3 || etag[0] != '"' {
+		t.Fatalf("first answer %d with ETag %q", first.StatusCode, etag)
+	}
+	// the revalidations below are answered from the disk cache
+	if hits := atomic.LoadInt32(&o.hits); hits != 1 {
+		t.Fatalf("origin hit %d times, want 1", hits)
+	}
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if res := get("card", header); res.StatusCode != http.StatusNotModified {
+			t.Errorf("If-None-Match %s answered %d, want 304", header, res.StatusCode)
+		}
+	}
+	if hits := atomic.LoadInt32(&o.hits); hits != 1 {
+		t.Errorf("origin hit %d times, cached image was fetched again", hits)
+	}
+	if res := get("card", `"other"`); res.StatusCode != http.StatusOK {
+		t.Errorf("a stale ETag answered %d, want 200", res.StatusCode)
+	}
+	if res := get("thumb", etag); res.StatusCode != http.StatusOK || res.Header.Get("ETag") == etag {
+		t.Errorf("another preset answered %d with the same ETag", res.StatusCode)
+	}
+}
+
+func TestSourceLimits(t *testing.T) {
+	o := newOrigin(t)
+	p := newTestProxy(t, o)
+	p.MaxSourceBytes = 1000
+
+	// with and without a Content-Length the body is cut at the limit
+	for _, src := range []string{o.URL + "/photo.png", o.URL + "/photo.png?chunked=1"} {
+		if _, err := p.Get(context.Background(), src, "card", FormatPNG); err != ErrSourceTooLarge {
+			t.Errorf("%s returned %v, want ErrSourceTooLarge", src, err)
+		}
+	}
+
+	p.MaxSourceBytes = 8 << 20
+	p.MaxSourcePixels = 1000 * 1000
+	if _, err := p.Get(context.Background(), o.URL+"/photo.png", "card", FormatPNG); err != ErrSourceTooLarge {
+		t.Errorf("a 2000x1000 source returned %v with a 1M pixels limit", err)
+	}
+
+	if _, err := p.Get(context.Background(), o.URL+"/missing.png", "card", FormatPNG); err != ErrSourceFetch {
+		t.Errorf("a missing source returned %v", err)
+	}
+	if _, err := p.Get(context.Background(), "file:///etc/passwd", "card", FormatPNG); err != ErrInvalidSource {
+		t.Errorf("a file url returned %v", err)
+	}
+}
+
+func TestPrivateSources(t *testing.T) {
+	o := newOrigin(t)
+	cache, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(cache, 8<<20)
+
+	if _, err := p.Get(context.Background(), o.URL+"/photo.png", "card", FormatPNG); err != ErrPrivateSource {
+		t.Errorf("a loopback origin returned %v, want ErrPrivateSource", err)
+	}
+
+	// a public looking host redirecting to the loopback origin is refused too
+	redirect := httptest.NewServer(http.RedirectHandler(o.URL+"/photo.png", http.StatusFound))
+	defer redirect.Close()
+	p.Client.Transport = &redirectDialer{public: redirect.Listener.Addr().String(), next: p.Client.Transport.(*http.Transport)}
+	if _, err := p.Get(context.Background(), "http://cdn.example/photo.png", "thumb", FormatPNG); err != ErrPrivateSource {
+		t.Errorf("a redirect to a loopback origin returned %v, want ErrPrivateSource", err)
+	}
+	if hits := atomic.LoadInt32(&o.hits); hits != 0 {
+		t.Errorf("origin hit %d times", hits)
+	}
+
+	for _, address := range []string{"127.0.0.1:80", "10.1.2.3:80", "192.168.0.1:443", "169.254.169.254:80", "[::1]:80", "[fe80::1]:80", "0.0.0.0:80", "100.64.0.1:80"} {
+		if err := dialPublic("tcp", address, nil); err != ErrPrivateSource {
+			t.Errorf("dialPublic(%s) = %v", address, err)
+		}
+	}
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443"} {
+		if err := dialPublic("tcp", address, nil); err != nil {
+			t.Errorf("dialPublic(%s) = %v", address, err)
+		}
+	}
+}
+
+// redirectDialer sends the request for cdn.example to the redirecting server, the requests that
+// follow the redirect go through the guarded transport of the proxy
+type redirectDialer struct {
+	public string
+	next   *http.Transport
+}
+
+func (d *redirectDialer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "cdn.example" {
+		req = req.Clone(req.Context())
+		req.URL.Host = d.public
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return d.next.RoundTrip(req)
+}
@@ -0,0 +1,75 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Preset is an allowed output size. Crop fills the box and cuts what overflows around the center,
+// else the image fits in the box. Images are never enlarged.
+type Preset struct {
+	Width  int
+	Height int
+	Crop   bool
+}
+
+// Presets are the sizes /img serves, the frontend can't ask for another one
+var Presets = map[string]Preset{
+	"thumb":  {Width: 160, Height: 160, Crop: true},
+	"card":   {Width: 320, Height: 320, Crop: true},
+	"medium": {Width: 640, Height: 640},
+	"large":  {Width: 1280, Height: 1280},
+}
+
+// Resize scales src down to the preset
+func Resize(src image.Image, preset Preset) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if preset.Crop {
+		// the largest part of src with the ratio of the box
+		cropW, cropH := w, w*preset.Height/preset.Width
+		if cropH > h {
+			cropW, cropH = h*preset.Width/preset.Height, h
+		}
+		x0 := b.Min.X + (w-cropW)/2
+		y0 := b.Min.Y + (h-cropH)/2
+		b = image.Rect(x0, y0, x0+cropW, y0+cropH)
+		w, h = cropW, cropH
+		if w > preset.Width {
+			w, h = preset.Width, preset.Height
+		}
+	} else if w > preset.Width || h > preset.Height {
+		if w*preset.Height > h*preset.Width {
+			w, h = preset.Width, max(1, h*preset.Width/w)
+		} else {
+			w, h = max(1, w*preset.Height/h), preset.Height
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if w == b.Dx() && h == b.Dy() {
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+		return dst
+	}
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// flatten draws img on white, JPEG has no alpha
+func flatten(img image.Image) image.Image {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+	return dst
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,586 @@
+package images
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// EncodeWebP writes img as a lossless WebP (VP8L). There is no WebP encoder in the standard library nor in
+// golang.org/x/image, this one keeps to the parts of the format that pay off on product photos: the subtract
+// green and predictor transforms, backward references to repeated pixels and one set of prefix codes.
+func EncodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return errors.New("webp: invalid image size")
+	}
+
+	argb := make([]uint32, width*height)
+	alpha := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			argb[y*width+x] = uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+			if c.A != 0xff {
+				alpha = true
+			}
+		}
+	}
+
+	var bw bitWriter
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// transforms are undone by the decoder in the reverse order they are written
+	bw.write(1, 1)
+	bw.write(transformSubtractGreen, 2)
+	subtractGreen(argb)
+
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	modes, modesWidth := predict(argb, width, height)
+	writeEntropyImage(&bw, modes, modesWidth, false)
+
+	bw.write(0, 1)
+	writeEntropyImage(&bw, argb, width, true)
+
+	data := bw.bytes()
+	chunk := uint32(len(data))
+	pad := chunk & 1
+	var header [20]byte
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], 4+8+chunk+pad)
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], chunk)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if pad == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	// predictorBits sets the 16x16 blocks sharing a predictor mode
+	predictorBits = 4
+
+	numLiteralCodes  = 256
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+	maxCodeLength    = 15
+	maxRunLength     = 4096
+)
+
+// codeLengthOrder is the order in which the code lengths of the code length code are written
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := (p >> 8) & 0xff
+		r := (((p >> 16) & 0xff) - g) & 0xff
+		b := ((p & 0xff) - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// predictor modes tried on every block: left, top and select
+var predictorModes = []uint32{1, 2, 11}
+
+func predictorValue(mode uint32, left, top, topLeft uint32) uint32 {
+	switch mode {
+	case 1:
+		return left
+	case 2:
+		return top
+	default:
+		return selectPredictor(left, top, topLeft)
+	}
+}
+
+func channelDistance(a, b uint32) int {
+	d := 0
+	for shift := 0; shift < 32; shift += 8 {
+		x := int((a >> shift) & 0xff)
+		y := int((b >> shift) & 0xff)
+		if x > y {
+			d += x - y
+		} else {
+			d += y - x
+		}
+	}
+	return d
+}
+
+func selectPredictor(left, top, topLeft uint32) uint32 {
+	pL, pT := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		l := int((left >> shift) & 0xff)
+		t := int((top >> shift) & 0xff)
+		tl := int((topLeft >> shift) & 0xff)
+		p := l + t - tl
+		pL += abs(p - l)
+		pT += abs(p - t)
+	}
+	if pL < pT {
+		return left
+	}
+	return top
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func subPixels(a, b uint32) uint32 {
+	alpha := ((a >> 24) - (b >> 24)) & 0xff
+	red := ((a >> 16) - (b >> 16)) & 0xff
+	green := ((a >> 8) - (b >> 8)) & 0xff
+	blue := (a - b) & 0xff
+	return alpha<<24 | red<<16 | green<<8 | blue
+}
+
+// predict replaces argb by its residuals, it returns the mode image with the mode of each block in green
+func predict(argb []uint32, width, height int) ([]uint32, int) {
+	block := 1 << predictorBits
+	modesWidth := (width + block - 1) / block
+	modesHeight := (height + block - 1) / block
+	modes := make([]uint32, modesWidth*modesHeight)
+
+	// the predictions use the original neighbours, like the decoder does once it restored them
+	original := make([]uint32, len(argb))
+	copy(original, argb)
+	prediction := func(mode uint32, x, y int) uint32 {
+		i := y*width + x
+		switch {
+		case x == 0 && y == 0:
+			return 0xff000000
+		case y == 0:
+			return original[i-1]
+		case x == 0:
+			return original[i-width]
+		}
+		return predictorValue(mode, original[i-1], original[i-width], original[i-width-1])
+	}
+
+	for by := 0; by < modesHeight; by++ {
+		for bx := 0; bx < modesWidth; bx++ {
+			best, bestCost := predictorModes[0], -1
+			for _, mode := range predictorModes {
+				cost := 0
+				for y := by * block; y < (by+1)*block && y < height; y++ {
+					for x := bx * block; x < (bx+1)*block && x < width; x++ {
+						cost += channelDistance(original[y*width+x], prediction(mode, x, y))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[by*modesWidth+bx] = 0xff000000 | best<<8
+			for y := by * block; y < (by+1)*block && y < height; y++ {
+				for x := bx * block; x < (bx+1)*block && x < width; x++ {
+					argb[y*width+x] = subPixels(original[y*width+x], prediction(best, x, y))
+				}
+			}
+		}
+	}
+	return modes, modesWidth
+}
+
+// token is a literal pixel, or a copy of length pixels from distance pixels back when length > 0
+type token struct {
+	pixel    uint32
+	length   int
+	distance int
+}
+
+const (
+	hashBits   = 16
+	chainDepth = 32
+	minMatch   = 3
+	// maxDistance is the farthest distance the 40 distance prefix codes can write, less the 120 plane codes
+	maxDistance = 1<<20 - 120
+)
+
+// backwardReferences turns the pixels into literals and copies of earlier pixels, found with hash chains
+// over pairs of pixels
+func backwardReferences(pixels []uint32) []token {
+	n := len(pixels)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	hash := func(i int) uint32 {
+		return (pixels[i]*0x9e3779b1 ^ pixels[i+1]*0x85ebca6b) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < n {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var tokens []token
+	for i := 0; i < n; {
+		bestLength, bestDistance := 0, 0
+		if i+1 < n {
+			for j, depth := int(head[hash(i)]), 0; j >= 0 && i-j <= maxDistance && depth < chainDepth; j, depth = int(prev[j]), depth+1 {
+				length := 0
+				for i+length < n && length < maxRunLength && pixels[j+length] == pixels[i+length] {
+					length++
+				}
+				if length > bestLength {
+					bestLength, bestDistance = length, i-j
+					if length == maxRunLength {
+						break
+					}
+				}
+			}
+		}
+		if bestLength >= minMatch {
+			tokens = append(tokens, token{length: bestLength, distance: bestDistance})
+			for k := 0; k < bestLength; k++ {
+				insert(i + k)
+			}
+			i += bestLength
+			continue
+		}
+		tokens = append(tokens, token{pixel: pixels[i]})
+		insert(i)
+		i++
+	}
+	return tokens
+}
+
+// distanceCode maps a distance to the code written, the left and top pixels have short plane codes
+func distanceCode(distance, width int) int {
+	switch distance {
+	case 1:
+		return 2
+	case width:
+		return 1
+	}
+	return distance + 120
+}
+
+// prefixEncode splits value (>= 1) into the prefix symbol and the extra bits shared by lengths and distances
+func prefixEncode(value int) (symbol int, extraBits uint, extra uint32) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := uint(0)
+	for (d >> (h + 1)) != 0 {
+		h++
+	}
+	second := (d >> (h - 1)) & 1
+	extraBits = h - 1
+	return int(2*h) + second, extraBits, uint32(d) & (1<<extraBits - 1)
+}
+
+// writeEntropyImage writes the pixels without color cache, main adds the meta prefix bit of the main image
+func writeEntropyImage(bw *bitWriter, pixels []uint32, width int, main bool) {
+	bw.write(0, 1)
+	if main {
+		bw.write(0, 1)
+	}
+
+	tokens := backwardReferences(pixels)
+
+	green := make([]int, numLiteralCodes+numLengthCodes)
+	red := make([]int, numLiteralCodes)
+	blue := make([]int, numLiteralCodes)
+	alpha := make([]int, numLiteralCodes)
+	distance := make([]int, numDistanceCodes)
+	for _, t := range tokens {
+		if t.length > 0 {
+			symbol, _, _ := prefixEncode(t.length)
+			green[numLiteralCodes+symbol]++
+			distanceSymbol, _, _ := prefixEncode(distanceCode(t.distance, width))
+			distance[distanceSymbol]++
+			continue
+		}
+		green[(t.pixel>>8)&0xff]++
+		red[(t.pixel>>16)&0xff]++
+		blue[t.pixel&0xff]++
+		alpha[t.pixel>>24]++
+	}
+
+	codes := make([]prefixCode, 5)
+	for i, counts := range [][]int{green, red, blue, alpha, distance} {
+		codes[i] = writePrefixCode(bw, counts)
+	}
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			symbol, extraBits, extra := prefixEncode(t.length)
+			codes[0].write(bw, numLiteralCodes+symbol)
+			bw.write(extra, extraBits)
+			dSymbol, dExtraBits, dExtra := prefixEncode(distanceCode(t.distance, width))
+			codes[4].write(bw, dSymbol)
+			bw.write(dExtra, dExtraBits)
+			continue
+		}
+		codes[0].write(bw, int((t.pixel>>8)&0xff))
+		codes[1].write(bw, int((t.pixel>>16)&0xff))
+		codes[2].write(bw, int(t.pixel&0xff))
+		codes[3].write(bw, int(t.pixel>>24))
+	}
+}
+
+// prefixCode holds the bit reversed canonical code of every symbol, a symbol with a 0 length is read without bits
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (p prefixCode) write(bw *bitWriter, symbol int) {
+	bw.write(p.codes[symbol], uint(p.lengths[symbol]))
+}
+
+// writePrefixCode writes the code of counts and returns it, the simple form is used for one or two small symbols
+func writePrefixCode(bw *bitWriter, counts []int) prefixCode {
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		code := prefixCode{lengths: make([]uint8, len(counts)), codes: make([]uint32, len(counts))}
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.write(uint32(used[1]), 8)
+			code.lengths[used[0]], code.lengths[used[1]] = 1, 1
+			code.codes[used[1]] = 1
+		}
+		return code
+	}
+
+	lengths := codeLengths(counts, maxCodeLength)
+	bw.write(0, 1)
+
+	// the code lengths are written with a code of their own, zero runs use symbols 17 (3 to 10) and 18 (11 to 138)
+	type lengthToken struct {
+		symbol int
+		extra  uint32
+		bits   uint
+	}
+	var lengthTokens []lengthToken
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			lengthTokens = append(lengthTokens, lengthToken{symbol: int(lengths[i])})
+			i++
+			continue
+		}
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		switch {
+		case run >= 11:
+			lengthTokens = append(lengthTokens, lengthToken{symbol: 18, extra: uint32(run - 11), bits: 7})
+		case run >= 3:
+			lengthTokens = append(lengthTokens, lengthToken{symbol: 17, extra: uint32(run - 3), bits: 3})
+		default:
+			for j := 0; j < run; j++ {
+				lengthTokens = append(lengthTokens, lengthToken{symbol: 0})
+			}
+		}
+		i += run
+	}
+
+	lengthCounts := make([]int, 19)
+	for _, t := range lengthTokens {
+		lengthCounts[t.symbol]++
+	}
+	lengthLengths := codeLengths(lengthCounts, 7)
+	last := 4
+	for i, symbol := range codeLengthOrder {
+		if lengthLengths[symbol] != 0 && i+1 > last {
+			last = i + 1
+		}
+	}
+	bw.write(uint32(last-4), 4)
+	for _, symbol := range codeLengthOrder[:last] {
+		bw.write(uint32(lengthLengths[symbol]), 3)
+	}
+	// the lengths of every symbol of the alphabet follow
+	bw.write(0, 1)
+
+	lengthCode := canonicalCode(lengthLengths)
+	for _, t := range lengthTokens {
+		lengthCode.write(bw, t.symbol)
+		bw.write(t.extra, t.bits)
+	}
+	return canonicalCode(lengths)
+}
+
+// codeLengths returns Huffman code lengths of at most maxLength bits. At least two symbols get a length,
+// the format has no normal code with a single symbol. Counts are flattened until the lengths fit.
+func codeLengths(counts []int, maxLength uint8) []uint8 {
+	weights := make([]int, len(counts))
+	copy(weights, counts)
+	nonZero := 0
+	for _, w := range weights {
+		if w > 0 {
+			nonZero++
+		}
+	}
+	for i := 0; nonZero < 2 && i < len(weights); i++ {
+		if weights[i] == 0 {
+			weights[i] = 1
+			nonZero++
+		}
+	}
+
+	for {
+		lengths := huffmanLengths(weights)
+		longest := uint8(0)
+		for _, l := range lengths {
+			if l > longest {
+				longest = l
+			}
+		}
+		if longest <= maxLength {
+			return lengths
+		}
+		for i, w := range weights {
+			if w > 0 {
+				weights[i] = (w + 1) / 2
+			}
+		}
+	}
+}
+
+// huffmanLengths returns the depth of every symbol with a weight in a Huffman tree
+func huffmanLengths(weights []int) []uint8 {
+	type node struct {
+		weight      int
+		symbol      int
+		left, right int
+	}
+	var nodes []node
+	var queue []int
+	for symbol, w := range weights {
+		if w > 0 {
+			nodes = append(nodes, node{weight: w, symbol: symbol, left: -1, right: -1})
+			queue = append(queue, len(nodes)-1)
+		}
+	}
+	less := func(a, b int) bool {
+		if nodes[a].weight != nodes[b].weight {
+			return nodes[a].weight < nodes[b].weight
+		}
+		return a < b
+	}
+	for len(queue) > 1 {
+		sort.Slice(queue, func(i, j int) bool { return less(queue[i], queue[j]) })
+		a, b := queue[0], queue[1]
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+		queue = append(queue[2:], len(nodes)-1)
+	}
+
+	lengths := make([]uint8, len(weights))
+	var walk func(i int, depth uint8)
+	walk = func(i int, depth uint8) {
+		if nodes[i].symbol >= 0 {
+			lengths[nodes[i].symbol] = depth
+			return
+		}
+		walk(nodes[i].left, depth+1)
+		walk(nodes[i].right, depth+1)
+	}
+	walk(queue[0], 0)
+	return lengths
+}
+
+// canonicalCode assigns the canonical codes of lengths, bit reversed for the LSB first bit writer
+func canonicalCode(lengths []uint8) prefixCode {
+	code := prefixCode{lengths: lengths, codes: make([]uint32, len(lengths))}
+	var countPerLength [maxCodeLength + 1]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			countPerLength[l]++
+		}
+	}
+	var next [maxCodeLength + 2]uint32
+	for l := 1; l <= maxCodeLength; l++ {
+		next[l+1] = (next[l] + countPerLength[l]) << 1
+	}
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		reversed := uint32(0)
+		for i := uint8(0); i < l; i++ {
+			reversed = reversed<<1 | (c>>i)&1
+		}
+		code.codes[symbol] = reversed
+	}
+	return code
+}
+
+// bitWriter packs bits LSB first, the bit order of VP8L
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) write(value uint32, n uint) {
+	b.acc |= uint64(value&(1<<n-1)) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nbits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nbits = 0, 0
+	}
+	return b.buf
+}
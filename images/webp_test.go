@@ -0,0 +1,116 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// webpPatterns fill an image with the kinds of pixels that take different paths through the encoder:
+// one color gives single symbol codes, stripes give backward references, noise gives long literal codes
+var webpPatterns = map[string]func(rng *rand.Rand, x, y int) color.NRGBA{
+	"flat": func(rng *rand.Rand, x, y int) color.NRGBA {
+		return color.NRGBA{R: 200, G: 30, B: 90, A: 0xff}
+	},
+	"gradient": func(rng *rand.Rand, x, y int) color.NRGBA {
+		return color.NRGBA{R: uint8(x * 7), G: uint8(y * 5), B: uint8(x + y), A: 0xff}
+	},
+	"stripes": func(rng *rand.Rand, x, y int) color.NRGBA {
+		if (x/3+y)%4 == 0 {
+			return color.NRGBA{R: 10, G: 20, B: 30, A: 0xff}
+		}
+		return color.NRGBA{R: 250, G: 240, B: 230, A: 0xff}
+	},
+	"noise": func(rng *rand.Rand, x, y int) color.NRGBA {
+		return color.NRGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: 0xff}
+	},
+	"alphaGradient": func(rng *rand.Rand, x, y int) color.NRGBA {
+		return color.NRGBA{R: uint8(x * 3), G: 128, B: uint8(y * 9), A: uint8(x*11 + y)}
+	},
+	"alphaNoise": func(rng *rand.Rand, x, y int) color.NRGBA {
+		// transparent pixels keep their color, the format is lossless
+		return color.NRGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(256)), B: uint8(rng.Intn(256)), A: uint8(rng.Intn(256))}
+	},
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	sizes := []image.Point{{1, 1}, {1, 9}, {9, 1}, {3, 5}, {15, 17}, {16, 16}, {33, 9}, {101, 67}, {257, 3}, {320, 240}}
+	for name, pattern := range webpPatterns {
+		for _, size := range sizes {
+			t.Run(fmt.Sprintf("%s/%dx%d", name, size.X, size.Y), func(t *testing.T) {
+				rng := rand.New(rand.NewSource(int64(size.X*1000 + size.Y)))
+				src := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+				for y := 0; y < size.Y; y++ {
+					for x := 0; x < size.X; x++ {
+						src.SetNRGBA(x, y, pattern(rng, x, y))
+					}
+				}
+
+				var buf bytes.Buffer
+				if err := EncodeWebP(&buf, src); err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := webp.Decode(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decoded.Bounds().Size() != size {
+					t.Fatalf("decoded size %v, want %v", decoded.Bounds().Size(), size)
+				}
+				b := decoded.Bounds()
+				for y := 0; y < size.Y; y++ {
+					for x := 0; x < size.X; x++ {
+						got := color.NRGBAModel.Convert(decoded.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+						if want := src.NRGBAAt(x, y); got != want {
+							t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeWebPSubImage(t *testing.T) {
+	// the bounds of a sub image don't start at 0
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 0xff})
+		}
+	}
+	sub := src.SubImage(image.Rect(7, 5, 26, 18)).(*image.NRGBA)
+
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, sub); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := webp.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds().Dx() != 19 || decoded.Bounds().Dy() != 13 {
+		t.Fatalf("decoded size %v, want 19x13", decoded.Bounds().Size())
+	}
+	for y := 0; y < 13; y++ {
+		for x := 0; x < 19; x++ {
+			got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			if want := sub.NRGBAAt(7+x, 5+y); got != want {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPInvalidSize(t *testing.T) {
+	for _, size := range []image.Rectangle{image.Rect(0, 0, 0, 5), image.Rect(0, 0, 1<<14+1, 1)} {
+		if err := EncodeWebP(&bytes.Buffer{}, image.NewNRGBA(size)); err == nil {
+			t.Fatalf("EncodeWebP accepted a %v image", size.Size())
+		}
+	}
+}
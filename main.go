@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"kamal/catalog"
+	"kamal/commands"
+	"kamal/config"
+	"kamal/images"
+	"kamal/notifications"
 	_db "kamal/database"
 	"kamal/other"
 	"kamal/print"
@@ -13,75 +23,268 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 )
 
-func loadEnv(keyName string) string {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-	apiKey := os.Getenv(keyName)
-	return apiKey
-}
-
 func main() {
 	defer print.Str("\n-----------END-----------\n")
+	if err := config.Load(); err != nil {
+		log.Fatal("Error loading .env file")
+	}
 	redis.CreateClient()
+	images.SetSecret(config.Get("IMG_SECRET"))
 
-	db, err := _db.ConnectToDatabase()
+	connectCtx, cancelConnect := context.WithTimeout(context.Background(), 30*time.Second)
+	db, err := _db.ConnectToDatabase(connectCtx)
+	cancelConnect()
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
 
-	queries := _db.GetProductDataQuery(&db)
+	// a migration may backfill the whole catalog, it has no deadline and only ctrl+c stops it
+	migrateCtx, stopMigrate := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = _db.Migrate(migrateCtx, db)
+	stopMigrate()
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	defer queries.GetProductData.Close()
-	defer queries.EmailAlreadyExist.Close()
-	defer queries.SignUpUser.Close()
-	defer queries.CreateDefaultWishlist.Close()
-	defer queries.Login.Close()
-	defer queries.GetUserAllWishListsNamesIds.Close()
-	defer queries.GetUserWishListData.Close()
-	defer queries.GetUserCertainWishListData.Close()
-	defer queries.GetUserData.Close()
-	defer queries.GetUserCartData.Close()
+	queries, err := _db.NewQueries(ctx, db)
+	if err != nil {
+		panic(err)
+	}
+	defer queries.Close()
+	print.Str("Prepared statements:", queries.Names())
+
+	// read replicas, e.g. DATABASE_REPLICAS=10.0.0.2:5432,10.0.0.3:5432
+	for _, addr := range config.List("DATABASE_REPLICAS") {
+		replica, err := _db.ConnectToReplica(ctx, addr)
+		if err != nil {
+			print.Str("Replica failed to connect:", addr, err)
+			continue
+		}
+		if err := queries.AddReplica(ctx, addr, replica); err != nil {
+			print.Str("Replica failed to prepare statements:", addr, err)
+			replica.Close()
+			continue
+		}
+		print.Str("Replica connected:", addr)
+	}
+	queries.SetMaxReplicaLag(config.Duration("DATABASE_REPLICA_MAX_LAG", 5*time.Second))
+	// a request that took a statement before a re-prepare keeps it until its route timeout at most
+	queries.SetRetireAfter(config.MaxTimeout() + time.Minute)
+
+	// go run . <command> [flags] runs a command instead of the server
+	if len(os.Args) > 1 {
+		if err := commands.Run(os.Args[1], os.Args[2:], queries); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// delivery channels of the notifications, mail only when an SMTP server is configured
+	channels := []notifications.Channel{notifications.InApp{Queries: queries}}
+	if addr := config.Get("SMTP_ADDR"); addr != "" {
+		channels = append(channels, notifications.NewEmail(addr, config.Get("SMTP_FROM"), config.Get("SMTP_USER"), config.Get("SMTP_PASSWORD")))
+	}
+	dispatcher := notifications.NewDispatcher(channels...)
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	go queries.WatchConnection(watchCtx, 10*time.Second)
+	go queries.WatchReplicas(watchCtx, 5*time.Second)
+	// price drop alerts of the wishlists, PRICE_ALERT_INTERVAL=0 leaves them to the price-alerts command
+	if config.Get("PRICE_ALERT_INTERVAL") != "0" {
+		go catalog.WatchPriceDrops(watchCtx, queries, config.Duration("PRICE_ALERT_INTERVAL", 15*time.Minute))
+	}
+	// back in stock and release alerts of the notify me subscriptions, STOCK_ALERT_INTERVAL=0 turns them off
+	if config.Get("STOCK_ALERT_INTERVAL") != "0" {
+		stockAlerts := catalog.StockAlertOptions{MaxPerHour: config.Int("STOCK_ALERTS_PER_HOUR", 10)}
+		go catalog.WatchStock(watchCtx, queries, dispatcher, stockAlerts, config.Duration("STOCK_ALERT_INTERVAL", time.Minute))
+	}
 
 	print.Str("Successfully connected to the database!")
 
 	router := gin.Default()
 	var useCors = true
 
-	setupRoutes(router, &db, &queries, useCors)
+	setupRoutes(router, db, queries, dispatcher, useCors)
 	other.LogHeapData()
-	router.Run("localhost:8080")
-	
+
+	server := &http.Server{Addr: "localhost:8080", Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// wait for ctrl+c so the deferred Close calls above get to run
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		print.Str("Error shutting down server:", err)
+	}
+
 	// log.Fatal(http.ListenAndServeTLS(":8080", "certificate/certificate.crt", "certificate/private.key", router))
 
 }
 
 
-func setupRoutes(router *gin.Engine, db *sql.DB, queries *_db.Queries , useCors bool) {
+func setupRoutes(router *gin.Engine, db *sql.DB, queries *_db.Queries , dispatcher *notifications.Dispatcher, useCors bool) {
 	// COOKIESIGNEDSECRET := loadEnv("COOKIESIGNEDSECRET")
-	JWTSECRET := loadEnv("JWTSECRET")
+	JWTSECRET := config.Get("JWTSECRET")
 
 	if useCors {
 		config := cors.DefaultConfig()
 		config.AllowMethods = []string{"GET", "DELETE", "POST"}
 		config.AllowCredentials = true
 		config.AllowOrigins = []string{"http://localhost:3000", "http://localhost:3001","https://localhost:3000", "https://localhost:3001"}
+		config.AllowHeaders = append(config.AllowHeaders, "Accept-Currency")
 		router.Use(cors.New(config))
 	} else {
-		router.Use(cors.Default())
+		config := cors.DefaultConfig()
+		config.AllowAllOrigins = true
+		config.AllowHeaders = append(config.AllowHeaders, "Accept-Currency")
+		router.Use(cors.New(config))
 	}
 
 	// store := cookie.NewStore([]byte(COOKIESIGNEDSECRET))
 	// router.Use(sessions.Sessions("mysession", store))
 
 	router.POST("/getProductData", func(c *gin.Context) {
-		route.GetProductData(c, queries)
+		route.GetProductData(c, JWTSECRET, queries)
+	})
+	router.GET("/product/:id", func(c *gin.Context) {
+		route.GetProduct(c, JWTSECRET, queries)
+	})
+	router.POST("/getProductsData", func(c *gin.Context) {
+		route.GetProductsData(c, JWTSECRET, queries)
+	})
+	router.POST("/resolveSku", func(c *gin.Context) {
+		route.ResolveSku(c, queries)
+	})
+	router.GET("/products", func(c *gin.Context) {
+		route.ListProducts(c, JWTSECRET, queries)
+	})
+	router.GET("/search", func(c *gin.Context) {
+		route.SearchProducts(c, JWTSECRET, queries)
+	})
+	router.GET("/categories", func(c *gin.Context) {
+		route.GetCategories(c, queries)
+	})
+	router.GET("/reviews", func(c *gin.Context) {
+		route.ListReviews(c, queries)
+	})
+	router.POST("/postReview", func(c *gin.Context) {
+		route.PostReview(c, JWTSECRET, queries)
+	})
+	router.DELETE("/deleteReview", func(c *gin.Context) {
+		route.DeleteReview(c, JWTSECRET, queries)
+	})
+	router.POST("/voteReview", func(c *gin.Context) {
+		route.VoteReview(c, JWTSECRET, queries)
+	})
+	router.GET("/questions", func(c *gin.Context) {
+		route.ListQuestions(c, queries)
+	})
+	router.GET("/answers", func(c *gin.Context) {
+		route.ListAnswers(c, queries)
+	})
+	router.POST("/askQuestion", func(c *gin.Context) {
+		route.AskQuestion(c, JWTSECRET, queries)
 	})
+	router.POST("/answerQuestion", func(c *gin.Context) {
+		route.AnswerQuestion(c, JWTSECRET, queries)
+	})
+	router.POST("/voteQuestion", func(c *gin.Context) {
+		route.VoteQuestion(c, JWTSECRET, queries)
+	})
+	router.POST("/voteAnswer", func(c *gin.Context) {
+		route.VoteAnswer(c, JWTSECRET, queries)
+	})
+	router.DELETE("/deleteQuestion", func(c *gin.Context) {
+		route.DeleteQuestion(c, JWTSECRET, queries)
+	})
+	router.DELETE("/deleteAnswer", func(c *gin.Context) {
+		route.DeleteAnswer(c, JWTSECRET, queries)
+	})
+	router.GET("/notifications", func(c *gin.Context) {
+		route.GetNotifications(c, JWTSECRET, queries)
+	})
+	router.POST("/readNotifications", func(c *gin.Context) {
+		route.ReadNotifications(c, JWTSECRET, queries)
+	})
+	router.GET("/related", func(c *gin.Context) {
+		route.RelatedProducts(c, JWTSECRET, queries)
+	})
+	router.GET("/recommendations", func(c *gin.Context) {
+		route.Recommendations(c, JWTSECRET, queries)
+	})
+	router.GET("/recentlyViewed", func(c *gin.Context) {
+		route.GetRecentlyViewed(c, JWTSECRET, queries)
+	})
+	router.DELETE("/recentlyViewed", func(c *gin.Context) {
+		route.ClearRecentlyViewed(c, JWTSECRET)
+	})
+	router.GET("/priceHistory", func(c *gin.Context) {
+		route.PriceHistory(c, queries)
+	})
+	router.GET("/priceAlertSettings", func(c *gin.Context) {
+		route.GetPriceAlertSettings(c, JWTSECRET, queries)
+	})
+	router.POST("/priceAlertSettings", func(c *gin.Context) {
+		route.SetPriceAlertSettings(c, JWTSECRET, queries)
+	})
+	router.GET("/notifyMe", func(c *gin.Context) {
+		route.GetNotifyMe(c, JWTSECRET, queries, dispatcher)
+	})
+	router.POST("/notifyMe", func(c *gin.Context) {
+		route.NotifyMe(c, JWTSECRET, queries, dispatcher)
+	})
+	router.DELETE("/notifyMe", func(c *gin.Context) {
+		route.CancelNotifyMe(c, JWTSECRET, queries)
+	})
+	router.GET("/currencies", func(c *gin.Context) {
+		route.GetCurrencies(c, queries)
+	})
+	router.GET("/currencyPreference", func(c *gin.Context) {
+		route.GetCurrencyPreference(c, JWTSECRET, queries)
+	})
+	router.POST("/currencyPreference", func(c *gin.Context) {
+		route.SetCurrencyPreference(c, JWTSECRET, queries)
+	})
+	router.GET("/graphql", func(c *gin.Context) {
+		route.GraphQL(c, JWTSECRET, queries)
+	})
+	router.POST("/graphql", func(c *gin.Context) {
+		route.GraphQL(c, JWTSECRET, queries)
+	})
+
+	// resized images, cached in IMG_CACHE_DIR up to IMG_CACHE_MAX_MB. Without IMG_SECRET anyone could sign
+	// a URL, the route is left out and the responses keep the image URLs of the shop
+	imageCacheDir := config.Get("IMG_CACHE_DIR")
+	if imageCacheDir == "" {
+		imageCacheDir = "cache/img"
+	}
+	if config.Get("IMG_SECRET") == "" {
+		print.Str("IMG_SECRET is not set, /img is not served")
+	} else if imageCache, err := images.NewDiskCache(imageCacheDir, int64(config.Int("IMG_CACHE_MAX_MB", 512))<<20); err != nil {
+		print.Str("Image cache failed to open:", err)
+		// the URLs stay unsigned since nothing serves /img
+		images.SetSecret("")
+	} else {
+		imageProxy := images.NewProxy(imageCache, int64(config.Int("IMG_MAX_SOURCE_MB", 20))<<20)
+		router.GET("/img", func(c *gin.Context) {
+			route.ServeImage(c, imageProxy)
+		})
+	}
 	router.POST("/getwishlist", func(c *gin.Context) {
 		route.GetWishlist(c, JWTSECRET, queries)
 	})
@@ -118,6 +321,57 @@ func setupRoutes(router *gin.Engine, db *sql.DB, queries *_db.Queries , useCors
 	router.POST("/deleteWishList", func(c *gin.Context) {
 		route.DeleteWishList(c, JWTSECRET, queries)
 	})
+	router.POST("/admin/createCategory", func(c *gin.Context) {
+		route.CreateCategory(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/updateCategory", func(c *gin.Context) {
+		route.UpdateCategory(c, JWTSECRET, queries)
+	})
+	router.DELETE("/admin/deleteCategory", func(c *gin.Context) {
+		route.DeleteCategory(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/assignCategory", func(c *gin.Context) {
+		route.AssignCategory(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/createProduct", func(c *gin.Context) {
+		route.CreateProduct(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/updateProduct", func(c *gin.Context) {
+		route.UpdateProduct(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/setProductDisplay", func(c *gin.Context) {
+		route.SetProductDisplay(c, JWTSECRET, queries)
+	})
+	router.DELETE("/admin/deleteProduct", func(c *gin.Context) {
+		route.DeleteProduct(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/importProducts", func(c *gin.Context) {
+		route.ImportProducts(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/currencyRates", func(c *gin.Context) {
+		route.SetCurrencyRates(c, JWTSECRET, queries)
+	})
+	router.DELETE("/admin/currencyRates", func(c *gin.Context) {
+		route.DeleteCurrencyRate(c, JWTSECRET, queries)
+	})
+	router.GET("/admin/reviews", func(c *gin.Context) {
+		route.ListModerationReviews(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/moderateReview", func(c *gin.Context) {
+		route.ModerateReview(c, JWTSECRET, queries)
+	})
+	router.GET("/admin/questions", func(c *gin.Context) {
+		route.ListModerationQuestions(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/moderateQuestion", func(c *gin.Context) {
+		route.ModerateQuestion(c, JWTSECRET, queries)
+	})
+	router.POST("/admin/moderateAnswer", func(c *gin.Context) {
+		route.ModerateAnswer(c, JWTSECRET, queries)
+	})
+	router.GET("/feed", func(c *gin.Context) {
+		route.ExportFeed(c, JWTSECRET, queries)
+	})
 	router.GET("/get", func(c *gin.Context) {
 		route.Test(c, JWTSECRET, queries)
 	})
@@ -0,0 +1,206 @@
+package notifications
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"mime"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	_db "kamal/database"
+)
+
+// names of the delivery channels, the ones a user can pick are the ones given to NewDispatcher
+const (
+	ChannelInApp = "inApp"
+	ChannelEmail = "email"
+)
+
+var ErrUnknownChannel = errors.New("unknown notification channel")
+
+// Message is one notification to deliver. The in-app channel stores Kind and Data, the mail
+// channel sends Subject and Text to Email.
+type Message struct {
+	UserId  int
+	Email   string
+	Kind    string
+	Data    interface{}
+	Subject string
+	Text    string
+}
+
+// Channel delivers messages to the users
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, m Message) error
+}
+
+// InApp delivers the messages as notifications listed by GET /notifications
+type InApp struct {
+	Queries *_db.Queries
+}
+
+func (InApp) Name() string {
+	return ChannelInApp
+}
+
+func (ch InApp) Send(ctx context.Context, m Message) error {
+	return ch.Queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		return Add(ctx, tx, m.UserId, m.Kind, m.Data)
+	})
+}
+
+// Email delivers the messages by mail through an SMTP server
+type Email struct {
+	// Addr is host:port of the server, From the sender address
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewEmail returns the mail channel, without user the server is used without authentication
+func NewEmail(addr, from, user, password string) *Email {
+	ch := &Email{Addr: addr, From: from}
+	if user != "" {
+		host := addr
+		if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+			host = addr[:i]
+		}
+		ch.Auth = smtp.PlainAuth("", user, password, host)
+	}
+	return ch
+}
+
+func (*Email) Name() string {
+	return ChannelEmail
+}
+
+func (ch *Email) Send(ctx context.Context, m Message) error {
+	if m.Email == "" {
+		return errors.New("user has no email")
+	}
+	// a title could carry a line break into the headers
+	header := strings.NewReplacer("\r", " ", "\n", " ")
+	body := "From: " + header.Replace(ch.From) + "\r\n" +
+		"To: " + header.Replace(m.Email) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", header.Replace(m.Subject)) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(m.Text, "\n", "\r\n") + "\r\n"
+	return ch.send(ctx, m.Email, []byte(body))
+}
+
+// sendTimeout bounds a delivery whose ctx has no earlier deadline, a server that stops answering
+// must not hold the stock watcher
+const sendTimeout = 30 * time.Second
+
+// send does what smtp.SendMail does on a connection that is dialed with ctx and interrupted once ctx is done
+func (ch *Email) send(ctx context.Context, to string, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", ch.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > sendTimeout {
+		deadline = time.Now().Add(sendTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the blocked read or write returns at once
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	host, _, err := net.SplitHostPort(ch.Addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if ch.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(ch.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(ch.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Dispatcher sends the messages through the channels configured on the server
+type Dispatcher struct {
+	channels map[string]Channel
+}
+
+func NewDispatcher(channels ...Channel) *Dispatcher {
+	d := &Dispatcher{channels: map[string]Channel{}}
+	for _, ch := range channels {
+		d.channels[ch.Name()] = ch
+	}
+	return d
+}
+
+// Has reports whether the channel is configured
+func (d *Dispatcher) Has(name string) bool {
+	_, ok := d.channels[name]
+	return ok
+}
+
+// Names returns the configured channels, sorted
+func (d *Dispatcher) Names() []string {
+	names := make([]string, 0, len(d.channels))
+	for name := range d.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Send delivers the message through the channel
+func (d *Dispatcher) Send(ctx context.Context, channel string, m Message) error {
+	ch, ok := d.channels[channel]
+	if !ok {
+		return ErrUnknownChannel
+	}
+	return ch.Send(ctx, m)
+}
@@ -0,0 +1,118 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+
+	_db "kamal/database"
+
+	"github.com/lib/pq"
+)
+
+// kinds of notification, the data of each one is documented with it
+const (
+	// QuestionAnswered tells the asker that a question got an answer: {productId, questionId, answerId, isStaff}
+	QuestionAnswered = "questionAnswered"
+	// PriceDrop tells that a wishlisted product got cheaper: {productId, longProductId, title, oldPrice, newPrice, dropPercent}
+	PriceDrop = "priceDrop"
+	// BackInStock tells a subscriber that a product or one of its skus can be bought again:
+	// {productId, longProductId, title, skuId, skuName}, skuId is null for the whole product
+	BackInStock = "backInStock"
+	// NowAvailable tells a subscriber that a coming soon product can be bought, same data as BackInStock
+	NowAvailable = "nowAvailable"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// Notification is a notification as listed, ReadAt is nil until the user reads it
+type Notification struct {
+	Id        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt int64           `json:"createdAt"`
+	ReadAt    *int64          `json:"readAt"`
+}
+
+// Page is one page of notifications, newest first. NextCursor is empty on the last page.
+type Page struct {
+	Items      []Notification `json:"items"`
+	NextCursor string         `json:"nextCursor"`
+	Unread     int            `json:"unread"`
+}
+
+// Add notifies the user in the transaction writing what the notification is about, so both are kept or lost together
+func Add(ctx context.Context, tx *sql.Tx, userId int, kind string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO shop.t_notifications(foreign_user_id, kind, data) VALUES($1, $2, $3)`, userId, kind, string(payload))
+	return err
+}
+
+// List returns a page of the notifications of the user, cursor is the nextCursor of the previous page
+func List(ctx context.Context, queries *_db.Queries, userId int, cursor string, limit int) (*Page, error) {
+	if limit < 1 || limit > MaxLimit {
+		limit = DefaultLimit
+	}
+	var before int64
+	if cursor != "" {
+		var err error
+		if before, err = strconv.ParseInt(cursor, 10, 64); err != nil || before < 1 {
+			before = 0
+		}
+	}
+
+	// always read from the primary, a notification marked as read must not come back unread
+	rows, err := queries.DB.QueryContext(ctx, `SELECT id, kind, data, created_at, read_at FROM shop.t_notifications
+		WHERE foreign_user_id = $1 AND ($2::bigint = 0 OR id < $2::bigint)
+		ORDER BY id DESC LIMIT $3`, userId, before, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &Page{Items: []Notification{}}
+	for rows.Next() {
+		var n Notification
+		var data []byte
+		var readAt sql.NullInt64
+		if err := rows.Scan(&n.Id, &n.Kind, &data, &n.CreatedAt, &readAt); err != nil {
+			return nil, err
+		}
+		n.Data = data
+		if readAt.Valid {
+			n.ReadAt = &readAt.Int64
+		}
+		page.Items = append(page.Items, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = strconv.FormatInt(page.Items[limit-1].Id, 10)
+	}
+
+	err = queries.DB.QueryRowContext(ctx, `SELECT count(*) FROM shop.t_notifications WHERE foreign_user_id = $1 AND read_at IS NULL`, userId).Scan(&page.Unread)
+	return page, err
+}
+
+// MarkRead marks the notifications of the user as read, all of them when ids is empty. It returns how many changed.
+func MarkRead(ctx context.Context, queries *_db.Queries, userId int, ids []int64) (int64, error) {
+	if ids == nil {
+		ids = []int64{}
+	}
+	_db.MarkWritten(ctx)
+	result, err := queries.DB.ExecContext(ctx, `UPDATE shop.t_notifications SET read_at = floor(extract(epoch from now())::integer)
+		WHERE foreign_user_id = $1 AND read_at IS NULL AND (cardinality($2::bigint[]) = 0 OR id = ANY($2))`, userId, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -2,12 +2,13 @@ package limiter
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"kamal/print"
 	"kamal/redis"
 )
 
-func SetLimit(ip *string, route *string, rate int, expireInSec int)  {
+func SetLimit(ctx context.Context, ip *string, route *string, rate int, expireInSec int)  {
 	redisKeyName := "rate-limit-" + *ip + "-" + *route
 	print.Str(redisKeyName)
 	var buf bytes.Buffer
@@ -17,21 +18,21 @@ func SetLimit(ip *string, route *string, rate int, expireInSec int)  {
 		return
 	}
 
-	redis.SetKey(redisKeyName, buf.Bytes(), expireInSec)
+	redis.SetKey(ctx, redisKeyName, buf.Bytes(), expireInSec)
 }
 
-func GetLimitRate(ip *string, route *string) (int, int) {
+func GetLimitRate(ctx context.Context, ip *string, route *string) (int, int) {
 	var value int
 	redisKeyName := "rate-limit-" + *ip + "-" + *route
 	print.Str(redisKeyName)
-	exist, val := redis.GetKey(&redisKeyName)
+	exist, val := redis.GetKey(ctx, &redisKeyName)
 	if exist {
 		dec := gob.NewDecoder(bytes.NewReader(val))
 		if err := dec.Decode(&value); err != nil {
 			print.Str("Error decoding struct:", err)
 			return 0, -1
 		}
-		remainingTime := redis.GetRemainingExpiryTime(redisKeyName)
+		remainingTime := redis.GetRemainingExpiryTime(ctx, redisKeyName)
 
 		return value, remainingTime
 	}
@@ -1,13 +1,17 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"kamal/print"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 )
 
+// The commands take the request's context, go-redis sets the read and write deadlines of the
+// connection from its deadline and gives up waiting for a pooled connection once it is done.
+// Every helper returns early when ctx is already done, without a round trip.
 var client *redis.Client
 
 func CreateClient() {
@@ -17,7 +21,7 @@ func CreateClient() {
 		DB:       0,                 // use default DB
 	})
 
-	_, err := client.Ping().Result()
+	_, err := client.Ping(context.Background()).Result()
 	if err != nil {
 		print.Str("Redis failed to connect:", err)
 		return
@@ -26,39 +30,52 @@ func CreateClient() {
 	print.Str("Redis Successfully Connected")
 }
 
-func GetKey(keyName *string) (bool, []byte)  {
-	val, err := client.Get(*keyName).Bytes()
+func GetKey(ctx context.Context, keyName *string) (bool, []byte)  {
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	val, err := client.Get(ctx, *keyName).Bytes()
 	if err != nil {
 		return false, nil
 	}
 	return true, val
 }
 
-func SetKey(keyName string, value []byte, expireInSec int) bool  {
-	err := client.Set(keyName, value, time.Duration(expireInSec)*time.Second).Err()
+func SetKey(ctx context.Context, keyName string, value []byte, expireInSec int) bool  {
+	if ctx.Err() != nil {
+		return false
+	}
+	err := client.Set(ctx, keyName, value, time.Duration(expireInSec)*time.Second).Err()
 	if err != nil {
-		panic(err)
+		print.Str("Error setting key:", err)
+		return false
 	}
 	return true
 }
 
-func HMSet(firstKeyName string, value *map[string]interface{}, expireInSec int)  error  {
-	
-	err := client.HMSet(firstKeyName, *value).Err()
+func HMSet(ctx context.Context, firstKeyName string, value *map[string]interface{}, expireInSec int)  error  {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	err := client.HMSet(ctx, firstKeyName, *value).Err()
 	if err != nil {
 		return err
 	}
 
 	// set key expiration time to 60 seconds
-	err2 := client.Expire(firstKeyName, time.Duration(expireInSec)*time.Second).Err()
-	if err != nil {
+	err2 := client.Expire(ctx, firstKeyName, time.Duration(expireInSec)*time.Second).Err()
+	if err2 != nil {
 		return err2
 	}
 	return nil
 }
 
-func HMexists(firstKeyName string, secondKeyName string) bool {
-	exists, err := client.HExists(firstKeyName, secondKeyName).Result()
+func HMexists(ctx context.Context, firstKeyName string, secondKeyName string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	exists, err := client.HExists(ctx, firstKeyName, secondKeyName).Result()
 	if err != nil {
 		return false
 	} else {
@@ -66,22 +83,28 @@ func HMexists(firstKeyName string, secondKeyName string) bool {
 	}
 }
 
-func HMGet(firstKeyName string, secondKeyName string) (bool, string, error)  {
-	exists := HMexists(firstKeyName, secondKeyName)
+func HMGet(ctx context.Context, firstKeyName string, secondKeyName string) (bool, string, error)  {
+	exists := HMexists(ctx, firstKeyName, secondKeyName)
 	if exists {
-		val, err := client.HGet(firstKeyName, secondKeyName).Result()
+		val, err := client.HGet(ctx, firstKeyName, secondKeyName).Result()
 		if err != nil {
 			return true, "" , err
 		}
-		
+
 		return true, val , nil
 	}
+	if ctx.Err() != nil {
+		return false, "", ctx.Err()
+	}
 	return false, "" , errors.New("key not found")
 }
 
-func IncreaseExpirationTime(keyName string, expireInSec int) bool {
+func IncreaseExpirationTime(ctx context.Context, keyName string, expireInSec int) bool {
+	if ctx.Err() != nil {
+		return false
+	}
 	// Get current expiration time of key
-	_, err := client.TTL(keyName).Result()
+	_, err := client.TTL(ctx, keyName).Result()
 	if err != nil {
 		return false
 	}
@@ -89,19 +112,110 @@ func IncreaseExpirationTime(keyName string, expireInSec int) bool {
 	// Set new expiration time for key
 	expiration := time.Duration(expireInSec)*time.Second
 	// expiration := ttl + time.Duration(expireInSec)*time.Second   // use this to add 20 secs + previous time
-	err = client.Expire(keyName, expiration).Err()
+	err = client.Expire(ctx, keyName, expiration).Err()
 	if err != nil {
 		return false
 	}
 	return true
 }
 
-func GetRemainingExpiryTime(redisKeyName string) int {
+func GetRemainingExpiryTime(ctx context.Context, redisKeyName string) int {
+	if ctx.Err() != nil {
+		return -1
+	}
 	// Get remaining time-to-live of key
-	ttl, err := client.TTL(redisKeyName).Result()
+	ttl, err := client.TTL(ctx, redisKeyName).Result()
 	if err != nil {
 		print.Str("Error getting ttl of key:", err)
-		return -1 
+		return -1
 	}
 	return int(ttl.Seconds())
-}
\ No newline at end of file
+}
+
+// DelKey removes the keys, it is used to invalidate cached data after an edit
+func DelKey(ctx context.Context, keyNames ...string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err := client.Del(ctx, keyNames...).Err(); err != nil {
+		print.Str("Error deleting keys:", keyNames, err)
+		return false
+	}
+	return true
+}
+
+// PushRecent adds member to the sorted set with score, keeps the max highest scores and sets the expiration,
+// in one MULTI so the set never grows past max
+func PushRecent(ctx context.Context, keyName string, member string, score float64, max int, expireInSec int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, keyName, &redis.Z{Score: score, Member: member})
+		pipe.ZRemRangeByRank(ctx, keyName, 0, int64(-max-1))
+		pipe.Expire(ctx, keyName, time.Duration(expireInSec)*time.Second)
+		return nil
+	})
+	return err
+}
+
+// RecentMembers returns the count members of the sorted set with the highest scores, highest first
+func RecentMembers(ctx context.Context, keyName string, count int) ([]string, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return client.ZRevRange(ctx, keyName, 0, int64(count-1)).Result()
+}
+
+// MergeRecent moves the members of the sorted set src into dest, a member in both keeps its highest score.
+// dest is trimmed to max members like PushRecent and src is deleted.
+func MergeRecent(ctx context.Context, dest string, src string, max int, expireInSec int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZUnionStore(ctx, dest, &redis.ZStore{Keys: []string{dest, src}, Aggregate: "MAX"})
+		pipe.ZRemRangeByRank(ctx, dest, 0, int64(-max-1))
+		pipe.Expire(ctx, dest, time.Duration(expireInSec)*time.Second)
+		pipe.Del(ctx, src)
+		return nil
+	})
+	return err
+}
+
+// GetKeys reads the keys with one MGET, the value of a missing key is nil. Every key is missing on error.
+func GetKeys(ctx context.Context, keyNames ...string) [][]byte {
+	values := make([][]byte, len(keyNames))
+	if ctx.Err() != nil || len(keyNames) == 0 {
+		return values
+	}
+	result, err := client.MGet(ctx, keyNames...).Result()
+	if err != nil {
+		print.Str("Error getting keys:", err)
+		return values
+	}
+	for i, value := range result {
+		if s, ok := value.(string); ok {
+			values[i] = []byte(s)
+		}
+	}
+	return values
+}
+
+// SetKeys sets every key of values with the same expiration, in one pipeline
+func SetKeys(ctx context.Context, values map[string][]byte, expireInSec int) bool {
+	if ctx.Err() != nil || len(values) == 0 {
+		return false
+	}
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for keyName, value := range values {
+			pipe.Set(ctx, keyName, value, time.Duration(expireInSec)*time.Second)
+		}
+		return nil
+	})
+	if err != nil {
+		print.Str("Error setting keys:", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package route
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	_db "kamal/database"
+	_err "kamal/errors"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminUserId reads the user id from the token cookie and checks that the user is an admin
+// (t_users.isAdmin), it aborts the request and returns false otherwise
+func adminUserId(c *gin.Context, ctx context.Context, JWTSECRET string, queries *_db.Queries, currentRoute *string) (int, bool) {
+	userId, ok := cookieUserId(c, JWTSECRET, currentRoute)
+	if !ok {
+		return 0, false
+	}
+
+	// always asked to the primary, a revoked admin must lose access at once
+	var isAdmin bool
+	err := queries.Write(ctx, _db.IsAdmin).QueryRowContext(ctx, userId).Scan(&isAdmin)
+	if err != nil && err != sql.ErrNoRows {
+		if _err.AbortIfCanceled(c, currentRoute, ctx, err) {
+			return 0, false
+		}
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return 0, false
+	}
+	if !isAdmin {
+		_err.AbortRequestWithError(c, currentRoute, http.StatusForbidden, gin.H{"error": true, "success": false, "code": "Admins only"}, true)
+		return 0, false
+	}
+
+	return userId, true
+}
+
+// adminRoute runs the rate limiter, allowing limit requests a minute, and the admin check shared by
+// the admin routes. It aborts the request and returns false when one of them fails.
+func adminRoute(c *gin.Context, ctx context.Context, JWTSECRET string, queries *_db.Queries, currentRoute *string, limit int) bool {
+	ip := c.ClientIP()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, currentRoute)
+	if currentRate >= limit {
+		_err.AbortRequestWithError(c, currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return false
+	}
+	limiter.SetLimit(ctx, &ip, currentRoute, currentRate+1, 60)
+
+	_, ok := adminUserId(c, ctx, JWTSECRET, queries, currentRoute)
+	return ok
+}
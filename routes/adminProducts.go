@@ -0,0 +1,165 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	"kamal/redis"
+
+	"github.com/gin-gonic/gin"
+)
+
+// productDataKey is the key of the copy of GetProductData cached in Redis, products are asked by their longProductId
+func productDataKey(longProductId int64) string {
+	return "getProductData-" + strconv.FormatInt(longProductId, 10)
+}
+
+// InvalidateProducts drops the cached copies of the products, call it after every change to them
+func InvalidateProducts(ctx context.Context, longProductIds ...int64) {
+	keys := make([]string, 0, len(longProductIds))
+	for _, id := range longProductIds {
+		keys = append(keys, productDataKey(id))
+	}
+	if len(keys) > 0 {
+		redis.DelKey(ctx, keys...)
+	}
+	// hiding or deleting a product changes the category counts
+	invalidateCategoryTree(ctx)
+}
+
+// abortProductError answers the errors returned by the catalog product functions
+func abortProductError(c *gin.Context, currentRoute *string, ctx context.Context, err error) {
+	if _err.AbortIfCanceled(c, currentRoute, ctx, err) {
+		return
+	}
+	var productErr *catalog.ProductError
+	switch {
+	case errors.As(err, &productErr):
+		_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "invalid product", "fields": productErr.Fields}, true)
+	case err == catalog.ErrProductNotFound:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case err == catalog.ErrProductExists:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusConflict, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	default:
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+	}
+}
+
+type productPayload struct {
+	Id int `json:"id"`
+	catalog.Product
+}
+
+// CreateProduct answers POST /admin/createProduct with the product in the format of GetProductData
+func CreateProduct(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "createProduct"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload productPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	id, err := catalog.CreateProduct(ctx, queries, &payload.Product)
+	if err != nil {
+		abortProductError(c, &currentRoute, ctx, err)
+		return
+	}
+	InvalidateProducts(ctx, payload.LongProductId)
+
+	c.AbortWithStatusJSON(http.StatusCreated, gin.H{"error": false, "success": true, "productId": id})
+}
+
+// UpdateProduct answers POST /admin/updateProduct {id, ...product}, every field of the product is replaced
+func UpdateProduct(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "updateProduct"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload productPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	previousLongProductId, err := catalog.UpdateProduct(ctx, queries, payload.Id, &payload.Product)
+	if err != nil {
+		abortProductError(c, &currentRoute, ctx, err)
+		return
+	}
+	// the key of the old longProductId is dropped too, cache hits keep extending its expiry
+	InvalidateProducts(ctx, previousLongProductId, payload.LongProductId)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+type productDisplayPayload struct {
+	Id      int  `json:"id"`
+	Display bool `json:"_display"`
+}
+
+// SetProductDisplay answers POST /admin/setProductDisplay {id, _display}, hidden products stay in
+// wishlists and carts but are not listed anymore
+func SetProductDisplay(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "setProductDisplay"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload productDisplayPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	longProductId, err := catalog.SetProductDisplay(ctx, queries, payload.Id, payload.Display)
+	if err != nil {
+		abortProductError(c, &currentRoute, ctx, err)
+		return
+	}
+	InvalidateProducts(ctx, longProductId)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+// DeleteProduct answers DELETE /admin/deleteProduct {id}, the product is removed from wishlists and carts too
+func DeleteProduct(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "deleteProduct"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload getProductDataPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	longProductId, err := catalog.DeleteProduct(ctx, queries, payload.Id)
+	if err != nil {
+		abortProductError(c, &currentRoute, ctx, err)
+		return
+	}
+	InvalidateProducts(ctx, longProductId)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
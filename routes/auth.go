@@ -0,0 +1,62 @@
+package route
+
+import (
+	"context"
+	"net/http"
+
+	_err "kamal/errors"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// tokenUserId reads the user id from the token cookie, code is the error code of the failure, empty on success
+func tokenUserId(c *gin.Context, JWTSECRET string) (int, string) {
+	cookie, err := c.Cookie("token")
+	if err != nil {
+		return 0, "Error Code 3"
+	}
+
+	token, err := jwt.Parse(cookie, func(t *jwt.Token) (interface{}, error) {
+		return []byte(JWTSECRET), nil
+	})
+	if err != nil || !token.Valid {
+		return 0, "Error Code 5"
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, "Error Code 8"
+	}
+	idTemp, ok := claims["id"].(float64)
+	if !ok {
+		return 0, "Error Code 9"
+	}
+	return int(idTemp), ""
+}
+
+// cookieUserId reads the user id from the token cookie like the other routes,
+// it aborts the request and returns false when the user is not logged in
+func cookieUserId(c *gin.Context, JWTSECRET string, currentRoute *string) (int, bool) {
+	userId, code := tokenUserId(c, JWTSECRET)
+	if code != "" {
+		_err.AbortRequestWithError(c, currentRoute, http.StatusUnauthorized, gin.H{"error": true, "success": false, "code": code}, true)
+		return 0, false
+	}
+	return userId, true
+}
+
+// userRoute runs the rate limiter, allowing limit requests a minute, and reads the logged in user,
+// it aborts the request and returns false when one of them fails
+func userRoute(c *gin.Context, ctx context.Context, JWTSECRET string, currentRoute *string, limit int) (int, bool) {
+	ip := c.ClientIP()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, currentRoute)
+	if currentRate >= limit {
+		_err.AbortRequestWithError(c, currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return 0, false
+	}
+	limiter.SetLimit(ctx, &ip, currentRoute, currentRate+1, 60)
+
+	return cookieUserId(c, JWTSECRET, currentRoute)
+}
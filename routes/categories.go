@@ -0,0 +1,200 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+	"kamal/redis"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the tree is cached until an admin edits it, the expiry only bounds how stale the product counts get
+const (
+	categoryTreeKey    = "categoryTree"
+	categoryTreeExpiry = 60 * 5
+)
+
+// invalidateCategoryTree drops the cached tree, call it after every change to categories or their products
+func invalidateCategoryTree(ctx context.Context) {
+	redis.DelKey(ctx, categoryTreeKey)
+}
+
+// GetCategories answers GET /categories with the whole tree and the product count of every category
+func GetCategories(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "getCategories"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	redisKeyName := categoryTreeKey
+	if exist, val := redis.GetKey(ctx, &redisKeyName); exist {
+		print.Str("From Redis")
+		c.Data(http.StatusOK, "application/json; charset=utf-8", val)
+		c.Abort()
+		return
+	}
+
+	tree, err := catalog.CategoryTree(ctx, queries)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	data, err := json.Marshal(gin.H{"error": false, "success": true, "data": tree})
+	if err != nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+	redis.SetKey(ctx, categoryTreeKey, data, categoryTreeExpiry)
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+	c.Abort()
+}
+
+// abortCategoryError answers the errors returned by the catalog category functions
+func abortCategoryError(c *gin.Context, currentRoute *string, ctx context.Context, err error) {
+	if _err.AbortIfCanceled(c, currentRoute, ctx, err) {
+		return
+	}
+	switch err {
+	case catalog.ErrCategoryNotFound:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case catalog.ErrInvalidCategory, catalog.ErrSlugTaken:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	default:
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+	}
+}
+
+type categoryPayload struct {
+	Id int64 `json:"id"`
+	catalog.CategoryInput
+}
+
+// CreateCategory answers POST /admin/createCategory {name, slug, parentId, position}
+func CreateCategory(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "createCategory"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 60) {
+		return
+	}
+
+	var payload categoryPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	id, err := catalog.CreateCategory(ctx, queries, payload.CategoryInput)
+	if err != nil {
+		abortCategoryError(c, &currentRoute, ctx, err)
+		return
+	}
+	invalidateCategoryTree(ctx)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "id": id})
+}
+
+// UpdateCategory answers POST /admin/updateCategory {id, name, slug, parentId, position},
+// changing parentId moves the category with its descendants
+func UpdateCategory(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "updateCategory"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 60) {
+		return
+	}
+
+	var payload categoryPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.UpdateCategory(ctx, queries, payload.Id, payload.CategoryInput); err != nil {
+		abortCategoryError(c, &currentRoute, ctx, err)
+		return
+	}
+	invalidateCategoryTree(ctx)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+// DeleteCategory answers DELETE /admin/deleteCategory {id}, descendants are deleted too
+func DeleteCategory(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "deleteCategory"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 60) {
+		return
+	}
+
+	var payload categoryPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.DeleteCategory(ctx, queries, payload.Id); err != nil {
+		abortCategoryError(c, &currentRoute, ctx, err)
+		return
+	}
+	invalidateCategoryTree(ctx)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+type assignCategoryPayload struct {
+	CategoryId int64   `json:"categoryId"`
+	ProductIds []int64 `json:"productIds"`
+	Remove     bool    `json:"remove"`
+}
+
+// maxAssignedProducts bounds the product ids of one assignCategory request
+const maxAssignedProducts = 1000
+
+// AssignCategory answers POST /admin/assignCategory {categoryId, productIds, remove},
+// the products are added to the category, or removed from it when remove is true
+func AssignCategory(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "assignCategory"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 60) {
+		return
+	}
+
+	var payload assignCategoryPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.CategoryId < 1 || len(payload.ProductIds) == 0 || len(payload.ProductIds) > maxAssignedProducts {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	changed, err := catalog.AssignCategory(ctx, queries, payload.CategoryId, payload.ProductIds, payload.Remove)
+	if err != nil {
+		abortCategoryError(c, &currentRoute, ctx, err)
+		return
+	}
+	invalidateCategoryTree(ctx)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "changed": changed})
+}
@@ -0,0 +1,16 @@
+package route
+
+import (
+	"context"
+	"kamal/config"
+	_db "kamal/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestContext returns the request's context with the deadline configured for the route,
+// it is canceled as soon as the client disconnects. It also tracks the request's writes so
+// the reads that follow them stay on the primary database.
+func requestContext(c *gin.Context, routeName string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(_db.WithSession(c.Request.Context()), config.Route(routeName).Timeout)
+}
@@ -0,0 +1,379 @@
+package route
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kamal/catalog"
+	"kamal/config"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+	"kamal/redis"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+)
+
+// key of the copy of t_currencies cached in Redis, dropped by InvalidateRates
+const currencyRatesKey = "currencyRates"
+
+// BaseCurrencyCode is the currency the prices are stored in, CURRENCY_BASE or else FEED_CURRENCY or USD
+func BaseCurrencyCode() string {
+	for _, key := range []string{"CURRENCY_BASE", "FEED_CURRENCY"} {
+		if code := strings.ToUpper(strings.TrimSpace(config.Get(key))); code != "" {
+			return code
+		}
+	}
+	return "USD"
+}
+
+func userCurrencyKey(userId int) string {
+	return "userCurrency-" + strconv.Itoa(userId)
+}
+
+// loadRates returns the supported currencies, cached in Redis for a minute
+func loadRates(ctx context.Context, queries *_db.Queries) (*catalog.Rates, error) {
+	base := BaseCurrencyCode()
+	redisKeyName := currencyRatesKey
+	if exist, val := redis.GetKey(ctx, &redisKeyName); exist {
+		var currencies []catalog.Currency
+		if err := json.Unmarshal(val, &currencies); err == nil {
+			return catalog.NewRates(base, currencies), nil
+		}
+	}
+
+	rates, err := catalog.LoadRates(ctx, queries, base)
+	if err != nil {
+		return nil, err
+	}
+	if val, err := json.Marshal(rates.List()); err == nil {
+		redis.SetKey(ctx, redisKeyName, val, 60)
+	}
+	return rates, nil
+}
+
+// InvalidateRates drops the cached rates, call it after every change to t_currencies
+func InvalidateRates(ctx context.Context) {
+	redis.DelKey(ctx, currencyRatesKey)
+}
+
+// userCurrency returns the currency the user chose, cached in Redis for an hour, empty when none
+func userCurrency(ctx context.Context, queries *_db.Queries, userId int) string {
+	redisKeyName := userCurrencyKey(userId)
+	if exist, val := redis.GetKey(ctx, &redisKeyName); exist {
+		return string(val)
+	}
+	code, err := catalog.UserCurrency(ctx, queries, userId)
+	if err != nil {
+		print.Str(err.Error())
+		return ""
+	}
+	redis.SetKey(ctx, redisKeyName, []byte(code), 60*60)
+	return code
+}
+
+// acceptCurrencies reads an Accept-Currency header like "EUR, GBP;q=0.5", the codes by preference
+func acceptCurrencies(header string) []string {
+	type accepted struct {
+		code    string
+		quality float64
+	}
+	var list []accepted
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		code := strings.TrimSpace(params[0])
+		if code == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.TrimSpace(name) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			list = append(list, accepted{code, quality})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].quality > list[j].quality })
+
+	codes := make([]string, len(list))
+	for i, item := range list {
+		codes[i] = item.code
+	}
+	return codes
+}
+
+// responseCurrency picks the currency of the prices sent: the first supported one of the Accept-Currency
+// header, else the one the logged in user chose, else the base currency. A failure falls back to the base one.
+func responseCurrency(c *gin.Context, ctx context.Context, JWTSECRET string, queries *_db.Queries) catalog.Currency {
+	base := catalog.BaseCurrency(BaseCurrencyCode())
+
+	codes := acceptCurrencies(c.GetHeader("Accept-Currency"))
+	if userId, code := tokenUserId(c, JWTSECRET); code == "" {
+		if preferred := userCurrency(ctx, queries, userId); preferred != "" {
+			codes = append(codes, preferred)
+		}
+	}
+	if len(codes) == 0 {
+		return base
+	}
+
+	rates, err := loadRates(ctx, queries)
+	if err != nil {
+		print.Str(err.Error())
+		return base
+	}
+	for _, code := range codes {
+		if currency, ok := rates.Lookup(code); ok {
+			return currency
+		}
+	}
+	return base
+}
+
+// currencyETag is the ETag of a product sent in another currency than the base one, it changes with the rate
+func currencyETag(etag string, currency catalog.Currency) string {
+	sum := sha256.Sum256([]byte(etag + currency.Code + currency.Rate + strconv.Itoa(currency.Decimals)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func convertJSONB(document *pgtype.JSONB, currency catalog.Currency) {
+	if document.Status == pgtype.Present {
+		document.Bytes = currency.ConvertPriceDocument(document.Bytes)
+	}
+}
+
+func convertProductData(data *getProductDataDB, currency catalog.Currency) {
+	data.Currency = currency.Code
+	if currency.IsBase() {
+		return
+	}
+	data.MinPrice = currency.Convert(data.MinPrice)
+	data.MaxPrice = currency.Convert(data.MaxPrice)
+	data.MinPriceAfterDiscount = currency.Convert(data.MinPriceAfterDiscount)
+	data.MaxPriceAfterDiscount = currency.Convert(data.MaxPriceAfterDiscount)
+	convertJSONB(&data.PriceListData, currency)
+	convertJSONB(&data.Shipping, currency)
+}
+
+func convertUserCart(cart []UserCart, currency catalog.Currency) {
+	if currency.IsBase() {
+		return
+	}
+	for i := range cart {
+		item := &cart[i]
+		item.SelectedPrice = currency.Convert(item.SelectedPrice)
+		item.SelectedShippingPrice = currency.Convert(item.SelectedShippingPrice)
+		item.MinPrice = currency.Convert(item.MinPrice)
+		item.MaxPrice = currency.Convert(item.MaxPrice)
+		convertJSONB(&item.SelectedShippingDetails, currency)
+		convertJSONB(&item.PriceListData, currency)
+	}
+}
+
+func convertWishListData(items []WishListData, currency catalog.Currency) {
+	if currency.IsBase() {
+		return
+	}
+	for i := range items {
+		items[i].MinPrice = currency.Convert(items[i].MinPrice)
+		items[i].MaxPrice = currency.Convert(items[i].MaxPrice)
+	}
+}
+
+// convertCards converts the prices of the cards of a listing
+func convertCards(cards []catalog.ProductCard, currency catalog.Currency) {
+	if currency.IsBase() {
+		return
+	}
+	for i := range cards {
+		card := &cards[i]
+		card.MinPrice = currency.Convert(card.MinPrice)
+		card.MaxPrice = currency.Convert(card.MaxPrice)
+		card.MinPriceAfterDiscount = currency.Convert(card.MinPriceAfterDiscount)
+		card.MaxPriceAfterDiscount = currency.Convert(card.MaxPriceAfterDiscount)
+	}
+}
+
+// baseFilter converts minPrice and maxPrice, asked in the currency of the response, to the base currency
+// they are compared to. The priceBucket keys stay ranges of the base currency.
+func baseFilter(filter *catalog.ProductFilter, currency catalog.Currency) {
+	for _, bound := range []*catalog.Price{filter.MinPrice, filter.MaxPrice} {
+		if bound == nil {
+			continue
+		}
+		if price, ok := currency.Base(*bound); ok {
+			*bound = price
+		}
+	}
+}
+
+// GetCurrencies answers GET /currencies with the currencies prices can be sent in, the base one first
+func GetCurrencies(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "getCurrencies"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	rates, err := loadRates(ctx, queries)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "base": rates.Base.Code, "data": rates.List()})
+}
+
+// GetCurrencyPreference answers GET /currencyPreference with the currency the user chose, empty when none
+func GetCurrencyPreference(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "getCurrencyPreference"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	code, err := catalog.UserCurrency(ctx, queries, userId)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "currency": code})
+}
+
+type setCurrencyPreferencePayload struct {
+	Currency *string `json:"currency"`
+}
+
+// SetCurrencyPreference answers POST /currencyPreference {currency}, the prices are then sent in that
+// currency when the request has no Accept-Currency. An empty currency goes back to the base one.
+func SetCurrencyPreference(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "setCurrencyPreference"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 20)
+	if !ok {
+		return
+	}
+
+	var payload setCurrencyPreferencePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Currency == nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.SetUserCurrency(ctx, queries, userId, BaseCurrencyCode(), *payload.Currency); err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrInvalidCurrency || err == catalog.ErrUnknownCurrency {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+	redis.DelKey(ctx, userCurrencyKey(userId))
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "currency": strings.ToUpper(strings.TrimSpace(*payload.Currency))})
+}
+
+type setCurrencyRatesPayload struct {
+	Rates []catalog.RateInput `json:"rates"`
+}
+
+// SetCurrencyRates answers POST /admin/currencyRates {rates: [{code, rate, decimals}]}, it adds or
+// updates the currencies. Nothing is written when one of them is invalid, errors lists them.
+func SetCurrencyRates(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "setCurrencyRates"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 30) {
+		return
+	}
+
+	var payload setCurrencyRatesPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || len(payload.Rates) == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	rateErrors, err := catalog.SetRates(ctx, queries, BaseCurrencyCode(), payload.Rates)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+	if len(rateErrors) > 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "Invalid rates", "errors": rateErrors}, true)
+		return
+	}
+	InvalidateRates(ctx)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "updated": len(payload.Rates)})
+}
+
+// DeleteCurrencyRate answers DELETE /admin/currencyRates?code=, the currency is no longer supported
+func DeleteCurrencyRate(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "deleteCurrencyRate"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 30) {
+		return
+	}
+
+	if err := catalog.DeleteCurrency(ctx, queries, c.Query("code")); err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrUnknownCurrency {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+	InvalidateRates(ctx)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+func convertUserWishList(userWishList *UserWishListNames, currency catalog.Currency) {
+	userWishList.Currency = currency.Code
+	for _, items := range userWishList.WishListData {
+		convertWishListData(items, currency)
+	}
+}
@@ -0,0 +1,89 @@
+package route
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kamal/catalog"
+	"kamal/config"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+var feedContentTypes = map[string]string{
+	catalog.FeedXML:  "application/xml; charset=utf-8",
+	catalog.FeedCSV:  "text/csv; charset=utf-8",
+	catalog.FeedJSON: "application/json; charset=utf-8",
+}
+
+// FeedOptions returns the options of an export with the shop settings of .env:
+// FEED_CURRENCY (USD by default), FEED_PRODUCT_URL (e.g. https://shop.com/product/{id}), FEED_TITLE and FEED_LINK
+func FeedOptions(format string, since time.Time) catalog.FeedOptions {
+	currency := config.Get("FEED_CURRENCY")
+	if currency == "" {
+		currency = "USD"
+	}
+	return catalog.FeedOptions{
+		Format:     format,
+		Since:      since,
+		Currency:   currency,
+		ProductURL: config.Get("FEED_PRODUCT_URL"),
+		Title:      config.Get("FEED_TITLE"),
+		Link:       config.Get("FEED_LINK"),
+	}
+}
+
+// ExportFeed answers GET /feed?format=xml|csv|json&since= with the catalog feed, written as it is read.
+// Shopping sites authenticate with FEED_TOKEN in the X-Feed-Token header or the token param, admins with their cookie.
+// The X-Feed-Generated-At header is the since to send for the next incremental export.
+func ExportFeed(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "exportFeed"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+
+	token := c.GetHeader("X-Feed-Token")
+	if token == "" {
+		token = c.Query("token")
+	}
+	feedToken := config.Get("FEED_TOKEN")
+	if feedToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(feedToken)) == 1 {
+		ip := c.ClientIP()
+		currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+		if currentRate >= 10 {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+			return
+		}
+		limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+	} else if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 10) {
+		return
+	}
+
+	format := c.DefaultQuery("format", catalog.FeedXML)
+	contentType, ok := feedContentTypes[format]
+	if !ok {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": catalog.ErrInvalidFeed.Error()}, true)
+		return
+	}
+	since, err := catalog.ParseSince(c.Query("since"))
+	if err != nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("X-Feed-Generated-At", strconv.FormatInt(time.Now().Unix(), 10))
+	c.Status(http.StatusOK)
+
+	// the status is sent with the first bytes, an error after that can only cut the feed short
+	count, err := catalog.WriteFeed(ctx, queries, c.Writer, FeedOptions(format, since))
+	if err != nil {
+		print.Str("Feed export stopped after", count, "products:", err)
+	}
+	c.Abort()
+}
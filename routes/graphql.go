@@ -0,0 +1,399 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"kamal/catalog"
+	"kamal/config"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/graphql"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	// most products asked at once by products(ids:)
+	maxGraphqlProducts = 100
+	// items loaded for every wishlist, Wishlist.items(first:) returns some of them
+	maxGraphqlWishlistItems = 20
+	// largest request body accepted by POST /graphql
+	maxGraphqlBody = 64 << 10
+)
+
+var errGraphqlInternal = errors.New("Something wrong!")
+
+type graphqlStateKey struct{}
+
+// graphqlState is what the resolvers of a request share, it is stored in the context of the request
+type graphqlState struct {
+	queries *_db.Queries
+	// userId is the logged in user, 0 for a visitor
+	userId   int
+	products *graphql.Loader
+	// currency is the one of the prices sent, see responseCurrency
+	currency catalog.Currency
+}
+
+// withGraphqlState returns ctx with the state of a request of the user, 0 for a visitor
+func withGraphqlState(ctx context.Context, queries *_db.Queries, userId int, currency catalog.Currency) context.Context {
+	state := &graphqlState{queries: queries, userId: userId, currency: currency}
+	state.products = graphql.NewLoader(ctx, loadProducts(queries, currency))
+	return context.WithValue(ctx, graphqlStateKey{}, state)
+}
+
+func stateOf(ctx context.Context) *graphqlState {
+	return ctx.Value(graphqlStateKey{}).(*graphqlState)
+}
+
+// internalError logs the error of a resolver and hides it from the response
+func internalError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	print.Str(err.Error())
+	return errGraphqlInternal
+}
+
+// loadProducts is the BatchFunc of the products of a request, they are asked by productId
+func loadProducts(queries *_db.Queries, currency catalog.Currency) graphql.BatchFunc {
+	return func(ctx context.Context, keys []int64) (map[int64]interface{}, error) {
+		rows, err := queries.Read(ctx, _db.GetProductDataByIds).QueryContext(ctx, pq.Array(keys))
+		if err != nil {
+			return nil, internalError(ctx, err)
+		}
+		defer rows.Close()
+
+		products := make(map[int64]interface{}, len(keys))
+		for rows.Next() {
+			var data getProductDataDB
+			if err := scanProductData(rows, &data); err != nil {
+				return nil, internalError(ctx, err)
+			}
+			convertProductData(&data, currency)
+			signProductImages(&data)
+			products[int64(data.ProductId)] = &data
+		}
+		if err := rows.Err(); err != nil {
+			return nil, internalError(ctx, err)
+		}
+		return products, nil
+	}
+}
+
+// loadProduct resolves the product of the productId read by id from the source
+func loadProduct(id func(source interface{}) int) graphql.ResolveFunc {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return stateOf(p.Context).products.Load(int64(id(p.Source))), nil
+	}
+}
+
+type graphqlUser struct {
+	Id int `json:"id"`
+}
+
+type graphqlWishlist struct {
+	Id    int            `json:"id"`
+	Name  string         `json:"name"`
+	Items []WishListData `json:"items"`
+}
+
+func resolveMe(p graphql.ResolveParams) (interface{}, error) {
+	userId := stateOf(p.Context).userId
+	if userId == 0 {
+		return nil, nil
+	}
+	return &graphqlUser{Id: userId}, nil
+}
+
+func resolveEmail(p graphql.ResolveParams) (interface{}, error) {
+	state := stateOf(p.Context)
+	var userData UserData
+	if err := state.queries.Stmt(_db.GetUserData).QueryRowContext(p.Context, state.userId).Scan(&userData.Email); err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	return userData.Email, nil
+}
+
+// resolveCart reads the cart like GetUserData
+func resolveCart(p graphql.ResolveParams) (interface{}, error) {
+	state := stateOf(p.Context)
+	rows, err := state.queries.Stmt(_db.GetUserCartData).QueryContext(p.Context, state.userId)
+	if err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	defer rows.Close()
+
+	items := []UserCart{}
+	for rows.Next() {
+		var userCart UserCart
+		if err := rows.Scan(&userCart.Title,
+			&userCart.CartId,
+			&userCart.ProductId,
+			&userCart.LongProductId,
+			&userCart.CartName,
+			&userCart.SelectedImageUrl,
+			&userCart.SelectedPrice,
+			&userCart.SelectedQuantity,
+			&userCart.SelectedDiscount,
+			&userCart.SelectedProperties,
+			&userCart.SelectedShippingDetails,
+			&userCart.SelectedShippingPrice,
+			&userCart.MinPrice,
+			&userCart.MaxPrice,
+			&userCart.MultiUnitName,
+			&userCart.OddUnitName,
+			&userCart.MaxPurchaseLimit,
+			&userCart.BuyLimitText,
+			&userCart.QuantityAvaliable,
+			&userCart.PriceListInNames,
+			&userCart.PriceListInNumbers,
+			&userCart.PriceListData,
+			&userCart.SkuId); err != nil {
+			return nil, internalError(p.Context, err)
+		}
+		items = append(items, userCart)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	convertUserCart(items, state.currency)
+	signCartImages(items)
+	return items, nil
+}
+
+// resolveWishlists reads every list of the user with its newest items in one query, like GetWishlist
+func resolveWishlists(p graphql.ResolveParams) (interface{}, error) {
+	state := stateOf(p.Context)
+	rows, err := state.queries.Stmt(_db.GetUserWishListsTopItems).QueryContext(p.Context, state.userId, maxGraphqlWishlistItems)
+	if err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	defer rows.Close()
+
+	wishlists := []graphqlWishlist{}
+	for rows.Next() {
+		var wishlist graphqlWishlist
+		var items []byte
+		if err := rows.Scan(&wishlist.Id, &wishlist.Name, &items); err != nil {
+			return nil, internalError(p.Context, err)
+		}
+		if err := json.Unmarshal(items, &wishlist.Items); err != nil {
+			return nil, internalError(p.Context, err)
+		}
+		convertWishListData(wishlist.Items, state.currency)
+		signWishListImages(wishlist.Items)
+		wishlists = append(wishlists, wishlist)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	return wishlists, nil
+}
+
+func intArg(args map[string]interface{}, name string) int {
+	n, _ := args[name].(int)
+	return n
+}
+
+func newShopSchema() *graphql.Schema {
+	priceList := &graphql.Object{Name: "PriceList", Fields: map[string]*graphql.FieldDef{
+		"inNames":   {Type: graphql.JSON, Resolve: graphql.FieldOf("priceList_InNames")},
+		"inNumbers": {Type: graphql.JSON, Resolve: graphql.FieldOf("priceList_InNumbers")},
+		"data":      {Type: graphql.JSON, Resolve: graphql.FieldOf("priceList_Data")},
+	}}
+
+	// Product is the product page of getProductData, its price list is the same row
+	product := &graphql.Object{Name: "Product", Fields: map[string]*graphql.FieldDef{
+		"id":                    {Type: &graphql.NonNull{Of: graphql.Int}, Resolve: graphql.FieldOf("productId")},
+		"longProductId":         {Type: &graphql.NonNull{Of: graphql.String}, Resolve: graphql.FieldOf("longProductId")},
+		"display":               {Type: &graphql.NonNull{Of: graphql.Boolean}, Resolve: graphql.FieldOf("_display")},
+		"link":                  {Type: graphql.String, Resolve: graphql.FieldOf("link")},
+		"title":                 {Type: graphql.String, Resolve: graphql.FieldOf("title")},
+		"minPrice":              {Type: graphql.Float, Resolve: graphql.FieldOf("minPrice")},
+		"maxPrice":              {Type: graphql.Float, Resolve: graphql.FieldOf("maxPrice")},
+		"discount":              {Type: graphql.String, Resolve: graphql.FieldOf("discount")},
+		"discountNumber":        {Type: graphql.Float, Resolve: graphql.FieldOf("discountNumber")},
+		"minPriceAfterDiscount": {Type: graphql.Float, Resolve: graphql.FieldOf("minPrice_AfterDiscount")},
+		"maxPriceAfterDiscount": {Type: graphql.Float, Resolve: graphql.FieldOf("maxPrice_AfterDiscount")},
+		"multiUnitName":         {Type: graphql.String, Resolve: graphql.FieldOf("multiUnitName")},
+		"oddUnitName":           {Type: graphql.String, Resolve: graphql.FieldOf("oddUnitName")},
+		"maxPurchaseLimit":      {Type: graphql.Int, Resolve: graphql.FieldOf("maxPurchaseLimit")},
+		"buyLimitText":          {Type: graphql.String, Resolve: graphql.FieldOf("buyLimitText")},
+		"quantityAvaliable":     {Type: graphql.Int, Resolve: graphql.FieldOf("quantityAvaliable")},
+		"comingSoon":            {Type: &graphql.NonNull{Of: graphql.Boolean}, Resolve: graphql.FieldOf("comingSoon")},
+		"images":                {Type: graphql.JSON, Resolve: graphql.FieldOf("images")},
+		"imageSizes":            {Type: graphql.JSON, Resolve: graphql.FieldOf("imageSizes")},
+		"sizesColors":           {Type: graphql.JSON, Resolve: graphql.FieldOf("sizesColors")},
+		"specs":                 {Type: graphql.JSON, Resolve: graphql.FieldOf("specs")},
+		"shipping":              {Type: graphql.JSON, Resolve: graphql.FieldOf("shipping")},
+		"description":           {Type: graphql.String, Resolve: graphql.FieldOf("modified_description_content")},
+		"ratingAverage":         {Type: graphql.Float, Resolve: graphql.FieldOf("ratingAverage")},
+		"ratingCount":           {Type: graphql.Int, Resolve: graphql.FieldOf("ratingCount")},
+		"priceList": {Type: &graphql.NonNull{Of: priceList}, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source, nil
+		}},
+	}}
+
+	cartItem := &graphql.Object{Name: "CartItem", Fields: map[string]*graphql.FieldDef{
+		"id":                 {Type: &graphql.NonNull{Of: graphql.Int}, Resolve: graphql.FieldOf("cartId")},
+		"cartName":           {Type: graphql.String, Resolve: graphql.FieldOf("cartName")},
+		"title":              {Type: graphql.String, Resolve: graphql.FieldOf("title")},
+		"selectedImageUrl":   {Type: graphql.String, Resolve: graphql.FieldOf("selectedImageUrl")},
+		"thumbnail":          {Type: graphql.String, Resolve: graphql.FieldOf("thumbnail")},
+		"price":              {Type: graphql.Float, Resolve: graphql.FieldOf("selectedPrice")},
+		"quantity":           {Type: graphql.Int, Resolve: graphql.FieldOf("selectedQuantity")},
+		"discount":           {Type: graphql.Float, Resolve: graphql.FieldOf("selectedDiscount")},
+		"shippingPrice":      {Type: graphql.Float, Resolve: graphql.FieldOf("selectedShippingPrice")},
+		"selectedProperties": {Type: graphql.JSON, Resolve: graphql.FieldOf("selectedProperties")},
+		"shippingDetails":    {Type: graphql.JSON, Resolve: graphql.FieldOf("selectedShippingDetails")},
+		"skuId":              {Type: graphql.ID, Resolve: graphql.FieldOf("skuId")},
+		"product": {Type: product, Resolve: loadProduct(func(source interface{}) int {
+			return source.(UserCart).ProductId
+		})},
+	}}
+
+	cart := &graphql.Object{Name: "Cart", Fields: map[string]*graphql.FieldDef{
+		"items": {Type: &graphql.NonNull{Of: &graphql.List{Of: &graphql.NonNull{Of: cartItem}}}, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source, nil
+		}},
+		"count": {Type: &graphql.NonNull{Of: graphql.Int}, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return len(p.Source.([]UserCart)), nil
+		}},
+	}}
+
+	wishlistItem := &graphql.Object{Name: "WishlistItem", Fields: map[string]*graphql.FieldDef{
+		"id":               {Type: &graphql.NonNull{Of: graphql.Int}, Resolve: graphql.FieldOf("wishListId")},
+		"title":            {Type: graphql.String, Resolve: graphql.FieldOf("title")},
+		"selectedImageUrl": {Type: graphql.String, Resolve: graphql.FieldOf("selectedImageUrl")},
+		"thumbnail":        {Type: graphql.String, Resolve: graphql.FieldOf("thumbnail")},
+		"product": {Type: product, Resolve: loadProduct(func(source interface{}) int {
+			return source.(WishListData).ProductId
+		})},
+	}}
+
+	wishlist := &graphql.Object{Name: "Wishlist", Fields: map[string]*graphql.FieldDef{
+		"id":   {Type: &graphql.NonNull{Of: graphql.Int}, Resolve: graphql.FieldOf("id")},
+		"name": {Type: &graphql.NonNull{Of: graphql.String}, Resolve: graphql.FieldOf("name")},
+		"items": {
+			Type:       &graphql.NonNull{Of: &graphql.List{Of: &graphql.NonNull{Of: wishlistItem}}},
+			Args:       map[string]*graphql.ArgDef{"first": {Type: graphql.Int, Default: 5}},
+			Multiplier: func(args map[string]interface{}) int { return intArg(args, "first") },
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				first := intArg(p.Args, "first")
+				if first < 0 || first > maxGraphqlWishlistItems {
+					return nil, errors.New("first must be between 0 and 20")
+				}
+				items := p.Source.(graphqlWishlist).Items
+				if len(items) > first {
+					items = items[:first]
+				}
+				return items, nil
+			},
+		},
+	}}
+
+	user := &graphql.Object{Name: "User", Fields: map[string]*graphql.FieldDef{
+		"id":        {Type: &graphql.NonNull{Of: graphql.Int}, Resolve: graphql.FieldOf("id")},
+		"email":     {Type: graphql.String, Resolve: resolveEmail},
+		"cart":      {Type: &graphql.NonNull{Of: cart}, Resolve: resolveCart},
+		"wishlists": {Type: &graphql.NonNull{Of: &graphql.List{Of: &graphql.NonNull{Of: wishlist}}}, Resolve: resolveWishlists},
+	}}
+
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.FieldDef{
+		"product": {
+			Type: product,
+			Args: map[string]*graphql.ArgDef{"id": {Type: &graphql.NonNull{Of: graphql.Int}}},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return stateOf(p.Context).products.Load(int64(intArg(p.Args, "id"))), nil
+			},
+		},
+		"products": {
+			Type:       &graphql.NonNull{Of: &graphql.List{Of: product}},
+			Args:       map[string]*graphql.ArgDef{"ids": {Type: &graphql.NonNull{Of: &graphql.List{Of: &graphql.NonNull{Of: graphql.Int}}}}},
+			Multiplier: func(args map[string]interface{}) int { ids, _ := args["ids"].([]interface{}); return len(ids) },
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				ids := p.Args["ids"].([]interface{})
+				if len(ids) > maxGraphqlProducts {
+					return nil, errors.New("at most 100 products can be asked at once")
+				}
+				products := make([]graphql.Thunk, len(ids))
+				for i, id := range ids {
+					products[i] = stateOf(p.Context).products.Load(int64(id.(int)))
+				}
+				return products, nil
+			},
+		},
+		// me is null when the token cookie is missing or invalid
+		"me": {Type: user, Resolve: resolveMe},
+		// currency is the one of every price of the response
+		"currency": {Type: &graphql.NonNull{Of: graphql.String}, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return stateOf(p.Context).currency.Code, nil
+		}},
+	}}
+
+	return graphql.NewSchema(query, nil)
+}
+
+var shopSchema = newShopSchema()
+
+// GraphQL answers POST /graphql with a JSON body {query, operationName, variables} and
+// GET /graphql?query=&operationName=&variables=. The user is the one of the token cookie, like the other routes.
+func GraphQL(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "graphql"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	var req graphql.Request
+	if c.Request.Method == http.MethodGet {
+		req.Query = c.Query("query")
+		req.OperationName = c.Query("operationName")
+		if variables := c.Query("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+				return
+			}
+		}
+	} else {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxGraphqlBody)
+		if err := c.ShouldBindJSON(&req); err != nil {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+			return
+		}
+	}
+	if req.Query == "" {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "Required field are empty"}, true)
+		return
+	}
+
+	userId, _ := tokenUserId(c, JWTSECRET)
+	ctx = withGraphqlState(ctx, queries, userId, responseCurrency(c, ctx, JWTSECRET, queries))
+
+	response := shopSchema.Execute(ctx, req, graphql.Limits{
+		MaxDepth:      config.Int("GRAPHQL_MAX_DEPTH", 8),
+		MaxComplexity: config.Int("GRAPHQL_MAX_COMPLEXITY", 1000),
+	})
+	if _err.AbortIfCanceled(c, &currentRoute, ctx, ctx.Err()) {
+		return
+	}
+
+	status := http.StatusOK
+	if response.Data == nil {
+		status = http.StatusBadRequest
+	}
+	c.AbortWithStatusJSON(status, response)
+}
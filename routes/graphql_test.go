@@ -0,0 +1,149 @@
+package route
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	"kamal/graphql"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// newMockQueries prepares every statement on a sqlmock connection, the queries run on them are
+// expected in any order
+func newMockQueries(t *testing.T) (*_db.Queries, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for range _db.Statements() {
+		mock.ExpectPrepare(".")
+	}
+	queries, err := _db.NewQueries(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	return queries, mock
+}
+
+var productDataColumns = []string{"_display", "link", "minPrice", "maxPrice", "discountNumber", "discount",
+	"minPrice_AfterDiscount", "maxPrice_AfterDiscount", "multiUnitName", "oddUnitName", "maxPurchaseLimit",
+	"buyLimitText", "quantityAvaliable", "comingSoon", "id", "myProductId", "title", "images", "sizesColors",
+	"priceList_InNames", "priceList_InNumbers", "priceList_Data", "specs", "shipping",
+	"modified_description_content", "ratingAverage", "ratingCount"}
+
+// productRows is what GetProductDataByIds returns for the products
+func productRows(ids ...int) *sqlmock.Rows {
+	rows := sqlmock.NewRows(productDataColumns)
+	for _, id := range ids {
+		rows.AddRow(true, "link", "9.99", "19.99", 0.0, "", "9.99", "19.99", "", "", 5, "", 10, false,
+			id, id*100, "product", []byte(`[]`), []byte(`{}`), []byte(`[]`), []byte(`[]`), []byte(`{}`),
+			[]byte(`{}`), []byte(`{}`), "", 4.5, 2)
+	}
+	return rows
+}
+
+func executeGraphql(t *testing.T, ctx context.Context, query string) string {
+	t.Helper()
+	response := shopSchema.Execute(ctx, graphql.Request{Query: query}, graphql.Limits{})
+	if len(response.Errors) > 0 {
+		t.Fatalf("errors %+v", response.Errors[0])
+	}
+	data, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGraphqlLoadsProductsOncePerLevel(t *testing.T) {
+	queries, mock := newMockQueries(t)
+	// the products asked at the root are loaded together, the ones of the wishlists in one more query
+	mock.ExpectQuery(`t_productId\.id = ANY\(\$1\)`).WithArgs("{1,2}").WillReturnRows(productRows(1, 2))
+	mock.ExpectQuery("t_wishlist").WithArgs(7, maxGraphqlWishlistItems).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "wishlistname", "items"}).
+			AddRow(1, "first", []byte(`[{"wishListId": 1, "productId": 3}, {"wishListId": 2, "productId": 2}]`)).
+			AddRow(2, "second", []byte(`[{"wishListId": 3, "productId": 4}, {"wishListId": 4, "productId": 3}]`)))
+	mock.ExpectQuery(`t_productId\.id = ANY\(\$1\)`).WithArgs("{3,4}").WillReturnRows(productRows(3, 4))
+
+	ctx := withGraphqlState(context.Background(), queries, 7, catalog.BaseCurrency("USD"))
+	data := executeGraphql(t, ctx, `{
+		products(ids: [1, 2]) { id }
+		me { wishlists { items { product { id } } } }
+	}`)
+
+	want := `{"products":[{"id":1},{"id":2}],"me":{"wishlists":[` +
+		`{"items":[{"product":{"id":3}},{"product":{"id":2}}]},` +
+		`{"items":[{"product":{"id":4}},{"product":{"id":3}}]}]}}`
+	if data != want {
+		t.Fatalf("data is %s, want %s", data, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tokenContext is the context of a request with the token cookie, none when token is empty
+func tokenContext(token string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/graphql", nil)
+	if token != "" {
+		c.Request.AddCookie(&http.Cookie{Name: "token", Value: token})
+	}
+	return c
+}
+
+func signedToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestGraphqlMeFromTokenCookie(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const secret = "test secret"
+	tests := []struct {
+		name  string
+		token string
+		data  string
+		// email is the email GetUserData is expected to read, none when the user is not logged in
+		email driver.Value
+	}{
+		{"valid", signedToken(t, secret, jwt.MapClaims{"id": 7}), `{"me":{"id":7,"email":"user@shop.test"}}`, "user@shop.test"},
+		{"other secret", signedToken(t, "other secret", jwt.MapClaims{"id": 7}), `{"me":null}`, nil},
+		{"no id", signedToken(t, secret, jwt.MapClaims{"name": "user"}), `{"me":null}`, nil},
+		{"malformed", "not a token", `{"me":null}`, nil},
+		{"no cookie", "", `{"me":null}`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queries, mock := newMockQueries(t)
+			if test.email != nil {
+				mock.ExpectQuery(`from shop\.t_users WHERE id`).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow(test.email))
+			}
+
+			userId, _ := tokenUserId(tokenContext(test.token), secret)
+			ctx := withGraphqlState(context.Background(), queries, userId, catalog.BaseCurrency("USD"))
+			if data := executeGraphql(t, ctx, `{ me { id email } }`); data != test.data {
+				t.Fatalf("data is %s, want %s", data, test.data)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package route
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	_err "kamal/errors"
+	"kamal/images"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+)
+
+// signProductImages sets the /img URLs of every product image, in the order of Images. Like the currency
+// they are set on the copy being sent, so the cached products don't depend on IMG_SECRET.
+func signProductImages(data *getProductDataDB) {
+	var sources []string
+	if data.Images.Status == pgtype.Present {
+		json.Unmarshal(data.Images.Bytes, &sources)
+	}
+	data.ImageSizes = make([]images.Sizes, len(sources))
+	for i, src := range sources {
+		data.ImageSizes[i] = images.URLs(src)
+	}
+}
+
+// signedETag is the ETag of a product with the /img URLs set by signProductImages, etag is the one of the
+// cached product that has none. It changes with the key and the presets the URLs are signed with.
+func signedETag(etag string) string {
+	sum := sha256.Sum256([]byte(etag + images.SigningTag()))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// signWishListImages sets the card sized /img URL of the image picked for every item
+func signWishListImages(items []WishListData) {
+	for i := range items {
+		items[i].Thumbnail = images.URL(items[i].SelectedImageUrl, "card", "")
+	}
+}
+
+func signUserWishListImages(userWishList *UserWishListNames) {
+	for _, items := range userWishList.WishListData {
+		signWishListImages(items)
+	}
+}
+
+// signCartImages sets the card sized /img URL of the image picked for every item
+func signCartImages(items []UserCart) {
+	for i := range items {
+		items[i].Thumbnail = images.URL(items[i].SelectedImageUrl, "card", "")
+	}
+}
+
+// imageFormat is the format asked by f, else the best one the client accepts
+func imageFormat(c *gin.Context) string {
+	if format := c.Query("f"); format != "" {
+		return format
+	}
+	c.Header("Vary", "Accept")
+	if strings.Contains(c.GetHeader("Accept"), "image/webp") {
+		return images.FormatWebP
+	}
+	return images.FormatJPEG
+}
+
+// ServeImage answers GET /img?src=&p=thumb|card|medium|large&f=jpeg|png|webp&s= with the source image resized to
+// the preset, s is the signature made by images.URL. Without f the format follows the Accept header.
+func ServeImage(c *gin.Context, proxy *images.Proxy) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "serveImage"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 600 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	src, preset := c.Query("src"), c.Query("p")
+	if !images.Verify(src, preset, c.Query("f"), c.Query("s")) {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusForbidden, gin.H{"error": true, "success": false, "code": "invalid signature"}, true)
+		return
+	}
+
+	img, err := proxy.Get(ctx, src, preset, imageFormat(c))
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		switch err {
+		case images.ErrUnknownPreset, images.ErrUnknownFormat, images.ErrInvalidSource, images.ErrPrivateSource:
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+		case images.ErrSourceFetch, images.ErrSourceTooLarge, images.ErrNotImage:
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadGateway, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+		default:
+			print.Str(err.Error())
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		}
+		return
+	}
+
+	c.Header("ETag", img.ETag)
+	c.Header("Cache-Control", "public, max-age=604800")
+	if img.Matches(c.GetHeader("If-None-Match")) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, img.ContentType, img.Data)
+	c.Abort()
+}
@@ -0,0 +1,71 @@
+package route
+
+import (
+	"errors"
+	"net/http"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxReportedErrors bounds the row errors sent back by ImportProducts, the report still counts all of them
+	maxReportedErrors = 1000
+	// maxImportBody is the largest file ImportProducts reads, bigger catalogs go through the import command
+	maxImportBody = 256 << 20
+)
+
+// ImportProducts answers POST /admin/importProducts?format=csv|jsonl&job=&dryRun=true with the file as
+// the request body. The body is read as it arrives, a job that was interrupted is resumed by sending
+// the same file with the same job again.
+func ImportProducts(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "importProducts"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 10) {
+		return
+	}
+
+	rowErrors := []catalog.RowError{}
+	opts := catalog.ImportOptions{
+		Format: c.Query("format"),
+		Job:    c.Query("job"),
+		DryRun: c.Query("dryRun") == "true",
+		OnError: func(rowErr catalog.RowError) {
+			if len(rowErrors) < maxReportedErrors {
+				rowErrors = append(rowErrors, rowErr)
+			}
+		},
+		OnBatch: func(productIds []int64) {
+			InvalidateProducts(ctx, productIds...)
+		},
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBody)
+	report, err := catalog.Import(ctx, queries, c.Request.Body, opts)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			// the batches read before the limit are committed, the report says how far the import went
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusRequestEntityTooLarge, gin.H{"error": true, "success": false, "code": "file too large", "report": report, "rowErrors": rowErrors}, true)
+			return
+		}
+		if err == catalog.ErrInvalidFormat || err == catalog.ErrInvalidJob {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		// what was committed before the error stays, the report says how far the import went
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusUnprocessableEntity, gin.H{"error": true, "success": false, "code": err.Error(), "report": report, "rowErrors": rowErrors}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "report": report, "rowErrors": rowErrors})
+}
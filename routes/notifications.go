@@ -0,0 +1,71 @@
+package route
+
+import (
+	"net/http"
+	"strconv"
+
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/notifications"
+	"kamal/print"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetNotifications answers GET /notifications?cursor=&limit= with the notifications of the user, newest first,
+// and the number of unread ones
+func GetNotifications(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "getNotifications"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	page, err := notifications.List(ctx, queries, userId, c.Query("cursor"), limit)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor, "unread": page.Unread})
+}
+
+type readNotificationsPayload struct {
+	Ids []int64 `json:"ids"`
+}
+
+// ReadNotifications answers POST /readNotifications {ids}, without ids every notification of the user is marked as read
+func ReadNotifications(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "readNotifications"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	var payload readNotificationsPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || len(payload.Ids) > notifications.MaxLimit {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	changed, err := notifications.MarkRead(ctx, queries, userId, payload.Ids)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "read": changed})
+}
@@ -0,0 +1,123 @@
+package route
+
+import (
+	"net/http"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PriceHistory answers GET /priceHistory?productId=&since=&limit= with the price series of the product,
+// oldest first. since is unix seconds, the point in effect at since comes first.
+func PriceHistory(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "priceHistory"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 120 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	productId, ok := positiveQuery(c, &currentRoute, "productId", 0)
+	if !ok {
+		return
+	}
+	since, ok := positiveQuery(c, &currentRoute, "since", 0)
+	if !ok {
+		return
+	}
+	limit, ok := positiveQuery(c, &currentRoute, "limit", catalog.MaxHistoryLimit)
+	if !ok {
+		return
+	}
+	if productId == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "productId is invalid"}, true)
+		return
+	}
+
+	points, err := catalog.PriceHistory(ctx, queries, int(productId), since, int(limit))
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrProductNotFound {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": points})
+}
+
+// GetPriceAlertSettings answers GET /priceAlertSettings with the drop in percent the user is notified of
+// for wishlisted products, 0 when the alerts are off
+func GetPriceAlertSettings(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "getPriceAlertSettings"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	threshold, err := catalog.PriceAlertThreshold(ctx, queries, userId)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "thresholdPercent": threshold})
+}
+
+type priceAlertSettingsPayload struct {
+	ThresholdPercent *int `json:"thresholdPercent"`
+}
+
+// SetPriceAlertSettings answers POST /priceAlertSettings {thresholdPercent}, 0 turns the alerts off
+func SetPriceAlertSettings(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "setPriceAlertSettings"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 30)
+	if !ok {
+		return
+	}
+
+	var payload priceAlertSettingsPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ThresholdPercent == nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	err := catalog.SetPriceAlertThreshold(ctx, queries, userId, *payload.ThresholdPercent)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrInvalidThreshold {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "thresholdPercent": *payload.ThresholdPercent})
+}
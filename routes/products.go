@@ -0,0 +1,121 @@
+package route
+
+import (
+	"net/http"
+	"strconv"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListProducts answers GET /products?minPrice=&maxPrice=&discount=&comingSoon=&category=&sort=&cursor=&limit=
+// and the multi-select facets color=&size=&shipsFrom=&priceBucket=&discountBand=. The prices of the cards,
+// and minPrice and maxPrice, are in the currency of responseCurrency, the priceBucket keys in the base one.
+func ListProducts(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "listProducts"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	req, ok := parseListRequest(c, &currentRoute, catalog.SortNewest)
+	if !ok {
+		return
+	}
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	baseFilter(&req.Filter, currency)
+
+	page, err := catalog.List(ctx, queries, req)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrInvalidCursor || err == catalog.ErrInvalidFilter {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	convertCards(page.Items, currency)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor, "facets": page.Facets, "currency": currency.Code})
+}
+
+// parseListRequest reads the filter, sort and pagination params shared by the listing routes,
+// it aborts the request and returns false when one of them is invalid
+func parseListRequest(c *gin.Context, currentRoute *string, defaultSort catalog.Sort) (catalog.ListRequest, bool) {
+	filter, err := catalog.ParseFilter(c.Request.URL.Query())
+	if err != nil {
+		_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+		return catalog.ListRequest{}, false
+	}
+	// hidden products are never listed publicly
+	display := true
+	filter.Display = &display
+
+	req := catalog.ListRequest{Filter: filter, Sort: catalog.Sort(c.DefaultQuery("sort", string(defaultSort))), Cursor: c.Query("cursor"), Limit: catalog.DefaultLimit}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > catalog.MaxLimit {
+			_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "limit must be between 1 and " + strconv.Itoa(catalog.MaxLimit)}, true)
+			return catalog.ListRequest{}, false
+		}
+		req.Limit = limit
+	}
+
+	return req, true
+}
+
+// SearchProducts answers GET /search?q= with the same filters, sorts and cursors as ListProducts,
+// plus sort=relevance which is the default. Quoted words are matched as a phrase.
+func SearchProducts(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "searchProducts"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	listReq, ok := parseListRequest(c, &currentRoute, catalog.SortRelevance)
+	if !ok {
+		return
+	}
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	baseFilter(&listReq.Filter, currency)
+
+	page, err := catalog.Search(ctx, queries, catalog.SearchRequest{ListRequest: listReq, Query: c.Query("q")})
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrInvalidCursor || err == catalog.ErrInvalidFilter || err == catalog.ErrInvalidQuery {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	convertCards(page.Items, currency)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor, "facets": page.Facets, "currency": currency.Code})
+}
@@ -0,0 +1,321 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kamal/config"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+	"kamal/redis"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// most products asked at once by getProductsData
+const maxProductsData = 50
+
+type getProductsDataPayload struct {
+	Ids []int64 `json:"ids"`
+}
+
+// GetProductsData answers POST /getProductsData {ids} with the getProductData of up to 50 products,
+// asked by their longProductId. data is keyed by id, a product that does not exist gets
+// {"error": true, "code": "Product not found!"} like getProductData. The cached products are read with
+// one MGET and the others with one query, they share the cache of getProductData. The prices are in currency.
+func GetProductsData(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "getProductsData"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	var payload getProductsDataPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+	if len(payload.Ids) == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "Required field are empty"}, true)
+		return
+	}
+
+	ids := make([]int64, 0, len(payload.Ids))
+	seen := make(map[int64]bool, len(payload.Ids))
+	for _, id := range payload.Ids {
+		if id <= 0 {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "ids are invalid"}, true)
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxProductsData {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "At most " + strconv.Itoa(maxProductsData) + " ids can be asked at once"}, true)
+		return
+	}
+
+	data := make(map[string]interface{}, len(ids))
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = productDataKey(id)
+	}
+	var misses []int64
+	for i, val := range redis.GetKeys(ctx, keys...) {
+		if val == nil {
+			misses = append(misses, ids[i])
+			continue
+		}
+		cached, err := decodeProductData(val)
+		if err != nil {
+			print.Str("Error decoding struct: ", err)
+			misses = append(misses, ids[i])
+			continue
+		}
+		data[strconv.FormatInt(ids[i], 10)] = &cached.Data
+	}
+
+	if len(misses) > 0 {
+		rows, err := queries.Read(ctx, _db.GetProductDataByLongIds).QueryContext(ctx, pq.Array(misses))
+		if err != nil {
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
+			print.Str(err.Error())
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+			return
+		}
+		defer rows.Close()
+
+		cache := make(map[string][]byte, len(misses))
+		for rows.Next() {
+			product := new(getProductDataDB)
+			if err := scanProductData(rows, product); err != nil {
+				if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+					return
+				}
+				print.Str(err.Error())
+				_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+				return
+			}
+			id := int64(product.LongProductId)
+			data[strconv.FormatInt(id, 10)] = product
+
+			if _, val, err := encodeProductData(product); err != nil {
+				print.Str("Error encoding struct: ", err)
+			} else {
+				cache[productDataKey(id)] = val
+			}
+		}
+		if err := rows.Err(); err != nil {
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
+			print.Str(err.Error())
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+			return
+		}
+
+		redis.SetKeys(ctx, cache, 20)
+	}
+
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	for _, id := range ids {
+		key := strconv.FormatInt(id, 10)
+		if product, ok := data[key].(*getProductDataDB); ok {
+			convertProductData(product, currency)
+			signProductImages(product)
+		} else {
+			data[key] = gin.H{"error": true, "code": "Product not found!"}
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": data, "currency": currency.Code})
+}
+
+// productDataCache is the copy of a product cached in Redis, ETag is the strong entity tag of Data
+type productDataCache struct {
+	ETag string
+	Data getProductDataDB
+}
+
+// productETag hashes the JSON of the cached product, the tag changes whenever one of its fields does.
+// The cached copy has no /img URLs, signedETag adds them before it is sent.
+func productETag(data *getProductDataDB) (string, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// encodeProductData returns the ETag of the product and the blob cached for it under productDataKey
+func encodeProductData(data *getProductDataDB) (string, []byte, error) {
+	etag, err := productETag(data)
+	if err != nil {
+		return "", nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(productDataCache{ETag: etag, Data: *data}); err != nil {
+		return "", nil, err
+	}
+	return etag, buf.Bytes(), nil
+}
+
+func decodeProductData(val []byte) (productDataCache, error) {
+	var cached productDataCache
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&cached); err != nil {
+		return cached, err
+	}
+	if cached.ETag == "" {
+		return cached, errors.New("cached product has no ETag")
+	}
+	return cached, nil
+}
+
+// loadProductData returns the product from Redis, or from the database and caches it for 20 seconds.
+// sql.ErrNoRows is returned when the product does not exist.
+func loadProductData(ctx context.Context, queries *_db.Queries, longProductId int64) (productDataCache, error) {
+	redisKeyName := productDataKey(longProductId)
+	if exist, val := redis.GetKey(ctx, &redisKeyName); exist {
+		cached, err := decodeProductData(val)
+		if err == nil {
+			print.Str("From Redis")
+			redis.IncreaseExpirationTime(ctx, redisKeyName, 20) // increase 20 seconds again
+			return cached, nil
+		}
+		print.Str("Error decoding struct: ", err)
+	}
+
+	print.Str("From Database")
+
+	var cached productDataCache
+	if err := scanProductData(queries.Read(ctx, _db.GetProductData).QueryRowContext(ctx, longProductId), &cached.Data); err != nil {
+		return cached, err
+	}
+	etag, val, err := encodeProductData(&cached.Data)
+	if err != nil {
+		return cached, err
+	}
+	cached.ETag = etag
+	redis.SetKey(ctx, redisKeyName, val, 20)
+	return cached, nil
+}
+
+// etagMatches tells if the If-None-Match header lists etag, the comparison is weak as RFC 7232 asks
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveProductData answers with the product page in the currency of the request, the rate limit of the
+// route is already applied. Every answer has the ETag of the product with its image URLs in that currency and the Cache-Control
+// of the route config, made private when the answer sets a cookie. A GET whose If-None-Match lists the ETag
+// gets 304 Not Modified.
+func serveProductData(c *gin.Context, ctx context.Context, currentRoute *string, JWTSECRET string, queries *_db.Queries, longProductId int64) {
+	cached, err := loadProductData(ctx, queries, longProductId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			_err.AbortRequestWithError(c, currentRoute, http.StatusNotFound, gin.H{"error": true, "code": "Product not found!"}, true)
+			return
+		}
+		if _err.AbortIfCanceled(c, currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "code": "Something wrong!"}, true)
+		return
+	}
+
+	if cached.Data.Display {
+		recordView(c, ctx, JWTSECRET, cached.Data.ProductId)
+	}
+
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	convertProductData(&cached.Data, currency)
+	signProductImages(&cached.Data)
+	etag := signedETag(cached.ETag)
+	if !currency.IsBase() {
+		etag = currencyETag(etag, currency)
+	}
+
+	// the currency comes from Accept-Currency or the preference of the user of the token cookie
+	c.Header("Vary", "Accept-Currency, Cookie")
+	c.Header("ETag", etag)
+	if cacheControl := config.Route(*currentRoute).CacheControl; cacheControl != "" {
+		// recordView may have given a new visitor its cookie, a shared cache must not hand it to others
+		if len(c.Writer.Header().Values("Set-Cookie")) > 0 {
+			cacheControl = privateCacheControl(cacheControl)
+		}
+		c.Header("Cache-Control", cacheControl)
+	}
+	if c.Request.Method == http.MethodGet && etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, &cached.Data)
+}
+
+// privateCacheControl returns cacheControl with public replaced by private, the other directives are kept
+func privateCacheControl(cacheControl string) string {
+	directives := []string{"private"}
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" || strings.EqualFold(directive, "public") || strings.EqualFold(directive, "private") {
+			continue
+		}
+		directives = append(directives, directive)
+	}
+	return strings.Join(directives, ", ")
+}
+
+// GetProduct answers GET /product/:id with the same product page as getProductData, id is the longProductId.
+// Unlike the POST route the answer can be cached by the browser and revalidated with If-None-Match.
+func GetProduct(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "getProduct"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 50 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60*5)
+
+	longProductId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || longProductId <= 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": "productId params not found or are of invalid type"}, true)
+		return
+	}
+
+	serveProductData(c, ctx, &currentRoute, JWTSECRET, queries, longProductId)
+}
@@ -0,0 +1,383 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"kamal/catalog"
+	"kamal/config"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// abortQuestionError answers the errors returned by the catalog question functions
+func abortQuestionError(c *gin.Context, currentRoute *string, ctx context.Context, err error) {
+	if _err.AbortIfCanceled(c, currentRoute, ctx, err) {
+		return
+	}
+	switch err {
+	case catalog.ErrQuestionNotFound, catalog.ErrAnswerNotFound, catalog.ErrProductNotFound:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case catalog.ErrOwnPost:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusForbidden, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case catalog.ErrInvalidQuestion, catalog.ErrInvalidStatus, catalog.ErrInvalidCursor, catalog.ErrInvalidFilter:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	default:
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+	}
+}
+
+// qaPremoderation tells if questions and answers wait for an admin, QA_PREMODERATION=true in .env
+func qaPremoderation() bool {
+	return config.Get("QA_PREMODERATION") == "true"
+}
+
+// positiveQuery reads an optional positive integer param, it aborts the request and returns false when it is invalid
+func positiveQuery(c *gin.Context, currentRoute *string, name string, max int64) (int64, bool) {
+	raw := c.Query(name)
+	if raw == "" {
+		return 0, true
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || value < 1 || (max > 0 && value > max) {
+		_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": name + " is invalid"}, true)
+		return 0, false
+	}
+	return value, true
+}
+
+// ListQuestions answers GET /questions?productId=&sort=newest|votes&cursor=&limit= with the approved
+// questions of a product, each with its first answers
+func ListQuestions(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "listQuestions"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	productId, ok := positiveQuery(c, &currentRoute, "productId", 0)
+	if !ok {
+		return
+	}
+	limit, ok := positiveQuery(c, &currentRoute, "limit", catalog.MaxLimit)
+	if !ok {
+		return
+	}
+	if productId == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "productId is invalid"}, true)
+		return
+	}
+
+	page, err := catalog.ListQuestions(ctx, queries, catalog.QuestionQuery{
+		ProductId: int(productId),
+		Status:    catalog.ReviewApproved,
+		Sort:      catalog.Sort(c.DefaultQuery("sort", string(catalog.SortQuestionNewest))),
+		Cursor:    c.Query("cursor"),
+		Limit:     int(limit),
+	})
+	if err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor})
+}
+
+// ListAnswers answers GET /answers?questionId=&cursor=&limit= with the approved answers of a question,
+// staff answers first then by upvotes
+func ListAnswers(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "listAnswers"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	questionId, ok := positiveQuery(c, &currentRoute, "questionId", 0)
+	if !ok {
+		return
+	}
+	limit, ok := positiveQuery(c, &currentRoute, "limit", catalog.MaxLimit)
+	if !ok {
+		return
+	}
+	if questionId == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "questionId is invalid"}, true)
+		return
+	}
+
+	page, err := catalog.ListAnswers(ctx, queries, catalog.AnswerQuery{QuestionId: questionId, Status: catalog.ReviewApproved, Cursor: c.Query("cursor"), Limit: int(limit)})
+	if err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor})
+}
+
+type askQuestionPayload struct {
+	ProductId int    `json:"productId"`
+	Body      string `json:"body"`
+}
+
+// AskQuestion answers POST /askQuestion {productId, body}
+func AskQuestion(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "askQuestion"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 10)
+	if !ok {
+		return
+	}
+
+	var payload askQuestionPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ProductId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	question, err := catalog.AskQuestion(ctx, queries, userId, payload.ProductId, payload.Body, qaPremoderation())
+	if err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": question})
+}
+
+type answerQuestionPayload struct {
+	QuestionId int64  `json:"questionId"`
+	Body       string `json:"body"`
+}
+
+// AnswerQuestion answers POST /answerQuestion {questionId, body}, the asker is notified once the answer is approved
+func AnswerQuestion(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "answerQuestion"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 20)
+	if !ok {
+		return
+	}
+
+	var payload answerQuestionPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.QuestionId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	answer, err := catalog.AnswerQuestion(ctx, queries, userId, payload.QuestionId, payload.Body, qaPremoderation())
+	if err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": answer})
+}
+
+type voteQAPayload struct {
+	QuestionId int64 `json:"questionId"`
+	AnswerId   int64 `json:"answerId"`
+	Up         bool  `json:"up"`
+}
+
+// voteQA is shared by VoteQuestion and VoteAnswer
+func voteQA(c *gin.Context, JWTSECRET string, queries *_db.Queries, currentRoute string, kind string) {
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	var payload voteQAPayload
+	err := c.ShouldBindJSON(&payload)
+	id := payload.QuestionId
+	if kind == catalog.VoteAnswer {
+		id = payload.AnswerId
+	}
+	if err != nil || id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	count, err := catalog.VoteQA(ctx, queries, userId, kind, id, payload.Up)
+	if err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "upvotes": count})
+}
+
+// VoteQuestion answers POST /voteQuestion {questionId, up}, up false takes the upvote back
+func VoteQuestion(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	voteQA(c, JWTSECRET, queries, "voteQuestion", catalog.VoteQuestion)
+}
+
+// VoteAnswer answers POST /voteAnswer {answerId, up}, up false takes the upvote back
+func VoteAnswer(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	voteQA(c, JWTSECRET, queries, "voteAnswer", catalog.VoteAnswer)
+}
+
+// DeleteQuestion answers DELETE /deleteQuestion {questionId}, users delete their own questions with their answers
+func DeleteQuestion(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "deleteQuestion"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 10)
+	if !ok {
+		return
+	}
+
+	var payload voteQAPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.QuestionId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.DeleteQuestion(ctx, queries, userId, payload.QuestionId); err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+// DeleteAnswer answers DELETE /deleteAnswer {answerId}, users delete their own answers
+func DeleteAnswer(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "deleteAnswer"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 10)
+	if !ok {
+		return
+	}
+
+	var payload voteQAPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.AnswerId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.DeleteAnswer(ctx, queries, userId, payload.AnswerId); err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+// ListModerationQuestions answers GET /admin/questions?kind=question|answer&status=pending&productId=&cursor=&limit=,
+// the questions, or the answers, of every product in one moderation state
+func ListModerationQuestions(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "listModerationQuestions"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	productId, ok := positiveQuery(c, &currentRoute, "productId", 0)
+	if !ok {
+		return
+	}
+	limit, ok := positiveQuery(c, &currentRoute, "limit", catalog.MaxLimit)
+	if !ok {
+		return
+	}
+	status := c.DefaultQuery("status", catalog.ReviewPending)
+
+	var data interface{}
+	var nextCursor string
+	switch c.DefaultQuery("kind", catalog.VoteQuestion) {
+	case catalog.VoteQuestion:
+		page, err := catalog.ListQuestions(ctx, queries, catalog.QuestionQuery{ProductId: int(productId), Status: status, Cursor: c.Query("cursor"), Limit: int(limit)})
+		if err != nil {
+			abortQuestionError(c, &currentRoute, ctx, err)
+			return
+		}
+		data, nextCursor = page.Items, page.NextCursor
+	case catalog.VoteAnswer:
+		page, err := catalog.ListAnswers(ctx, queries, catalog.AnswerQuery{Status: status, Cursor: c.Query("cursor"), Limit: int(limit)})
+		if err != nil {
+			abortQuestionError(c, &currentRoute, ctx, err)
+			return
+		}
+		data, nextCursor = page.Items, page.NextCursor
+	default:
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "kind must be question or answer"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": data, "nextCursor": nextCursor})
+}
+
+type moderateQAPayload struct {
+	QuestionId int64  `json:"questionId"`
+	AnswerId   int64  `json:"answerId"`
+	Status     string `json:"status"`
+}
+
+// ModerateQuestion answers POST /admin/moderateQuestion {questionId, status}, status is pending, approved or rejected
+func ModerateQuestion(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "moderateQuestion"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload moderateQAPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.QuestionId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.ModerateQuestion(ctx, queries, payload.QuestionId, payload.Status); err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+// ModerateAnswer answers POST /admin/moderateAnswer {answerId, status}, approving an answer notifies the asker
+func ModerateAnswer(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "moderateAnswer"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload moderateQAPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.AnswerId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	if err := catalog.ModerateAnswer(ctx, queries, payload.AnswerId, payload.Status); err != nil {
+		abortQuestionError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
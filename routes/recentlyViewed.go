@@ -0,0 +1,184 @@
+package route
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+	"kamal/redis"
+	myCookie "kamal/setCookie"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// recentlyViewedMax is how many products are kept in the history
+	recentlyViewedMax = 50
+	// the history of a user lasts 90 days after the last view, the one of a visitor as long as the visitor cookie
+	recentlyViewedUserTTL    = 90 * 24 * 60 * 60
+	recentlyViewedVisitorTTL = 30 * 24 * 60 * 60
+)
+
+func recentlyViewedUserKey(userId int) string {
+	return "recentlyViewed-user-" + strconv.Itoa(userId)
+}
+
+func recentlyViewedVisitorKey(visitorId string) string {
+	return "recentlyViewed-visitor-" + visitorId
+}
+
+// visitorId returns the id of the visitor cookie, empty when there is none or it was not made by newVisitorId
+func visitorId(c *gin.Context) string {
+	var cookieName = "visitor"
+	cookie := myCookie.CookieExist(c, &cookieName)
+	if !cookie.Exists || len(cookie.Value) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(cookie.Value); err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func newVisitorId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// recentlyViewedKey returns the history key of the logged in user or else of the visitor, with its expiration.
+// When create is true a visitor without cookie gets one, else the key is empty.
+func recentlyViewedKey(c *gin.Context, JWTSECRET string, create bool) (string, int) {
+	if userId, code := tokenUserId(c, JWTSECRET); code == "" {
+		return recentlyViewedUserKey(userId), recentlyViewedUserTTL
+	}
+	id := visitorId(c)
+	if id == "" && create {
+		var err error
+		if id, err = newVisitorId(); err != nil {
+			print.Str("Error creating visitor id:", err)
+			return "", 0
+		}
+		myCookie.SetVisitorCookie(c, id, recentlyViewedVisitorTTL)
+	}
+	if id == "" {
+		return "", 0
+	}
+	return recentlyViewedVisitorKey(id), recentlyViewedVisitorTTL
+}
+
+// recordView adds the product to the recently viewed products of the user or of the visitor,
+// a failure is only logged, it must not fail GetProductData
+func recordView(c *gin.Context, ctx context.Context, JWTSECRET string, productId int) {
+	key, ttl := recentlyViewedKey(c, JWTSECRET, true)
+	if key == "" {
+		return
+	}
+	if err := redis.PushRecent(ctx, key, strconv.Itoa(productId), float64(time.Now().UnixMilli()), recentlyViewedMax, ttl); err != nil {
+		print.Str("Error recording view:", err)
+	}
+}
+
+// mergeRecentlyViewed moves the history of the visitor into the one of the user who just logged in
+func mergeRecentlyViewed(c *gin.Context, ctx context.Context, userId int) {
+	id := visitorId(c)
+	if id == "" {
+		return
+	}
+	if err := redis.MergeRecent(ctx, recentlyViewedUserKey(userId), recentlyViewedVisitorKey(id), recentlyViewedMax, recentlyViewedUserTTL); err != nil {
+		print.Str("Error merging recently viewed:", err)
+	}
+}
+
+// GetRecentlyViewed answers GET /recentlyViewed?limit= with the cards of the products the user, or the visitor,
+// viewed last, most recent first
+func GetRecentlyViewed(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "getRecentlyViewed"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	limit, ok := positiveQuery(c, &currentRoute, "limit", recentlyViewedMax)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = catalog.DefaultLimit
+	}
+
+	cards := []catalog.ProductCard{}
+	if key, _ := recentlyViewedKey(c, JWTSECRET, false); key != "" {
+		members, err := redis.RecentMembers(ctx, key, int(limit))
+		if err != nil {
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
+			print.Str("Error reading recently viewed:", err)
+		}
+		ids := make([]int64, 0, len(members))
+		for _, member := range members {
+			if id, err := strconv.ParseInt(member, 10, 64); err == nil {
+				ids = append(ids, id)
+			}
+		}
+
+		if cards, err = catalog.CardsByIds(ctx, queries, ids); err != nil {
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
+			print.Str(err.Error())
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+			return
+		}
+	}
+
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	convertCards(cards, currency)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": cards, "currency": currency.Code})
+}
+
+// ClearRecentlyViewed answers DELETE /recentlyViewed, the history of the user and of the visitor cookie is deleted
+func ClearRecentlyViewed(c *gin.Context, JWTSECRET string) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "clearRecentlyViewed"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 10 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	var keys []string
+	if userId, code := tokenUserId(c, JWTSECRET); code == "" {
+		keys = append(keys, recentlyViewedUserKey(userId))
+	}
+	if id := visitorId(c); id != "" {
+		keys = append(keys, recentlyViewedVisitorKey(id))
+	}
+	if len(keys) > 0 && !redis.DelKey(ctx, keys...) {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
@@ -0,0 +1,87 @@
+package route
+
+import (
+	"net/http"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RelatedProducts answers GET /related?productId=&limit= with the products saved together with the product,
+// topped up with popular products. fallback is how many of the last ones are popular products.
+func RelatedProducts(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "relatedProducts"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 120 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	productId, ok := positiveQuery(c, &currentRoute, "productId", 0)
+	if !ok {
+		return
+	}
+	limit, ok := positiveQuery(c, &currentRoute, "limit", catalog.MaxLimit)
+	if !ok {
+		return
+	}
+	if productId == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "productId is invalid"}, true)
+		return
+	}
+
+	recs, err := catalog.Related(ctx, queries, int(productId), int(limit))
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	convertCards(recs.Items, currency)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": recs.Items, "fallback": recs.Fallback, "currency": currency.Code})
+}
+
+// Recommendations answers GET /recommendations?limit= with the products saved together with the ones in the
+// user's wishlists and cart, topped up with popular products
+func Recommendations(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "recommendations"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	limit, ok := positiveQuery(c, &currentRoute, "limit", catalog.MaxLimit)
+	if !ok {
+		return
+	}
+
+	recs, err := catalog.ForUser(ctx, queries, userId, int(limit))
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	convertCards(recs.Items, currency)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": recs.Items, "fallback": recs.Fallback, "currency": currency.Code})
+}
@@ -0,0 +1,234 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"kamal/catalog"
+	"kamal/config"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+// abortReviewError answers the errors returned by the catalog review functions
+func abortReviewError(c *gin.Context, currentRoute *string, ctx context.Context, err error) {
+	if _err.AbortIfCanceled(c, currentRoute, ctx, err) {
+		return
+	}
+	switch err {
+	case catalog.ErrReviewNotFound, catalog.ErrProductNotFound:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case catalog.ErrOwnReview:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusForbidden, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case catalog.ErrInvalidReview, catalog.ErrInvalidStatus, catalog.ErrInvalidCursor, catalog.ErrInvalidFilter:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	default:
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+	}
+}
+
+// reviewQuery reads productId=&rating=&sort=&cursor=&limit=, it aborts the request and returns false when one is invalid
+func reviewQuery(c *gin.Context, currentRoute *string) (catalog.ReviewQuery, bool) {
+	q := catalog.ReviewQuery{Sort: catalog.Sort(c.DefaultQuery("sort", string(catalog.SortReviewNewest))), Cursor: c.Query("cursor"), Limit: catalog.DefaultLimit}
+	for _, param := range []struct {
+		name string
+		dest *int
+		max  int
+	}{{"productId", &q.ProductId, 0}, {"rating", &q.Rating, 5}, {"limit", &q.Limit, catalog.MaxLimit}} {
+		raw := c.Query(param.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 1 || (param.max > 0 && value > param.max) {
+			_err.AbortRequestWithError(c, currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": param.name + " is invalid"}, true)
+			return q, false
+		}
+		*param.dest = value
+	}
+	return q, true
+}
+
+// ListReviews answers GET /reviews?productId=&rating=&sort=newest|oldest|helpful|rating_desc|rating_asc&cursor=&limit=
+// with the approved reviews of a product, the first page comes with the rating of the product
+func ListReviews(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "listReviews"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 60 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	q, ok := reviewQuery(c, &currentRoute)
+	if !ok {
+		return
+	}
+	if q.ProductId == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "productId is invalid"}, true)
+		return
+	}
+	q.Status = catalog.ReviewApproved
+
+	page, err := catalog.ListReviews(ctx, queries, q)
+	if err != nil {
+		abortReviewError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor, "rating": page.Rating})
+}
+
+type postReviewPayload struct {
+	ProductId int `json:"productId"`
+	catalog.ReviewInput
+}
+
+// PostReview answers POST /postReview {productId, rating, title, body}, posting again edits the review.
+// With REVIEWS_PREMODERATION=true in .env reviews wait for an admin before being listed.
+func PostReview(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "postReview"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 10)
+	if !ok {
+		return
+	}
+
+	var payload postReviewPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ProductId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	review, longProductId, err := catalog.PostReview(ctx, queries, userId, payload.ProductId, payload.ReviewInput, config.Get("REVIEWS_PREMODERATION") == "true")
+	if err != nil {
+		abortReviewError(c, &currentRoute, ctx, err)
+		return
+	}
+	// the cached product data holds the rating
+	InvalidateProducts(ctx, longProductId)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": review})
+}
+
+// DeleteReview answers DELETE /deleteReview {id} with the product id, the user's review of the product is deleted
+func DeleteReview(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "deleteReview"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 10)
+	if !ok {
+		return
+	}
+
+	var payload getProductDataPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Id < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	longProductId, err := catalog.DeleteReview(ctx, queries, userId, payload.Id)
+	if err != nil {
+		abortReviewError(c, &currentRoute, ctx, err)
+		return
+	}
+	InvalidateProducts(ctx, longProductId)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+type voteReviewPayload struct {
+	ReviewId int64 `json:"reviewId"`
+	Helpful  bool  `json:"helpful"`
+}
+
+// VoteReview answers POST /voteReview {reviewId, helpful}, helpful false takes the vote back
+func VoteReview(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "voteReview"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	var payload voteReviewPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ReviewId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	count, err := catalog.VoteReview(ctx, queries, userId, payload.ReviewId, payload.Helpful)
+	if err != nil {
+		abortReviewError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "helpfulCount": count})
+}
+
+// ListModerationReviews answers GET /admin/reviews?status=pending&productId=&sort=&cursor=&limit=,
+// the reviews of every product in one moderation state
+func ListModerationReviews(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "listModerationReviews"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	q, ok := reviewQuery(c, &currentRoute)
+	if !ok {
+		return
+	}
+	q.Status = c.DefaultQuery("status", catalog.ReviewPending)
+
+	page, err := catalog.ListReviews(ctx, queries, q)
+	if err != nil {
+		abortReviewError(c, &currentRoute, ctx, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": page.Items, "nextCursor": page.NextCursor})
+}
+
+type moderateReviewPayload struct {
+	ReviewId int64  `json:"reviewId"`
+	Status   string `json:"status"`
+}
+
+// ModerateReview answers POST /admin/moderateReview {reviewId, status}, status is pending, approved or rejected
+func ModerateReview(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "moderateReview"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	if !adminRoute(c, ctx, JWTSECRET, queries, &currentRoute, 120) {
+		return
+	}
+
+	var payload moderateReviewPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ReviewId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	longProductId, err := catalog.ModerateReview(ctx, queries, payload.ReviewId, payload.Status)
+	if err != nil {
+		abortReviewError(c, &currentRoute, ctx, err)
+		return
+	}
+	InvalidateProducts(ctx, longProductId)
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
@@ -13,8 +13,10 @@ import (
 	"strings"
 	"time"
 
+	"kamal/catalog"
 	_db "kamal/database"
 	_err "kamal/errors"
+	"kamal/images"
 	myCookie "kamal/setCookie"
 
 	"github.com/gin-contrib/sessions"
@@ -32,12 +34,12 @@ type getProductDataPayload struct {
 type getProductDataDB struct {
 	Display bool `json:"_display"`
 	Link string `json:"link"`
-	MinPrice float32 `json:"minPrice"`
-	MaxPrice float32 `json:"maxPrice"`
+	MinPrice catalog.Price `json:"minPrice"`
+	MaxPrice catalog.Price `json:"maxPrice"`
 	DiscountNumber float32 `json:"discountNumber"`
 	Discount string `json:"discount"`
-	MinPriceAfterDiscount float32 `json:"minPrice_AfterDiscount"`
-	MaxPriceAfterDiscount float32 `json:"maxPrice_AfterDiscount"`
+	MinPriceAfterDiscount catalog.Price `json:"minPrice_AfterDiscount"`
+	MaxPriceAfterDiscount catalog.Price `json:"maxPrice_AfterDiscount"`
 	MultiUnitName string `json:"multiUnitName"`
 	OddUnitName string `json:"oddUnitName"`
 	MaxPurchaseLimit int `json:"maxPurchaseLimit"`
@@ -55,49 +57,17 @@ type getProductDataDB struct {
 	Specs pgtype.JSONB `json:"specs"`
 	Shipping pgtype.JSONB `json:"shipping"`
 	ModifiedDescriptionContent string `json:"modified_description_content"`
+	RatingAverage float32 `json:"ratingAverage"`
+	RatingCount int `json:"ratingCount"`
+	// Currency is the currency of the prices sent, set by convertProductData
+	Currency string `json:"currency"`
+	// ImageSizes are the /img URLs of Images, set by signProductImages
+	ImageSizes []images.Sizes `json:"imageSizes"`
 }
 
-func GetProductData(c *gin.Context, queries *_db.Queries)  {
-	// rate limiter
-	ip := c.ClientIP()
-	var currentRoute = "getProductData"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
-	if currentRate >= 50 {
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": &remainingTime}, true)
-		return
-	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60 * 5)
-
-	var productId getProductDataPayload
-	if err := c.ShouldBindJSON(&productId); err != nil {
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true,"success": false, "code": "productId params not found or are of invalid type"}, true)
-		return
-	}
-
-	if productId.Id == 0 {
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true,"success": false, "code": "Required field are empty"}, true)
-		return
-	}
-
-	var data getProductDataDB
-
-	redisKeyName := "getProductData-" + strconv.Itoa(productId.Id)
-	exist, val := redis.GetKey(&redisKeyName)
-	if exist {
-		print.Str("From Redis")
-		dec := gob.NewDecoder(bytes.NewReader(val))
-		if err := dec.Decode(&data); err != nil {
-			print.Str("Error decoding struct: " , err)
-			return
-		}
-		redis.IncreaseExpirationTime(redisKeyName, 20) // increase 20 seconds again
-		c.AbortWithStatusJSON(http.StatusOK, &data)
-		return
-	}
-
-	print.Str("From Database")
-
-	err := queries.GetProductData.QueryRow(productId.Id).Scan(&data.Display,
+// scanProductData reads a row of GetProductData or GetProductDataByIds
+func scanProductData(row interface{ Scan(dest ...interface{}) error }, data *getProductDataDB) error {
+	return row.Scan(&data.Display,
 		&data.Link,
 		&data.MinPrice,
 		&data.MaxPrice,
@@ -121,30 +91,36 @@ func GetProductData(c *gin.Context, queries *_db.Queries)  {
 		&data.PriceListData,
 		&data.Specs,
 		&data.Shipping,
-		&data.ModifiedDescriptionContent)
+		&data.ModifiedDescriptionContent,
+		&data.RatingAverage,
+		&data.RatingCount)
+}
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true, "code": "Product not found!"}, true)
-			return
-		}
-		print.Str(err.Error())
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "code": "Something wrong!"}, true)
+func GetProductData(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "getProductData"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 50 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": &remainingTime}, true)
 		return
 	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60 * 5)
 
-	// redis
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(data); err != nil {
-		print.Str("Error encoding struct: " , err)
+	var productId getProductDataPayload
+	if err := c.ShouldBindJSON(&productId); err != nil {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true,"success": false, "code": "productId params not found or are of invalid type"}, true)
 		return
 	}
 
-	redis.SetKey(redisKeyName, buf.Bytes(), 20)
-
+	if productId.Id == 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true,"success": false, "code": "Required field are empty"}, true)
+		return
+	}
 
-	c.AbortWithStatusJSON(http.StatusOK, &data)
+	serveProductData(c, ctx, &currentRoute, JWTSECRET, queries, int64(productId.Id))
 }
 
 type signupPayload struct {
@@ -157,12 +133,14 @@ func Signup(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "signup"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 5 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": &remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var signup signupPayload
 	if err := c.ShouldBindJSON(&signup); err != nil {
@@ -176,8 +154,11 @@ func Signup(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	}
 
 	var emailAlreadyExist sql.NullString
-	err := queries.EmailAlreadyExist.QueryRow(signup.Email).Scan(&emailAlreadyExist)
+	err := queries.Stmt(_db.EmailAlreadyExist).QueryRowContext(ctx, signup.Email).Scan(&emailAlreadyExist)
 	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
 		// handle error
 		// do not write "return" here
 		print.Str(err.Error())
@@ -196,37 +177,22 @@ func Signup(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 
 		signup.HashedPassword = string(hashedPassword)
 
-		tx, err := queries.DB.Begin()
-		if err != nil {
-			print.Str("Error beginning transaction: " , err)
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Something's wrong here" }, true)
-			return
-		}
-
 		var id int
-		err2 := tx.Stmt(queries.SignUpUser).QueryRow(signup.Email, signup.HashedPassword).Scan(&id)
-		if err2 != nil {
-			print.Str(err2.Error())
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Could not sign up, Something's wrong." }, true)
-			return
-		}
-		
-		_, err3 := tx.Stmt(queries.CreateDefaultWishlist).Exec(id, "Default")
-		if err3 != nil {
-			print.Str(err3.Error())
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Could not exec command, Something's wrong." }, true)
-			return
-		}
-
-		err = tx.Commit()
-        if err != nil {
-            print.Str("Error committing transaction: " , err)
+		err = queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+			if err := tx.StmtContext(ctx, queries.Stmt(_db.SignUpUser)).QueryRowContext(ctx, signup.Email, signup.HashedPassword).Scan(&id); err != nil {
+				return err
+			}
+			_, err := tx.StmtContext(ctx, queries.Stmt(_db.CreateDefaultWishlist)).ExecContext(ctx, id, "Default")
+			return err
+		})
+		if err != nil {
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
+			print.Str("Error signing up: " , err)
 			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Something's wrong" }, true)
 			return
-        }
+		}
 
 		// jwt
 		claims := jwt.MapClaims{"id": id}
@@ -246,6 +212,7 @@ func Signup(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 		}
 	
 		myCookie.SetCookie(c, token)
+		mergeRecentlyViewed(c, ctx, id)
 		c.AbortWithStatusJSON(http.StatusCreated, gin.H{  "error": false, "success": true, "email": &signup.Email })
 	}
 }
@@ -264,12 +231,14 @@ func Login(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "login"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 5 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": &remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var login loginPayload
 	if err := c.ShouldBindJSON(&login); err != nil {
@@ -283,8 +252,11 @@ func Login(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	}
 	
 	var loginDBData loginDB
-	err := queries.Login.QueryRow(login.Email).Scan(&loginDBData.Id, &loginDBData.Email, &loginDBData.HashedPassword)
+	err := queries.Stmt(_db.Login).QueryRowContext(ctx, login.Email).Scan(&loginDBData.Id, &loginDBData.Email, &loginDBData.HashedPassword)
 	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
 		print.Str(err.Error())
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusUnauthorized, gin.H{ "error": true, "success": false, "reason": "Credentials Error 1" }, true)
 		return
@@ -316,6 +288,7 @@ func Login(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 		}
 	
 		myCookie.SetCookie(c, token)
+		mergeRecentlyViewed(c, ctx, loginDBData.Id)
 		c.AbortWithStatusJSON(http.StatusCreated, gin.H{  "error": false, "success": true, "email": &loginDBData.Email })
 	}
 
@@ -338,6 +311,7 @@ type UserWishListNames struct {
 	WishListNames pgtype.JSON `json:"wishListNames"`
 	WishListIds pgtype.JSON `json:"wishListIds"`
 	WishListData map[string][]WishListData `json:"wishListData"`
+	Currency string `json:"currency"`
 }
 
 type WishListData struct {
@@ -345,23 +319,27 @@ type WishListData struct {
     WishListId     int    `json:"wishListId"`
     ParentWishList int    `json:"parentWishListId"`
     SelectedImageUrl	string `json:"selectedImageUrl"`
+    // Thumbnail is the /img URL of SelectedImageUrl, set by signWishListImages
+    Thumbnail      string `json:"thumbnail"`
     ProductId      int    `json:"productId"`
     LongProductId  int    `json:"longProductId"`
     WishListName   string `json:"wishListName"`
-    MinPrice       float32    `json:"minPrice"`
-    MaxPrice       float32    `json:"maxPrice"`
+    MinPrice       catalog.Price `json:"minPrice"`
+    MaxPrice       catalog.Price `json:"maxPrice"`
 }
 
 func GetWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "getWishlist"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	cookie, err := c.Cookie("token")
 	if err != nil {
@@ -407,14 +385,16 @@ func GetWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 
 	// redis get
 	redisKeyName := "getWishlist-" + strconv.Itoa(id)
-	exist, val := redis.GetKey(&redisKeyName)
+	exist, val := redis.GetKey(ctx, &redisKeyName)
 	if exist {
 		print.Str("From Redis")
 		dec := gob.NewDecoder(bytes.NewReader(val))
 		if err := dec.Decode(&userWishList); err != nil {
 			print.Str("Error decoding struct:", err)
 		} else {
-			redis.IncreaseExpirationTime(redisKeyName, 20) // increase 20 seconds again
+			redis.IncreaseExpirationTime(ctx, redisKeyName, 20) // increase 20 seconds again
+			convertUserWishList(&userWishList, responseCurrency(c, ctx, JWTSECRET, queries))
+			signUserWishListImages(&userWishList)
 			c.AbortWithStatusJSON(http.StatusOK, &userWishList)
 			return
 		}
@@ -422,65 +402,19 @@ func GetWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 	// redis end
 
 	print.Str("From Database")
-	err2 := queries.GetUserAllWishListsNamesIds.QueryRow(id).Scan(&userWishList.WishListNames, &userWishList.WishListIds)
-	if err2 != nil {
-		print.Str(err2.Error())
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
-		return
-	}
-	
-    var wishListIdsData []int
-    err = json.Unmarshal(userWishList.WishListIds.Bytes, &wishListIdsData)
-    if err != nil {
-		print.Str(err.Error())
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 11" }, true)
-		return
-    }
-	
-	var wishListNamesData []string
-    err = json.Unmarshal(userWishList.WishListNames.Bytes, &wishListNamesData)
-    if err != nil {
-		print.Str(err.Error())
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 12" }, true)
-		return
-    }
-
-	objData := make(map[string][]WishListData)
-	
-	for index, element := range wishListIdsData {
-		var arrData []WishListData
-		rows, err2 := queries.GetUserWishListData.Query(element, 5)
-
-		if err2 != nil {
-			print.Str(err2.Error())
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 13" }, true)
+	userWishList, err = LoadWishlist(ctx, queries, id, wishlistPreviewLimit)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
 			return
 		}
-		
-		for rows.Next() {
-			var userWishListData WishListData
-			if err := rows.Scan(&userWishListData.Title, 
-				&userWishListData.WishListId,
-				&userWishListData.ParentWishList,
-				&userWishListData.SelectedImageUrl,
-				&userWishListData.ProductId,
-				&userWishListData.LongProductId,
-				&userWishListData.WishListName,
-				&userWishListData.MinPrice,
-				&userWishListData.MaxPrice); err != nil {
-				print.Str(err)
-				_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 14" }, true)
-				return
-			}
-			arrData = append(arrData, userWishListData)
-		}
-		rows.Close()
-
-		if arrData != nil {
-			objData[wishListNamesData[index]] = arrData
+		print.Str(err.Error())
+		if err == sql.ErrNoRows {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
+			return
 		}
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 13" }, true)
+		return
 	}
-	userWishList.WishListData = objData
 
 	// redis set
 	var buf bytes.Buffer
@@ -489,8 +423,10 @@ func GetWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 		print.Str("Error encoding struct:", err)
 	}
 
-	redis.SetKey(redisKeyName, buf.Bytes(), 20)
+	redis.SetKey(ctx, redisKeyName, buf.Bytes(), 20)
 
+	convertUserWishList(&userWishList, responseCurrency(c, ctx, JWTSECRET, queries))
+	signUserWishListImages(&userWishList)
 	c.AbortWithStatusJSON(http.StatusOK, &userWishList)
 
 }
@@ -505,12 +441,14 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "getCertainWishlist"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var certainWishlistData CertainWishlistPayload
 
@@ -570,7 +508,7 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 	redisSecondKey := "page-" + strconv.Itoa(certainWishlistData.PageNumber)
 
 	// redis get 
-	exist, val, err := redis.HMGet(redisFirstKey, redisSecondKey)
+	exist, val, err := redis.HMGet(ctx, redisFirstKey, redisSecondKey)
 	if err != nil && exist {
 		// do not write "return" here
 		_err.AbortRequestWithError(nil, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "err": err.Error(), "reason": "error getting HMGet from redis" }, false)
@@ -582,7 +520,10 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 			// do not write "return" here
 			_err.AbortRequestWithError(nil, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "err": err.Error(), "reason": "error converting json string to struct from redis" }, false)
 		} else {
-			c.AbortWithStatusJSON(http.StatusOK, gin.H{"data": &arrData, "wishlistId": &certainWishlistData.WishlistId, "wishlistName" : &certainWishlistData.WishlistName, "pageNumber": &certainWishlistData.PageNumber })
+			currency := responseCurrency(c, ctx, JWTSECRET, queries)
+			convertWishListData(arrData, currency)
+			signWishListImages(arrData)
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{"data": &arrData, "wishlistId": &certainWishlistData.WishlistId, "wishlistName" : &certainWishlistData.WishlistName, "pageNumber": &certainWishlistData.PageNumber, "currency": currency.Code })
 			return
 		}
 	}
@@ -590,9 +531,12 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 
 	print.Str("From Database")
 	var LIMIT = 5
-	rows, err2 := queries.GetUserCertainWishListData.Query(userId, certainWishlistData.WishlistId, LIMIT, LIMIT * (certainWishlistData.PageNumber - 1))
+	rows, err2 := queries.Stmt(_db.GetUserCertainWishListData).QueryContext(ctx, userId, certainWishlistData.WishlistId, LIMIT, LIMIT * (certainWishlistData.PageNumber - 1))
 
 	if err2 != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err2) {
+			return
+		}
 		print.Str(err2.Error())
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 13" }, true)
 		return
@@ -609,6 +553,10 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 			&userWishListData.WishListName,
 			&userWishListData.MinPrice,
 			&userWishListData.MaxPrice); err != nil {
+			rows.Close()
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
 			print.Str(err)
 			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 14" }, true)
 			return
@@ -616,6 +564,9 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 		arrData = append(arrData, userWishListData)
 	}
 	rows.Close()
+	if _err.AbortIfCanceled(c, &currentRoute, ctx, rows.Err()) {
+		return
+	}
 
 	// redis set
 	jsonArrayData, err := json.Marshal(arrData)
@@ -631,13 +582,16 @@ func GetCertainWishlist(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 	// print.Str(redisFirstKey)
 	// print.Str(redisSecondKey)
 	
-	err3 := redis.HMSet(redisFirstKey, &data, 20)
+	err3 := redis.HMSet(ctx, redisFirstKey, &data, 20)
 	if err3 != nil {
 		// do not write return here
 		_err.AbortRequestWithError(nil, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "err": err3.Error(), "reason": "error setting HMSet in redis" }, false)
 	}
 	
-	c.AbortWithStatusJSON(http.StatusOK, gin.H{"data": &arrData, "wishlistId": &certainWishlistData.WishlistId, "wishlistName" : &certainWishlistData.WishlistName, "pageNumber": &certainWishlistData.PageNumber })
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	convertWishListData(arrData, currency)
+	signWishListImages(arrData)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"data": &arrData, "wishlistId": &certainWishlistData.WishlistId, "wishlistName" : &certainWishlistData.WishlistName, "pageNumber": &certainWishlistData.PageNumber, "currency": currency.Code })
 }
 
 type UserData struct {
@@ -651,14 +605,16 @@ type UserCart struct {
     LongProductId int `json:"longProductId"`
     CartName string `json:"cartName"`
     SelectedImageUrl string `json:"selectedImageUrl"`
-    SelectedPrice float32 `json:"selectedPrice"`
+    // Thumbnail is the /img URL of SelectedImageUrl, set by signCartImages
+    Thumbnail string `json:"thumbnail"`
+    SelectedPrice catalog.Price `json:"selectedPrice"`
     SelectedQuantity int `json:"selectedQuantity"`
     SelectedDiscount float32 `json:"selectedDiscount"`
     SelectedProperties pgtype.JSONB `json:"selectedProperties"`
     SelectedShippingDetails pgtype.JSONB `json:"selectedShippingDetails"`
-    SelectedShippingPrice float32 `json:"selectedShippingPrice"`
-    MinPrice float32 `json:"minPrice"`
-    MaxPrice float32 `json:"maxPrice"`
+    SelectedShippingPrice catalog.Price `json:"selectedShippingPrice"`
+    MinPrice catalog.Price `json:"minPrice"`
+    MaxPrice catalog.Price `json:"maxPrice"`
     MultiUnitName string `json:"multiUnitName"`
     OddUnitName string `json:"oddUnitName"`
     MaxPurchaseLimit int `json:"maxPurchaseLimit"`
@@ -667,6 +623,7 @@ type UserCart struct {
     PriceListInNames pgtype.JSONB `json:"priceList_InNames"`
     PriceListInNumbers pgtype.JSONB `json:"priceList_InNumbers"`
     PriceListData pgtype.JSONB `json:"priceList_Data"`
+    SkuId *int64 `json:"skuId"`
 }
 
 type UserWishListNamesIds struct {
@@ -679,12 +636,14 @@ func GetUserData(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "getUserData"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 	
 	cookie, err := c.Cookie("token")
 	if err != nil {
@@ -731,16 +690,22 @@ func GetUserData(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	var userData UserData
 	data := make(map[string]interface{})
 
-	err = queries.GetUserData.QueryRow(userId).Scan(&userData.Email)
+	err = queries.Stmt(_db.GetUserData).QueryRowContext(ctx, userId).Scan(&userData.Email)
 	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
 		return
 	}
 	data["userData"] = &userData
 
 	
-	rows, err := queries.GetUserCartData.Query(userId)
+	rows, err := queries.Stmt(_db.GetUserCartData).QueryContext(ctx, userId)
 	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 11" }, true)
 		return
 	}
@@ -769,7 +734,12 @@ func GetUserData(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 			&userCart.QuantityAvaliable,
 			&userCart.PriceListInNames,
 			&userCart.PriceListInNumbers,
-			&userCart.PriceListData); err != nil {
+			&userCart.PriceListData,
+			&userCart.SkuId); err != nil {
+			rows.Close()
+			if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+				return
+			}
 			print.Str(err)
 			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 12" }, true)
 			return
@@ -778,12 +748,22 @@ func GetUserData(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
 	}
 
 	rows.Close()
+	if _err.AbortIfCanceled(c, &currentRoute, ctx, rows.Err()) {
+		return
+	}
 	
+	currency := responseCurrency(c, ctx, JWTSECRET, queries)
+	convertUserCart(arrData, currency)
+	signCartImages(arrData)
 	data["userCart"] = &arrData
+	data["currency"] = currency.Code
 
 	var userWishList UserWishListNamesIds
-	err2 := queries.GetUserAllWishListsNamesIds.QueryRow(userId).Scan(&userWishList.WishListNames, &userWishList.WishListIds)
+	err2 := queries.Stmt(_db.GetUserAllWishListsNamesIds).QueryRowContext(ctx, userId).Scan(&userWishList.WishListNames, &userWishList.WishListIds)
 	if err2 != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err2) {
+			return
+		}
 		print.Str(err2.Error())
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 12" }, true)
 		return
@@ -803,12 +783,14 @@ func DeleteProductFromCart(c *gin.Context, JWTSECRET string, queries *_db.Querie
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "deleteProductFromCart"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 
 	var deleteProductFromCartData DeleteProductFromCartPayload
@@ -866,8 +848,11 @@ func DeleteProductFromCart(c *gin.Context, JWTSECRET string, queries *_db.Querie
 
 	print.Str("From Database")
 	var deletedId int
-	err2 := queries.DeleteProductFromCart.QueryRow(deleteProductFromCartData.ProductId, userId, deleteProductFromCartData.CartId).Scan(&deletedId)
+	err2 := queries.Write(ctx, _db.DeleteProductFromCart).QueryRowContext(ctx, deleteProductFromCartData.ProductId, userId, deleteProductFromCartData.CartId).Scan(&deletedId)
 	if err2 != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err2) {
+			return
+		}
 		print.Str(err2.Error())
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
 		return
@@ -887,12 +872,14 @@ func AddProductToWishList(c *gin.Context, JWTSECRET string, queries *_db.Queries
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "addProductToWishList"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 20 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 
 	var addProductToWishlistData AddProductToWishlistPayload
@@ -951,63 +938,46 @@ func AddProductToWishList(c *gin.Context, JWTSECRET string, queries *_db.Queries
 	print.Str(userId)
 	print.Str("From Database")
 
-	tx, err := queries.DB.Begin()
-		if err != nil {
-			print.Str("Error beginning transaction: " , err)
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Something's wrong here" }, true)
-			return
-		}
-
-		var id int
-		err2 := tx.Stmt(queries.AddProductToWishlist).QueryRow(userId, addProductToWishlistData.ProductId, addProductToWishlistData.WishListId, addProductToWishlistData.SelectedImageUrl, addProductToWishlistData.WishListId, addProductToWishlistData.SelectedImageUrl).Scan(&id)
-		if err2 != nil {
-			print.Str(err2.Error())
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Could not sign up, Something's wrong." }, true)
-			return
+	var id int
+	err = queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		if err := tx.StmtContext(ctx, queries.Stmt(_db.AddProductToWishlist)).QueryRowContext(ctx, userId, addProductToWishlistData.ProductId, addProductToWishlistData.WishListId, addProductToWishlistData.SelectedImageUrl, addProductToWishlistData.WishListId, addProductToWishlistData.SelectedImageUrl).Scan(&id); err != nil {
+			return err
 		}
-		
-		_, err3 := tx.Stmt(queries.DeleteProductFromCart).Exec(addProductToWishlistData.ProductId, userId, addProductToWishlistData.CartId)
-		if err3 != nil {
-			print.Str(err3.Error())
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Could not exec command, Something's wrong." }, true)
+		_, err := tx.StmtContext(ctx, queries.Stmt(_db.DeleteProductFromCart)).ExecContext(ctx, addProductToWishlistData.ProductId, userId, addProductToWishlistData.CartId)
+		return err
+	})
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
 			return
 		}
-
-		err = tx.Commit()
-        if err != nil {
-            print.Str("Error committing transaction: " , err)
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Something's wrong" }, true)
-			return
-        }
+		print.Str("Error in transaction: " , err)
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Something's wrong" }, true)
+		return
+	}
 
 	c.AbortWithStatusJSON(http.StatusOK, gin.H{ "error": false, "success": true, "id": id  })
 }
 
+// AddProductToCartPayload picks the variant by its sku id, price, discount, image and properties
+// are read from the sku. ShippingCompany chooses the shipping method, the first one when empty.
 type AddProductToCartPayload struct {
-	ProductId int `binding:"required"`
-	CartName string `binding:"required"`
-  	Price float32 `binding:"required"`
-	ShippingPrice float32
-	Discount float32 
-	Quantity int `binding:"required"`
-	SelectedImageUrl string `binding:"required"`
-	SelectedProperties pgtype.JSON `binding:"required"`
-	ShippingDetails pgtype.JSON `binding:"required"`
+	SkuId int64 `binding:"required"`
+	Quantity int `binding:"required,min=1"`
+	ShippingCompany string
 }
 
 func AddProductToCart(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "addProductToCart"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var addProductToCartData AddProductToCartPayload
 
@@ -1058,58 +1028,52 @@ func AddProductToCart(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 
 	userId = int(idTemp)
 
-	tx, err := queries.DB.Begin()
-	if err != nil {
-		print.Str("Error beginning transaction: " , err)
-		tx.Rollback()
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "reason": "Error Code 10" }, true)
-		return
-	}
-
 	id := 0
-	err2 := tx.Stmt(queries.CheckProductExistInUserCart).QueryRow(addProductToCartData.CartName, userId).Scan(&id)
-	if err2 != nil {
-		if err2 == sql.ErrNoRows {
-			id = 0
-		} else {
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "reason": "Error Code 11" }, true)
-			return
+	err = queries.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		id = 0
+		sku, err := catalog.CartSkuForUpdate(ctx, tx, addProductToCartData.SkuId, addProductToCartData.Quantity, addProductToCartData.ShippingCompany)
+		if err != nil {
+			return err
 		}
-	}
+		cartName := sku.CartName()
+		selectedProperties := string(sku.SelectedProperties())
+		shippingDetails := string(sku.ShippingDetails)
 
-	if id > 0 {
-		// product already exist so updating
-		_, err3 := tx.Stmt(queries.UpdateProductInCart).Exec(addProductToCartData.Quantity, addProductToCartData.Price, addProductToCartData.ShippingPrice, addProductToCartData.Discount, addProductToCartData.SelectedProperties, addProductToCartData.ShippingDetails, addProductToCartData.SelectedImageUrl, userId, addProductToCartData.ProductId, addProductToCartData.CartName)
-		if err3 != nil {
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "reason": "Error Code 12" }, true)
-			return
+		err = tx.StmtContext(ctx, queries.Stmt(_db.CheckProductExistInUserCart)).QueryRowContext(ctx, cartName, userId).Scan(&id)
+		if err != nil && err != sql.ErrNoRows {
+			return err
 		}
-	} else {
-		// product does not exist so inserting
-		err3 := tx.Stmt(queries.AddProductInCart).QueryRow(addProductToCartData.ProductId, userId, addProductToCartData.CartName, addProductToCartData.Quantity, addProductToCartData.Price, addProductToCartData.ShippingPrice, addProductToCartData.Discount, addProductToCartData.SelectedProperties, addProductToCartData.ShippingDetails, addProductToCartData.SelectedImageUrl).Scan(&id)
-		if err3 != nil {
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "reason": "Error Code 13" }, true)
-			return
+
+		if id > 0 {
+			// product already exist so updating
+			_, err := tx.StmtContext(ctx, queries.Stmt(_db.UpdateProductInCart)).ExecContext(ctx, addProductToCartData.Quantity, sku.Price, sku.ShippingPrice, sku.Discount, selectedProperties, shippingDetails, sku.ImageUrl, userId, sku.ProductId, cartName, sku.Id)
+			return err
 		}
 
-		// product inserted so incrementing count
-		_, err4 := tx.Stmt(queries.IncrementCartCount).Exec(userId)
-		if err4 != nil {
-			tx.Rollback()
-			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "reason": "Error Code 14" }, true)
-			return
+		// product does not exist so inserting
+		err = tx.StmtContext(ctx, queries.Stmt(_db.AddProductInCart)).QueryRowContext(ctx, sku.ProductId, userId, cartName, addProductToCartData.Quantity, sku.Price, sku.ShippingPrice, sku.Discount, selectedProperties, shippingDetails, sku.ImageUrl, sku.Id).Scan(&id)
+		if err != nil {
+			return err
 		}
 
+		// product inserted so incrementing count
+		_, err = tx.StmtContext(ctx, queries.Stmt(_db.IncrementCartCount)).ExecContext(ctx, userId)
+		return err
+	})
+	if err == catalog.ErrSkuNotFound {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "code": err.Error() }, true)
+		return
+	}
+	if err == catalog.ErrOutOfStock {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusConflict, gin.H{ "error": true, "success": false, "code": err.Error() }, true)
+		return
 	}
-	
-
-	err = tx.Commit()
 	if err != nil {
-		print.Str("Error committing transaction: " , err)
-		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{ "error": true, "success": false, "reason": "Error Code 15" }, true)
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		print.Str("Error in transaction: " , err)
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{ "error": true, "success": false, "reason": "Something's wrong" }, true)
 		return
 	}
 
@@ -1124,12 +1088,14 @@ func CreateNewListInWishlist(c *gin.Context, JWTSECRET string, queries *_db.Quer
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "createNewListInWishlist"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var createNewListInWishlistData createNewListInWishlistPayload
 
@@ -1182,8 +1148,11 @@ func CreateNewListInWishlist(c *gin.Context, JWTSECRET string, queries *_db.Quer
 
 	id := 0
 
-	err2 := queries.CreateNewListInWishList.QueryRow(userId, createNewListInWishlistData.WishListName).Scan(&id)
+	err2 := queries.Write(ctx, _db.CreateNewListInWishList).QueryRowContext(ctx, userId, createNewListInWishlistData.WishListName).Scan(&id)
 	if err2 != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err2) {
+			return
+		}
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
 		return
 	}
@@ -1201,12 +1170,14 @@ func UpdateWishListName(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "updateWishListName"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var updateWishListNamePayloadData updateWishListNamePayload
 
@@ -1274,8 +1245,11 @@ func UpdateWishListName(c *gin.Context, JWTSECRET string, queries *_db.Queries)
 	userId = int(idTemp)
 	print.Str(userId)
 
-	rows, err2 := queries.UpdateWishlistName.Query(updateWishListNamePayloadData.WishListName, userId, updateWishListNamePayloadData.WishListId, updateWishListNamePayloadData.OldWishlistName)
+	rows, err2 := queries.Write(ctx, _db.UpdateWishlistName).QueryContext(ctx, updateWishListNamePayloadData.WishListName, userId, updateWishListNamePayloadData.WishListId, updateWishListNamePayloadData.OldWishlistName)
 	if err2 != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err2) {
+			return
+		}
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
 		return
 	}
@@ -1292,12 +1266,14 @@ func DeleteWishList(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 	// rate limiter
 	ip := c.ClientIP()
 	var currentRoute = "deleteWishList"
-	currentRate, remainingTime := limiter.GetLimitRate(&ip, &currentRoute)
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
 	if currentRate >= 10 {
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests,  gin.H{"error": true,"success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
 		return
 	}
-	limiter.SetLimit(&ip, &currentRoute, currentRate + 1, 60)
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate + 1, 60)
 
 	var deleteWishListPayload deleteWishListPayload
 
@@ -1355,8 +1331,11 @@ func DeleteWishList(c *gin.Context, JWTSECRET string, queries *_db.Queries)  {
 	userId = int(idTemp)
 	print.Str(userId)
 
-	rows, err2 := queries.DeleteWishlist.Query(userId, deleteWishListPayload.WishListId)
+	rows, err2 := queries.Write(ctx, _db.DeleteWishlist).QueryContext(ctx, userId, deleteWishListPayload.WishListId)
 	if err2 != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err2) {
+			return
+		}
 		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound,  gin.H{ "error": true,"success": false, "code": "Error Code 10" }, true)
 		return
 	}
@@ -0,0 +1,58 @@
+package route
+
+import (
+	"net/http"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/print"
+	limiter "kamal/rateLimiter"
+
+	"github.com/gin-gonic/gin"
+)
+
+type resolveSkuPayload struct {
+	ProductId  int               `json:"productId"`
+	Properties map[string]string `json:"properties"`
+}
+
+// ResolveSku answers POST /resolveSku {productId, properties: {"Color": "Red", "Size": "XL"}} with the sku
+// picked by the selection, the skus still matching it and the values of every property still in stock.
+// Without properties it lists all the skus of the product.
+func ResolveSku(c *gin.Context, queries *_db.Queries) {
+	// rate limiter
+	ip := c.ClientIP()
+	var currentRoute = "resolveSku"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	currentRate, remainingTime := limiter.GetLimitRate(ctx, &ip, &currentRoute)
+	if currentRate >= 120 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusTooManyRequests, gin.H{"error": true, "success": false, "code": "To many requests", "waitForSeconds": remainingTime}, true)
+		return
+	}
+	limiter.SetLimit(ctx, &ip, &currentRoute, currentRate+1, 60)
+
+	var payload resolveSkuPayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ProductId < 1 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	skus, err := catalog.ProductSkus(ctx, queries, payload.ProductId)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		if err == catalog.ErrSkuNotFound {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+			return
+		}
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+		return
+	}
+
+	resolution := catalog.ResolveSku(skus, payload.Properties)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "sku": resolution.Sku, "matches": resolution.Matches, "options": resolution.Options})
+}
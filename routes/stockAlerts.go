@@ -0,0 +1,126 @@
+package route
+
+import (
+	"net/http"
+
+	"kamal/catalog"
+	_db "kamal/database"
+	_err "kamal/errors"
+	"kamal/notifications"
+	"kamal/print"
+
+	"github.com/gin-gonic/gin"
+)
+
+type notifyMePayload struct {
+	ProductId int   `json:"productId"`
+	SkuId     int64 `json:"skuId"`
+	// Channels defaults to in-app notifications
+	Channels []string `json:"channels"`
+}
+
+func abortStockAlertError(c *gin.Context, currentRoute *string, err error) {
+	switch err {
+	case catalog.ErrProductNotFound, catalog.ErrSkuNotFound:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	case catalog.ErrAlreadyAvailable:
+		_err.AbortRequestWithError(c, currentRoute, http.StatusConflict, gin.H{"error": true, "success": false, "code": err.Error()}, true)
+	default:
+		print.Str(err.Error())
+		_err.AbortRequestWithError(c, currentRoute, http.StatusInternalServerError, gin.H{"error": true, "success": false, "code": "Something wrong!"}, true)
+	}
+}
+
+// NotifyMe answers POST /notifyMe {productId, skuId, channels} by subscribing the user to the release of a coming
+// soon product or the restock of a product or sku. channels are the ones of GET /notifyMe, inApp by default.
+// Products that can be bought already answer 409.
+func NotifyMe(c *gin.Context, JWTSECRET string, queries *_db.Queries, dispatcher *notifications.Dispatcher) {
+	var currentRoute = "notifyMe"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 30)
+	if !ok {
+		return
+	}
+
+	var payload notifyMePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ProductId < 1 || payload.SkuId < 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+	for _, channel := range payload.Channels {
+		if !dispatcher.Has(channel) {
+			_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": notifications.ErrUnknownChannel.Error(), "channels": dispatcher.Names()}, true)
+			return
+		}
+	}
+	channels := payload.Channels
+	if len(channels) == 0 {
+		channels = []string{notifications.ChannelInApp}
+	}
+
+	sub, err := catalog.Subscribe(ctx, queries, userId, payload.ProductId, payload.SkuId, channels)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		abortStockAlertError(c, &currentRoute, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": sub})
+}
+
+// CancelNotifyMe answers DELETE /notifyMe {productId, skuId}
+func CancelNotifyMe(c *gin.Context, JWTSECRET string, queries *_db.Queries) {
+	var currentRoute = "cancelNotifyMe"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 30)
+	if !ok {
+		return
+	}
+
+	var payload notifyMePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.ProductId < 1 || payload.SkuId < 0 {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusBadRequest, gin.H{"error": true, "success": false, "code": "params not found or are of invalid type"}, true)
+		return
+	}
+
+	deleted, err := catalog.Unsubscribe(ctx, queries, userId, payload.ProductId, payload.SkuId)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		abortStockAlertError(c, &currentRoute, err)
+		return
+	}
+	if !deleted {
+		_err.AbortRequestWithError(c, &currentRoute, http.StatusNotFound, gin.H{"error": true, "success": false, "code": "subscription not found"}, true)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true})
+}
+
+// GetNotifyMe answers GET /notifyMe with the pending subscriptions of the user and the channels they can use
+func GetNotifyMe(c *gin.Context, JWTSECRET string, queries *_db.Queries, dispatcher *notifications.Dispatcher) {
+	var currentRoute = "getNotifyMe"
+	ctx, cancel := requestContext(c, currentRoute)
+	defer cancel()
+	userId, ok := userRoute(c, ctx, JWTSECRET, &currentRoute, 60)
+	if !ok {
+		return
+	}
+
+	subs, err := catalog.Subscriptions(ctx, queries, userId)
+	if err != nil {
+		if _err.AbortIfCanceled(c, &currentRoute, ctx, err) {
+			return
+		}
+		abortStockAlertError(c, &currentRoute, err)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"error": false, "success": true, "data": subs, "channels": dispatcher.Names()})
+}
@@ -0,0 +1,64 @@
+package route
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	_db "kamal/database"
+)
+
+// number of items sent for every list by GetWishlist
+const wishlistPreviewLimit = 5
+
+// LoadWishlist builds the GetWishlist response for a user with a single query,
+// every list comes with its newest `limit` items. sql.ErrNoRows is returned when the user has no list.
+func LoadWishlist(ctx context.Context, queries *_db.Queries, userId int, limit int) (UserWishListNames, error) {
+	var userWishList UserWishListNames
+
+	rows, err := queries.Stmt(_db.GetUserWishListsTopItems).QueryContext(ctx, userId, limit)
+	if err != nil {
+		return userWishList, err
+	}
+	defer rows.Close()
+
+	wishListIds := []int{}
+	wishListNames := []string{}
+	objData := make(map[string][]WishListData)
+
+	for rows.Next() {
+		var id int
+		var name string
+		var items []byte
+		if err := rows.Scan(&id, &name, &items); err != nil {
+			return userWishList, err
+		}
+		wishListIds = append(wishListIds, id)
+		wishListNames = append(wishListNames, name)
+
+		var arrData []WishListData
+		if err := json.Unmarshal(items, &arrData); err != nil {
+			return userWishList, err
+		}
+		if len(arrData) > 0 {
+			objData[name] = arrData
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return userWishList, err
+	}
+
+	if len(wishListIds) == 0 {
+		return userWishList, sql.ErrNoRows
+	}
+
+	if err := userWishList.WishListIds.Set(wishListIds); err != nil {
+		return userWishList, err
+	}
+	if err := userWishList.WishListNames.Set(wishListNames); err != nil {
+		return userWishList, err
+	}
+	userWishList.WishListData = objData
+
+	return userWishList, nil
+}
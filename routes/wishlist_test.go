@@ -0,0 +1,131 @@
+package route
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	_db "kamal/database"
+)
+
+// loadWishlistPerList builds the same response as LoadWishlist with one query for the list names
+// and one more query per list, the way GetWishlist loaded it before
+func loadWishlistPerList(ctx context.Context, queries *_db.Queries, userId int, limit int) (UserWishListNames, error) {
+	var userWishList UserWishListNames
+
+	err := queries.Stmt(_db.GetUserAllWishListsNamesIds).QueryRowContext(ctx, userId).Scan(&userWishList.WishListNames, &userWishList.WishListIds)
+	if err != nil {
+		return userWishList, err
+	}
+
+	var wishListIdsData []int
+	if err := json.Unmarshal(userWishList.WishListIds.Bytes, &wishListIdsData); err != nil {
+		return userWishList, err
+	}
+
+	var wishListNamesData []string
+	if err := json.Unmarshal(userWishList.WishListNames.Bytes, &wishListNamesData); err != nil {
+		return userWishList, err
+	}
+
+	objData := make(map[string][]WishListData)
+
+	for index, element := range wishListIdsData {
+		var arrData []WishListData
+		rows, err := queries.Stmt(_db.GetUserWishListData).QueryContext(ctx, element, limit)
+		if err != nil {
+			return userWishList, err
+		}
+
+		for rows.Next() {
+			var userWishListData WishListData
+			if err := rows.Scan(&userWishListData.Title,
+				&userWishListData.WishListId,
+				&userWishListData.ParentWishList,
+				&userWishListData.SelectedImageUrl,
+				&userWishListData.ProductId,
+				&userWishListData.LongProductId,
+				&userWishListData.WishListName,
+				&userWishListData.MinPrice,
+				&userWishListData.MaxPrice); err != nil {
+				rows.Close()
+				return userWishList, err
+			}
+			arrData = append(arrData, userWishListData)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return userWishList, err
+		}
+
+		if arrData != nil {
+			objData[wishListNamesData[index]] = arrData
+		}
+	}
+	userWishList.WishListData = objData
+
+	return userWishList, nil
+}
+
+// benchWishlist connects to the database and returns the registry with the user set in BENCH_WISHLIST_USER,
+// the benchmark is skipped without it
+func benchWishlist(b *testing.B) (*_db.Queries, int) {
+	userId, err := strconv.Atoi(os.Getenv("BENCH_WISHLIST_USER"))
+	if err != nil || userId < 1 {
+		b.Skip("BENCH_WISHLIST_USER is not set")
+	}
+
+	ctx := context.Background()
+	db, err := _db.ConnectToDatabase(ctx)
+	if err != nil {
+		b.Skip("database unreachable:", err)
+	}
+	queries, err := _db.NewQueries(ctx, db)
+	if err != nil {
+		db.Close()
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		queries.Close()
+		db.Close()
+	})
+
+	// both loaders must build the same response before their speed means anything
+	single, err := LoadWishlist(ctx, queries, userId, wishlistPreviewLimit)
+	if err != nil {
+		b.Fatal(err)
+	}
+	perList, err := loadWishlistPerList(ctx, queries, userId, wishlistPreviewLimit)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !reflect.DeepEqual(single.WishListData, perList.WishListData) {
+		b.Fatal("loaders returned different wishlist data")
+	}
+	return queries, userId
+}
+
+func BenchmarkLoadWishlist(b *testing.B) {
+	queries, userId := benchWishlist(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadWishlist(context.Background(), queries, userId, wishlistPreviewLimit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadWishlistPerList(b *testing.B) {
+	queries, userId := benchWishlist(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := loadWishlistPerList(context.Background(), queries, userId, wishlistPreviewLimit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
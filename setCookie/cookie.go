@@ -29,4 +29,9 @@ func CookieExist(c *gin.Context, cookieName *string) cookieExistStruct {
 		return cookieExistStruct{Exists: false, Value: ""}
 	}
     return cookieExistStruct{Exists: true, Value: cookie}
-}
\ No newline at end of file
+}
+
+// SetVisitorCookie identifies an anonymous visitor, like the recently viewed products before login
+func SetVisitorCookie(c *gin.Context, visitorId string, maxAgeInSec int) {
+    c.SetCookie("visitor", visitorId, maxAgeInSec, "/", "", false, true)
+}